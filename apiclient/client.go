@@ -0,0 +1,216 @@
+// Package apiclient is a client of the web API of paninv_controller, used by paninv_rc to control the inverter through a
+// running controller instead of opening the database and the LIRC device itself.
+package apiclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/rcutils"
+)
+
+// Returned (wrapped) when the controller can't be reached, e.g. because it isn't running.
+var ErrUnreachable = errors.New("controller is unreachable")
+
+func GetServer() string {
+	return os.Getenv("PANINV_SERVER")
+}
+
+// An error returned by the API, with the details of rejected settings or an invalid config.
+type APIError struct {
+	StatusCode int
+	Message    string                `json:"error"`
+	Fields     []*rcutils.FieldError `json:"fields,omitempty"`
+	Violations codec.Violations      `json:"violations,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("request failed with status %d", e.StatusCode)
+	}
+	return e.Message
+}
+
+type Client struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+// Create a client of the controller at server, which is either an HTTP URL, e.g. "http://piir:3333", or the path of
+// the unix socket of the API, e.g. "unix:/run/paninv/api.sock".
+func New(server string) (*Client, error) {
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	transport := &http.Transport{DialContext: dialer.DialContext}
+	baseUrl := strings.TrimSuffix(server, "/")
+
+	if socket, found := strings.CutPrefix(server, "unix:"); found {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		baseUrl = "http://paninv"
+	} else if u, err := url.Parse(server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server %q, expecting http://host:port or unix:/path", server)
+	}
+
+	return &Client{baseUrl, &http.Client{Transport: transport, Timeout: 30 * time.Second}}, nil
+}
+
+// Send a request and decode the JSON response into result.
+func (c *Client) do(method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseUrl+"/api/v1"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// only a failure to connect means that the controller didn't get the request, any other error (e.g. a
+		// timeout) may happen after it has already acted on it
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("%w: %w", ErrUnreachable, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(respBody, apiErr) != nil {
+			// not all errors are returned as JSON
+			apiErr.Message = strings.TrimSpace(string(respBody))
+		}
+		return apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, result)
+}
+
+func unitPath(unit, path string) string {
+	return "/units/" + url.PathEscape(unit) + path
+}
+
+func (c *Client) GetSettings(unit string) (*codecbase.AllSettings, error) {
+	var all codecbase.AllSettings
+	if err := c.do("GET", unitPath(unit, "/settings"), nil, &all); err != nil {
+		return nil, err
+	}
+	return &all, nil
+}
+
+// Apply the settings to the current config of the unit and send it, returning the resulting settings.
+func (c *Client) PostSettings(unit string, settings *codecbase.Settings) (*codecbase.AllSettings, error) {
+	var all codecbase.AllSettings
+	if err := c.do("POST", unitPath(unit, "/settings"), settings, &all); err != nil {
+		return nil, err
+	}
+	return &all, nil
+}
+
+func (c *Client) GetPreset(name string) (*codecbase.Settings, error) {
+	var preset struct {
+		Settings codecbase.Settings `json:"settings"`
+	}
+	if err := c.do("GET", "/presets/"+url.PathEscape(name), nil, &preset); err != nil {
+		return nil, fmt.Errorf("preset %q: %w", name, err)
+	}
+	return &preset.Settings, nil
+}
+
+// A settings change that is applied once at a specific time.
+type OneTimeJob struct {
+	ID       uint               `json:"id,omitempty"`
+	At       time.Time          `json:"at"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+}
+
+// Create a one-time job for the unit, returning all one-time jobs of the unit.
+func (c *Client) PostOneTimeJob(unit string, job *OneTimeJob) ([]OneTimeJob, error) {
+	var jobs []OneTimeJob
+	if err := c.do("POST", unitPath(unit, "/onetimejobs"), job, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// A run of a job within the forecast of a unit, and the config that is expected after it.
+type UpcomingRun struct {
+	At         time.Time           `json:"at"`
+	Kind       string              `json:"kind"`
+	Name       string              `json:"name"`
+	JobSet     string              `json:"jobset,omitempty"`
+	Preset     string              `json:"preset,omitempty"`
+	Settings   *codecbase.Settings `json:"settings,omitempty"`
+	Suppressed string              `json:"suppressed,omitempty"`
+	Hold       string              `json:"hold,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	Config     codecbase.Settings  `json:"config"`
+}
+
+// Return the runs of the jobs of the unit within the next hours.
+func (c *Client) GetUpcoming(unit string, hours int) ([]UpcomingRun, error) {
+	var runs []UpcomingRun
+	if err := c.do("GET", unitPath(unit, "/schedule/upcoming?hours="+strconv.Itoa(hours)), nil, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// Settings held for a while, after which the fields changed by the hold are reverted.
+type Hold struct {
+	Until    time.Time           `json:"until"`
+	Preset   string              `json:"preset,omitempty"`
+	Settings codecbase.Settings  `json:"settings"`
+	Policy   string              `json:"policy,omitempty"`
+	Revert   *codecbase.Settings `json:"revert,omitempty"`
+	Deferred int                 `json:"deferred,omitempty"`
+}
+
+// Hold settings on the unit, replacing any current hold, and return the hold.
+func (c *Client) PutHold(unit string, hold *Hold) (*Hold, error) {
+	var result Hold
+	if err := c.do("PUT", unitPath(unit, "/hold"), hold, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// End the hold of the unit now, returning the resulting settings.
+func (c *Client) DeleteHold(unit string) (*codecbase.AllSettings, error) {
+	var all codecbase.AllSettings
+	if err := c.do("DELETE", unitPath(unit, "/hold"), nil, &all); err != nil {
+		return nil, err
+	}
+	return &all, nil
+}
@@ -0,0 +1,128 @@
+package apiclient
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sched"
+	"rpi_panasonic_inverter_rc/server"
+)
+
+// Start a controller API with an in-memory store, and an IR sender that writes to a file.
+func startController(t *testing.T) (http.Handler, *db.MemStore) {
+	store := db.NewMemStore()
+	senderOptions := codec.NewSenderOptions()
+	senderOptions.Device = false
+	irSender := codec.StartIrSender(filepath.Join(t.TempDir(), "out.lirc"), senderOptions)
+	t.Cleanup(irSender.Stop)
+	irSenders := map[string]*codec.IrSender{db.DefaultUnit: irSender}
+	if err := sched.InitScheduler(store, irSenders); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sched.Stop)
+	return server.NewRouter("error", store, irSenders), store
+}
+
+func TestHttp(t *testing.T) {
+	handler, store := startController(t)
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	store.SavePreset("Night", &codecbase.Settings{Mode: "heat", Temperature: "18"})
+
+	client, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preset, err := client.GetPreset("Night")
+	if err != nil || preset.Temperature != "18" {
+		t.Fatalf("get preset: %+v, %v", preset, err)
+	}
+	all, err := client.PostSettings(db.DefaultUnit, preset)
+	if err != nil || all.Settings.Mode != "heat" || all.Settings.Temperature != "18" {
+		t.Errorf("post settings: %+v, %v", all, err)
+	}
+
+	_, err = client.PostSettings(db.DefaultUnit, &codecbase.Settings{Temperature: "35"})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || len(apiErr.Fields) != 1 {
+		t.Errorf("expected an API error with rejected fields, got %v", err)
+	}
+	if _, err = client.GetSettings("attic"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	at := time.Now().Add(time.Hour)
+	jobs, err := client.PostOneTimeJob(db.DefaultUnit, &OneTimeJob{At: at, Preset: "Night"})
+	if err != nil || len(jobs) != 1 || !jobs[0].At.Equal(at) || jobs[0].Preset != "Night" {
+		t.Errorf("post one-time job: %+v, %v", jobs, err)
+	}
+	runs, err := client.GetUpcoming(db.DefaultUnit, 2)
+	if err != nil || len(runs) != 1 || runs[0].Kind != "onetime" || runs[0].Config.Temperature != "18" {
+		t.Errorf("get upcoming: %+v, %v", runs, err)
+	}
+	hold, err := client.PutHold(db.DefaultUnit, &Hold{Until: time.Now().Add(time.Hour), Settings: codecbase.Settings{Powerful: "on"}})
+	if err != nil || hold.Policy != "defer" || hold.Revert == nil || hold.Revert.Powerful != "off" {
+		t.Errorf("put hold: %+v, %v", hold, err)
+	}
+	if all, err := client.DeleteHold(db.DefaultUnit); err != nil || all.Settings.Powerful != "off" {
+		t.Errorf("delete hold: %+v, %v", all, err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	handler, _ := startController(t)
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(listener, handler)
+	defer listener.Close()
+
+	client, err := New("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all, err := client.GetSettings(db.DefaultUnit); err != nil || all.Settings.Temperature != "20" {
+		t.Errorf("get settings: %+v, %v", all, err)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	client, err := New("unix:" + filepath.Join(t.TempDir(), "missing.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetSettings(db.DefaultUnit); !errors.Is(err, ErrUnreachable) {
+		t.Errorf("expected ErrUnreachable, got %v", err)
+	}
+	if _, err := New("piir:3333"); err == nil {
+		t.Error("expected an invalid server error")
+	}
+}
+
+func TestTimeoutIsNotUnreachable(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer ts.Close()
+	defer close(done)
+	client, err := New(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.httpClient.Timeout = 50 * time.Millisecond
+	// the controller may have acted on the request, so paninv_rc must not fall back to sending it itself
+	if _, err := client.GetSettings(db.DefaultUnit); err == nil || errors.Is(err, ErrUnreachable) {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,583 @@
+// Package backup exports the state of a store to JSON, and imports it again, e.g. to move the controller to a new SD
+// card or to restore it after the database has been corrupted.
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"rpi_panasonic_inverter_rc/calendar"
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/rcutils"
+	"rpi_panasonic_inverter_rc/sched"
+)
+
+// The version of the backup format. Increase it when the format changes incompatibly.
+const FORMAT = 1
+
+// How an import treats state that is not in the backup.
+type Mode string
+
+const (
+	// Keep units, job sets, one-time jobs, holds and presets that are not in the backup. Job sets, holds and presets in
+	// the backup replace existing ones, and one-time jobs and job runs that already exist are not added again.
+	MODE_MERGE Mode = "merge"
+	// Delete job sets, one-time jobs, holds, job runs and presets that are not in the backup. Units are kept, since they
+	// are configured by the controller.
+	MODE_REPLACE Mode = "replace"
+)
+
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case MODE_MERGE, MODE_REPLACE:
+		return Mode(mode), nil
+	}
+	return "", fmt.Errorf("invalid import mode %q, expecting %s or %s", mode, MODE_MERGE, MODE_REPLACE)
+}
+
+type Backup struct {
+	Format  int       `json:"format"`
+	Created time.Time `json:"created"`
+	Units   []Unit    `json:"units"`
+	Presets []Preset  `json:"presets"`
+}
+
+type Unit struct {
+	Name         string         `json:"name"`
+	IrInput      string         `json:"irin,omitempty"`
+	IrOutput     string         `json:"irout,omitempty"`
+	Config       codec.RcConfig `json:"config"`
+	ModeSettings []ModeSetting  `json:"modeSettings"`
+	JobSets      []JobSet       `json:"jobsets"`
+	OneTimeJobs  []OneTimeJob   `json:"onetimejobs,omitempty"`
+	Hold         *Hold          `json:"hold,omitempty"`
+	JobRuns      []JobRun       `json:"jobruns,omitempty"`
+}
+
+type ModeSetting struct {
+	Mode        uint `json:"mode"`
+	Temperature uint `json:"temp"`
+	FanSpeed    uint `json:"fan"`
+}
+
+type JobSet struct {
+	Name       string               `json:"name"`
+	Active     bool                 `json:"active"`
+	Priority   int                  `json:"priority,omitempty"`
+	SkipMissed bool                 `json:"skipMissed,omitempty"`
+	Activation *calendar.Activation `json:"activation,omitempty"`
+	CronJobs   []CronJob            `json:"cronjobs"`
+}
+
+type CronJob struct {
+	Schedule string             `json:"schedule"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+	Ramp     *db.Ramp           `json:"ramp,omitempty"`
+}
+
+type OneTimeJob struct {
+	At       time.Time          `json:"at"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+}
+
+type Hold struct {
+	Until    time.Time            `json:"until"`
+	Preset   string               `json:"preset,omitempty"`
+	Settings codecbase.Settings   `json:"settings"`
+	Policy   string               `json:"policy"`
+	Revert   codecbase.Settings   `json:"revert"`
+	Deferred []codecbase.Settings `json:"deferred,omitempty"`
+}
+
+type JobRun struct {
+	JobName   string              `json:"jobName"`
+	Kind      string              `json:"kind"`
+	JobSet    string              `json:"jobset,omitempty"`
+	JobID     uint                `json:"jobId,omitempty"`
+	Scheduled time.Time           `json:"scheduled"`
+	Started   time.Time           `json:"started"`
+	Duration  time.Duration       `json:"duration"`
+	Preset    string              `json:"preset,omitempty"`
+	Settings  *codecbase.Settings `json:"settings,omitempty"`
+	Config    *codecbase.Settings `json:"config,omitempty"`
+	Outcome   string              `json:"outcome"`
+	Error     string              `json:"error,omitempty"`
+}
+
+type Preset struct {
+	Name     string             `json:"name"`
+	Settings codecbase.Settings `json:"settings"`
+}
+
+var modes = []uint{codecbase.C_Mode_Auto, codecbase.C_Mode_Heat, codecbase.C_Mode_Cool, codecbase.C_Mode_Dry}
+
+// Export all state in the store, read in a single transaction so that the backup is consistent.
+func Export(store db.Store) (*Backup, error) {
+	var b *Backup
+	err := store.WithTx(func(tx db.Store) error {
+		var err error
+		b, err = export(tx)
+		return err
+	})
+	return b, err
+}
+
+func export(store db.Store) (*Backup, error) {
+	b := &Backup{Format: FORMAT, Created: time.Now(), Units: []Unit{}, Presets: []Preset{}}
+
+	units, err := store.GetUnits()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range *units {
+		bu := Unit{Name: u.Name, IrInput: u.IrInput, IrOutput: u.IrOutput, JobSets: []JobSet{}}
+		rc, err := store.CurrentConfig(u.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+		}
+		bu.Config = *rc
+
+		for _, mode := range modes {
+			temp, fan, err := store.GetModeSettings(u.Name, mode)
+			if err != nil {
+				return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+			}
+			bu.ModeSettings = append(bu.ModeSettings, ModeSetting{mode, temp, fan})
+		}
+
+		jobsets, err := store.GetJobSets(u.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+		}
+		for _, js := range *jobsets {
+			bjs := JobSet{Name: js.Name, Active: js.Active, Priority: js.Priority, SkipMissed: js.SkipMissed, CronJobs: []CronJob{}}
+			if bjs.Activation, err = sched.JobSetActivation(&js); err != nil {
+				return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+			}
+			cronjobs, err := store.GetCronJobs(u.Name, js.Name)
+			if err != nil {
+				return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+			}
+			for _, cj := range *cronjobs {
+				bcj := CronJob{Schedule: cj.Schedule, Preset: cj.Preset}
+				if err := json.Unmarshal(cj.Settings, &bcj.Settings); err != nil {
+					return nil, fmt.Errorf("unit %q job set %q: %w", u.Name, js.Name, err)
+				}
+				if cj.Ramp != nil {
+					if err := json.Unmarshal(cj.Ramp, &bcj.Ramp); err != nil {
+						return nil, fmt.Errorf("unit %q job set %q: %w", u.Name, js.Name, err)
+					}
+				}
+				bjs.CronJobs = append(bjs.CronJobs, bcj)
+			}
+			bu.JobSets = append(bu.JobSets, bjs)
+		}
+
+		otjs, err := store.GetOneTimeJobs(u.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+		}
+		for _, otj := range *otjs {
+			botj := OneTimeJob{At: otj.At, Preset: otj.Preset}
+			if err := json.Unmarshal(otj.Settings, &botj.Settings); err != nil {
+				return nil, fmt.Errorf("unit %q one-time job at %s: %w", u.Name, otj.At, err)
+			}
+			bu.OneTimeJobs = append(bu.OneTimeJobs, botj)
+		}
+
+		if bu.Hold, err = exportHold(store, u.Name); err != nil {
+			return nil, fmt.Errorf("unit %q hold: %w", u.Name, err)
+		}
+
+		runs, err := store.GetJobRuns(u.Name, time.Time{})
+		if err != nil {
+			return nil, fmt.Errorf("unit %q: %w", u.Name, err)
+		}
+		for _, run := range *runs {
+			bu.JobRuns = append(bu.JobRuns, exportJobRun(&run))
+		}
+		b.Units = append(b.Units, bu)
+	}
+
+	presets, err := store.GetPresets()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range *presets {
+		bp := Preset{Name: p.Name}
+		if err := json.Unmarshal(p.Settings, &bp.Settings); err != nil {
+			return nil, fmt.Errorf("preset %q: %w", p.Name, err)
+		}
+		b.Presets = append(b.Presets, bp)
+	}
+	return b, nil
+}
+
+// Return the hold of a unit, or nil if it has none.
+func exportHold(store db.Store, unit string) (*Hold, error) {
+	hold, err := store.GetHold(unit)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	bh := &Hold{Until: hold.Until, Preset: hold.Preset, Policy: hold.Policy}
+	if err := json.Unmarshal(hold.Settings, &bh.Settings); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(hold.Revert, &bh.Revert); err != nil {
+		return nil, err
+	}
+	if hold.Deferred != nil {
+		if err := json.Unmarshal(hold.Deferred, &bh.Deferred); err != nil {
+			return nil, err
+		}
+	}
+	return bh, nil
+}
+
+// Return a job run as it is exported. The settings and config are left out if they can't be read, since the history is
+// only informational.
+func exportJobRun(run *db.JobRun) JobRun {
+	br := JobRun{JobName: run.JobName, Kind: run.Kind, JobSet: run.JobSet, JobID: run.JobID, Scheduled: run.Scheduled,
+		Started: run.Started, Duration: run.Duration, Preset: run.Preset, Outcome: run.Outcome, Error: run.Error}
+	if run.Settings != nil {
+		br.Settings = new(codecbase.Settings)
+		if json.Unmarshal(run.Settings, br.Settings) != nil {
+			br.Settings = nil
+		}
+	}
+	if run.Config != nil {
+		br.Config = new(codecbase.Settings)
+		if json.Unmarshal(run.Config, br.Config) != nil {
+			br.Config = nil
+		}
+	}
+	return br
+}
+
+// Check that settings are valid, by composing a config from them.
+func validateSettings(settings *codecbase.Settings, modeSettings rcutils.ModeSettingsProvider) error {
+	sendRc, err := rcutils.ComposeSendConfig(modeSettings, settings, codec.NewRcConfig())
+	if err != nil {
+		return err
+	}
+	if violations := sendRc.Validate(); violations != nil {
+		return violations
+	}
+	return nil
+}
+
+// Check the backup before anything is written, and return all problems that are found. Presets that are referred to by
+// cron jobs must be in the backup, or in the store when merging.
+func Validate(store db.Store, b *Backup, mode Mode) error {
+	var errs []error
+	if b.Format != FORMAT {
+		return fmt.Errorf("unsupported backup format %d, expecting %d", b.Format, FORMAT)
+	}
+
+	presets := make(map[string]bool)
+	for _, p := range b.Presets {
+		if p.Name == "" {
+			errs = append(errs, errors.New("preset without name"))
+		} else if presets[p.Name] {
+			errs = append(errs, fmt.Errorf("duplicate preset %q", p.Name))
+		}
+		presets[p.Name] = true
+		if err := validateSettings(&p.Settings, rcutils.NewMemModeSettings()); err != nil {
+			errs = append(errs, fmt.Errorf("preset %q: %w", p.Name, err))
+		}
+	}
+	presetExists := func(name string) bool {
+		if presets[name] {
+			return true
+		}
+		if mode == MODE_MERGE {
+			_, err := store.GetPreset(name)
+			return err == nil
+		}
+		return false
+	}
+
+	units := make(map[string]bool)
+	for _, u := range b.Units {
+		if u.Name == "" {
+			errs = append(errs, errors.New("unit without name"))
+			continue
+		}
+		if units[u.Name] {
+			errs = append(errs, fmt.Errorf("duplicate unit %q", u.Name))
+		}
+		units[u.Name] = true
+
+		if violations := u.Config.Validate(); violations != nil {
+			errs = append(errs, fmt.Errorf("unit %q: %w", u.Name, violations))
+		}
+		modeSettings := rcutils.NewMemModeSettings()
+		for _, ms := range u.ModeSettings {
+			rc := codec.NewRcConfig()
+			rc.Mode, rc.Temperature, rc.FanSpeed = ms.Mode, ms.Temperature, ms.FanSpeed
+			if violations := rc.Validate(); violations != nil {
+				errs = append(errs, fmt.Errorf("unit %q mode settings: %w", u.Name, violations))
+			}
+			modeSettings[ms.Mode] = rcutils.ModeSetting{Temperature: ms.Temperature, FanSpeed: ms.FanSpeed}
+		}
+
+		jobsets := make(map[string]bool)
+		for _, js := range u.JobSets {
+			if jobsets[js.Name] {
+				errs = append(errs, fmt.Errorf("unit %q: duplicate job set %q", u.Name, js.Name))
+			}
+			jobsets[js.Name] = true
+			if js.Activation != nil {
+				// the calendar is not read, since it might not exist on this machine
+				if err := js.Activation.Validate(); err != nil {
+					errs = append(errs, fmt.Errorf("unit %q job set %q activation: %w", u.Name, js.Name, err))
+				}
+			}
+			for _, cj := range js.CronJobs {
+				prefix := fmt.Sprintf("unit %q job set %q schedule %q", u.Name, js.Name, cj.Schedule)
+				if err := sched.ValidateSchedule(cj.Schedule); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+				}
+				if cj.Preset != "" && !presetExists(cj.Preset) {
+					errs = append(errs, fmt.Errorf("%s: preset %q: %w", prefix, cj.Preset, db.ErrNotFound))
+				}
+				if err := validateSettings(&cj.Settings, modeSettings); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+				}
+				if cj.Ramp != nil {
+					if err := sched.ValidateRamp(cj.Ramp); err != nil {
+						errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+					}
+				}
+			}
+		}
+		for _, otj := range u.OneTimeJobs {
+			prefix := fmt.Sprintf("unit %q one-time job at %s", u.Name, otj.At.Format(time.DateTime))
+			if otj.Preset != "" && !presetExists(otj.Preset) {
+				errs = append(errs, fmt.Errorf("%s: preset %q: %w", prefix, otj.Preset, db.ErrNotFound))
+			}
+			if err := validateSettings(&otj.Settings, modeSettings); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			}
+		}
+		if h := u.Hold; h != nil {
+			prefix := fmt.Sprintf("unit %q hold", u.Name)
+			if !slices.Contains(sched.HoldPolicies, h.Policy) {
+				errs = append(errs, fmt.Errorf("%s: invalid policy %q", prefix, h.Policy))
+			}
+			if h.Preset != "" && !presetExists(h.Preset) {
+				errs = append(errs, fmt.Errorf("%s: preset %q: %w", prefix, h.Preset, db.ErrNotFound))
+			}
+			for _, settings := range append([]codecbase.Settings{h.Settings, h.Revert}, h.Deferred...) {
+				if err := validateSettings(&settings, modeSettings); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Validate the backup and write it to the store in a single transaction. Nothing is changed if the backup is invalid.
+func Import(store db.Store, b *Backup, mode Mode) error {
+	if err := Validate(store, b, mode); err != nil {
+		return err
+	}
+
+	return store.WithTx(func(tx db.Store) error {
+		if mode == MODE_REPLACE {
+			if err := tx.DeleteAllJobSetsPermanently(); err != nil {
+				return err
+			}
+			if err := tx.DeleteAllCronJobsPermanently(); err != nil {
+				return err
+			}
+			if err := tx.DeleteAllOneTimeJobsPermanently(); err != nil {
+				return err
+			}
+			if err := tx.DeleteAllHoldsPermanently(); err != nil {
+				return err
+			}
+			if err := tx.DeleteAllJobRunsPermanently(); err != nil {
+				return err
+			}
+			presets, err := tx.GetPresets()
+			if err != nil {
+				return err
+			}
+			for _, p := range *presets {
+				if !slices.ContainsFunc(b.Presets, func(bp Preset) bool { return bp.Name == p.Name }) {
+					if _, err := tx.DeletePreset(p.Name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		for _, p := range b.Presets {
+			if err := tx.SavePreset(p.Name, &p.Settings); err != nil {
+				return fmt.Errorf("preset %q: %w", p.Name, err)
+			}
+		}
+
+		for _, u := range b.Units {
+			if err := importUnit(tx, &u); err != nil {
+				return fmt.Errorf("unit %q: %w", u.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+func importUnit(tx db.Store, u *Unit) error {
+	if err := tx.SaveUnit(u.Name, u.IrInput, u.IrOutput); err != nil {
+		return err
+	}
+	dbRc, err := tx.CurrentConfig(u.Name)
+	if err != nil {
+		return err
+	}
+	if err := tx.SaveConfig(u.Name, &u.Config, dbRc); err != nil {
+		return err
+	}
+	// after the config, since saving the config also updates the mode settings of its mode
+	for _, ms := range u.ModeSettings {
+		if err := tx.SetModeSettings(u.Name, ms.Mode, ms.Temperature, ms.FanSpeed); err != nil {
+			return err
+		}
+	}
+	for _, js := range u.JobSets {
+		if err := tx.DeleteJobSet(u.Name, js.Name); err != nil {
+			return err
+		}
+		if err := tx.SaveJobSet(u.Name, js.Name, js.Active); err != nil {
+			return err
+		}
+		if js.Priority != 0 {
+			if err := tx.SetJobSetPriority(u.Name, js.Name, js.Priority); err != nil {
+				return err
+			}
+		}
+		if js.SkipMissed {
+			if err := tx.SetJobSetSkipMissed(u.Name, js.Name, true); err != nil {
+				return err
+			}
+		}
+		if js.Activation != nil {
+			activation, err := json.Marshal(js.Activation)
+			if err != nil {
+				return err
+			}
+			if err := tx.SetJobSetActivation(u.Name, js.Name, activation); err != nil {
+				return err
+			}
+		}
+		for _, cj := range js.CronJobs {
+			if err := tx.SaveCronJob(u.Name, js.Name, cj.Schedule, cj.Preset, &cj.Settings, cj.Ramp); err != nil {
+				return err
+			}
+		}
+	}
+
+	existing, err := tx.GetOneTimeJobs(u.Name)
+	if err != nil {
+		return err
+	}
+	for _, otj := range u.OneTimeJobs {
+		settings, err := json.Marshal(otj.Settings)
+		if err != nil {
+			return err
+		}
+		// importing the same backup twice doesn't duplicate the jobs
+		if slices.ContainsFunc(*existing, func(e db.OneTimeJob) bool {
+			return e.At.Equal(otj.At) && e.Preset == otj.Preset && string(e.Settings) == string(settings)
+		}) {
+			continue
+		}
+		if _, err := tx.SaveOneTimeJob(u.Name, otj.At, otj.Preset, &otj.Settings); err != nil {
+			return err
+		}
+	}
+
+	if u.Hold != nil {
+		if err := importHold(tx, u.Name, u.Hold); err != nil {
+			return err
+		}
+	}
+
+	runs, err := tx.GetJobRuns(u.Name, time.Time{})
+	if err != nil {
+		return err
+	}
+	for _, br := range u.JobRuns {
+		// importing the same backup twice doesn't duplicate the runs
+		if slices.ContainsFunc(*runs, func(r db.JobRun) bool { return r.JobName == br.JobName && r.Started.Equal(br.Started) }) {
+			continue
+		}
+		run := &db.JobRun{Unit: u.Name, JobName: br.JobName, Kind: br.Kind, JobSet: br.JobSet, JobID: br.JobID,
+			Scheduled: br.Scheduled, Started: br.Started, Duration: br.Duration, Preset: br.Preset, Outcome: br.Outcome,
+			Error: br.Error}
+		if br.Settings != nil {
+			if run.Settings, err = json.Marshal(br.Settings); err != nil {
+				return err
+			}
+		}
+		if br.Config != nil {
+			if run.Config, err = json.Marshal(br.Config); err != nil {
+				return err
+			}
+		}
+		if err := tx.SaveJobRun(run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the hold of a unit. A hold that has already ended is ended when the controller reloads the unit.
+func importHold(tx db.Store, unit string, bh *Hold) error {
+	hold := &db.Hold{Unit: unit, Until: bh.Until, Preset: bh.Preset, Policy: bh.Policy}
+	var err error
+	if hold.Settings, err = json.Marshal(&bh.Settings); err != nil {
+		return err
+	}
+	if hold.Revert, err = json.Marshal(&bh.Revert); err != nil {
+		return err
+	}
+	if len(bh.Deferred) > 0 {
+		if hold.Deferred, err = json.Marshal(bh.Deferred); err != nil {
+			return err
+		}
+	}
+	return tx.SaveHold(hold)
+}
+
+func WriteFile(file string, b *Backup) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(data, '\n'), 0644)
+}
+
+func ReadFile(file string) (*Backup, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var b Backup
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return &b, nil
+}
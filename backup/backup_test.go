@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+// Fill a store with a little of everything.
+func fillStore(t *testing.T, store db.Store) {
+	store.SaveUnit("bedroom", "/dev/lirc-rx1", "/dev/lirc-tx1")
+	rc, _ := store.CurrentConfig("bedroom")
+	sendRc := rc.CopyForSending()
+	sendRc.Mode, sendRc.Temperature = codecbase.C_Mode_Heat, 23
+	if err := store.SaveConfig("bedroom", sendRc, rc); err != nil {
+		t.Fatal(err)
+	}
+	store.SetModeSettings("bedroom", codecbase.C_Mode_Cool, 25, codecbase.C_FanSpeed_High)
+	store.SavePreset("Night", &codecbase.Settings{Temperature: "18"})
+	store.SaveJobSet("bedroom", "Normal", true)
+	store.SaveCronJob("bedroom", "Normal", "0 22 * * *", "Night", &codecbase.Settings{Quiet: "on"}, &db.Ramp{To: 17, Minutes: 120})
+	store.SaveJobSet("bedroom", "Christmas", false)
+	store.SetJobSetPriority("bedroom", "Christmas", 10)
+	store.SetJobSetSkipMissed("bedroom", "Christmas", true)
+	store.SetJobSetActivation("bedroom", "Christmas", []byte(`{"ranges":[{"start":"2030-12-20","end":"2031-01-06"}]}`))
+	store.SaveOneTimeJob("bedroom", time.Date(2030, 1, 2, 16, 30, 0, 0, time.Local), "Night", &codecbase.Settings{})
+	store.SaveHold(&db.Hold{Unit: "bedroom", Until: time.Date(2030, 1, 2, 18, 0, 0, 0, time.Local), Preset: "Night",
+		Policy: "defer", Settings: []byte(`{"quiet":"on"}`), Revert: []byte(`{"quiet":"off","temp":"23"}`),
+		Deferred: []byte(`[{"temp":"21"}]`)})
+	store.SaveJobRun(&db.JobRun{Unit: "bedroom", JobName: "bedroom/Normal_1 0 22 * * *", Kind: "settings", JobSet: "Normal",
+		Started: time.Date(2030, 1, 1, 22, 0, 0, 0, time.Local), Preset: "Night", Settings: []byte(`{"temp":"18"}`), Outcome: "ok"})
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, newStore := range map[string]func() db.Store{
+		"memory": func() db.Store { return db.NewMemStore() },
+		"sqlite": func() db.Store {
+			s, err := db.Open(filepath.Join(t.TempDir(), "paninv.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			src := newStore()
+			fillStore(t, src)
+			b, err := Export(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(t.TempDir(), "backup.json")
+			if err := WriteFile(file, b); err != nil {
+				t.Fatal(err)
+			}
+			b, err = ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := newStore()
+			if err := Import(dst, b, MODE_REPLACE); err != nil {
+				t.Fatal(err)
+			}
+			if u, err := dst.GetUnit("bedroom"); err != nil || u.IrOutput != "/dev/lirc-tx1" {
+				t.Errorf("unit not imported: %+v, %v", u, err)
+			}
+			if rc, _ := dst.CurrentConfig("bedroom"); rc.Mode != codecbase.C_Mode_Heat || rc.Temperature != 23 {
+				t.Errorf("config not imported: %+v", rc)
+			}
+			if temp, fan, _ := dst.GetModeSettings("bedroom", codecbase.C_Mode_Cool); temp != 25 || fan != codecbase.C_FanSpeed_High {
+				t.Errorf("mode settings not imported: %d %d", temp, fan)
+			}
+			if cjs, _ := dst.GetCronJobs("bedroom", "Normal"); len(*cjs) != 1 || (*cjs)[0].Preset != "Night" || string((*cjs)[0].Ramp) != `{"to":17,"minutes":120}` {
+				t.Errorf("cron jobs not imported: %+v", cjs)
+			}
+			if jss, _ := dst.GetJobSets("bedroom"); len(*jss) != 2 || (*jss)[1].Priority != 10 || !(*jss)[1].SkipMissed || string((*jss)[1].Activation) != `{"ranges":[{"start":"2030-12-20","end":"2031-01-06"}]}` {
+				t.Errorf("job sets not imported: %+v", jss)
+			}
+			if _, err := dst.GetPreset("Night"); err != nil {
+				t.Errorf("preset not imported: %v", err)
+			}
+			// a second import doesn't duplicate one-time jobs
+			if err := Import(dst, b, MODE_MERGE); err != nil {
+				t.Fatal(err)
+			}
+			if otjs, _ := dst.GetOneTimeJobs("bedroom"); len(*otjs) != 1 || (*otjs)[0].Preset != "Night" {
+				t.Errorf("one-time jobs not imported: %+v", otjs)
+			}
+			if hold, err := dst.GetHold("bedroom"); err != nil || hold.Policy != "defer" || hold.Preset != "Night" ||
+				string(hold.Revert) != `{"quiet":"off","temp":"23"}` || string(hold.Deferred) != `[{"temp":"21"}]` {
+				t.Errorf("hold not imported: %+v, %v", hold, err)
+			}
+			if runs, _ := dst.GetJobRuns("bedroom", time.Time{}); len(*runs) != 1 || (*runs)[0].JobSet != "Normal" ||
+				string((*runs)[0].Settings) != `{"temp":"18"}` {
+				t.Errorf("job runs not imported: %+v", runs)
+			}
+		})
+	}
+}
+
+func TestMergeAndReplace(t *testing.T) {
+	b := &Backup{Format: FORMAT, Presets: []Preset{{Name: "Day", Settings: codecbase.Settings{Temperature: "21"}}}}
+
+	store := db.NewMemStore()
+	fillStore(t, store)
+	if err := Import(store, b, MODE_MERGE); err != nil {
+		t.Fatal(err)
+	}
+	if presets, _ := store.GetPresets(); len(*presets) != 2 {
+		t.Errorf("merge: expected both presets, got %+v", presets)
+	}
+
+	// the job set refers to a preset that is not in the backup
+	if err := Import(store, b, MODE_REPLACE); err != nil {
+		t.Fatal(err)
+	}
+	if presets, _ := store.GetPresets(); len(*presets) != 1 || (*presets)[0].Name != "Day" {
+		t.Errorf("replace: expected only the imported preset, got %+v", presets)
+	}
+	if jobsets, _ := store.GetJobSets("bedroom"); len(*jobsets) != 0 {
+		t.Errorf("replace: expected no job sets, got %+v", jobsets)
+	}
+	if _, err := store.GetHold("bedroom"); err == nil {
+		t.Error("replace: expected no hold")
+	}
+	if runs, _ := store.GetJobRuns("bedroom", time.Time{}); len(*runs) != 0 {
+		t.Errorf("replace: expected no job runs, got %+v", runs)
+	}
+}
+
+func TestInvalidBackup(t *testing.T) {
+	store := db.NewMemStore()
+	fillStore(t, store)
+	before, _ := Export(store)
+
+	b, _ := Export(store)
+	b.Presets = append(b.Presets, Preset{Name: "Hot", Settings: codecbase.Settings{Temperature: "40"}})
+	b.Units[0].JobSets[0].CronJobs[0].Schedule = "0 25 * * *"
+	b.Units[0].JobSets[0].CronJobs = append(b.Units[0].JobSets[0].CronJobs, CronJob{Schedule: "0 6 * * *", Preset: "Missing"})
+	b.Units[0].JobSets = append(b.Units[0].JobSets, JobSet{Name: "Other"})
+
+	err := Import(store, b, MODE_REPLACE)
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{`preset "Hot"`, `schedule "0 25 * * *"`, `preset "Missing"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	after, _ := Export(store)
+	after.Created = before.Created
+	if len(after.Presets) != len(before.Presets) || len(after.Units[0].JobSets) != len(before.Units[0].JobSets) {
+		t.Errorf("store was changed by an invalid import")
+	}
+}
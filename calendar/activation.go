@@ -0,0 +1,179 @@
+package calendar
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How far ahead events are looked up. A job set that doesn't change state within this time is re-evaluated later.
+const HORIZON = 366 * 24 * time.Hour
+
+const dateFormat = "2006-01-02"
+const dateTimeFormat = "2006-01-02 15:04"
+
+// Decides when a job set is active, instead of the job set being activated manually. The job set is active during the
+// events in the calendar whose summary contains Match, and during the ranges. With Invert it is active outside them
+// instead, e.g. a "Normal" job set that is inactive during vacations.
+//
+//	{ "calendar": "/home/pi/family.ics", "match": "vacation" }
+//	{ "ranges": [ { "name": "Christmas", "start": "2024-12-20", "end": "2025-01-06" } ], "invert": true }
+type Activation struct {
+	Calendar string  `json:"calendar,omitempty"` // path of an iCalendar (.ics) file
+	Match    string  `json:"match,omitempty"`    // only use events whose summary contains this, ignoring case
+	Ranges   []Range `json:"ranges,omitempty"`
+	Invert   bool    `json:"invert,omitempty"`
+}
+
+// A range of dates, where both dates are included, e.g. "2024-12-20" to "2025-01-06". A time can be given, e.g.
+// "2024-12-20 15:00", in which case the range ends at that time.
+type Range struct {
+	Name  string `json:"name,omitempty"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// A period when a job set is active, from an event or a range. The end is exclusive.
+type Period struct {
+	Summary string
+	Start   time.Time
+	End     time.Time
+}
+
+// The state of an activation at a specific time.
+type Status struct {
+	Active bool
+	Reason string    // why the job set is active or inactive, e.g. `during "Vacation" until 2024-07-14 00:00`
+	Until  time.Time // when the state may change next, or zero if not within the horizon
+}
+
+func parseRangeTime(s string, loc *time.Location) (t time.Time, isDate bool, err error) {
+	if t, err = time.ParseInLocation(dateFormat, s, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err = time.ParseInLocation(dateTimeFormat, s, loc); err == nil {
+		return t, false, nil
+	}
+	return t, false, fmt.Errorf("invalid date %q, expecting e.g. 2024-12-20 or 2024-12-20 15:00", s)
+}
+
+func (r *Range) period(loc *time.Location) (*Period, error) {
+	start, _, err := parseRangeTime(r.Start, loc)
+	if err != nil {
+		return nil, err
+	}
+	end, isDate, err := parseRangeTime(r.End, loc)
+	if err != nil {
+		return nil, err
+	}
+	if isDate {
+		end = end.AddDate(0, 0, 1)
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("range %s - %s ends before it starts", r.Start, r.End)
+	}
+	summary := r.Name
+	if summary == "" {
+		summary = r.Start + " - " + r.End
+	}
+	return &Period{summary, start, end}, nil
+}
+
+// Check the activation without reading the calendar.
+func (a *Activation) Validate() error {
+	if a.Calendar == "" && len(a.Ranges) == 0 {
+		return errors.New("an activation needs a calendar or ranges")
+	}
+	if a.Match != "" && a.Calendar == "" {
+		return errors.New("match is only used with a calendar")
+	}
+	var errs []error
+	for _, r := range a.Ranges {
+		if _, err := r.period(time.Local); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Return the periods that end after from and start before to, ordered by start.
+func (a *Activation) Periods(from, to time.Time) ([]Period, error) {
+	var periods []Period
+	for _, r := range a.Ranges {
+		p, err := r.period(from.Location())
+		if err != nil {
+			return nil, err
+		}
+		if p.End.After(from) && p.Start.Before(to) {
+			periods = append(periods, *p)
+		}
+	}
+
+	if a.Calendar != "" {
+		f, err := os.Open(a.Calendar)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		events, err := ParseICS(f, from.Location())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Calendar, err)
+		}
+		match := strings.ToLower(a.Match)
+		for _, ev := range events {
+			if !strings.Contains(strings.ToLower(ev.Summary), match) {
+				continue
+			}
+			ev.Occurrences(to, func(start, end time.Time) bool {
+				if end.After(from) {
+					periods = append(periods, Period{ev.Summary, start, end})
+				}
+				return true
+			})
+		}
+	}
+
+	slices.SortStableFunc(periods, func(a, b Period) int { return a.Start.Compare(b.Start) })
+	return periods, nil
+}
+
+// Return the state of the activation at now. The calendar is read every time, so that changes to it are picked up.
+func (a *Activation) Evaluate(now time.Time) (*Status, error) {
+	periods, err := a.Periods(now, now.Add(HORIZON))
+	if err != nil {
+		return nil, err
+	}
+
+	var status Status
+	// overlapping and adjacent periods are merged, so that the state only changes when the last of them ends
+	var current *Period
+	until := now
+	for extended := true; extended; {
+		extended = false
+		for i, p := range periods {
+			if !p.Start.After(until) && p.End.After(until) {
+				if current == nil {
+					current = &periods[i]
+				}
+				until, extended = p.End, true
+			}
+		}
+	}
+	if current != nil {
+		status.Until = until
+		status.Reason = fmt.Sprintf("during %q until %s", current.Summary, until.Format(dateTimeFormat))
+	} else if i := slices.IndexFunc(periods, func(p Period) bool { return p.Start.After(now) }); i >= 0 {
+		status.Until = periods[i].Start
+		status.Reason = fmt.Sprintf("until %q starts %s", periods[i].Summary, periods[i].Start.Format(dateTimeFormat))
+	} else {
+		status.Reason = "no upcoming events"
+	}
+	if status.Until.After(now.Add(HORIZON)) {
+		status.Until = time.Time{}
+	}
+	status.Active = (current != nil) != a.Invert
+	return &status, nil
+}
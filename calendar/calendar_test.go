@@ -0,0 +1,156 @@
+package calendar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const familyICS = `BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Google Inc//Google Calendar 70.9054//EN
+BEGIN:VEVENT
+DTSTART;VALUE=DATE:20240701
+DTEND;VALUE=DATE:20240715
+SUMMARY:Vacation in Spain
+BEGIN:VALARM
+ACTION:EMAIL
+SUMMARY:Alarm notification
+TRIGGER:-P1D
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+DTSTART;TZID=Europe/Stockholm:20240712T180000
+DTEND;TZID=Europe/Stockholm:20240720T120000
+SUMMARY:Vacation at the
+  cabin
+END:VEVENT
+BEGIN:VEVENT
+DTSTART:20240605T160000Z
+DURATION:PT2H
+RRULE:FREQ=WEEKLY;COUNT=4
+EXDATE:20240612T160000Z
+SUMMARY:Football practice
+END:VEVENT
+BEGIN:VEVENT
+DTSTART;VALUE=DATE:20241224
+SUMMARY:Christmas Eve
+RRULE:FREQ=YEARLY
+END:VEVENT
+BEGIN:VEVENT
+DTSTART;VALUE=DATE:20240801
+DTEND;VALUE=DATE:20240802
+SUMMARY:Cancelled vacation
+STATUS:CANCELLED
+END:VEVENT
+END:VCALENDAR
+`
+
+func TestParseICS(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip(err)
+	}
+	events, err := ParseICS(strings.NewReader(strings.ReplaceAll(familyICS, "\n", "\r\n")), stockholm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %d events, want 4: %+v", len(events), events)
+	}
+
+	if ev := events[0]; ev.Summary != "Vacation in Spain" || !ev.AllDay ||
+		!ev.Start.Equal(time.Date(2024, 7, 1, 0, 0, 0, 0, stockholm)) || !ev.End.Equal(time.Date(2024, 7, 15, 0, 0, 0, 0, stockholm)) {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if ev := events[1]; ev.Summary != "Vacation at the cabin" || !ev.Start.Equal(time.Date(2024, 7, 12, 18, 0, 0, 0, stockholm)) {
+		t.Errorf("unexpected event %+v", ev)
+	}
+
+	var practices []string
+	events[2].Occurrences(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), func(start, end time.Time) bool {
+		practices = append(practices, start.UTC().Format("01-02 15:04")+"/"+end.Sub(start).String())
+		return true
+	})
+	if got := strings.Join(practices, " "); got != "06-05 16:00/2h0m0s 06-19 16:00/2h0m0s 06-26 16:00/2h0m0s" {
+		t.Errorf("practices %s", got)
+	}
+
+	var christmases []string
+	events[3].Occurrences(time.Date(2027, 1, 1, 0, 0, 0, 0, stockholm), func(start, end time.Time) bool {
+		christmases = append(christmases, start.Format(dateFormat)+"/"+end.Format(dateFormat))
+		return true
+	})
+	if got := strings.Join(christmases, " "); got != "2024-12-24/2024-12-25 2025-12-24/2025-12-25 2026-12-24/2026-12-25" {
+		t.Errorf("christmases %s", got)
+	}
+
+	if _, err := ParseICS(strings.NewReader("not a calendar"), stockholm); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	stockholm, err := time.LoadLocation("Europe/Stockholm")
+	if err != nil {
+		t.Skip(err)
+	}
+	file := filepath.Join(t.TempDir(), "family.ics")
+	if err := os.WriteFile(file, []byte(familyICS), 0644); err != nil {
+		t.Fatal(err)
+	}
+	at := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2024, month, day, hour, 0, 0, 0, stockholm)
+	}
+
+	vacation := &Activation{Calendar: file, Match: "VACATION"}
+	normal := &Activation{Calendar: file, Match: "vacation", Invert: true}
+	christmas := &Activation{Ranges: []Range{{Name: "Christmas", Start: "2024-12-20", End: "2025-01-06"}, {Start: "2025-01-07", End: "2025-01-07 18:00"}}}
+
+	for _, tt := range []struct {
+		a      *Activation
+		now    time.Time
+		active bool
+		reason string
+		until  time.Time
+	}{
+		{vacation, at(6, 1, 12), false, `until "Vacation in Spain" starts 2024-07-01 00:00`, at(7, 1, 0)},
+		{normal, at(6, 1, 12), true, `until "Vacation in Spain" starts 2024-07-01 00:00`, at(7, 1, 0)},
+		// the overlapping vacations are merged
+		{vacation, at(7, 1, 0), true, `during "Vacation in Spain" until 2024-07-20 12:00`, at(7, 20, 12)},
+		{normal, at(7, 14, 12), false, `during "Vacation in Spain" until 2024-07-20 12:00`, at(7, 20, 12)},
+		{vacation, at(7, 20, 12), false, "no upcoming events", time.Time{}},
+		{christmas, at(12, 19, 23), false, `until "Christmas" starts 2024-12-20 00:00`, at(12, 20, 0)},
+		{christmas, at(12, 24, 12), true, `during "Christmas" until 2025-01-07 18:00`, time.Date(2025, 1, 7, 18, 0, 0, 0, stockholm)},
+	} {
+		status, err := tt.a.Evaluate(tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Active != tt.active || status.Reason != tt.reason || !status.Until.Equal(tt.until) {
+			t.Errorf("Evaluate(%s) = %+v, want %v %q %s", tt.now, status, tt.active, tt.reason, tt.until)
+		}
+	}
+
+	if _, err := (&Activation{Calendar: filepath.Join(t.TempDir(), "missing.ics")}).Evaluate(at(6, 1, 0)); err == nil {
+		t.Error("expected an error for a missing calendar")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, a := range []*Activation{
+		{},
+		{Match: "vacation", Ranges: []Range{{Start: "2024-12-20", End: "2025-01-06"}}},
+		{Ranges: []Range{{Start: "2024-12-20", End: "tomorrow"}}},
+		{Ranges: []Range{{Start: "2025-01-06", End: "2024-12-20"}}},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("Validate(%+v) succeeded", a)
+		}
+	}
+	if err := (&Activation{Ranges: []Range{{Start: "2024-12-20 15:00", End: "2024-12-20"}}}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,312 @@
+// Package calendar decides when job sets are active, from the events in an iCalendar (.ics) file, e.g. exported from a
+// shared family calendar, or from explicit date ranges.
+package calendar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An event in an iCalendar file. Recurring events are expanded by Occurrences.
+type Event struct {
+	Summary string
+	Start   time.Time
+	End     time.Time // exclusive
+	AllDay  bool
+	Rule    *RecurrenceRule
+	ExDates []time.Time // start times of occurrences that have been removed
+}
+
+// The supported subset of RRULE: FREQ with INTERVAL, and COUNT or UNTIL.
+type RecurrenceRule struct {
+	Freq     string // DAILY, WEEKLY, MONTHLY or YEARLY
+	Interval int
+	Count    int       // 0 if not limited by count
+	Until    time.Time // zero if not limited by time
+}
+
+// A content line of an iCalendar file, e.g. "DTSTART;TZID=Europe/Stockholm:20240701T080000".
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+func parseProperty(line string) (*property, error) {
+	// the value may contain colons, but parameters only contain them in quoted strings
+	head, value, found := "", "", false
+	inQuote := false
+	for i, c := range line {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ':' && !inQuote {
+			head, value, found = line[:i], line[i+1:], true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("invalid line %q", line)
+	}
+	parts := strings.Split(head, ";")
+	p := &property{name: strings.ToUpper(parts[0]), params: make(map[string]string), value: value}
+	for _, param := range parts[1:] {
+		k, v, _ := strings.Cut(param, "=")
+		p.params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return p, nil
+}
+
+// Return the unfolded content lines. Long lines are folded by inserting a line break followed by a space or tab.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+var textUnescaper = strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// Parse a DATE or DATE-TIME value. Dates and floating times are in loc, and times with a TZID in that time zone, or in
+// loc if the time zone is unknown.
+func parseTime(p *property, loc *time.Location) (t time.Time, allDay bool, err error) {
+	value := p.value
+	if p.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	if tzid := p.params["TZID"]; tzid != "" {
+		if tz, err := time.LoadLocation(tzid); err == nil {
+			loc = tz
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// Parse a DURATION value, e.g. "P1D", "PT1H30M" or "P2W".
+func parseDuration(value string) (days int, d time.Duration, err error) {
+	s, found := strings.CutPrefix(strings.TrimPrefix(value, "+"), "P")
+	if !found || s == "" {
+		return 0, 0, fmt.Errorf("invalid duration %q", value)
+	}
+	inTime := false
+	for s != "" {
+		if s[0] == 'T' {
+			inTime, s = true, s[1:]
+			continue
+		}
+		i := strings.IndexFunc(s, func(c rune) bool { return c < '0' || c > '9' })
+		if i <= 0 {
+			return 0, 0, fmt.Errorf("invalid duration %q", value)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		switch unit := s[i]; {
+		case unit == 'W' && !inTime:
+			days += 7 * n
+		case unit == 'D' && !inTime:
+			days += n
+		case unit == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case unit == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case unit == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, 0, fmt.Errorf("invalid duration %q", value)
+		}
+		s = s[i+1:]
+	}
+	return days, d, nil
+}
+
+func parseRule(value string, loc *time.Location) (*RecurrenceRule, error) {
+	rule := &RecurrenceRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		var err error
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			rule.Freq = strings.ToUpper(v)
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(v)
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(v)
+		case "UNTIL":
+			rule.Until, _, err = parseTime(&property{value: v, params: map[string]string{}}, loc)
+		case "WKST":
+			// only matters for rules that aren't supported
+		default:
+			return nil, fmt.Errorf("unsupported rule part %q", k)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule part %q: %w", part, err)
+		}
+	}
+	switch rule.Freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+	default:
+		return nil, fmt.Errorf("unsupported frequency %q", rule.Freq)
+	}
+	if rule.Interval < 1 {
+		return nil, fmt.Errorf("invalid interval %d", rule.Interval)
+	}
+	return rule, nil
+}
+
+// Parse the events of an iCalendar file. Dates and times without a time zone are in loc. Cancelled events are skipped.
+// Recurring events with rules that aren't supported, e.g. "every second Tuesday of the month", are logged and only
+// their first occurrence is used.
+func ParseICS(r io.Reader, loc *time.Location) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(lines[0], "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an iCalendar file")
+	}
+
+	var events []Event
+	var ev *Event
+	var cancelled, hasEnd bool
+	var durDays, nested int
+	var dur time.Duration
+	for n, line := range lines {
+		p, err := parseProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if p.name == "BEGIN" && strings.EqualFold(p.value, "VEVENT") {
+			ev, cancelled, hasEnd, durDays, nested, dur = &Event{}, false, false, 0, 0, 0
+			continue
+		}
+		if ev == nil {
+			continue
+		}
+		// skip the properties of components within the event, e.g. alarms
+		if p.name == "BEGIN" {
+			nested++
+			continue
+		} else if nested > 0 {
+			if p.name == "END" {
+				nested--
+			}
+			continue
+		}
+		switch p.name {
+		case "SUMMARY":
+			ev.Summary = textUnescaper.Replace(p.value)
+		case "DTSTART":
+			ev.Start, ev.AllDay, err = parseTime(p, loc)
+		case "DTEND":
+			ev.End, _, err = parseTime(p, loc)
+			hasEnd = true
+		case "DURATION":
+			durDays, dur, err = parseDuration(p.value)
+		case "STATUS":
+			cancelled = strings.EqualFold(p.value, "CANCELLED")
+		case "RRULE":
+			var ruleErr error
+			if ev.Rule, ruleErr = parseRule(p.value, loc); ruleErr != nil {
+				slog.Warn("unsupported recurrence, only using the first occurrence", "line", n+1, "rule", p.value, "err", ruleErr)
+			}
+		case "EXDATE":
+			for _, v := range strings.Split(p.value, ",") {
+				t, _, err := parseTime(&property{value: v, params: p.params}, loc)
+				if err == nil {
+					ev.ExDates = append(ev.ExDates, t)
+				}
+			}
+		case "END":
+			if !strings.EqualFold(p.value, "VEVENT") {
+				continue
+			}
+			if ev.Start.IsZero() {
+				return nil, fmt.Errorf("line %d: event %q has no start", n+1, ev.Summary)
+			}
+			if !hasEnd {
+				// an all-day event without an end lasts the whole day
+				ev.End = ev.Start.AddDate(0, 0, durDays).Add(dur)
+				if ev.AllDay && durDays == 0 && dur == 0 {
+					ev.End = ev.Start.AddDate(0, 0, 1)
+				}
+			}
+			if !cancelled && ev.End.After(ev.Start) {
+				events = append(events, *ev)
+			}
+			ev = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+	}
+	return events, nil
+}
+
+// Call fn with the start and end of each occurrence of the event that starts before to, in order, until fn returns
+// false.
+func (ev *Event) Occurrences(to time.Time, fn func(start, end time.Time) bool) {
+	length := ev.End.Sub(ev.Start)
+	// all-day events keep their length in days across DST transitions
+	days := int(time.Date(ev.End.Year(), ev.End.Month(), ev.End.Day(), 0, 0, 0, 0, time.UTC).Sub(
+		time.Date(ev.Start.Year(), ev.Start.Month(), ev.Start.Day(), 0, 0, 0, 0, time.UTC)) / (24 * time.Hour))
+	isExDate := func(t time.Time) bool {
+		for _, ex := range ev.ExDates {
+			if ex.Equal(t) {
+				return true
+			}
+		}
+		return false
+	}
+	r := ev.Rule
+	if r == nil {
+		if ev.Start.Before(to) {
+			fn(ev.Start, ev.End)
+		}
+		return
+	}
+	for i := 0; r.Count == 0 || i < r.Count; i++ {
+		// step from the first occurrence, so that e.g. monthly events on the 31st don't drift
+		var start time.Time
+		switch r.Freq {
+		case "DAILY":
+			start = ev.Start.AddDate(0, 0, i*r.Interval)
+		case "WEEKLY":
+			start = ev.Start.AddDate(0, 0, 7*i*r.Interval)
+		case "MONTHLY":
+			start = ev.Start.AddDate(0, i*r.Interval, 0)
+		case "YEARLY":
+			start = ev.Start.AddDate(i*r.Interval, 0, 0)
+		}
+		if !start.Before(to) || (!r.Until.IsZero() && start.After(r.Until)) {
+			return
+		}
+		if isExDate(start) {
+			continue
+		}
+		end := start.Add(length)
+		if ev.AllDay {
+			end = start.AddDate(0, 0, days)
+		}
+		if !fn(start, end) {
+			return
+		}
+	}
+}
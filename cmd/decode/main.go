@@ -47,6 +47,10 @@ func printParameters(msg *codec.Message) {
 	}
 
 	c.PrintConfigAndChecksum(checksum)
+
+	if err := msg.Validate(); err != nil {
+		fmt.Printf("Rejected: %s\n", err)
+	}
 }
 
 func messageHandler(options *Options) func(*codec.Message) {
@@ -85,6 +89,7 @@ func main() {
 	flag.BoolVar(&recOptions.Device, "rec-dev", recOptions.Device, "receive option: reading from LIRC device")
 	flag.BoolVar(&recOptions.PrintRaw, "rec-raw", recOptions.PrintRaw, "receive option: print raw pulse data")
 	flag.BoolVar(&recOptions.PrintClean, "rec-clean", recOptions.PrintClean, "receive option: print cleaned up pulse data")
+	flag.BoolVar(&recOptions.AcceptInvalid, "rec-invalid", recOptions.AcceptInvalid, "receive option: decode messages that fail validation (e.g. from other remotes)")
 
 	flag.Parse()
 
@@ -2,17 +2,26 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
-	"io"
+	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
 
+	"rpi_panasonic_inverter_rc/backup"
 	"rpi_panasonic_inverter_rc/codec"
-	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/control"
 	"rpi_panasonic_inverter_rc/db"
 	"rpi_panasonic_inverter_rc/logs"
 	"rpi_panasonic_inverter_rc/sched"
+	"rpi_panasonic_inverter_rc/sensor"
 	"rpi_panasonic_inverter_rc/server"
+	"rpi_panasonic_inverter_rc/solar"
 )
 
 type Options struct {
@@ -21,7 +30,95 @@ type Options struct {
 	PrintMessage bool
 }
 
-func messageHandler(options *Options) func(*codec.Message) {
+// The LIRC devices of a unit, as configured in the units file:
+//
+//	{
+//	  "default": { "irin": "/dev/lirc-rx", "irout": "/dev/lirc-tx" },
+//	  "bedroom": { "irin": "/dev/lirc-rx1", "irout": "/dev/lirc-tx1" }
+//	}
+type UnitDevices struct {
+	IrInput  string `json:"irin"`
+	IrOutput string `json:"irout"`
+}
+
+// Read the units file. Without a units file, the default unit uses the devices given on the command line.
+func loadUnits(file, irInput, irOutput string) (map[string]UnitDevices, error) {
+	if file == "" {
+		return map[string]UnitDevices{db.DefaultUnit: {irInput, irOutput}}, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var units map[string]UnitDevices
+	if err := json.Unmarshal(data, &units); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	// receivers and senders are keyed by device, so a device can't be shared by several units
+	irInputs := make(map[string]string)
+	irOutputs := make(map[string]string)
+	for _, name := range slices.Sorted(maps.Keys(units)) {
+		u := units[name]
+		if u.IrInput == "" || u.IrOutput == "" {
+			return nil, fmt.Errorf("%s: unit %s: both irin and irout must be set", file, name)
+		}
+		if other, found := irInputs[u.IrInput]; found {
+			return nil, fmt.Errorf("%s: units %s and %s have the same irin %s", file, other, name, u.IrInput)
+		}
+		if other, found := irOutputs[u.IrOutput]; found {
+			return nil, fmt.Errorf("%s: units %s and %s have the same irout %s", file, other, name, u.IrOutput)
+		}
+		irInputs[u.IrInput], irOutputs[u.IrOutput] = name, name
+	}
+	return units, nil
+}
+
+// The room temperature sensors, and the thermostats of the units that use them, as configured in the sensors file:
+//
+//	{
+//	  "sensors": {
+//	    "living": { "type": "w1", "path": "/sys/bus/w1/devices/28-0000072a4c1b" },
+//	    "bedroom": { "type": "push" }
+//	  },
+//	  "thermostats": {
+//	    "default": { "sensor": "living", "target": 21.5, "min": 18, "max": 25 }
+//	  }
+//	}
+type SensorsFile struct {
+	Sensors     map[string]sensor.Config    `json:"sensors"`
+	Thermostats map[string]sched.Thermostat `json:"thermostats"`
+}
+
+// Read the sensors file, and set the sensors and thermostats of the scheduler.
+func loadSensors(file string, units map[string]UnitDevices) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var sf SensorsFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	sensors := make(sensor.Sensors)
+	for name, c := range sf.Sensors {
+		s, err := sensor.New(c)
+		if err != nil {
+			return fmt.Errorf("%s: sensor %s: %w", file, name, err)
+		}
+		sensors[name] = s
+	}
+	for unit := range sf.Thermostats {
+		if _, found := units[unit]; !found {
+			return fmt.Errorf("%s: thermostat of unknown unit %s", file, unit)
+		}
+	}
+	if err := sched.SetSensors(sensors, sf.Thermostats); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	return nil
+}
+
+func messageHandler(store db.Store, options *Options, unit string) func(*codec.Message) {
 	return func(msg *codec.Message) {
 		var checksum string
 		switch msg.Frame2.VerifyChecksum() {
@@ -40,6 +137,7 @@ func messageHandler(options *Options) func(*codec.Message) {
 
 		c := codec.RcConfigFromFrame(msg)
 
+		slog.Debug("received message", "unit", unit)
 		c.LogConfigAndChecksum("received config", checksum)
 		if options.PrintConfig {
 			c.PrintConfigAndChecksum(checksum)
@@ -49,74 +147,169 @@ func messageHandler(options *Options) func(*codec.Message) {
 			slog.Warn("checksum mismatch, discarding")
 			return
 		}
+		if violations := c.Validate(); violations != nil {
+			slog.Warn("invalid config, discarding", "err", violations)
+			return
+		}
 
 		// get current configuration
-		dbRc, err := db.CurrentConfig()
+		dbRc, err := store.CurrentConfig(unit)
 		if err != nil {
-			slog.Error("failed to get current config", "error", err)
+			slog.Error("failed to get current config", "unit", unit, "error", err)
 			return
 		}
 
-		err = db.SaveConfig(c, dbRc)
+		err = store.SaveConfig(unit, c, dbRc)
 		if err != nil {
-			slog.Error("failed to save the new config", "error", err)
+			slog.Error("failed to save the new config", "unit", unit, "error", err)
 			return
 		}
 
-		sched.RestartTimerJobs()
+		// a change made with the remote control stops a ramp in progress
+		sched.ManualOverride(unit, dbRc, c)
+		sched.RestartTimerJobs(unit)
 	}
 }
 
-type jobSet struct {
-	Active   bool      `json:"active"`
-	CronJobs []cronJob `json:"cronjobs"`
+// Lets paninv_rc suspend the controller while it sends, and reload a unit after it has changed the config.
+type controlHandler struct{}
+
+func (controlHandler) Suspend() {
+	codec.SuspendSending()
+}
+
+func (controlHandler) Resume() {
+	codec.ResumeSending()
 }
 
-type cronJob struct {
-	Schedule string             `json:"schedule"`
-	Settings codecbase.Settings `json:"settings"`
+func (controlHandler) Reload(unit string) error {
+	return sched.ReloadUnit(unit)
+}
+
+// Save the units of the units file, creating the units that don't exist yet.
+func saveUnits(store db.Store, units map[string]UnitDevices) error {
+	for name, u := range units {
+		if err := store.SaveUnit(name, u.IrInput, u.IrOutput); err != nil {
+			return fmt.Errorf("unit %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
-type jobSets map[string]jobSet
+// Returned to roll back the units saved for a dry run.
+var errDryRun = errors.New("dry run")
+
+// Load a jobs file, and tell a running controller to reload all units. The units are saved first, so that job sets can
+// refer to them; for a dry run they are only saved in a transaction that is rolled back.
+func loadJobs(store db.Store, file string, units map[string]UnitDevices, dryRun bool, socket string) (sched.JobsDiff, error) {
+	if dryRun {
+		var diff sched.JobsDiff
+		err := store.WithTx(func(tx db.Store) error {
+			if err := saveUnits(tx, units); err != nil {
+				return err
+			}
+			var err error
+			if diff, err = sched.LoadJobsFile(tx, file, true); err != nil {
+				return err
+			}
+			return errDryRun
+		})
+		if err != errDryRun {
+			return nil, err
+		}
+		return diff, nil
+	}
 
-func loadCronJobs(jobfile string) {
-	f, err := os.Open(jobfile)
+	if err := saveUnits(store, units); err != nil {
+		return nil, err
+	}
+	diff, err := sched.LoadJobsFile(store, file, false)
 	if err != nil {
-		slog.Error("failed to open jobs file")
-		return
+		return nil, err
 	}
-	defer f.Close()
-	data, err := io.ReadAll(f)
+	return diff, reloadController(store, socket)
+}
+
+// Import a backup file, and tell a running controller to reload all units.
+func importBackup(store db.Store, file, mode, socket string) error {
+	importMode, err := backup.ParseMode(mode)
 	if err != nil {
-		slog.Error("failed to read jobs file")
-		return
+		return err
 	}
+	b, err := backup.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := backup.Import(store, b, importMode); err != nil {
+		return err
+	}
+	return reloadController(store, socket)
+}
+
+// Tell a running controller to reload all units after the database has been changed.
+func reloadController(store db.Store, socket string) error {
+	if socket == "" {
+		return nil
+	}
+	controller, err := control.Dial(socket)
+	if err != nil {
+		slog.Debug("controller is not running", "socket", socket, "err", err)
+		return nil
+	}
+	defer controller.Close()
+	units, err := store.GetUnits()
+	if err != nil {
+		return err
+	}
+	for _, u := range *units {
+		// units that are not configured in the controller are not reloaded
+		if err := controller.Reload(u.Name); err != nil {
+			slog.Debug("controller did not reload unit", "unit", u.Name, "err", err)
+		}
+	}
+	return nil
+}
 
-	var jobsets jobSets
-	err = json.Unmarshal(data, &jobsets)
+// Print the status of the database migrations, after applying pending migrations if apply is true.
+func migrate(dbFile string, apply bool) error {
+	store, err := db.Connect(dbFile)
 	if err != nil {
-		slog.Error("failed to unmarshal jobsets")
-		return
+		return err
 	}
+	defer store.Close()
 
-	db.DeleteAllJobSetsPermanently()
-	db.DeleteAllCronJobsPermanently()
-	for name, js := range jobsets {
-		if err := db.SaveJobSet(name, js.Active); err != nil {
-			slog.Error("failed to save jobset", "jobset", name, "err", err)
+	if apply {
+		backup, err := store.Migrate()
+		if backup != "" {
+			fmt.Printf("saved backup to %s\n", backup)
 		}
-		for _, j := range js.CronJobs {
-			if err := db.SaveCronJob(name, j.Schedule, &j.Settings); err != nil {
-				slog.Error("failed to save cronjob", "err", err)
-			}
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err := store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, ms := range status {
+		applied := "pending"
+		if ms.AppliedAt != nil {
+			applied = ms.AppliedAt.Format(time.DateTime)
 		}
+		fmt.Printf("%3d  %-19s  %s\n", ms.Version, applied, ms.Name)
 	}
+	return nil
 }
 
 func main() {
-	var vIrInput = flag.String("irin", "/dev/lirc-rx", "LIRC receive device")
-	var vIrOutput = flag.String("irout", "/dev/lirc-tx", "LIRC transmit device")
+	var vIrInput = flag.String("irin", "/dev/lirc-rx", "LIRC receive device (of the default unit)")
+	var vIrOutput = flag.String("irout", "/dev/lirc-tx", "LIRC transmit device (of the default unit)")
+	var vUnits = flag.String("units", "", "JSON file with the LIRC devices of each unit (overrides -irin and -irout)")
 	var vRcDb = flag.String("db", db.GetDBPath(), "SQLite database")
+	var vHttp = flag.String("http", ":3333", "address of the web server")
+	var vApiSocket = flag.String("api-socket", "", "unix socket where the API is also served, e.g. for paninv_rc -server=unix:/path")
+	var vControl = flag.String("control", control.GetSocketPath(), "control socket used by paninv_rc (empty to disable)")
 	var vLogLevel = flag.String("log-level", "info", "log level [debug|info|warn|error]")
 	var vHelp = flag.Bool("help", false, "print usage")
 
@@ -136,6 +329,16 @@ func main() {
 	flag.BoolVar(&senderOptions.Device, "send-dev", senderOptions.Device, "send option: writing to a LIRC device")
 
 	var vLoadJobs = flag.String("load-jobs", "", "load cronjobs from file")
+	var vJobs = flag.String("jobs", "", "jobs file to load at startup, and to reload when it changes or on SIGHUP")
+	var vLocation = flag.String("location", "", "latitude,longitude of the house, e.g. 59.33,18.07, used by schedules relative to sunrise and sunset")
+	var vSensors = flag.String("sensors", "", "JSON file with the room temperature and humidity sensors, and the thermostats of the units")
+	var vJobsPoll = flag.Duration("jobs-poll", 30*time.Second, "how often to check if the jobs file has changed")
+	var vDryRun = flag.Bool("dry-run", false, "with -load-jobs, print the changes without saving them")
+	var vExport = flag.String("export", "", "export the database to a JSON file")
+	var vImport = flag.String("import", "", "import a JSON file exported with -export")
+	var vImportMode = flag.String("import-mode", string(backup.MODE_MERGE), "how to import [merge|replace]: replace deletes job sets and presets that are not in the file")
+	var vMigrateStatus = flag.Bool("migrate-status", false, "print the status of the database migrations")
+	var vMigrate = flag.Bool("migrate", false, "migrate the database to the latest version (the database is otherwise migrated at startup)")
 
 	flag.Parse()
 
@@ -146,6 +349,16 @@ func main() {
 
 	logs.InitLogger(*vLogLevel)
 
+	// the location is needed to validate schedules relative to sunrise and sunset, also when loading jobs or importing
+	if *vLocation != "" {
+		loc, err := solar.ParseLocation(*vLocation)
+		if err != nil {
+			slog.Error("invalid location", "err", err)
+			os.Exit(1)
+		}
+		sched.SetLocation(loc)
+	}
+
 	if *vRcDb == "" {
 		slog.Error("please set the db name")
 		os.Exit(1)
@@ -159,34 +372,129 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *vMigrateStatus || *vMigrate {
+		if err := migrate(*vRcDb, *vMigrate); err != nil {
+			slog.Error("migration failed", "db", *vRcDb, "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	// open and initialize database
-	db.Initialize(*vRcDb)
-	defer db.Close()
+	store, err := db.Open(*vRcDb)
+	if err != nil {
+		slog.Error("failed to open database", "db", *vRcDb, "err", err)
+		os.Exit(1)
+	}
+	defer store.Close()
 
-	if *vLoadJobs != "" {
-		loadCronJobs(*vLoadJobs)
+	if *vExport != "" {
+		b, err := backup.Export(store)
+		if err == nil {
+			err = backup.WriteFile(*vExport, b)
+		}
+		if err != nil {
+			slog.Error("failed to export database", "file", *vExport, "err", err)
+			os.Exit(1)
+		}
 		os.Exit(0)
 	}
 
-	// start the IR receiver
-	go func() {
-		// this call blocks
-		err := codec.RunIrReceiver(*vIrInput, messageHandler(&options), recOptions)
+	units, err := loadUnits(*vUnits, *vIrInput, *vIrOutput)
+	if err != nil {
+		slog.Error("failed to load units", "err", err)
+		os.Exit(1)
+	}
+
+	if *vLoadJobs != "" {
+		diff, err := loadJobs(store, *vLoadJobs, units, *vDryRun, *vControl)
 		if err != nil {
-			slog.Error("failed to start IR receiver", "err", err)
+			slog.Error("failed to load jobs file", "file", *vLoadJobs, "err", err)
+			os.Exit(1)
 		}
-	}()
+		if len(diff) == 0 {
+			fmt.Println("no changes")
+		}
+		fmt.Print(diff)
+		os.Exit(0)
+	}
+
+	if err := saveUnits(store, units); err != nil {
+		slog.Error("failed to save units", "err", err)
+		os.Exit(1)
+	}
+
+	if *vImport != "" {
+		if err := importBackup(store, *vImport, *vImportMode, *vControl); err != nil {
+			slog.Error("failed to import database", "file", *vImport, "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// start an IR receiver and sender for each unit
+	irSenders := make(map[string]*codec.IrSender)
+	for name, u := range units {
+		go func() {
+			// this call blocks
+			err := codec.RunIrReceiver(u.IrInput, messageHandler(store, &options, name), recOptions)
+			if err != nil {
+				slog.Error("failed to start IR receiver", "unit", name, "err", err)
+			}
+		}()
+
+		irSender := codec.StartIrSender(u.IrOutput, senderOptions)
+		defer irSender.Stop()
+		irSenders[name] = irSender
+	}
 
-	irSender := codec.StartIrSender(*vIrOutput, senderOptions)
-	defer irSender.Stop()
+	// load the jobs file before the scheduler starts, so that its jobs are scheduled
+	if *vJobs != "" {
+		if _, err := sched.LoadJobsFile(store, *vJobs, false); err != nil {
+			slog.Error("failed to load jobs file, keeping the current jobs", "file", *vJobs, "err", err)
+		}
+	}
+
+	if *vSensors != "" {
+		if err := loadSensors(*vSensors, units); err != nil {
+			slog.Error("failed to load sensors", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	// start gocron
-	err := sched.InitScheduler(irSender)
+	err = sched.InitScheduler(store, irSenders)
 	if err != nil {
 		slog.Error("failed to start scheduler", "error", err)
 	}
 	defer sched.Stop()
 
+	// SIGHUP reloads the jobs file, or the job sets and timers of all units if there is no jobs file
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	if *vJobs != "" {
+		go sched.WatchJobsFile(*vJobs, *vJobsPoll, hup, nil)
+	} else {
+		go func() {
+			for range hup {
+				for name := range irSenders {
+					if err := sched.ReloadUnit(name); err != nil {
+						slog.Error("failed to reload unit", "unit", name, "err", err)
+					}
+				}
+			}
+		}()
+	}
+
+	if *vControl != "" {
+		controlServer, err := control.Listen(*vControl, controlHandler{})
+		if err != nil {
+			slog.Error("failed to open control socket", "socket", *vControl, "err", err)
+		} else {
+			defer controlServer.Close()
+		}
+	}
+
 	// Start web server
-	server.StartServer(*vLogLevel, irSender)
+	server.StartServer(*vLogLevel, *vHttp, *vApiSocket, store, irSenders)
 }
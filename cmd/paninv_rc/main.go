@@ -1,38 +1,214 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/sys/unix"
 
+	"rpi_panasonic_inverter_rc/apiclient"
 	"rpi_panasonic_inverter_rc/codec"
 	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/control"
 	"rpi_panasonic_inverter_rc/db"
 	"rpi_panasonic_inverter_rc/logs"
 	"rpi_panasonic_inverter_rc/rcutils"
+	"rpi_panasonic_inverter_rc/sched"
 )
 
+// Print the details of rejected settings and invalid configs, whether they come from the controller or not.
+func printError(err error) {
+	var settingsErr *rcutils.SettingsError
+	var apiErr *apiclient.APIError
+	var violations codec.Violations
+	var fields []*rcutils.FieldError
+	switch {
+	case errors.As(err, &settingsErr):
+		fields = settingsErr.Fields
+	case errors.As(err, &apiErr) && (apiErr.Fields != nil || apiErr.Violations != nil):
+		fields, violations = apiErr.Fields, apiErr.Violations
+	case errors.As(err, &violations):
+	default:
+		fmt.Println(err)
+		return
+	}
+	for _, f := range fields {
+		fmt.Printf("invalid setting -%s=%q, allowed values: %s\n", f.Field, f.Value, strings.Join(f.Allowed, ", "))
+	}
+	for _, v := range violations {
+		fmt.Printf("invalid config: %s=%d: %s (%s)\n", v.Field, v.Value, v.Message, v.Rule)
+	}
+}
+
+// Print a value as indented JSON.
+func printJson(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// Print the upcoming runs of jobs, and the expected config after each of them.
+func printUpcoming(runs []apiclient.UpcomingRun) {
+	if len(runs) == 0 {
+		fmt.Println("no upcoming jobs")
+	}
+	for _, r := range runs {
+		fmt.Printf("%s  %-8s %s", r.At.Format("Mon 2006-01-02 15:04"), r.Kind, r.Name)
+		if r.Preset != "" {
+			fmt.Printf(" preset=%s", r.Preset)
+		}
+		if r.Settings != nil {
+			if b, err := json.Marshal(r.Settings); err == nil {
+				fmt.Printf(" %s", b)
+			}
+		}
+		fmt.Println()
+		if r.Suppressed != "" {
+			fmt.Printf("    suppressed by %s\n", r.Suppressed)
+		}
+		if r.Hold != "" {
+			fmt.Printf("    %s by the hold\n", r.Hold)
+		}
+		if r.Error != "" {
+			fmt.Printf("    error: %s\n", r.Error)
+		}
+		c := r.Config
+		fmt.Printf("    => power=%s mode=%s temp=%s fan=%s powerful=%s quiet=%s", c.Power, c.Mode, c.Temperature, c.FanSpeed, c.Powerful, c.Quiet)
+		// the times of disabled timers are not used
+		if c.TimerOn == "on" {
+			fmt.Printf(" tont=%s", c.TimerOnTime)
+		}
+		if c.TimerOff == "on" {
+			fmt.Printf(" tofft=%s", c.TimerOffTime)
+		}
+		fmt.Println()
+	}
+}
+
+// Convert the forecast of the scheduler to the format returned by the API.
+func upcomingRuns(runs []sched.UpcomingRun) []apiclient.UpcomingRun {
+	var urs []apiclient.UpcomingRun
+	for _, run := range runs {
+		ur := apiclient.UpcomingRun{At: run.At, Kind: run.Kind, Name: run.Name, JobSet: run.JobSet, Preset: run.Preset,
+			Settings: run.Settings, Suppressed: run.Suppressed, Hold: run.Hold, Error: run.Error}
+		rcutils.CopyToSettings(run.Config, &ur.Config)
+		urs = append(urs, ur)
+	}
+	return urs
+}
+
+// Parse the end of a hold, either a duration, e.g. "30m", or a time as for -at, e.g. "22:00".
+func parseHoldUntil(hold string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(hold); err == nil {
+		return now.Add(d), nil
+	}
+	if until, err := rcutils.ParseAt(hold, now); err == nil {
+		return until, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid hold %q, expecting a duration, e.g. \"30m\", or a time, e.g. \"22:00\"", hold)
+}
+
+// Apply the settings through a running controller and print the resulting settings, or if at is set, schedule them
+// and print the one-time jobs of the unit. If holdUntil is set, the settings are held until then and the hold is
+// printed, and if unhold is set, the hold is ended. If upcoming is set, the jobs that run within that many hours are
+// printed instead. The returned error wraps apiclient.ErrUnreachable if the controller can't be reached.
+func runClient(server, unit, preset string, show bool, upcoming int, at, holdUntil time.Time, holdPolicy string, unhold bool, settings *codecbase.Settings) error {
+	client, err := apiclient.New(server)
+	if err != nil {
+		return err
+	}
+
+	if upcoming > 0 {
+		runs, err := client.GetUpcoming(unit, upcoming)
+		if err != nil {
+			return err
+		}
+		printUpcoming(runs)
+		return nil
+	}
+
+	if unhold {
+		all, err := client.DeleteHold(unit)
+		if err != nil {
+			return err
+		}
+		return printJson(all)
+	}
+
+	if !holdUntil.IsZero() {
+		hold, err := client.PutHold(unit, &apiclient.Hold{Until: holdUntil, Preset: preset, Settings: *settings, Policy: holdPolicy})
+		if err != nil {
+			return err
+		}
+		return printJson(hold)
+	}
+
+	if !at.IsZero() {
+		jobs, err := client.PostOneTimeJob(unit, &apiclient.OneTimeJob{At: at, Preset: preset, Settings: *settings})
+		if err != nil {
+			return err
+		}
+		return printJson(jobs)
+	}
+
+	var all *codecbase.AllSettings
+	if show {
+		all, err = client.GetSettings(unit)
+	} else {
+		if preset != "" {
+			ps, err := client.GetPreset(preset)
+			if err != nil {
+				return err
+			}
+			merged := codecbase.MergeSettings(*ps, *settings)
+			settings = &merged
+		}
+		all, err = client.PostSettings(unit, settings)
+	}
+	if err != nil {
+		return err
+	}
+	return printJson(all)
+}
+
 func main() {
 	var err error
 	var vRcDb = flag.String("db", db.GetDBPath(), "SQLite database")
-	var vIrOutput = flag.String("irout", "/dev/lirc-tx", "LIRC output device or file")
+	var vIrOutput = flag.String("irout", "/dev/lirc-tx", "LIRC output device or file (default is the transmit device of the unit, if known)")
+	var vUnit = flag.String("unit", db.DefaultUnit, "the unit to control")
+	var vServer = flag.String("server", apiclient.GetServer(), "send the settings to a running paninv_controller, e.g. http://piir:3333 or unix:/run/paninv/api.sock (falls back to direct mode if unreachable)")
+	var vControl = flag.String("control", control.GetSocketPath(), "control socket of a running paninv_controller (empty to not notify the controller)")
 	var vShow = flag.Bool("show", false, "show the current configuration")
+	var vUpcoming = flag.Bool("upcoming", false, "show the jobs that will run, and the expected configuration after each of them")
+	var vHours = flag.Int("hours", 48, "the number of hours shown by -upcoming")
 	var vLogLevel = flag.String("log-level", "warn", "log level [debug|info|warn|error]")
 	var vVerbose = flag.Bool("verbose", false, "print verbose output")
 	var vHelp = flag.Bool("help", false, "print usage")
 	var vPriority = flag.Int("prio", -10, "The priority, or niceness, of the process (-20..19)")
+	var vPreset = flag.String("preset", "", "apply a named preset (other settings override the preset)")
+	var vAt = flag.String("at", "", "apply the settings once at a later time instead of now, e.g. \"2024-05-17 16:30\", or \"16:30\" for the next time the clock shows 16:30 (requires paninv_controller)")
+	var vHold = flag.String("hold", "", "hold the settings for a duration, e.g. 30m, or until a time, e.g. 22:00, after which the changed settings are reverted (requires paninv_controller)")
+	var vHoldPolicy = flag.String("hold-policy", "defer", "what is done with scheduled jobs during -hold [defer|skip|merge]")
+	var vUnhold = flag.Bool("unhold", false, "end the hold of the unit now (requires paninv_controller)")
 
 	var settings codecbase.Settings
 	flag.StringVar(&settings.Power, "power", "", "power [on|off]")
 	flag.StringVar(&settings.Mode, "mode", "", "mode [auto|heat|cool|dry]")
 	flag.StringVar(&settings.Powerful, "powerful", "", "powerful [on|off]")
 	flag.StringVar(&settings.Quiet, "quiet", "", "quiet [on|off]")
-	flag.StringVar(&settings.Temperature, "temp", "", "temperature (set per mode)")
-	flag.StringVar(&settings.FanSpeed, "fan", "", "fan speed (set per mode, overridden if powerful or quiet is enabled) [auto|lowest|low|middle|high|highest]")
-	flag.StringVar(&settings.VentVertical, "vert", "", "vent vertical position [auto|lowest|low|middle|high|highest]")
-	flag.StringVar(&settings.VentHorizontal, "horiz", "", "vent horizontal position [auto|farleft|left|middle|right|farright]")
+	flag.StringVar(&settings.Temperature, "temp", "", "temperature (set per mode), or a step relative to the current temperature, e.g. +1 or -2")
+	flag.StringVar(&settings.FanSpeed, "fan", "", "fan speed (set per mode, overridden if powerful or quiet is enabled) [auto|lowest|low|middle|high|highest|next|prev]")
+	flag.StringVar(&settings.VentVertical, "vert", "", "vent vertical position [auto|lowest|low|middle|high|highest|next|prev]")
+	flag.StringVar(&settings.VentHorizontal, "horiz", "", "vent horizontal position [auto|farleft|left|middle|right|farright|next|prev]")
 	flag.StringVar(&settings.TimerOn, "ton", "", "timer_on [on|off]")
 	flag.StringVar(&settings.TimerOnTime, "tont", "", "timer_on time, e.g. 09:00")
 	flag.StringVar(&settings.TimerOff, "toff", "", "timer_off [on|off]")
@@ -67,12 +243,106 @@ func main() {
 
 	logs.InitLogger(*vLogLevel)
 
+	var at time.Time
+	if *vAt != "" {
+		if at, err = rcutils.ParseAt(*vAt, time.Now()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if !at.After(time.Now()) {
+			fmt.Printf("%s is in the past\n", at.Format(time.DateTime))
+			os.Exit(1)
+		}
+	}
+
+	var holdUntil time.Time
+	if *vHold != "" {
+		if holdUntil, err = parseHoldUntil(*vHold, time.Now()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if *vServer != "" {
+		upcoming := 0
+		if *vUpcoming {
+			upcoming = *vHours
+		}
+		err = runClient(*vServer, *vUnit, *vPreset, *vShow, upcoming, at, holdUntil, *vHoldPolicy, *vUnhold, &settings)
+		if err == nil {
+			os.Exit(0)
+		}
+		if !errors.Is(err, apiclient.ErrUnreachable) {
+			printError(err)
+			os.Exit(1)
+		}
+		slog.Warn("using direct mode", "err", err)
+	}
+	// the controller reverts the settings when the hold ends
+	if !holdUntil.IsZero() || *vUnhold {
+		fmt.Println("-hold and -unhold require a running paninv_controller, given with -server")
+		os.Exit(1)
+	}
+
 	// open and initialize database
-	db.Initialize(*vRcDb)
-	defer db.Close()
+	store, err := db.Open(*vRcDb)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	unit, err := store.GetUnit(*vUnit)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// use the transmit device that the controller has saved for the unit, unless -irout is given
+	irOutputSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "irout" {
+			irOutputSet = true
+		}
+	})
+	if !irOutputSet && unit.IrOutput != "" {
+		*vIrOutput = unit.IrOutput
+	}
+
+	if *vUpcoming {
+		// without the controller, the location of schedules relative to sunrise and sunset is not known
+		now := time.Now()
+		runs, err := sched.Upcoming(store, unit.Name, now, now.Add(time.Duration(*vHours)*time.Hour))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		printUpcoming(upcomingRuns(runs))
+		os.Exit(0)
+	}
+
+	// Tell a running controller to hold off sending and receiving until we are done, so that it doesn't decode our
+	// transmission or change the config at the same time. It is then told to reload the unit, e.g. to restart timers or
+	// to schedule a new one-time job.
+	var controller *control.Client
+	if *vControl != "" && !*vShow {
+		controller, err = control.Dial(*vControl)
+		if err != nil {
+			slog.Debug("controller is not running", "socket", *vControl, "err", err)
+			controller = nil
+		} else {
+			defer controller.Close()
+			// nothing is sent now when scheduling a one-time job
+			if at.IsZero() {
+				if err = controller.Suspend(); err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+		}
+	}
 
 	// get current configuration
-	dbRc, err := db.CurrentConfig()
+	dbRc, err := store.CurrentConfig(unit.Name)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -91,7 +361,40 @@ func main() {
 	// Create a new configuration by making a copy of the current configuration. The copy contains
 	// everything except the time fields, which are unset by default. The new configuration is then
 	// modified according to command line arguments.
-	sendRc := rcutils.ComposeSendConfig(&settings, dbRc)
+	resolved, err := db.ResolvePreset(store, *vPreset, &settings)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	sendRc, err := rcutils.ComposeSendConfig(db.UnitModeSettings{Store: store, Unit: unit.Name}, resolved, dbRc)
+	if err != nil {
+		printError(err)
+		os.Exit(1)
+	}
+	if violations := sendRc.Validate(); violations != nil {
+		printError(violations)
+		os.Exit(1)
+	}
+
+	if !at.IsZero() {
+		// the settings are checked against the current config, but are applied to the config current at that time
+		if _, err = store.SaveOneTimeJob(unit.Name, at, *vPreset, &settings); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if controller == nil {
+			fmt.Println("saved the job, but it will only run if paninv_controller is started in time")
+			os.Exit(0)
+		}
+		if err = controller.Reload(unit.Name); err != nil {
+			fmt.Printf("failed to notify the controller: %v\n", err)
+			os.Exit(1)
+		}
+		if *vVerbose {
+			fmt.Printf("scheduled settings for %s\n", at.Format(time.DateTime))
+		}
+		os.Exit(0)
+	}
 
 	if *vVerbose {
 		fmt.Println("config to send")
@@ -102,11 +405,20 @@ func main() {
 	irSender.SendConfig(sendRc)
 	irSender.Stop()
 
-	err = db.SaveConfig(sendRc, dbRc)
+	err = store.SaveConfig(unit.Name, sendRc, dbRc)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+
+	if controller != nil {
+		if err = controller.Resume(); err == nil {
+			err = controller.Reload(unit.Name)
+		}
+		if err != nil {
+			fmt.Printf("failed to notify the controller: %v\n", err)
+		}
+	}
 	if *vVerbose {
 		fmt.Printf("saved config to %s\n", *vRcDb)
 	}
@@ -3,6 +3,7 @@ package codec
 import (
 	"fmt"
 	"math/big"
+	"sync"
 
 	"rpi_panasonic_inverter_rc/codecbase"
 )
@@ -67,3 +68,77 @@ func (msg *Message) ToLirc() *LircBuffer {
 	msg.Frame2.ToLirc(b)
 	return b
 }
+
+// Reasons for rejecting a received message
+type RejectReason int
+
+const (
+	REJECT_FRAME1_CHECKSUM RejectReason = iota + 1
+	REJECT_FRAME1_MISMATCH
+	REJECT_FRAME2_CHECKSUM
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case REJECT_FRAME1_CHECKSUM:
+		return "frame1_checksum"
+	case REJECT_FRAME1_MISMATCH:
+		return "frame1_mismatch"
+	case REJECT_FRAME2_CHECKSUM:
+		return "frame2_checksum"
+	}
+	return fmt.Sprintf("unknown(%d)", int(r))
+}
+
+// A RejectionError is returned by Validate when a message was not sent by a Panasonic IR Controller A75C3115, or was
+// corrupted during transmission.
+type RejectionError struct {
+	Reason      RejectReason
+	Description string
+}
+
+func (e *RejectionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Reason, e.Description)
+}
+
+// Validate the message. The first frame must have a valid checksum and be identical to the constant first frame sent
+// by the Panasonic IR Controller A75C3115, and the second frame must have a valid checksum. Other remotes using the
+// same protocol (e.g. for other models) send different first frames.
+func (msg *Message) Validate() error {
+	if !msg.Frame1.VerifyChecksum() {
+		return &RejectionError{REJECT_FRAME1_CHECKSUM, fmt.Sprintf("frame 1 checksum mismatch: %s", msg.Frame1.ToByteString())}
+	}
+	expected := InitializedMessage().Frame1
+	if !msg.Frame1.Equal(expected) {
+		return &RejectionError{REJECT_FRAME1_MISMATCH, fmt.Sprintf("unexpected frame 1: %s", msg.Frame1.ToByteString())}
+	}
+	if !msg.Frame2.VerifyChecksum() {
+		return &RejectionError{REJECT_FRAME2_CHECKSUM, fmt.Sprintf("frame 2 checksum mismatch: %#02x != %#02x", msg.Frame2.GetChecksum(), msg.Frame2.ComputeChecksum())}
+	}
+	return nil
+}
+
+// Counters for rejected messages, per reason. This makes it possible to detect interference from other remotes.
+var rejections = struct {
+	sync.Mutex
+	counts map[RejectReason]int
+}{counts: make(map[RejectReason]int)}
+
+// Count a rejected message, and return the number of rejections so far for the reason.
+func countRejection(reason RejectReason) int {
+	rejections.Lock()
+	defer rejections.Unlock()
+	rejections.counts[reason]++
+	return rejections.counts[reason]
+}
+
+// Return the number of rejected messages per reason since the program was started.
+func RejectionCounts() map[string]int {
+	rejections.Lock()
+	defer rejections.Unlock()
+	counts := make(map[string]int, len(rejections.counts))
+	for reason, n := range rejections.counts {
+		counts[reason.String()] = n
+	}
+	return counts
+}
@@ -0,0 +1,47 @@
+package codec
+
+import (
+	"errors"
+	"testing"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+func TestValidate(t *testing.T) {
+	msg := NewRcConfig().ToMessage()
+	msg.Frame2.SetChecksum()
+	if err := msg.Validate(); err != nil {
+		t.Fatalf("valid message rejected: %v", err)
+	}
+
+	// a different first frame with a valid checksum, e.g. from another model
+	foreign := NewRcConfig().ToMessage()
+	foreign.Frame2.SetChecksum()
+	foreign.Frame1.SetValue(0x0f, 32, 8)
+	foreign.Frame1.SetChecksum()
+	assertRejected(t, foreign, REJECT_FRAME1_MISMATCH)
+
+	// a corrupted first frame
+	corrupt1 := NewRcConfig().ToMessage()
+	corrupt1.Frame2.SetChecksum()
+	corrupt1.Frame1.SetValue(1, 3, 1)
+	assertRejected(t, corrupt1, REJECT_FRAME1_CHECKSUM)
+
+	// a corrupted second frame
+	corrupt2 := NewRcConfig().ToMessage()
+	corrupt2.Frame2.SetChecksum()
+	corrupt2.Frame2.SetValue(codecbase.C_Power_On, codecbase.P_PANASONIC_POWER_BIT0, codecbase.P_PANASONIC_POWER_BITS)
+	assertRejected(t, corrupt2, REJECT_FRAME2_CHECKSUM)
+}
+
+func assertRejected(t *testing.T, msg *Message, reason RejectReason) {
+	t.Helper()
+	err := msg.Validate()
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) {
+		t.Fatalf("expected rejection %s, got %v", reason, err)
+	}
+	if rejection.Reason != reason {
+		t.Fatalf("expected rejection %s, got %s", reason, rejection.Reason)
+	}
+}
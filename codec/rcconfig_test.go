@@ -2,6 +2,8 @@ package codec
 
 import (
 	"testing"
+
+	"rpi_panasonic_inverter_rc/codecbase"
 )
 
 func TestConversions(t *testing.T) {
@@ -42,3 +44,32 @@ func TestConversions(t *testing.T) {
 		t.Fatalf("m2.Frame2 config not equal to m1.Frame2")
 	}
 }
+
+func TestValidateConfig(t *testing.T) {
+	if v := NewRcConfig().Validate(); v != nil {
+		t.Fatalf("default config is invalid: %v", v)
+	}
+
+	c := NewRcConfig()
+	c.Powerful = codecbase.C_Powerful_Enabled
+	c.Quiet = codecbase.C_Quiet_Enabled
+	c.FanSpeed = 0
+	c.Temperature = 50
+	c.TimerOnTime = NewTime(24, 0)
+
+	rules := make(map[Rule]bool)
+	for _, v := range c.Validate() {
+		rules[v.Rule] = true
+	}
+	for _, rule := range []Rule{RULE_POWERFUL_QUIET, RULE_FAN_SPEED, RULE_TEMPERATURE, RULE_TIME} {
+		if !rules[rule] {
+			t.Errorf("expected violation of rule %s", rule)
+		}
+	}
+
+	c = NewRcConfig()
+	c.Quiet = codecbase.C_Quiet_Enabled
+	if v := c.Validate(); len(v) != 1 || v[0].Rule != RULE_QUIET_FAN_SPEED {
+		t.Errorf("expected violation of rule %s, got %v", RULE_QUIET_FAN_SPEED, v)
+	}
+}
@@ -0,0 +1,113 @@
+package codec
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+// The rules that an RcConfig must follow to be meaningful to the inverter.
+type Rule string
+
+const (
+	RULE_POWER              Rule = "power"
+	RULE_MODE               Rule = "mode"
+	RULE_POWERFUL           Rule = "powerful"
+	RULE_QUIET              Rule = "quiet"
+	RULE_POWERFUL_QUIET     Rule = "powerful_quiet_exclusive"
+	RULE_TEMPERATURE        Rule = "temperature"
+	RULE_FAN_SPEED          Rule = "fan_speed"
+	RULE_POWERFUL_FAN_SPEED Rule = "powerful_fan_speed"
+	RULE_QUIET_FAN_SPEED    Rule = "quiet_fan_speed"
+	RULE_VENT_VERTICAL      Rule = "vent_vertical"
+	RULE_VENT_HORIZONTAL    Rule = "vent_horizontal"
+	RULE_TIMER              Rule = "timer"
+	RULE_TIME               Rule = "time"
+)
+
+// A Violation describes a field in an RcConfig that breaks a rule.
+type Violation struct {
+	Rule    Rule   `json:"rule"`
+	Field   string `json:"field"`
+	Value   uint   `json:"value"`
+	Message string `json:"message"`
+}
+
+type Violations []Violation
+
+func (v Violations) Error() string {
+	msgs := make([]string, 0, len(v))
+	for _, violation := range v {
+		msgs = append(msgs, fmt.Sprintf("%s=%d: %s", violation.Field, violation.Value, violation.Message))
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// Check that the config can be sent to the inverter. Returns nil if the config is valid, otherwise a list of all the
+// rules that are broken.
+func (c *RcConfig) Validate() Violations {
+	var v Violations
+	add := func(rule Rule, field string, value uint, format string, args ...any) {
+		v = append(v, Violation{rule, field, value, fmt.Sprintf(format, args...)})
+	}
+
+	onOff := []uint{codecbase.P_PANASONIC_DISABLED, codecbase.P_PANASONIC_ENABLED}
+	if !slices.Contains(onOff, c.Power) {
+		add(RULE_POWER, "Power", c.Power, "must be on or off")
+	}
+	if !slices.Contains([]uint{codecbase.C_Mode_Auto, codecbase.C_Mode_Dry, codecbase.C_Mode_Cool, codecbase.C_Mode_Heat}, c.Mode) {
+		add(RULE_MODE, "Mode", c.Mode, "unknown mode")
+	}
+	if !slices.Contains(onOff, c.Powerful) {
+		add(RULE_POWERFUL, "Powerful", c.Powerful, "must be on or off")
+	}
+	if !slices.Contains(onOff, c.Quiet) {
+		add(RULE_QUIET, "Quiet", c.Quiet, "must be on or off")
+	}
+	if c.Temperature < codecbase.C_Temp_Min || c.Temperature > codecbase.C_Temp_Max {
+		add(RULE_TEMPERATURE, "Temperature", c.Temperature, "must be between %d and %d", codecbase.C_Temp_Min, codecbase.C_Temp_Max)
+	}
+	if !slices.Contains([]uint{codecbase.C_FanSpeed_Auto, codecbase.C_FanSpeed_Lowest, codecbase.C_FanSpeed_Low,
+		codecbase.C_FanSpeed_Middle, codecbase.C_FanSpeed_High, codecbase.C_FanSpeed_Highest}, c.FanSpeed) {
+		add(RULE_FAN_SPEED, "FanSpeed", c.FanSpeed, "unknown fan speed")
+	}
+
+	// powerful and quiet are mutually exclusive, and override the fan speed
+	if c.Powerful == codecbase.C_Powerful_Enabled && c.Quiet == codecbase.C_Quiet_Enabled {
+		add(RULE_POWERFUL_QUIET, "Quiet", c.Quiet, "powerful and quiet cannot both be enabled")
+	} else if c.Powerful == codecbase.C_Powerful_Enabled && c.FanSpeed != codecbase.C_FanSpeed_Auto {
+		add(RULE_POWERFUL_FAN_SPEED, "FanSpeed", c.FanSpeed, "fan speed must be auto when powerful is enabled")
+	} else if c.Quiet == codecbase.C_Quiet_Enabled && c.FanSpeed != codecbase.C_FanSpeed_Lowest {
+		add(RULE_QUIET_FAN_SPEED, "FanSpeed", c.FanSpeed, "fan speed must be lowest when quiet is enabled")
+	}
+
+	if !slices.Contains([]uint{codecbase.C_VentVertical_Auto, codecbase.C_VentVertical_Lowest, codecbase.C_VentVertical_Low,
+		codecbase.C_VentVertical_Middle, codecbase.C_VentVertical_High, codecbase.C_VentVertical_Highest}, c.VentVertical) {
+		add(RULE_VENT_VERTICAL, "VentVertical", c.VentVertical, "unknown vertical vent position")
+	}
+	if !slices.Contains([]uint{codecbase.C_VentHorizontal_Auto, codecbase.C_VentHorizontal_FarLeft, codecbase.C_VentHorizontal_Left,
+		codecbase.C_VentHorizontal_Middle, codecbase.C_VentHorizontal_Right, codecbase.C_VentHorizontal_FarRight}, c.VentHorizontal) {
+		add(RULE_VENT_HORIZONTAL, "VentHorizontal", c.VentHorizontal, "unknown horizontal vent position")
+	}
+
+	if !slices.Contains(onOff, c.TimerOn) {
+		add(RULE_TIMER, "TimerOn", c.TimerOn, "must be on or off")
+	}
+	if !slices.Contains(onOff, c.TimerOff) {
+		add(RULE_TIMER, "TimerOff", c.TimerOff, "must be on or off")
+	}
+
+	// times are minutes after midnight, or unset
+	for _, t := range []struct {
+		field string
+		time  Time
+	}{{"TimerOnTime", c.TimerOnTime}, {"TimerOffTime", c.TimerOffTime}, {"Clock", c.Clock}} {
+		if t.time != codecbase.C_Time_Unset && t.time.Minutes() >= 24*60 {
+			add(RULE_TIME, t.field, t.time.Minutes(), "must be unset or between 00:00 and 23:59")
+		}
+	}
+
+	return v
+}
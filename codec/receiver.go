@@ -2,9 +2,11 @@ package codec
 
 import (
 	"bufio"
+	"errors"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"rpi_panasonic_inverter_rc/ioctl"
@@ -14,6 +16,8 @@ type ReceiverOptions struct {
 	Device     bool
 	PrintRaw   bool
 	PrintClean bool
+	// pass on messages that fail validation (e.g. from other remotes) instead of rejecting them
+	AcceptInvalid bool
 }
 
 type command struct {
@@ -21,39 +25,59 @@ type command struct {
 	confirm chan<- struct{}
 }
 
-var receiveCommands chan command
+// A running receiver. done is closed when the receiver returns, so that commands aren't sent to it anymore.
+type receiver struct {
+	commands chan command
+	done     chan struct{}
+}
 
-func SuspendReceiver(confirmCommand chan<- struct{}) {
-	slog.Debug("suspending IR receiver")
-	if receiveCommands != nil {
-		receiveCommands <- command{"suspend", confirmCommand}
-	} else if confirmCommand != nil {
+// The running receivers, keyed by input file. There is one receiver per unit.
+var receivers = make(map[string]*receiver)
+var receiversMutex sync.Mutex
+
+// Send a command to all running receivers and wait until they have all handled it. All receivers are suspended while
+// sending, since the IR signal of one unit may well be picked up by the receivers of other units.
+func sendReceiverCommand(cmd string, confirmCommand chan<- struct{}) {
+	receiversMutex.Lock()
+	running := make([]*receiver, 0, len(receivers))
+	for _, r := range receivers {
+		running = append(running, r)
+	}
+	receiversMutex.Unlock()
+
+	// a receiver may return after the snapshot, e.g. when it is told to quit by another caller
+	confirmed := make(chan struct{})
+	sent := 0
+	for _, r := range running {
+		select {
+		case r.commands <- command{cmd, confirmed}:
+			sent++
+		case <-r.done:
+		}
+	}
+	for range sent {
+		<-confirmed
+	}
+	if confirmCommand != nil {
 		go func() {
 			confirmCommand <- struct{}{}
 		}()
 	}
 }
 
+func SuspendReceiver(confirmCommand chan<- struct{}) {
+	slog.Debug("suspending IR receivers")
+	sendReceiverCommand("suspend", confirmCommand)
+}
+
 func ResumeReceiver(confirmCommand chan<- struct{}) {
-	slog.Debug("resuming IR receiver")
-	if receiveCommands != nil {
-		receiveCommands <- command{"resume", confirmCommand}
-	} else if confirmCommand != nil {
-		go func() {
-			confirmCommand <- struct{}{}
-		}()
-	}
+	slog.Debug("resuming IR receivers")
+	sendReceiverCommand("resume", confirmCommand)
 }
 
 func QuitReceiver(confirmCommand chan<- struct{}) {
-	slog.Debug("quiting IR receiver")
-	if receiveCommands != nil {
-		receiveCommands <- command{"quit", confirmCommand}
-	} else if confirmCommand != nil {
-		go func() {
-			confirmCommand <- struct{}{}
-		}()
-	}
+	slog.Debug("quiting IR receivers")
+	sendReceiverCommand("quit", confirmCommand)
 }
 
 // ensure there are reasonable defaults
@@ -69,6 +93,16 @@ func processMessages(messageStream <-chan *Message, processor func(*Message), op
 			slog.Debug("messageStream was closed")
 			return
 		}
+		if err := msg.Validate(); err != nil {
+			var rejection *RejectionError
+			if errors.As(err, &rejection) {
+				n := countRejection(rejection.Reason)
+				slog.Warn("rejected message", "reason", rejection.Reason.String(), "description", rejection.Description, "rejections", n)
+			}
+			if !options.AcceptInvalid {
+				continue
+			}
+		}
 		processor(msg)
 	}
 }
@@ -160,10 +194,16 @@ func RunIrReceiver(file string, messageHandler func(*Message), options *Receiver
 	}
 	defer f.Close()
 
-	receiveCommands = make(chan command)
+	r := &receiver{make(chan command), make(chan struct{})}
+	receiveCommands := r.commands
+	receiversMutex.Lock()
+	receivers[file] = r
+	receiversMutex.Unlock()
 	defer func() {
-		close(receiveCommands)
-		receiveCommands = nil
+		receiversMutex.Lock()
+		delete(receivers, file)
+		receiversMutex.Unlock()
+		close(r.done)
 	}()
 
 	messageStream := make(chan *Message)
@@ -201,6 +241,9 @@ func RunIrReceiver(file string, messageHandler func(*Message), options *Receiver
 		case "quit":
 			// Quit is sent to stop the receiver completely. All channels and files will be closed,
 			// and goroutines will exit.
+			if cmd.confirm != nil {
+				cmd.confirm <- struct{}{}
+			}
 			return nil
 		}
 		// send confirmation if requested
@@ -0,0 +1,28 @@
+package codec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandToReturnedReceiver(t *testing.T) {
+	// a receiver that has returned after the senders took their snapshot of the receivers
+	r := &receiver{make(chan command), make(chan struct{})}
+	close(r.done)
+	receiversMutex.Lock()
+	receivers["gone"] = r
+	receiversMutex.Unlock()
+	defer func() {
+		receiversMutex.Lock()
+		delete(receivers, "gone")
+		receiversMutex.Unlock()
+	}()
+
+	confirm := make(chan struct{})
+	go SuspendReceiver(confirm)
+	select {
+	case <-confirm:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command to a receiver that has returned blocked")
+	}
+}
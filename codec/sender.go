@@ -7,6 +7,8 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"rpi_panasonic_inverter_rc/codecbase"
 	"rpi_panasonic_inverter_rc/ioctl"
 )
@@ -54,18 +56,33 @@ func (sender *IrSender) processConfigs() {
 	}
 }
 
-// Actually send a config. This is a separate function so we can make use of defer to close resources after sending.
-func (sender *IrSender) send(sendRc *RcConfig) {
-	var err error
+// Only one config is sent at a time, even with several senders, so that the receivers are suspended and resumed once
+// per config.
+var sendMutex sync.Mutex
 
-	// suspend the receiver while sending
+// Suspend the receivers and hold back all senders, e.g. while another process is sending. Must be followed by
+// ResumeSending.
+func SuspendSending() {
+	sendMutex.Lock()
 	confirmCommand := make(chan struct{})
 	SuspendReceiver(confirmCommand)
 	<-confirmCommand
-	defer func() {
-		ResumeReceiver(confirmCommand)
-		<-confirmCommand
-	}()
+}
+
+func ResumeSending() {
+	confirmCommand := make(chan struct{})
+	ResumeReceiver(confirmCommand)
+	<-confirmCommand
+	sendMutex.Unlock()
+}
+
+// Actually send a config. This is a separate function so we can make use of defer to close resources after sending.
+func (sender *IrSender) send(sendRc *RcConfig) {
+	var err error
+
+	// suspend the receivers while sending
+	SuspendSending()
+	defer ResumeSending()
 
 	f := sender.openIrOutputFile()
 	if f == nil {
@@ -74,6 +91,12 @@ func (sender *IrSender) send(sendRc *RcConfig) {
 	}
 	defer f.Close()
 
+	// other processes, e.g. paninv_rc and paninv_controller, may send to the same device
+	if err = unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		slog.Error("failed to lock IR output file", "err", err)
+		return
+	}
+
 	sendRc.LogConfigAndChecksum("sending config", "")
 	err = SendIrConfig(sendRc, f, &sender.senderOptions)
 	if err != nil {
@@ -34,6 +34,30 @@ type AllSettings struct {
 	ModeSettings ModeSettingsMap `json:"modeSettings"`
 }
 
+// Return the base settings, with the fields that are set in overrides replaced.
+func MergeSettings(base, overrides Settings) Settings {
+	merged := base
+	for _, f := range []struct{ dst, src *string }{
+		{&merged.Power, &overrides.Power},
+		{&merged.Mode, &overrides.Mode},
+		{&merged.Powerful, &overrides.Powerful},
+		{&merged.Quiet, &overrides.Quiet},
+		{&merged.Temperature, &overrides.Temperature},
+		{&merged.FanSpeed, &overrides.FanSpeed},
+		{&merged.VentVertical, &overrides.VentVertical},
+		{&merged.VentHorizontal, &overrides.VentHorizontal},
+		{&merged.TimerOn, &overrides.TimerOn},
+		{&merged.TimerOnTime, &overrides.TimerOnTime},
+		{&merged.TimerOff, &overrides.TimerOff},
+		{&merged.TimerOffTime, &overrides.TimerOffTime},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	return merged
+}
+
 func Power2String(power uint) string {
 	switch power {
 	case C_Power_On:
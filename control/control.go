@@ -0,0 +1,184 @@
+// Package control lets paninv_rc tell a running paninv_controller about what it does, over a unix socket next to the
+// database. The protocol is line based: the client sends a command and the server replies with "ok" or "error <reason>".
+//
+//	suspend        suspend the receivers and senders of the controller while the client is sending
+//	resume         resume the receivers and senders
+//	reload <unit>  reload the state of a unit, e.g. the timers, after the client has changed its config
+//
+// If the connection is closed while suspended, the controller resumes, so that a client that dies while sending can't
+// leave the controller deaf.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The longest time that a client may keep the controller suspended.
+const MAX_SUSPEND = 30 * time.Second
+
+// The control socket of the controller, where the systemd unit runs it, unless PANINV_CONTROL is set.
+const DEFAULT_SOCKET = "/run/paninv/control.sock"
+
+func GetSocketPath() string {
+	path := os.Getenv("PANINV_CONTROL")
+	if path == "" {
+		path = DEFAULT_SOCKET
+	}
+	return path
+}
+
+// The actions of the controller that can be triggered by clients.
+type Handler interface {
+	Suspend()
+	Resume()
+	Reload(unit string) error
+}
+
+type Server struct {
+	listener net.Listener
+	handler  Handler
+	wg       sync.WaitGroup
+}
+
+// Listen for clients on the socket, and call the handler for the commands they send.
+func Listen(path string, handler Handler) (*Server, error) {
+	// remove the socket of a previous controller, unless it is still running
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is used by another controller", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{listener: listener, handler: handler}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("control socket failed", "err", err)
+			}
+			return
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	suspended := false
+	defer func() {
+		if suspended {
+			slog.Warn("control client left while suspended, resuming")
+			s.handler.Resume()
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		slog.Debug("control command", "cmd", cmd, "arg", arg)
+
+		var err error
+		switch cmd {
+		case "suspend":
+			if !suspended {
+				s.handler.Suspend()
+				suspended = true
+				conn.SetReadDeadline(time.Now().Add(MAX_SUSPEND))
+			}
+		case "resume":
+			if suspended {
+				s.handler.Resume()
+				suspended = false
+				conn.SetReadDeadline(time.Time{})
+			}
+		case "reload":
+			err = s.handler.Reload(arg)
+		default:
+			err = fmt.Errorf("unknown command %q", cmd)
+		}
+
+		reply := "ok"
+		if err != nil {
+			reply = "error " + err.Error()
+		}
+		if _, err := fmt.Fprintln(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// Stop listening and remove the socket. Connected clients are not waited for.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+type Client struct {
+	conn    net.Conn
+	replies *bufio.Scanner
+}
+
+// Connect to a running controller.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn, bufio.NewScanner(conn)}, nil
+}
+
+func (c *Client) command(cmd string) error {
+	c.conn.SetDeadline(time.Now().Add(MAX_SUSPEND))
+	if _, err := fmt.Fprintln(c.conn, cmd); err != nil {
+		return err
+	}
+	if !c.replies.Scan() {
+		if err := c.replies.Err(); err != nil {
+			return err
+		}
+		return errors.New("controller closed the connection")
+	}
+	reply := c.replies.Text()
+	if reply != "ok" {
+		return errors.New(strings.TrimPrefix(reply, "error "))
+	}
+	return nil
+}
+
+func (c *Client) Suspend() error {
+	return c.command("suspend")
+}
+
+func (c *Client) Resume() error {
+	return c.command("resume")
+}
+
+func (c *Client) Reload(unit string) error {
+	return c.command("reload " + unit)
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
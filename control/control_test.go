@@ -0,0 +1,102 @@
+package control
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeHandler struct {
+	mu        sync.Mutex
+	suspended int
+	reloaded  []string
+}
+
+func (h *fakeHandler) Suspend() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.suspended++
+}
+
+func (h *fakeHandler) Resume() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.suspended--
+}
+
+func (h *fakeHandler) Reload(unit string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if unit != "default" {
+		return errors.New("unknown unit")
+	}
+	h.reloaded = append(h.reloaded, unit)
+	return nil
+}
+
+func (h *fakeHandler) isSuspended() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.suspended > 0
+}
+
+func startServer(t *testing.T) (string, *fakeHandler) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	h := &fakeHandler{}
+	s, err := Listen(path, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return path, h
+}
+
+func TestCommands(t *testing.T) {
+	path, h := startServer(t)
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Suspend(); err != nil || !h.isSuspended() {
+		t.Errorf("suspend: %v", err)
+	}
+	if err := c.Resume(); err != nil || h.isSuspended() {
+		t.Errorf("resume: %v", err)
+	}
+	if err := c.Reload("default"); err != nil || len(h.reloaded) != 1 {
+		t.Errorf("reload: %v", err)
+	}
+	if err := c.Reload("attic"); err == nil || err.Error() != "unknown unit" {
+		t.Errorf("reload of unknown unit: %v", err)
+	}
+}
+
+func TestResumeWhenClientLeaves(t *testing.T) {
+	path, h := startServer(t)
+	c, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Suspend(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	for i := 0; h.isSuspended(); i++ {
+		if i == 100 {
+			t.Fatal("still suspended after the client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSecondServer(t *testing.T) {
+	path, _ := startServer(t)
+	if _, err := Listen(path, &fakeHandler{}); err == nil {
+		t.Error("expected an error when the socket is in use")
+	}
+}
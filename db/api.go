@@ -2,17 +2,24 @@ package db
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
 	"rpi_panasonic_inverter_rc/codec"
 	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/rcutils"
 )
 
-var myDb *gorm.DB
+// A Store that keeps the state in an SQLite database.
+type SqliteStore struct {
+	db   *gorm.DB
+	file string
+}
 
 func GetDBPath() string {
 	db := os.Getenv("PANINV_DB")
@@ -22,86 +29,123 @@ func GetDBPath() string {
 	return db
 }
 
-func Initialize(dbFile string) error {
-	var err error
-	myDb, err = gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+// Open the database without migrating it, e.g. to check the migration status.
+//
+// The database is shared by paninv_controller and paninv_rc. WAL mode lets them read while the other one writes, and
+// the busy timeout makes a writer wait for the other one instead of failing. Transactions take the write lock at once,
+// since a transaction that upgrades a read lock fails immediately if the other process is writing.
+func Connect(dbFile string) (*SqliteStore, error) {
+	dsn := dbFile + "?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate"
+	myDb, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{})
 	if err != nil {
-		panic("failed to connect database")
+		return nil, fmt.Errorf("failed to connect database: %w", err)
 	}
+	return &SqliteStore{myDb, dbFile}, nil
+}
 
-	// Migrate the schema
-	myDb.AutoMigrate(&DbIrConfig{}, &ModeSetting{}, &JobSet{}, &CronJob{})
+// Open the database, creating, migrating and initializing it if needed.
+func Open(dbFile string) (*SqliteStore, error) {
+	s, err := Connect(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Migrate(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.initializeUnit(DefaultUnit); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Create the initial records of a unit, unless they already exist.
+func (s *SqliteStore) initializeUnit(unit string) error {
+	var u Unit
+	result := s.db.Where(&Unit{Name: unit}).Limit(1).Find(&u)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		if result := s.db.Create(&Unit{Name: unit}); result.Error != nil {
+			return result.Error
+		}
+	}
 
-	// Create initial records
 	var dbRc DbIrConfig
+	result = s.db.Where(&DbIrConfig{Unit: unit}).Limit(1).Find(&dbRc)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		slog.Info("Initializing db", "unit", unit)
 
-	result := myDb.First(&dbRc, 1)
-	if result.Error != nil && result.RowsAffected == 0 {
-		slog.Info("Initializing db")
-
-		rc := codec.NewRcConfig()
-		c := &DbIrConfig{
-			Power:          rc.Power,
-			Mode:           rc.Mode,
-			Powerful:       rc.Powerful,
-			Quiet:          rc.Quiet,
-			Temperature:    rc.Temperature,
-			FanSpeed:       rc.FanSpeed,
-			VentVertical:   rc.VentVertical,
-			VentHorizontal: rc.VentHorizontal,
-			TimerOn:        rc.TimerOn,
-			TimerOff:       rc.TimerOff,
-			TimerOnTime:    uint(rc.TimerOnTime),
-			TimerOffTime:   uint(rc.TimerOffTime),
-		}
-		result := myDb.Create(c)
+		result := s.db.Create(newDbIrConfig(unit, codec.NewRcConfig()))
 		if result.Error != nil {
-			return err
+			return result.Error
 		}
 
-		settings := []*ModeSetting{
-			{Mode: codecbase.C_Mode_Auto, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
-			{Mode: codecbase.C_Mode_Dry, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
-			{Mode: codecbase.C_Mode_Heat, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
-			{Mode: codecbase.C_Mode_Cool, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
-		}
-		result = myDb.Create(settings)
+		result = s.db.Create(defaultModeSettings(unit))
 		if result.Error != nil {
-			return err
+			return result.Error
 		}
 	}
 
 	return nil
 }
 
-func Close() {
+func (s *SqliteStore) Close() error {
+	sqlDb, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDb.Close()
+}
+
+func (s *SqliteStore) WithTx(fn func(tx Store) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&SqliteStore{tx, s.file})
+	})
+}
+
+// Units
 
+// Save the LIRC devices of a unit, creating the unit and its initial config if it doesn't exist.
+func (s *SqliteStore) SaveUnit(unit, irInput, irOutput string) error {
+	if err := s.initializeUnit(unit); err != nil {
+		return err
+	}
+	result := s.db.Model(&Unit{}).Where(&Unit{Name: unit}).Updates(map[string]interface{}{"IrInput": irInput, "IrOutput": irOutput})
+	return result.Error
 }
 
-func CurrentConfig() (*codec.RcConfig, error) {
+func (s *SqliteStore) GetUnits() (*[]Unit, error) {
+	var units []Unit
+	if result := s.db.Order("name").Find(&units); result.Error != nil {
+		return nil, result.Error
+	}
+	return &units, nil
+}
+
+func (s *SqliteStore) GetUnit(unit string) (*Unit, error) {
+	var u Unit
+	if result := s.db.Where(&Unit{Name: unit}).First(&u); result.Error != nil {
+		return nil, fmt.Errorf("unit %q: %w", unit, result.Error)
+	}
+	return &u, nil
+}
+
+func (s *SqliteStore) CurrentConfig(unit string) (*codec.RcConfig, error) {
 	var dbRc DbIrConfig
-	result := myDb.First(&dbRc, 1)
+	result := s.db.Where(&DbIrConfig{Unit: unit}).First(&dbRc)
 	if result.Error != nil {
 		return nil, result.Error
 	}
-	return &codec.RcConfig{
-		Power:          dbRc.Power,
-		Mode:           dbRc.Mode,
-		Powerful:       dbRc.Powerful,
-		Quiet:          dbRc.Quiet,
-		Temperature:    dbRc.Temperature,
-		FanSpeed:       dbRc.FanSpeed,
-		VentVertical:   dbRc.VentVertical,
-		VentHorizontal: dbRc.VentHorizontal,
-		TimerOn:        dbRc.TimerOn,
-		TimerOff:       dbRc.TimerOff,
-		TimerOnTime:    codec.Time(dbRc.TimerOnTime),
-		TimerOffTime:   codec.Time(dbRc.TimerOffTime),
-		Clock:          codecbase.C_Time_Unset,
-	}, nil
-}
-
-func SaveConfig(rc, dbRc *codec.RcConfig) error {
+	return dbRc.rcConfig(), nil
+}
+
+func (s *SqliteStore) SaveConfig(unit string, rc, dbRc *codec.RcConfig) error {
 	// update current configuration, but timer on and off should only be updated if set
 	// mode settings should be updated, but fan speed should be ignored if Powerful or Quiet is set
 
@@ -144,19 +188,19 @@ func SaveConfig(rc, dbRc *codec.RcConfig) error {
 	}
 
 	var nc DbIrConfig
-	if result := myDb.First(&nc, 1); result.Error != nil {
+	if result := s.db.Where(&DbIrConfig{Unit: unit}).First(&nc); result.Error != nil {
 		return result.Error
 	}
-	if result := myDb.Model(&nc).Updates(updates); result.Error != nil {
+	if result := s.db.Model(&nc).Updates(updates); result.Error != nil {
 		return result.Error
 	}
 
 	settings := make(map[string]interface{})
 	settings["Temperature"] = rc.Temperature
-	if rc.Powerful == codecbase.C_Powerful_Disabled && rc.Quiet == codecbase.C_Quiet_Disabled {
+	if rcutils.RemembersFanSpeed(rc) {
 		settings["FanSpeed"] = rc.FanSpeed
 	}
-	if result := myDb.Model(&ModeSetting{}).Where(map[string]interface{}{"Mode": rc.Mode}).Updates(settings); result.Error != nil {
+	if result := s.db.Model(&ModeSetting{}).Where(map[string]interface{}{"Unit": unit, "Mode": rc.Mode}).Updates(settings); result.Error != nil {
 		return result.Error
 	}
 
@@ -164,81 +208,318 @@ func SaveConfig(rc, dbRc *codec.RcConfig) error {
 	return nil
 }
 
-func SetPower(power uint) error {
+func (s *SqliteStore) SetPower(unit string, power uint) error {
 	var nc DbIrConfig
-	if result := myDb.First(&nc, 1); result.Error != nil {
+	if result := s.db.Where(&DbIrConfig{Unit: unit}).First(&nc); result.Error != nil {
 		return result.Error
 	}
-	if result := myDb.Model(&nc).Updates(map[string]interface{}{"Power": power}); result.Error != nil {
+	if result := s.db.Model(&nc).Updates(map[string]interface{}{"Power": power}); result.Error != nil {
 		return result.Error
 	}
 	return nil
 }
 
-func GetModeSettings(mode uint) (temp, fan uint, err error) {
+func (s *SqliteStore) GetModeSettings(unit string, mode uint) (temp, fan uint, err error) {
 	var ms ModeSetting
-	result := myDb.First(&ms, "mode = ?", mode)
+	result := s.db.First(&ms, "unit = ? AND mode = ?", unit, mode)
 	if result.Error != nil {
 		return 0, 0, result.Error
 	}
 	return ms.Temperature, ms.FanSpeed, nil
 }
 
+func (s *SqliteStore) SetModeSettings(unit string, mode uint, temp, fan uint) error {
+	result := s.db.Model(&ModeSetting{}).Where(map[string]interface{}{"Unit": unit, "Mode": mode}).Updates(map[string]interface{}{"Temperature": temp, "FanSpeed": fan})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("mode %d of unit %q: %w", mode, unit, ErrNotFound)
+	}
+	return nil
+}
+
 // CronJob
 
-func SaveCronJob(jobset string, schedule string, settings *codecbase.Settings) error {
+func (s *SqliteStore) SaveCronJob(unit string, jobset string, schedule string, preset string, settings *codecbase.Settings, ramp *Ramp) error {
 	json, err := json.Marshal(settings)
 	if err != nil {
 		return err
 	}
-	cj := CronJob{JobSet: jobset, Schedule: schedule, Settings: json}
-	myDb.Create(&cj)
-	return nil
+	rj, err := RampJson(ramp)
+	if err != nil {
+		return err
+	}
+	cj := CronJob{Unit: unit, JobSet: jobset, Schedule: schedule, Preset: preset, Settings: json, Ramp: rj}
+	return s.db.Create(&cj).Error
 }
 
-func GetCronJobs(jobset string) (*[]CronJob, error) {
+func (s *SqliteStore) GetCronJobs(unit string, jobset string) (*[]CronJob, error) {
 	var cronjobs []CronJob
-	if result := myDb.Where(&CronJob{JobSet: jobset}).Find(&cronjobs); result.Error != nil {
+	if result := s.db.Where(&CronJob{Unit: unit, JobSet: jobset}).Find(&cronjobs); result.Error != nil {
 		return nil, result.Error
 	}
 	return &cronjobs, nil
 }
 
-func DeleteAllCronJobsPermanently() {
+func (s *SqliteStore) DeleteCronJob(id uint) error {
+	// Unscoped is needed to bypass soft delete
+	return s.db.Unscoped().Delete(&CronJob{}, id).Error
+}
+
+func (s *SqliteStore) SetCronJobLastRun(id uint, lastRun time.Time) error {
+	return s.db.Model(&CronJob{}).Where("id = ?", id).UpdateColumn("last_run", lastRun).Error
+}
+
+func (s *SqliteStore) DeleteAllCronJobsPermanently() error {
 	// AllowGlobalUpdate needed to delete all, Unscoped needed to bypass soft delete
-	myDb.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&CronJob{})
+	return s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&CronJob{}).Error
 }
 
 // JobSets
 
-func SaveJobSet(jobset string, active bool) error {
-	cj := JobSet{Name: jobset, Active: active}
-	myDb.Create(&cj)
-	return nil
+func (s *SqliteStore) SaveJobSet(unit string, jobset string, active bool) error {
+	cj := JobSet{Unit: unit, Name: jobset, Active: active}
+	return s.db.Create(&cj).Error
 }
 
-func GetJobSets() (*[]JobSet, error) {
+func (s *SqliteStore) GetJobSets(unit string) (*[]JobSet, error) {
 	var jobsets []JobSet
-	if result := myDb.Find(&jobsets); result.Error != nil {
+	if result := s.db.Where(&JobSet{Unit: unit}).Find(&jobsets); result.Error != nil {
 		return nil, result.Error
 	}
 	return &jobsets, nil
 }
 
-func UpdateJobSet(jobset string, active bool) error {
-	myDb.Model(&JobSet{}).Where("name = ?", jobset).Updates(map[string]interface{}{"Active": active})
-	return nil
+func (s *SqliteStore) UpdateJobSet(unit string, jobset string, active bool) error {
+	return s.db.Model(&JobSet{}).Where("unit = ? AND name = ?", unit, jobset).Updates(map[string]interface{}{"Active": active}).Error
+}
+
+func (s *SqliteStore) SetJobSetActivation(unit string, jobset string, activation []byte) error {
+	return s.db.Model(&JobSet{}).Where("unit = ? AND name = ?", unit, jobset).Updates(map[string]interface{}{"Activation": activation}).Error
+}
+
+func (s *SqliteStore) SetJobSetPriority(unit string, jobset string, priority int) error {
+	return s.db.Model(&JobSet{}).Where("unit = ? AND name = ?", unit, jobset).Updates(map[string]interface{}{"Priority": priority}).Error
 }
 
-func GetActiveJobSets() (*[]JobSet, error) {
+func (s *SqliteStore) SetJobSetSkipMissed(unit string, jobset string, skip bool) error {
+	return s.db.Model(&JobSet{}).Where("unit = ? AND name = ?", unit, jobset).Updates(map[string]interface{}{"SkipMissed": skip}).Error
+}
+
+func (s *SqliteStore) DeleteJobSet(unit string, jobset string) error {
+	// Unscoped is needed to bypass soft delete
+	if err := s.db.Unscoped().Where("unit = ? AND job_set = ?", unit, jobset).Delete(&CronJob{}).Error; err != nil {
+		return err
+	}
+	return s.db.Unscoped().Where("unit = ? AND name = ?", unit, jobset).Delete(&JobSet{}).Error
+}
+
+func (s *SqliteStore) GetActiveJobSets() (*[]JobSet, error) {
 	var jobsets []JobSet
-	if result := myDb.Where(map[string]interface{}{"Active": true}).Find(&jobsets); result.Error != nil {
+	if result := s.db.Where(map[string]interface{}{"Active": true}).Find(&jobsets); result.Error != nil {
 		return nil, result.Error
 	}
 	return &jobsets, nil
 }
 
-func DeleteAllJobSetsPermanently() {
+func (s *SqliteStore) DeleteAllJobSetsPermanently() error {
+	// AllowGlobalUpdate needed to delete all, Unscoped needed to bypass soft delete
+	return s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&JobSet{}).Error
+}
+
+// OneTimeJobs
+
+func (s *SqliteStore) SaveOneTimeJob(unit string, at time.Time, preset string, settings *codecbase.Settings) (*OneTimeJob, error) {
+	json, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	otj := OneTimeJob{Unit: unit, At: at, Preset: preset, Settings: json}
+	if result := s.db.Create(&otj); result.Error != nil {
+		return nil, result.Error
+	}
+	return &otj, nil
+}
+
+func (s *SqliteStore) GetOneTimeJobs(unit string) (*[]OneTimeJob, error) {
+	var jobs []OneTimeJob
+	if result := s.db.Where(&OneTimeJob{Unit: unit}).Order("at").Find(&jobs); result.Error != nil {
+		return nil, result.Error
+	}
+	return &jobs, nil
+}
+
+func (s *SqliteStore) DeleteOneTimeJob(id uint) (bool, error) {
+	// Unscoped is needed to bypass soft delete
+	result := s.db.Unscoped().Delete(&OneTimeJob{}, id)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *SqliteStore) DeleteAllOneTimeJobsPermanently() error {
+	// AllowGlobalUpdate needed to delete all, Unscoped needed to bypass soft delete
+	return s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&OneTimeJob{}).Error
+}
+
+// Job runs
+
+func (s *SqliteStore) SaveJobRun(run *JobRun) error {
+	return s.db.Create(run).Error
+}
+
+func (s *SqliteStore) GetJobRuns(unit string, since time.Time) (*[]JobRun, error) {
+	var runs []JobRun
+	if result := s.db.Where(&JobRun{Unit: unit}).Where("started >= ?", since).Order("started desc").Find(&runs); result.Error != nil {
+		return nil, result.Error
+	}
+	return &runs, nil
+}
+
+func (s *SqliteStore) DeleteJobRunsBefore(t time.Time) error {
+	// Unscoped is needed to bypass soft delete
+	return s.db.Unscoped().Where("started < ?", t).Delete(&JobRun{}).Error
+}
+
+func (s *SqliteStore) DeleteAllJobRunsPermanently() error {
+	// AllowGlobalUpdate needed to delete all, Unscoped needed to bypass soft delete
+	return s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&JobRun{}).Error
+}
+
+// Sensor readings
+
+func (s *SqliteStore) SaveSensorReading(reading *SensorReading) error {
+	return s.db.Create(reading).Error
+}
+
+func (s *SqliteStore) GetSensorReadings(sensor string, from, to time.Time) (*[]SensorReading, error) {
+	var readings []SensorReading
+	result := s.db.Where(&SensorReading{Sensor: sensor}).Where("time >= ? AND time < ?", from, to).Order("time").Find(&readings)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &readings, nil
+}
+
+func (s *SqliteStore) DeleteSensorReadings(ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	// Unscoped is needed to bypass soft delete
+	return s.db.Unscoped().Delete(&SensorReading{}, ids).Error
+}
+
+func (s *SqliteStore) DeleteSensorReadingsBefore(t time.Time) error {
+	// Unscoped is needed to bypass soft delete
+	return s.db.Unscoped().Where("time < ?", t).Delete(&SensorReading{}).Error
+}
+
+// Holds
+
+func (s *SqliteStore) SaveHold(hold *Hold) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Unscoped is needed to bypass soft delete
+		if result := tx.Unscoped().Where(&Hold{Unit: hold.Unit}).Delete(&Hold{}); result.Error != nil {
+			return result.Error
+		}
+		hold.Model = gorm.Model{}
+		return tx.Create(hold).Error
+	})
+}
+
+func (s *SqliteStore) GetHold(unit string) (*Hold, error) {
+	// settings jobs check for a hold each time they run, so a missing hold is not logged like First would do
+	var holds []Hold
+	if result := s.db.Where(&Hold{Unit: unit}).Limit(1).Find(&holds); result.Error != nil {
+		return nil, result.Error
+	}
+	if len(holds) == 0 {
+		return nil, fmt.Errorf("hold of unit %q: %w", unit, ErrNotFound)
+	}
+	return &holds[0], nil
+}
+
+func (s *SqliteStore) DeleteHold(unit string) (bool, error) {
+	// Unscoped is needed to bypass soft delete
+	result := s.db.Unscoped().Where(&Hold{Unit: unit}).Delete(&Hold{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (s *SqliteStore) DeleteAllHoldsPermanently() error {
 	// AllowGlobalUpdate needed to delete all, Unscoped needed to bypass soft delete
-	myDb.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&JobSet{})
+	return s.db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(&Hold{}).Error
+}
+
+// Ramps
+
+func (s *SqliteStore) SaveRampState(ramp *RampState) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// Unscoped is needed to bypass soft delete
+		if result := tx.Unscoped().Where(&RampState{Unit: ramp.Unit}).Delete(&RampState{}); result.Error != nil {
+			return result.Error
+		}
+		ramp.Model = gorm.Model{}
+		return tx.Create(ramp).Error
+	})
+}
+
+func (s *SqliteStore) GetRampState(unit string) (*RampState, error) {
+	var ramps []RampState
+	if result := s.db.Where(&RampState{Unit: unit}).Limit(1).Find(&ramps); result.Error != nil {
+		return nil, result.Error
+	}
+	if len(ramps) == 0 {
+		return nil, fmt.Errorf("ramp of unit %q: %w", unit, ErrNotFound)
+	}
+	return &ramps[0], nil
+}
+
+func (s *SqliteStore) DeleteRampState(unit string) (bool, error) {
+	// Unscoped is needed to bypass soft delete
+	result := s.db.Unscoped().Where(&RampState{Unit: unit}).Delete(&RampState{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// Presets
+
+func (s *SqliteStore) SavePreset(name string, settings *codecbase.Settings) error {
+	json, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	var p Preset
+	result := s.db.Where(&Preset{Name: name}).Limit(1).Find(&p)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		p = Preset{Name: name, Settings: json}
+		return s.db.Create(&p).Error
+	}
+	return s.db.Model(&p).Updates(map[string]interface{}{"Settings": json}).Error
+}
+
+func (s *SqliteStore) GetPresets() (*[]Preset, error) {
+	var presets []Preset
+	if result := s.db.Order("name").Find(&presets); result.Error != nil {
+		return nil, result.Error
+	}
+	return &presets, nil
+}
+
+func (s *SqliteStore) GetPreset(name string) (*codecbase.Settings, error) {
+	var p Preset
+	if result := s.db.Where(&Preset{Name: name}).First(&p); result.Error != nil {
+		return nil, result.Error
+	}
+	var settings = new(codecbase.Settings)
+	if err := json.Unmarshal(p.Settings, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *SqliteStore) DeletePreset(name string) (bool, error) {
+	// Unscoped is needed to bypass soft delete, so that the name can be reused
+	result := s.db.Unscoped().Where(&Preset{Name: name}).Delete(&Preset{})
+	return result.RowsAffected > 0, result.Error
 }
@@ -0,0 +1,648 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/rcutils"
+)
+
+// A Store that keeps the state in memory, e.g. for tests. It behaves like the SQLite store, but nothing is persisted.
+type MemStore struct {
+	txMu         sync.Mutex // serializes transactions
+	mu           sync.Mutex
+	lastId       uint
+	units        map[string]*Unit
+	configs      map[string]*DbIrConfig
+	modeSettings map[string]map[uint]*ModeSetting
+	jobSets      []*JobSet
+	cronJobs     []*CronJob
+	oneTimeJobs  []*OneTimeJob
+	jobRuns      []*JobRun
+	readings     []*SensorReading
+	holds        map[string]*Hold
+	ramps        map[string]*RampState
+	presets      map[string]*Preset
+}
+
+// Return a new store with an initialized default unit.
+func NewMemStore() *MemStore {
+	m := &MemStore{
+		units:        make(map[string]*Unit),
+		configs:      make(map[string]*DbIrConfig),
+		modeSettings: make(map[string]map[uint]*ModeSetting),
+		presets:      make(map[string]*Preset),
+		holds:        make(map[string]*Hold),
+		ramps:        make(map[string]*RampState),
+	}
+	m.initializeUnit(DefaultUnit)
+	return m
+}
+
+// Return the ID and timestamps of a new record.
+func (m *MemStore) newModel() gorm.Model {
+	m.lastId++
+	now := time.Now()
+	return gorm.Model{ID: m.lastId, CreatedAt: now, UpdatedAt: now}
+}
+
+func (m *MemStore) initializeUnit(unit string) {
+	if _, found := m.units[unit]; !found {
+		u := &Unit{Name: unit}
+		u.Model = m.newModel()
+		m.units[unit] = u
+	}
+	if _, found := m.configs[unit]; !found {
+		c := newDbIrConfig(unit, codec.NewRcConfig())
+		c.Model = m.newModel()
+		m.configs[unit] = c
+
+		m.modeSettings[unit] = make(map[uint]*ModeSetting)
+		for _, ms := range defaultModeSettings(unit) {
+			ms.Model = m.newModel()
+			m.modeSettings[unit][ms.Mode] = ms
+		}
+	}
+}
+
+func (m *MemStore) Close() error {
+	return nil
+}
+
+// Return a deep copy of the state.
+func (m *MemStore) snapshot() *MemStore {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := &MemStore{
+		lastId:       m.lastId,
+		units:        make(map[string]*Unit),
+		configs:      make(map[string]*DbIrConfig),
+		modeSettings: make(map[string]map[uint]*ModeSetting),
+		presets:      make(map[string]*Preset),
+		holds:        make(map[string]*Hold),
+		ramps:        make(map[string]*RampState),
+	}
+	for k, u := range m.units {
+		cu := *u
+		c.units[k] = &cu
+	}
+	for k, cfg := range m.configs {
+		ccfg := *cfg
+		c.configs[k] = &ccfg
+	}
+	for k, mss := range m.modeSettings {
+		c.modeSettings[k] = make(map[uint]*ModeSetting)
+		for mode, ms := range mss {
+			cms := *ms
+			c.modeSettings[k][mode] = &cms
+		}
+	}
+	for _, js := range m.jobSets {
+		cjs := *js
+		c.jobSets = append(c.jobSets, &cjs)
+	}
+	for _, cj := range m.cronJobs {
+		ccj := *cj
+		c.cronJobs = append(c.cronJobs, &ccj)
+	}
+	for _, otj := range m.oneTimeJobs {
+		cotj := *otj
+		c.oneTimeJobs = append(c.oneTimeJobs, &cotj)
+	}
+	for _, r := range m.jobRuns {
+		cr := *r
+		c.jobRuns = append(c.jobRuns, &cr)
+	}
+	for _, r := range m.readings {
+		cr := *r
+		c.readings = append(c.readings, &cr)
+	}
+	for k, h := range m.holds {
+		ch := *h
+		c.holds[k] = &ch
+	}
+	for k, r := range m.ramps {
+		cr := *r
+		c.ramps[k] = &cr
+	}
+	for k, p := range m.presets {
+		cp := *p
+		c.presets[k] = &cp
+	}
+	return c
+}
+
+// Transactions are not isolated from other callers, but the state is restored if fn fails.
+func (m *MemStore) WithTx(fn func(tx Store) error) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+	saved := m.snapshot()
+	if err := fn(m); err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.lastId, m.units, m.configs, m.modeSettings = saved.lastId, saved.units, saved.configs, saved.modeSettings
+		m.jobSets, m.cronJobs, m.oneTimeJobs, m.presets = saved.jobSets, saved.cronJobs, saved.oneTimeJobs, saved.presets
+		m.jobRuns, m.readings, m.holds, m.ramps = saved.jobRuns, saved.readings, saved.holds, saved.ramps
+		return err
+	}
+	return nil
+}
+
+// Units
+
+func (m *MemStore) SaveUnit(unit, irInput, irOutput string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.initializeUnit(unit)
+	u := m.units[unit]
+	u.IrInput, u.IrOutput, u.UpdatedAt = irInput, irOutput, time.Now()
+	return nil
+}
+
+func (m *MemStore) GetUnits() (*[]Unit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	units := make([]Unit, 0, len(m.units))
+	for _, u := range m.units {
+		units = append(units, *u)
+	}
+	slices.SortFunc(units, func(a, b Unit) int { return strings.Compare(a.Name, b.Name) })
+	return &units, nil
+}
+
+func (m *MemStore) GetUnit(unit string) (*Unit, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u, found := m.units[unit]
+	if !found {
+		return nil, fmt.Errorf("unit %q: %w", unit, ErrNotFound)
+	}
+	c := *u
+	return &c, nil
+}
+
+// Current config and mode settings
+
+func (m *MemStore) CurrentConfig(unit string) (*codec.RcConfig, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, found := m.configs[unit]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return c.rcConfig(), nil
+}
+
+func (m *MemStore) SaveConfig(unit string, rc, dbRc *codec.RcConfig) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, found := m.configs[unit]
+	if !found {
+		return ErrNotFound
+	}
+
+	// like the SQLite store, times are only updated if set, and the fan speed of the mode is only updated if neither
+	// powerful nor quiet is enabled
+	model := c.Model
+	*c = *newDbIrConfig(unit, rcutils.SavedConfig(rc, c.rcConfig()))
+	c.Model = model
+	c.UpdatedAt = time.Now()
+
+	if ms, found := m.modeSettings[unit][rc.Mode]; found {
+		ms.Temperature = rc.Temperature
+		if rcutils.RemembersFanSpeed(rc) {
+			ms.FanSpeed = rc.FanSpeed
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) SetPower(unit string, power uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, found := m.configs[unit]
+	if !found {
+		return ErrNotFound
+	}
+	c.Power = power
+	return nil
+}
+
+func (m *MemStore) GetModeSettings(unit string, mode uint) (temp, fan uint, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms, found := m.modeSettings[unit][mode]
+	if !found {
+		return 0, 0, ErrNotFound
+	}
+	return ms.Temperature, ms.FanSpeed, nil
+}
+
+func (m *MemStore) SetModeSettings(unit string, mode uint, temp, fan uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ms, found := m.modeSettings[unit][mode]
+	if !found {
+		return fmt.Errorf("mode %d of unit %q: %w", mode, unit, ErrNotFound)
+	}
+	ms.Temperature, ms.FanSpeed, ms.UpdatedAt = temp, fan, time.Now()
+	return nil
+}
+
+// Job sets and cron jobs
+
+func (m *MemStore) SaveCronJob(unit string, jobset string, schedule string, preset string, settings *codecbase.Settings, ramp *Ramp) error {
+	json, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	rj, err := RampJson(ramp)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cj := &CronJob{Unit: unit, JobSet: jobset, Schedule: schedule, Preset: preset, Settings: json, Ramp: rj}
+	cj.Model = m.newModel()
+	m.cronJobs = append(m.cronJobs, cj)
+	return nil
+}
+
+func (m *MemStore) GetCronJobs(unit string, jobset string) (*[]CronJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cronjobs := make([]CronJob, 0)
+	for _, cj := range m.cronJobs {
+		if cj.Unit == unit && cj.JobSet == jobset {
+			cronjobs = append(cronjobs, *cj)
+		}
+	}
+	return &cronjobs, nil
+}
+
+func (m *MemStore) DeleteCronJob(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cronJobs = slices.DeleteFunc(m.cronJobs, func(cj *CronJob) bool { return cj.ID == id })
+	return nil
+}
+
+func (m *MemStore) SetCronJobLastRun(id uint, lastRun time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, cj := range m.cronJobs {
+		if cj.ID == id {
+			cj.LastRun = lastRun
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteAllCronJobsPermanently() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cronJobs = nil
+	return nil
+}
+
+func (m *MemStore) SaveJobSet(unit string, jobset string, active bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	js := &JobSet{Unit: unit, Name: jobset, Active: active}
+	js.Model = m.newModel()
+	m.jobSets = append(m.jobSets, js)
+	return nil
+}
+
+func (m *MemStore) findJobSets(match func(js *JobSet) bool) *[]JobSet {
+	jobsets := make([]JobSet, 0)
+	for _, js := range m.jobSets {
+		if match(js) {
+			jobsets = append(jobsets, *js)
+		}
+	}
+	return &jobsets
+}
+
+func (m *MemStore) GetJobSets(unit string) (*[]JobSet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findJobSets(func(js *JobSet) bool { return js.Unit == unit }), nil
+}
+
+func (m *MemStore) UpdateJobSet(unit string, jobset string, active bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, js := range m.jobSets {
+		if js.Unit == unit && js.Name == jobset {
+			js.Active = active
+			js.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) SetJobSetActivation(unit string, jobset string, activation []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, js := range m.jobSets {
+		if js.Unit == unit && js.Name == jobset {
+			js.Activation = activation
+			js.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) SetJobSetPriority(unit string, jobset string, priority int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, js := range m.jobSets {
+		if js.Unit == unit && js.Name == jobset {
+			js.Priority = priority
+			js.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) SetJobSetSkipMissed(unit string, jobset string, skip bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, js := range m.jobSets {
+		if js.Unit == unit && js.Name == jobset {
+			js.SkipMissed = skip
+			js.UpdatedAt = time.Now()
+		}
+	}
+	return nil
+}
+
+func (m *MemStore) DeleteJobSet(unit string, jobset string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobSets = slices.DeleteFunc(m.jobSets, func(js *JobSet) bool { return js.Unit == unit && js.Name == jobset })
+	m.cronJobs = slices.DeleteFunc(m.cronJobs, func(cj *CronJob) bool { return cj.Unit == unit && cj.JobSet == jobset })
+	return nil
+}
+
+func (m *MemStore) GetActiveJobSets() (*[]JobSet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findJobSets(func(js *JobSet) bool { return js.Active }), nil
+}
+
+func (m *MemStore) DeleteAllJobSetsPermanently() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobSets = nil
+	return nil
+}
+
+// OneTimeJobs
+
+func (m *MemStore) SaveOneTimeJob(unit string, at time.Time, preset string, settings *codecbase.Settings) (*OneTimeJob, error) {
+	json, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	otj := &OneTimeJob{Unit: unit, At: at, Preset: preset, Settings: json}
+	otj.Model = m.newModel()
+	m.oneTimeJobs = append(m.oneTimeJobs, otj)
+	saved := *otj
+	return &saved, nil
+}
+
+func (m *MemStore) GetOneTimeJobs(unit string) (*[]OneTimeJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]OneTimeJob, 0)
+	for _, otj := range m.oneTimeJobs {
+		if otj.Unit == unit {
+			jobs = append(jobs, *otj)
+		}
+	}
+	slices.SortStableFunc(jobs, func(a, b OneTimeJob) int { return a.At.Compare(b.At) })
+	return &jobs, nil
+}
+
+func (m *MemStore) DeleteOneTimeJob(id uint) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.oneTimeJobs)
+	m.oneTimeJobs = slices.DeleteFunc(m.oneTimeJobs, func(otj *OneTimeJob) bool { return otj.ID == id })
+	return len(m.oneTimeJobs) < n, nil
+}
+
+func (m *MemStore) DeleteAllOneTimeJobsPermanently() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oneTimeJobs = nil
+	return nil
+}
+
+// Job runs
+
+func (m *MemStore) SaveJobRun(run *JobRun) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run.Model = m.newModel()
+	saved := *run
+	m.jobRuns = append(m.jobRuns, &saved)
+	return nil
+}
+
+func (m *MemStore) GetJobRuns(unit string, since time.Time) (*[]JobRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	runs := make([]JobRun, 0)
+	for _, r := range m.jobRuns {
+		if r.Unit == unit && !r.Started.Before(since) {
+			runs = append(runs, *r)
+		}
+	}
+	slices.SortStableFunc(runs, func(a, b JobRun) int { return b.Started.Compare(a.Started) })
+	return &runs, nil
+}
+
+func (m *MemStore) DeleteJobRunsBefore(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobRuns = slices.DeleteFunc(m.jobRuns, func(r *JobRun) bool { return r.Started.Before(t) })
+	return nil
+}
+
+func (m *MemStore) DeleteAllJobRunsPermanently() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobRuns = nil
+	return nil
+}
+
+// Sensor readings
+
+func (m *MemStore) SaveSensorReading(reading *SensorReading) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reading.Model = m.newModel()
+	saved := *reading
+	m.readings = append(m.readings, &saved)
+	return nil
+}
+
+func (m *MemStore) GetSensorReadings(sensor string, from, to time.Time) (*[]SensorReading, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	readings := make([]SensorReading, 0)
+	for _, r := range m.readings {
+		if r.Sensor == sensor && !r.Time.Before(from) && r.Time.Before(to) {
+			readings = append(readings, *r)
+		}
+	}
+	slices.SortStableFunc(readings, func(a, b SensorReading) int { return a.Time.Compare(b.Time) })
+	return &readings, nil
+}
+
+func (m *MemStore) DeleteSensorReadings(ids []uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readings = slices.DeleteFunc(m.readings, func(r *SensorReading) bool { return slices.Contains(ids, r.ID) })
+	return nil
+}
+
+func (m *MemStore) DeleteSensorReadingsBefore(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.readings = slices.DeleteFunc(m.readings, func(r *SensorReading) bool { return r.Time.Before(t) })
+	return nil
+}
+
+// Holds
+
+func (m *MemStore) SaveHold(hold *Hold) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hold.Model = m.newModel()
+	saved := *hold
+	m.holds[hold.Unit] = &saved
+	return nil
+}
+
+func (m *MemStore) GetHold(unit string) (*Hold, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hold, found := m.holds[unit]
+	if !found {
+		return nil, fmt.Errorf("hold of unit %q: %w", unit, ErrNotFound)
+	}
+	saved := *hold
+	return &saved, nil
+}
+
+func (m *MemStore) DeleteHold(unit string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.holds[unit]
+	delete(m.holds, unit)
+	return found, nil
+}
+
+func (m *MemStore) DeleteAllHoldsPermanently() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.holds = make(map[string]*Hold)
+	return nil
+}
+
+// Ramps
+
+func (m *MemStore) SaveRampState(ramp *RampState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ramp.Model = m.newModel()
+	saved := *ramp
+	m.ramps[ramp.Unit] = &saved
+	return nil
+}
+
+func (m *MemStore) GetRampState(unit string) (*RampState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ramp, found := m.ramps[unit]
+	if !found {
+		return nil, fmt.Errorf("ramp of unit %q: %w", unit, ErrNotFound)
+	}
+	saved := *ramp
+	return &saved, nil
+}
+
+func (m *MemStore) DeleteRampState(unit string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.ramps[unit]
+	delete(m.ramps, unit)
+	return found, nil
+}
+
+// Presets
+
+func (m *MemStore) SavePreset(name string, settings *codecbase.Settings) error {
+	json, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p, found := m.presets[name]; found {
+		p.Settings = json
+		p.UpdatedAt = time.Now()
+		return nil
+	}
+	p := &Preset{Name: name, Settings: json}
+	p.Model = m.newModel()
+	m.presets[name] = p
+	return nil
+}
+
+func (m *MemStore) GetPresets() (*[]Preset, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	presets := make([]Preset, 0, len(m.presets))
+	for _, p := range m.presets {
+		presets = append(presets, *p)
+	}
+	slices.SortFunc(presets, func(a, b Preset) int { return strings.Compare(a.Name, b.Name) })
+	return &presets, nil
+}
+
+func (m *MemStore) GetPreset(name string) (*codecbase.Settings, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, found := m.presets[name]
+	if !found {
+		return nil, ErrNotFound
+	}
+	var settings = new(codecbase.Settings)
+	if err := json.Unmarshal(p.Settings, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (m *MemStore) DeletePreset(name string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, found := m.presets[name]
+	delete(m.presets, name)
+	return found, nil
+}
@@ -0,0 +1,428 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Records which migrations have been applied to the database.
+type SchemaMigration struct {
+	Version   uint `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+// A migration brings the database from the previous version to its version. Migrations must also work on databases
+// created before versioning was introduced, which have version 0 but may already contain tables and data.
+type migration struct {
+	version uint
+	name    string
+	migrate func(tx *gorm.DB) error
+}
+
+// All migrations in order. Never change or remove a migration that has been released, add a new one instead. The
+// migrations only use the snapshots of the tables below and table names, never the current models, so that what a
+// migration does doesn't change when the models change.
+var migrations = []migration{
+	{1, "create tables", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&unitV1{}, &dbIrConfigV1{}, &modeSettingV1{}, &jobSetV1{}, &cronJobV1{}, &presetV1{})
+	}},
+	{2, "assign existing rows to the default unit", func(tx *gorm.DB) error {
+		for _, table := range []string{"db_ir_configs", "mode_settings", "job_sets", "cron_jobs"} {
+			if result := tx.Table(table).Where("unit = '' OR unit IS NULL").Update("unit", DefaultUnit); result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	}},
+	{3, "normalize stored settings", func(tx *gorm.DB) error {
+		// drop unknown and empty fields, so that later migrations of settings only need to handle known fields
+		normalize := func(settings map[string]interface{}) (map[string]interface{}, error) {
+			var s settingsV3
+			if err := convertJson(settings, &s); err != nil {
+				return nil, err
+			}
+			var m map[string]interface{}
+			err := convertJson(s, &m)
+			return m, err
+		}
+		if err := convertSettings(tx, "cron_jobs", normalize); err != nil {
+			return err
+		}
+		return convertSettings(tx, "presets", normalize)
+	}},
+	{4, "add one-time jobs", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&oneTimeJobV4{})
+	}},
+	{5, "add job set activation", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&jobSetV5{})
+	}},
+	{6, "add job set priority", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&jobSetV6{})
+	}},
+	{7, "add catch-up of missed jobs", func(tx *gorm.DB) error {
+		if err := tx.AutoMigrate(&jobSetV7{}, &cronJobV7{}); err != nil {
+			return err
+		}
+		// the existing jobs have been run by the controller before it was upgraded, so they are not caught up
+		return tx.Table("cron_jobs").Where("last_run IS NULL OR last_run = ?", time.Time{}).Update("last_run", time.Now()).Error
+	}},
+	{8, "add job run history", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&jobRunV8{})
+	}},
+	{9, "add holds", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&holdV9{})
+	}},
+	{10, "add temperature ramps", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&cronJobV10{})
+	}},
+	{11, "add sensor readings", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&sensorReadingV11{})
+	}},
+	{12, "add ramp state", func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&rampStateV12{})
+	}},
+}
+
+// Snapshots of the tables as they are created or changed by the migrations, named after the version of the migration.
+// A snapshot embeds the previous snapshot of the table, and adds the new columns.
+
+type unitV1 struct {
+	gorm.Model
+	Name     string `gorm:"uniqueIndex"`
+	IrInput  string
+	IrOutput string
+}
+
+func (unitV1) TableName() string { return "units" }
+
+type dbIrConfigV1 struct {
+	gorm.Model
+	Unit           string `gorm:"index"`
+	Power          uint
+	Mode           uint
+	Powerful       uint
+	Quiet          uint
+	Temperature    uint
+	FanSpeed       uint
+	VentVertical   uint
+	VentHorizontal uint
+	TimerOn        uint
+	TimerOff       uint
+	TimerOnTime    uint
+	TimerOffTime   uint
+}
+
+func (dbIrConfigV1) TableName() string { return "db_ir_configs" }
+
+type modeSettingV1 struct {
+	gorm.Model
+	Unit        string `gorm:"index"`
+	Mode        uint
+	Temperature uint
+	FanSpeed    uint
+}
+
+func (modeSettingV1) TableName() string { return "mode_settings" }
+
+type jobSetV1 struct {
+	gorm.Model
+	Unit   string `gorm:"index"`
+	Name   string
+	Active bool
+}
+
+func (jobSetV1) TableName() string { return "job_sets" }
+
+type cronJobV1 struct {
+	gorm.Model
+	Unit     string `gorm:"index"`
+	JobSet   string
+	Schedule string
+	Preset   string
+	Settings []byte
+}
+
+func (cronJobV1) TableName() string { return "cron_jobs" }
+
+type presetV1 struct {
+	gorm.Model
+	Name     string `gorm:"uniqueIndex"`
+	Settings []byte
+}
+
+func (presetV1) TableName() string { return "presets" }
+
+// The settings as they were stored when they were normalized.
+type settingsV3 struct {
+	Power          string `json:"power,omitempty"`
+	Mode           string `json:"mode,omitempty"`
+	Powerful       string `json:"powerful,omitempty"`
+	Quiet          string `json:"quiet,omitempty"`
+	Temperature    string `json:"temp,omitempty"`
+	FanSpeed       string `json:"fan,omitempty"`
+	VentVertical   string `json:"vert,omitempty"`
+	VentHorizontal string `json:"horiz,omitempty"`
+	TimerOn        string `json:"ton,omitempty"`
+	TimerOnTime    string `json:"tont,omitempty"`
+	TimerOff       string `json:"toff,omitempty"`
+	TimerOffTime   string `json:"tofft,omitempty"`
+}
+
+type oneTimeJobV4 struct {
+	gorm.Model
+	Unit     string `gorm:"index"`
+	At       time.Time
+	Preset   string
+	Settings []byte
+}
+
+func (oneTimeJobV4) TableName() string { return "one_time_jobs" }
+
+type jobSetV5 struct {
+	jobSetV1
+	Activation []byte
+}
+
+type jobSetV6 struct {
+	jobSetV5
+	Priority int
+}
+
+type jobSetV7 struct {
+	jobSetV6
+	SkipMissed bool
+}
+
+type cronJobV7 struct {
+	cronJobV1
+	LastRun time.Time
+}
+
+type jobRunV8 struct {
+	gorm.Model
+	Unit      string `gorm:"index"`
+	JobName   string
+	Kind      string
+	JobSet    string
+	JobID     uint
+	Scheduled time.Time
+	Started   time.Time `gorm:"index"`
+	Duration  time.Duration
+	Preset    string
+	Settings  []byte
+	Config    []byte
+	Outcome   string
+	Error     string
+}
+
+func (jobRunV8) TableName() string { return "job_runs" }
+
+type holdV9 struct {
+	gorm.Model
+	Unit     string `gorm:"uniqueIndex"`
+	Until    time.Time
+	Preset   string
+	Settings []byte
+	Policy   string
+	Revert   []byte
+	Deferred []byte
+}
+
+func (holdV9) TableName() string { return "holds" }
+
+type cronJobV10 struct {
+	cronJobV7
+	Ramp []byte
+}
+
+type sensorReadingV11 struct {
+	gorm.Model
+	Sensor      string    `gorm:"index"`
+	Time        time.Time `gorm:"index"`
+	Temperature float64
+	Humidity    *float64
+	Period      time.Duration
+}
+
+func (sensorReadingV11) TableName() string { return "sensor_readings" }
+
+type rampStateV12 struct {
+	gorm.Model
+	Unit    string `gorm:"uniqueIndex"`
+	JobName string
+	From    uint
+	To      uint
+	Step    uint
+	Start   time.Time
+	End     time.Time
+}
+
+func (rampStateV12) TableName() string { return "ramp_states" }
+
+// The schema version of the database that this program uses.
+func LatestVersion() uint {
+	return migrations[len(migrations)-1].version
+}
+
+// Convert a value to another type by way of JSON.
+func convertJson(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, to)
+}
+
+// Convert the JSON settings of all rows of a table ("cron_jobs" or "presets"), including soft deleted rows. The settings
+// are passed as a map, so that fields that no longer exist in codecbase.Settings can be converted.
+func convertSettings(tx *gorm.DB, table string, convert func(map[string]interface{}) (map[string]interface{}, error)) error {
+	var rows []struct {
+		ID       uint
+		Settings []byte
+	}
+	if result := tx.Unscoped().Table(table).Select("id", "settings").Find(&rows); result.Error != nil {
+		return result.Error
+	}
+	for _, row := range rows {
+		settings := make(map[string]interface{})
+		if len(row.Settings) > 0 && string(row.Settings) != "null" {
+			if err := json.Unmarshal(row.Settings, &settings); err != nil {
+				return fmt.Errorf("row %d: invalid settings %q: %w", row.ID, row.Settings, err)
+			}
+		}
+		converted, err := convert(settings)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", row.ID, err)
+		}
+		b, err := json.Marshal(converted)
+		if err != nil {
+			return fmt.Errorf("row %d: %w", row.ID, err)
+		}
+		if result := tx.Unscoped().Table(table).Where("id = ?", row.ID).UpdateColumn("settings", b); result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// The status of a migration. AppliedAt is nil if the migration is pending.
+type MigrationStatus struct {
+	Version   uint
+	Name      string
+	AppliedAt *time.Time
+}
+
+// Return the version of the database, i.e. the highest applied migration, or 0 if no migrations have been applied.
+func (s *SqliteStore) SchemaVersion() (uint, error) {
+	if !s.db.Migrator().HasTable(&SchemaMigration{}) {
+		return 0, nil
+	}
+	var version uint
+	if result := s.db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version); result.Error != nil {
+		return 0, result.Error
+	}
+	return version, nil
+}
+
+// Return the status of all migrations.
+func (s *SqliteStore) MigrationStatus() ([]MigrationStatus, error) {
+	if err := s.checkVersion(); err != nil {
+		return nil, err
+	}
+	applied := make(map[uint]time.Time)
+	if s.db.Migrator().HasTable(&SchemaMigration{}) {
+		var rows []SchemaMigration
+		if result := s.db.Find(&rows); result.Error != nil {
+			return nil, result.Error
+		}
+		for _, row := range rows {
+			applied[row.Version] = row.AppliedAt
+		}
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		ms := MigrationStatus{Version: m.version, Name: m.name}
+		if t, found := applied[m.version]; found {
+			ms.AppliedAt = &t
+		}
+		status = append(status, ms)
+	}
+	return status, nil
+}
+
+// Fail if the database was migrated by a newer version of the program, since it might not understand the data.
+func (s *SqliteStore) checkVersion() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > LatestVersion() {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d, please upgrade the program or restore a backup", version, LatestVersion())
+	}
+	return nil
+}
+
+// Apply all pending migrations, each in its own transaction. If the database already contains data, a copy of it is
+// saved before migrating, and the name of the copy is returned.
+func (s *SqliteStore) Migrate() (backup string, err error) {
+	if err := s.checkVersion(); err != nil {
+		return "", err
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return "", err
+	}
+	if version == LatestVersion() {
+		return "", nil
+	}
+
+	if s.db.Migrator().HasTable("db_ir_configs") {
+		backup, err = s.backup(version)
+		if err != nil {
+			return "", fmt.Errorf("backup before migration failed: %w", err)
+		}
+	}
+
+	if err := s.db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return backup, err
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		slog.Info("Migrating db", "version", m.version, "migration", m.name)
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return backup, fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+	}
+	return backup, nil
+}
+
+// Save a consistent copy of the database next to the database file. Nothing is saved for in-memory databases.
+func (s *SqliteStore) backup(version uint) (string, error) {
+	if fi, err := os.Stat(s.file); err != nil || !fi.Mode().IsRegular() {
+		return "", nil
+	}
+	file := fmt.Sprintf("%s.v%d-%s.bak", s.file, version, time.Now().Format("20060102T150405"))
+	if _, err := os.Stat(file); !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%s already exists", file)
+	}
+	if result := s.db.Exec("VACUUM INTO ?", file); result.Error != nil {
+		return "", result.Error
+	}
+	slog.Info("Saved db backup", "file", file)
+	return file, nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// The tables as they were before units and versioning were introduced.
+type legacyDbIrConfig struct {
+	gorm.Model
+	Mode        uint
+	Temperature uint
+}
+
+func (legacyDbIrConfig) TableName() string { return "db_ir_configs" }
+
+type legacyCronJob struct {
+	gorm.Model
+	JobSet   string
+	Schedule string
+	Settings []byte
+}
+
+func (legacyCronJob) TableName() string { return "cron_jobs" }
+
+func createLegacyDb(t *testing.T, file string) {
+	legacyDb, err := gorm.Open(sqlite.Open(file), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := legacyDb.AutoMigrate(&legacyDbIrConfig{}, &legacyCronJob{}); err != nil {
+		t.Fatal(err)
+	}
+	legacyDb.Create(&legacyDbIrConfig{Mode: 4, Temperature: 23})
+	legacyDb.Create(&legacyCronJob{JobSet: "Normal", Schedule: "0 6 * * *", Settings: []byte(`{"temp":"21","fan":"","removed":"x"}`)})
+	sqlDb, _ := legacyDb.DB()
+	sqlDb.Close()
+}
+
+func TestMigrateNewDatabase(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(filepath.Join(dir, "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if version, _ := s.SchemaVersion(); version != LatestVersion() {
+		t.Errorf("version %d, want %d", version, LatestVersion())
+	}
+	if backups, _ := filepath.Glob(filepath.Join(dir, "*.bak")); len(backups) != 0 {
+		t.Errorf("unexpected backups %v", backups)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "paninv.db")
+	createLegacyDb(t, file)
+
+	s, err := Connect(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if status, _ := s.MigrationStatus(); len(status) != len(migrations) || status[0].AppliedAt != nil {
+		t.Errorf("unexpected status before migrating %+v", status)
+	}
+
+	backup, err := s.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(backup, file+".v0-") {
+		t.Errorf("unexpected backup %q", backup)
+	}
+	backupDb, err := Connect(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backupDb.Close()
+	if version, _ := backupDb.SchemaVersion(); version != 0 || !backupDb.db.Migrator().HasTable(&legacyCronJob{}) {
+		t.Errorf("backup is not a copy of the legacy database")
+	}
+
+	if rc, err := s.CurrentConfig(DefaultUnit); err != nil || rc.Temperature != 23 {
+		t.Errorf("config not assigned to the default unit: %+v, %v", rc, err)
+	}
+	cronjobs, _ := s.GetCronJobs(DefaultUnit, "Normal")
+	if len(*cronjobs) != 1 || string((*cronjobs)[0].Settings) != `{"temp":"21"}` {
+		t.Errorf("unexpected cron jobs %+v", cronjobs)
+	} else if (*cronjobs)[0].LastRun.IsZero() {
+		t.Errorf("existing cron job would be caught up %+v", (*cronjobs)[0])
+	}
+
+	// migrating again does nothing
+	if backup, err := s.Migrate(); err != nil || backup != "" {
+		t.Errorf("second migration: %q, %v", backup, err)
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "paninv.db")
+	s, err := Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.db.Create(&SchemaMigration{Version: LatestVersion() + 1, Name: "from the future"})
+	s.Close()
+
+	if _, err := Open(file); err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+		t.Errorf("expected a version error, got %v", err)
+	}
+}
@@ -1,11 +1,29 @@
 package db
 
 import (
+	"encoding/json"
+	"time"
+
 	"gorm.io/gorm"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
 )
 
+// The unit that is used for databases created before units were introduced, and when no unit is given.
+const DefaultUnit = "default"
+
+// An indoor unit, usually one per room, that has its own LIRC devices for sending and receiving.
+type Unit struct {
+	gorm.Model
+	Name     string `gorm:"uniqueIndex"`
+	IrInput  string // LIRC receive device
+	IrOutput string // LIRC transmit device
+}
+
 type DbIrConfig struct {
 	gorm.Model
+	Unit           string `gorm:"index"`
 	Power          uint
 	Mode           uint
 	Powerful       uint
@@ -20,25 +38,170 @@ type DbIrConfig struct {
 	TimerOffTime   uint
 }
 
+func newDbIrConfig(unit string, rc *codec.RcConfig) *DbIrConfig {
+	return &DbIrConfig{
+		Unit:           unit,
+		Power:          rc.Power,
+		Mode:           rc.Mode,
+		Powerful:       rc.Powerful,
+		Quiet:          rc.Quiet,
+		Temperature:    rc.Temperature,
+		FanSpeed:       rc.FanSpeed,
+		VentVertical:   rc.VentVertical,
+		VentHorizontal: rc.VentHorizontal,
+		TimerOn:        rc.TimerOn,
+		TimerOff:       rc.TimerOff,
+		TimerOnTime:    uint(rc.TimerOnTime),
+		TimerOffTime:   uint(rc.TimerOffTime),
+	}
+}
+
+func (c *DbIrConfig) rcConfig() *codec.RcConfig {
+	return &codec.RcConfig{
+		Power:          c.Power,
+		Mode:           c.Mode,
+		Powerful:       c.Powerful,
+		Quiet:          c.Quiet,
+		Temperature:    c.Temperature,
+		FanSpeed:       c.FanSpeed,
+		VentVertical:   c.VentVertical,
+		VentHorizontal: c.VentHorizontal,
+		TimerOn:        c.TimerOn,
+		TimerOff:       c.TimerOff,
+		TimerOnTime:    codec.Time(c.TimerOnTime),
+		TimerOffTime:   codec.Time(c.TimerOffTime),
+		Clock:          codecbase.C_Time_Unset,
+	}
+}
+
 type ModeSetting struct {
 	gorm.Model
+	Unit        string `gorm:"index"`
 	Mode        uint
 	Temperature uint
 	FanSpeed    uint
 }
 
+// The mode settings of a new unit.
+func defaultModeSettings(unit string) []*ModeSetting {
+	return []*ModeSetting{
+		{Unit: unit, Mode: codecbase.C_Mode_Auto, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
+		{Unit: unit, Mode: codecbase.C_Mode_Dry, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
+		{Unit: unit, Mode: codecbase.C_Mode_Heat, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
+		{Unit: unit, Mode: codecbase.C_Mode_Cool, Temperature: 20, FanSpeed: codecbase.C_FanSpeed_Auto},
+	}
+}
+
 // Define sets of cronjobs, e.g. Normal, Vacation, Home, Away, etc.
 // This allows toggling which cronjobs are active.
 type JobSet struct {
 	gorm.Model
+	Unit   string `gorm:"index"` // the unit that the job set controls
 	Name   string // name of the job set
 	Active bool   // true or false
+	// JSON representation of a calendar.Activation, which activates the job set automatically (optional)
+	Activation []byte
+	// jobs of job sets with a higher priority suppress jobs of this job set that run at about the same time
+	Priority int
+	// jobs that were missed while the controller wasn't running are not run when it starts
+	SkipMissed bool
 }
 
 // Define cronjobs, their schedules, and which job set each cronjob belongs to.
 type CronJob struct {
 	gorm.Model
+	Unit     string `gorm:"index"` // the unit of the job set
 	JobSet   string // the job set that the cronjob belongs to
 	Schedule string // schedule in crontab format
+	Preset   string // name of a preset to apply, resolved when the job runs (optional)
+	Settings []byte // JSON representation of Settings struct, overrides the preset
+	// when the job last ran, used to catch up on jobs that were missed while the controller wasn't running
+	LastRun time.Time
+	Ramp    []byte // JSON representation of a Ramp that starts when the job has run (optional)
+}
+
+// A gradual change of the temperature after a cron job has set it, e.g. from 22 to 18 degrees over three hours in steps
+// of one degree.
+type Ramp struct {
+	To      uint `json:"to"`             // the temperature at the end of the ramp
+	Minutes uint `json:"minutes"`        // how long the ramp lasts
+	Step    uint `json:"step,omitempty"` // degrees per step, 1 if not given
+}
+
+// Return the JSON representation of a ramp, or nil if there is none.
+func RampJson(ramp *Ramp) ([]byte, error) {
+	if ramp == nil {
+		return nil, nil
+	}
+	return json.Marshal(ramp)
+}
+
+// A job that runs once at a specific time, e.g. to turn on the heating before coming home. It is deleted after it has run.
+type OneTimeJob struct {
+	gorm.Model
+	Unit     string    `gorm:"index"` // the unit to send the settings to
+	At       time.Time // when to run the job
+	Preset   string    // name of a preset to apply, resolved when the job runs (optional)
+	Settings []byte    // JSON representation of Settings struct, overrides the preset
+}
+
+// A run of a scheduled job, kept for a while so that it's possible to check afterwards what the scheduler did.
+type JobRun struct {
+	gorm.Model
+	Unit      string `gorm:"index"`
+	JobName   string
+	Kind      string    // "settings" for cron jobs, "onetime", "timer", "dst", "hold", "ramp" or "thermostat"
+	JobSet    string    // the job set of a cron job
+	JobID     uint      // the ID of the cron job or the one-time job
+	Scheduled time.Time // when the job should have run
+	Started   time.Time `gorm:"index"` // when the job actually ran
+	Duration  time.Duration
+	Preset    string
+	Settings  []byte // JSON representation of the Settings applied by the job
+	Config    []byte // JSON representation of the Settings of the config after the run
+	Outcome   string // "ok", "suppressed", "deferred" or "skipped" during a hold, or "failed"
+	Error     string // why the job failed
+}
+
+// A reading of a room sensor. Old readings are downsampled, i.e. replaced by the average of the readings of each hour.
+type SensorReading struct {
+	gorm.Model
+	Sensor      string    `gorm:"index"`
+	Time        time.Time `gorm:"index"` // when the reading was taken, or the start of the period of an average
+	Temperature float64
+	Humidity    *float64      // relative humidity in percent, if the sensor measures it
+	Period      time.Duration // the period of an average, 0 for a single reading
+}
+
+// Settings that are held for a while, e.g. powerful for 30 minutes, after which the fields changed by the hold are
+// reverted. A unit has at most one hold.
+type Hold struct {
+	gorm.Model
+	Unit     string    `gorm:"uniqueIndex"`
+	Until    time.Time // when the hold ends
+	Preset   string    // name of a preset to hold (optional)
+	Settings []byte    // JSON representation of Settings struct, overrides the preset
+	Policy   string    // what is done with settings jobs that run during the hold: "defer", "skip" or "merge"
+	Revert   []byte    // JSON representation of the Settings before the hold, of the fields changed by the hold
+	Deferred []byte    // JSON representation of the Settings of the deferred or merged jobs, in the order they ran
+}
+
+// The ramp in progress on a unit, so that its remaining steps are taken after the controller is restarted. A unit has at
+// most one ramp.
+type RampState struct {
+	gorm.Model
+	Unit    string    `gorm:"uniqueIndex"`
+	JobName string    // the cron job that started the ramp
+	From    uint      // the temperature at the start of the ramp
+	To      uint      // the temperature at the end of the ramp
+	Step    uint      // degrees per step
+	Start   time.Time // when the ramp started
+	End     time.Time // when the ramp ends
+}
+
+// Named settings, e.g. "Evening" or "Boost", that are often used together.
+type Preset struct {
+	gorm.Model
+	Name     string `gorm:"uniqueIndex"`
 	Settings []byte // JSON representation of Settings struct
 }
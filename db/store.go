@@ -0,0 +1,188 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+// Returned (possibly wrapped) when a record doesn't exist.
+var ErrNotFound = gorm.ErrRecordNotFound
+
+// A Store keeps the state of the controller: the units with their current config and mode settings, the job sets and
+// cron jobs, and the presets.
+type Store interface {
+	Close() error
+	// Run fn in a transaction. If fn returns an error, none of its changes are kept.
+	WithTx(fn func(tx Store) error) error
+
+	// Units
+	SaveUnit(unit, irInput, irOutput string) error
+	GetUnits() (*[]Unit, error)
+	GetUnit(unit string) (*Unit, error)
+
+	// Current config and mode settings of a unit
+	CurrentConfig(unit string) (*codec.RcConfig, error)
+	SaveConfig(unit string, rc, dbRc *codec.RcConfig) error
+	SetPower(unit string, power uint) error
+	GetModeSettings(unit string, mode uint) (temp, fan uint, err error)
+	SetModeSettings(unit string, mode uint, temp, fan uint) error
+
+	// Job sets and cron jobs
+	SaveCronJob(unit string, jobset string, schedule string, preset string, settings *codecbase.Settings, ramp *Ramp) error
+	GetCronJobs(unit string, jobset string) (*[]CronJob, error)
+	DeleteCronJob(id uint) error
+	SetCronJobLastRun(id uint, lastRun time.Time) error
+	DeleteAllCronJobsPermanently() error
+	SaveJobSet(unit string, jobset string, active bool) error
+	GetJobSets(unit string) (*[]JobSet, error)
+	UpdateJobSet(unit string, jobset string, active bool) error
+	// Set the activation of a job set, or remove it if activation is nil, so that the job set is activated manually.
+	SetJobSetActivation(unit string, jobset string, activation []byte) error
+	SetJobSetPriority(unit string, jobset string, priority int) error
+	SetJobSetSkipMissed(unit string, jobset string, skip bool) error
+	// Delete a job set and its cron jobs.
+	DeleteJobSet(unit string, jobset string) error
+	// Return the active job sets of all units.
+	GetActiveJobSets() (*[]JobSet, error)
+	DeleteAllJobSetsPermanently() error
+
+	// One-time jobs
+	SaveOneTimeJob(unit string, at time.Time, preset string, settings *codecbase.Settings) (*OneTimeJob, error)
+	// Return the one-time jobs of a unit, ordered by time.
+	GetOneTimeJobs(unit string) (*[]OneTimeJob, error)
+	DeleteOneTimeJob(id uint) (bool, error)
+	DeleteAllOneTimeJobsPermanently() error
+
+	// Job run history
+	SaveJobRun(run *JobRun) error
+	// Return the runs of a unit that started at or after since, the most recent first.
+	GetJobRuns(unit string, since time.Time) (*[]JobRun, error)
+	// Delete the runs of all units that started before t.
+	DeleteJobRunsBefore(t time.Time) error
+	DeleteAllJobRunsPermanently() error
+
+	// Sensor readings
+	SaveSensorReading(reading *SensorReading) error
+	// Return the readings of a sensor taken at or after from and before to, ordered by time.
+	GetSensorReadings(sensor string, from, to time.Time) (*[]SensorReading, error)
+	DeleteSensorReadings(ids []uint) error
+	// Delete the readings of all sensors taken before t.
+	DeleteSensorReadingsBefore(t time.Time) error
+
+	// Holds
+	// Save the hold of a unit, replacing any previous hold.
+	SaveHold(hold *Hold) error
+	// Return the hold of a unit, or ErrNotFound if there is none.
+	GetHold(unit string) (*Hold, error)
+	DeleteHold(unit string) (bool, error)
+	DeleteAllHoldsPermanently() error
+
+	// Ramps
+	// Save the ramp in progress on a unit, replacing any previous ramp.
+	SaveRampState(ramp *RampState) error
+	// Return the ramp in progress on a unit, or ErrNotFound if there is none.
+	GetRampState(unit string) (*RampState, error)
+	DeleteRampState(unit string) (bool, error)
+
+	// Presets
+	SavePreset(name string, settings *codecbase.Settings) error
+	GetPresets() (*[]Preset, error)
+	GetPreset(name string) (*codecbase.Settings, error)
+	DeletePreset(name string) (bool, error)
+}
+
+var _ Store = (*SqliteStore)(nil)
+var _ Store = (*MemStore)(nil)
+
+// The mode settings of a unit, to be used when composing configs to send to the unit.
+type UnitModeSettings struct {
+	Store Store
+	Unit  string
+}
+
+func (ms UnitModeSettings) GetModeSettings(mode uint) (temp, fan uint, err error) {
+	return ms.Store.GetModeSettings(ms.Unit, mode)
+}
+
+// Return the settings of the preset, with the fields that are set in settings overriding the preset. If the preset
+// name is empty, settings are returned as they are.
+func ResolvePreset(store Store, preset string, settings *codecbase.Settings) (*codecbase.Settings, error) {
+	if preset == "" {
+		return settings, nil
+	}
+	ps, err := store.GetPreset(preset)
+	if err != nil {
+		return nil, fmt.Errorf("preset %q: %w", preset, err)
+	}
+	merged := codecbase.MergeSettings(*ps, *settings)
+	return &merged, nil
+}
+
+// Return descriptions of the cron jobs, one-time jobs and holds of all units that use the preset, e.g.
+// "default/Normal cron job 3". A preset that is in use must not be deleted, since the jobs would fail when they run.
+func PresetUsers(store Store, preset string) ([]string, error) {
+	var users []string
+	err := forEachPresetUser(store, preset, func(unit, user string) {
+		users = append(users, user)
+	})
+	return users, err
+}
+
+// Return the names of the units that have cron jobs, one-time jobs or a hold that use the preset.
+func PresetUnits(store Store, preset string) ([]string, error) {
+	var units []string
+	err := forEachPresetUser(store, preset, func(unit, user string) {
+		if !slices.Contains(units, unit) {
+			units = append(units, unit)
+		}
+	})
+	return units, err
+}
+
+// Call fn with the unit and a description of each cron job, one-time job and hold that uses the preset.
+func forEachPresetUser(store Store, preset string, fn func(unit, user string)) error {
+	units, err := store.GetUnits()
+	if err != nil {
+		return err
+	}
+	for _, u := range *units {
+		jobsets, err := store.GetJobSets(u.Name)
+		if err != nil {
+			return err
+		}
+		for _, js := range *jobsets {
+			cjs, err := store.GetCronJobs(u.Name, js.Name)
+			if err != nil {
+				return err
+			}
+			for _, cj := range *cjs {
+				if cj.Preset == preset {
+					fn(u.Name, fmt.Sprintf("%s/%s cron job %d", u.Name, js.Name, cj.ID))
+				}
+			}
+		}
+		otjs, err := store.GetOneTimeJobs(u.Name)
+		if err != nil {
+			return err
+		}
+		for _, otj := range *otjs {
+			if otj.Preset == preset {
+				fn(u.Name, fmt.Sprintf("%s one-time job %d", u.Name, otj.ID))
+			}
+		}
+		switch hold, err := store.GetHold(u.Name); {
+		case err == nil && hold.Preset == preset:
+			fn(u.Name, fmt.Sprintf("%s hold", u.Name))
+		case err != nil && !errors.Is(err, ErrNotFound):
+			return err
+		}
+	}
+	return nil
+}
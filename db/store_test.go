@@ -0,0 +1,214 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+func TestWithTxRollback(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			store.SavePreset("Day", &codecbase.Settings{Temperature: "21"})
+			failed := errors.New("failed")
+			err := store.WithTx(func(tx Store) error {
+				tx.DeletePreset("Day")
+				tx.SaveUnit("bedroom", "", "")
+				tx.SetModeSettings(DefaultUnit, codecbase.C_Mode_Heat, 25, codecbase.C_FanSpeed_High)
+				return failed
+			})
+			if err != failed {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if _, err := store.GetPreset("Day"); err != nil {
+				t.Errorf("deleted preset was not restored: %v", err)
+			}
+			if _, err := store.GetUnit("bedroom"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("created unit was not removed: %v", err)
+			}
+			if temp, _, _ := store.GetModeSettings(DefaultUnit, codecbase.C_Mode_Heat); temp != 20 {
+				t.Errorf("mode settings were not restored: %d", temp)
+			}
+		})
+	}
+}
+
+func TestCronJobLastRun(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	lastRun := time.Date(2024, 5, 17, 6, 0, 0, 0, time.Local)
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			store.SaveJobSet(DefaultUnit, "Normal", true)
+			store.SaveCronJob(DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Temperature: "22"}, nil)
+			cjs, _ := store.GetCronJobs(DefaultUnit, "Normal")
+			if !(*cjs)[0].LastRun.IsZero() {
+				t.Errorf("new job has run at %v", (*cjs)[0].LastRun)
+			}
+			if err := store.SetCronJobLastRun((*cjs)[0].ID, lastRun); err != nil {
+				t.Fatal(err)
+			}
+			if cjs, _ = store.GetCronJobs(DefaultUnit, "Normal"); !(*cjs)[0].LastRun.Equal(lastRun) {
+				t.Errorf("last run %v, want %v", (*cjs)[0].LastRun, lastRun)
+			}
+		})
+	}
+}
+
+func TestJobRuns(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	day := time.Date(2024, 5, 17, 0, 0, 0, 0, time.Local)
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			for _, h := range []int{6, 30, 54} {
+				run := JobRun{Unit: DefaultUnit, JobName: fmt.Sprintf("run %d", h), Started: day.Add(time.Duration(h) * time.Hour), Outcome: "ok"}
+				if err := store.SaveJobRun(&run); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.SaveJobRun(&JobRun{Unit: "bedroom", Started: day.Add(40 * time.Hour)})
+
+			runs, err := store.GetJobRuns(DefaultUnit, day.Add(24*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*runs) != 2 || (*runs)[0].JobName != "run 54" || (*runs)[1].JobName != "run 30" {
+				t.Errorf("unexpected runs %+v", *runs)
+			}
+			if err := store.DeleteJobRunsBefore(day.Add(48 * time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if runs, _ = store.GetJobRuns(DefaultUnit, day); len(*runs) != 1 {
+				t.Errorf("%d runs after deleting old runs, want 1", len(*runs))
+			}
+		})
+	}
+}
+
+func TestSensorReadings(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	day := time.Date(2024, 11, 2, 0, 0, 0, 0, time.Local)
+	humidity := 45.5
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			for _, h := range []int{30, 6, 54} {
+				r := SensorReading{Sensor: "living", Time: day.Add(time.Duration(h) * time.Hour), Temperature: float64(h), Humidity: &humidity}
+				if err := store.SaveSensorReading(&r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store.SaveSensorReading(&SensorReading{Sensor: "bedroom", Time: day.Add(40 * time.Hour), Period: time.Hour})
+
+			readings, err := store.GetSensorReadings("living", day, day.Add(48*time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*readings) != 2 || (*readings)[0].Temperature != 6 || (*readings)[1].Temperature != 30 ||
+				(*readings)[1].Humidity == nil || *(*readings)[1].Humidity != humidity {
+				t.Errorf("unexpected readings %+v", *readings)
+			}
+			if readings, _ = store.GetSensorReadings("bedroom", day, day.Add(48*time.Hour)); len(*readings) != 1 ||
+				(*readings)[0].Humidity != nil || (*readings)[0].Period != time.Hour {
+				t.Errorf("unexpected readings %+v", *readings)
+			}
+
+			if err := store.DeleteSensorReadings([]uint{(*readings)[0].ID}); err != nil {
+				t.Fatal(err)
+			}
+			if readings, _ = store.GetSensorReadings("bedroom", day, day.Add(48*time.Hour)); len(*readings) != 0 {
+				t.Errorf("%d readings after deleting them, want 0", len(*readings))
+			}
+			if err := store.DeleteSensorReadingsBefore(day.Add(48 * time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if readings, _ = store.GetSensorReadings("living", day, day.Add(72*time.Hour)); len(*readings) != 1 {
+				t.Errorf("%d readings after deleting old readings, want 1", len(*readings))
+			}
+		})
+	}
+}
+
+func TestHolds(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	until := time.Date(2024, 5, 17, 22, 0, 0, 0, time.Local)
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.GetHold(DefaultUnit); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+			store.SaveHold(&Hold{Unit: DefaultUnit, Until: until, Policy: "defer", Settings: []byte(`{"powerful":"on"}`)})
+			store.SaveHold(&Hold{Unit: DefaultUnit, Until: until.Add(time.Hour), Policy: "skip", Settings: []byte(`{"temp":"25"}`)})
+			hold, err := store.GetHold(DefaultUnit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !hold.Until.Equal(until.Add(time.Hour)) || hold.Policy != "skip" {
+				t.Errorf("the hold was not replaced: %+v", hold)
+			}
+			if deleted, _ := store.DeleteHold(DefaultUnit); !deleted {
+				t.Error("the hold was not deleted")
+			}
+			if _, err := store.GetHold(DefaultUnit); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestRampStates(t *testing.T) {
+	sqliteStore, err := Open(filepath.Join(t.TempDir(), "paninv.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqliteStore.Close()
+
+	start := time.Date(2024, 5, 17, 22, 0, 0, 0, time.Local)
+	for name, store := range map[string]Store{"memory": NewMemStore(), "sqlite": sqliteStore} {
+		t.Run(name, func(t *testing.T) {
+			store.SaveRampState(&RampState{Unit: DefaultUnit, JobName: "a", From: 22, To: 18, Step: 1, Start: start, End: start.Add(time.Hour)})
+			store.SaveRampState(&RampState{Unit: DefaultUnit, JobName: "b", From: 18, To: 22, Step: 2, Start: start, End: start.Add(time.Hour)})
+			ramp, err := store.GetRampState(DefaultUnit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ramp.JobName != "b" || ramp.From != 18 || !ramp.End.Equal(start.Add(time.Hour)) {
+				t.Errorf("the ramp was not replaced: %+v", ramp)
+			}
+			if deleted, _ := store.DeleteRampState(DefaultUnit); !deleted {
+				t.Error("the ramp was not deleted")
+			}
+			if _, err := store.GetRampState(DefaultUnit); !errors.Is(err, ErrNotFound) {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package rcutils
+
+import (
+	"fmt"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+// The inverter remembers the temperature and fan speed of each mode, and restores them when the mode is changed. A
+// ModeSettingsProvider returns the remembered settings, e.g. from the database.
+type ModeSettingsProvider interface {
+	GetModeSettings(mode uint) (temp, fan uint, err error)
+}
+
+type ModeSetting struct {
+	Temperature uint
+	FanSpeed    uint
+}
+
+// An in-memory ModeSettingsProvider, keyed by mode.
+type MemModeSettings map[uint]ModeSetting
+
+// Return mode settings with the same defaults as a new database.
+func NewMemModeSettings() MemModeSettings {
+	return MemModeSettings{
+		codecbase.C_Mode_Auto: {20, codecbase.C_FanSpeed_Auto},
+		codecbase.C_Mode_Dry:  {20, codecbase.C_FanSpeed_Auto},
+		codecbase.C_Mode_Heat: {20, codecbase.C_FanSpeed_Auto},
+		codecbase.C_Mode_Cool: {20, codecbase.C_FanSpeed_Auto},
+	}
+}
+
+func (m MemModeSettings) GetModeSettings(mode uint) (temp, fan uint, err error) {
+	ms, found := m[mode]
+	if !found {
+		return 0, 0, fmt.Errorf("no settings for mode %d", mode)
+	}
+	return ms.Temperature, ms.FanSpeed, nil
+}
+
+// Remember the temperature and fan speed of the mode of a config that has been sent, like the database does.
+func (m MemModeSettings) Update(rc *codec.RcConfig) {
+	ms := m[rc.Mode]
+	ms.Temperature = rc.Temperature
+	if RemembersFanSpeed(rc) {
+		ms.FanSpeed = rc.FanSpeed
+	}
+	m[rc.Mode] = ms
+}
+
+// Whether the fan speed of a config is remembered for its mode. It isn't while powerful or quiet override it.
+func RemembersFanSpeed(rc *codec.RcConfig) bool {
+	return rc.Powerful == codecbase.C_Powerful_Disabled && rc.Quiet == codecbase.C_Quiet_Disabled
+}
+
+// Return the config that is saved when rc has been sent instead of current: the timer times are only changed if they
+// are set in rc, and the clock is not saved.
+func SavedConfig(rc, current *codec.RcConfig) *codec.RcConfig {
+	saved := *rc
+	if saved.TimerOnTime == codecbase.C_Time_Unset {
+		saved.TimerOnTime = current.TimerOnTime
+	}
+	if saved.TimerOffTime == codecbase.C_Time_Unset {
+		saved.TimerOffTime = current.TimerOffTime
+	}
+	saved.Clock = current.Clock
+	return &saved
+}
@@ -1,29 +1,60 @@
 package rcutils
 
 import (
+	"errors"
 	"fmt"
-	"log/slog"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"rpi_panasonic_inverter_rc/codec"
 	"rpi_panasonic_inverter_rc/codecbase"
-	"rpi_panasonic_inverter_rc/db"
 )
 
-func SetPower(setting string, rc *codec.RcConfig) {
+// A FieldError describes a setting that was rejected, and the values that are allowed.
+type FieldError struct {
+	Field   string   `json:"field"`
+	Value   string   `json:"value"`
+	Allowed []string `json:"allowed"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s=%q: allowed values are %s", e.Field, e.Value, strings.Join(e.Allowed, ", "))
+}
+
+// A SettingsError lists all the settings that were rejected by ComposeSendConfig.
+type SettingsError struct {
+	Fields []*FieldError `json:"fields"`
+}
+
+func (e *SettingsError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Error())
+	}
+	return "invalid settings: " + strings.Join(msgs, "; ")
+}
+
+var onOffValues = []string{"on", "off"}
+
+func SetPower(setting string, rc *codec.RcConfig) error {
 	switch setting {
+	case "":
 	case "on", "yes", "enable", "enabled":
 		rc.Power = codecbase.C_Power_On
 	case "off", "no", "disable", "disabled":
 		rc.Power = codecbase.C_Power_Off
 	default:
-		return
+		return &FieldError{"power", setting, onOffValues}
 	}
+	return nil
 }
 
-func SetMode(mode string, rc *codec.RcConfig) {
+func SetMode(modeSettings ModeSettingsProvider, mode string, rc *codec.RcConfig) error {
 	switch mode {
+	case "":
+		return nil
 	case "auto":
 		rc.Mode = codecbase.C_Mode_Auto
 	case "dry":
@@ -33,97 +64,155 @@ func SetMode(mode string, rc *codec.RcConfig) {
 	case "heat":
 		rc.Mode = codecbase.C_Mode_Heat
 	default:
-		return
+		return &FieldError{"mode", mode, []string{"auto", "dry", "cool", "heat"}}
 	}
-	temp, fan, err := db.GetModeSettings(rc.Mode)
+	temp, fan, err := modeSettings.GetModeSettings(rc.Mode)
 	if err != nil {
-		return
+		return err
 	}
 	if rc.Powerful == codecbase.C_Powerful_Disabled && rc.Quiet == codecbase.C_Quiet_Disabled {
 		rc.FanSpeed = fan
 	}
 	rc.Temperature = temp
+	return nil
 }
 
-func SetPowerful(setting string, rc *codec.RcConfig) {
+func SetPowerful(modeSettings ModeSettingsProvider, setting string, rc *codec.RcConfig) error {
 	switch setting {
+	case "":
+		return nil
 	case "on", "yes", "enable", "enabled":
 		rc.Powerful = codecbase.C_Powerful_Enabled
 	case "off", "no", "disable", "disabled":
 		rc.Powerful = codecbase.C_Powerful_Disabled
 	default:
-		return
+		return &FieldError{"powerful", setting, onOffValues}
 	}
 	if rc.Powerful == codecbase.C_Powerful_Enabled {
 		rc.FanSpeed = codecbase.C_FanSpeed_Auto
 		rc.Quiet = codecbase.C_Quiet_Disabled
 	} else {
-		_, fan, err := db.GetModeSettings(rc.Mode)
+		_, fan, err := modeSettings.GetModeSettings(rc.Mode)
 		if err != nil {
-			return
+			return err
 		}
 		rc.FanSpeed = fan
 	}
+	return nil
 }
 
-func SetQuiet(setting string, rc *codec.RcConfig) {
+func SetQuiet(modeSettings ModeSettingsProvider, setting string, rc *codec.RcConfig) error {
 	switch setting {
+	case "":
+		return nil
 	case "on", "yes", "enable", "enabled":
 		rc.Quiet = codecbase.C_Quiet_Enabled
 	case "off", "no", "disable", "disabled":
 		rc.Quiet = codecbase.C_Quiet_Disabled
 	default:
-		return
+		return &FieldError{"quiet", setting, onOffValues}
 	}
 	if rc.Quiet == codecbase.C_Quiet_Enabled {
 		rc.FanSpeed = codecbase.C_FanSpeed_Lowest
 		rc.Powerful = codecbase.C_Powerful_Disabled
 	} else {
-		_, fan, err := db.GetModeSettings(rc.Mode)
+		_, fan, err := modeSettings.GetModeSettings(rc.Mode)
 		if err != nil {
-			return
+			return err
 		}
 		rc.FanSpeed = fan
 	}
+	return nil
 }
 
-func SetTemperature(temp string, rc *codec.RcConfig) {
+var temperatureValues = []string{fmt.Sprintf("%d..%d", codecbase.C_Temp_Min, codecbase.C_Temp_Max), "+N", "-N"}
+
+// Set the temperature. Besides absolute values, relative steps like "+1" or "-2" adjust the current temperature, like
+// the up and down buttons on the remote. The result is clamped to the allowed range.
+func SetTemperature(temp string, rc *codec.RcConfig) error {
 	if temp == "" {
-		return
+		return nil
 	}
-	if t, err := strconv.Atoi(temp); err == nil {
-		if codecbase.C_Temp_Min <= t && t <= codecbase.C_Temp_Max {
-			rc.Temperature = uint(t)
+	if temp[0] == '+' || temp[0] == '-' {
+		// the inverter only accepts whole degrees
+		step, err := strconv.Atoi(temp)
+		if err != nil {
+			return &FieldError{"temp", temp, temperatureValues}
 		}
-	} else {
-		slog.Warn("cannot convert temperature", "temp", temp, "err", err)
+		// limit the step before adding it, so that huge steps can't overflow
+		step = min(max(step, -codecbase.C_Temp_Max), codecbase.C_Temp_Max)
+		t := min(max(int(rc.Temperature)+step, codecbase.C_Temp_Min), codecbase.C_Temp_Max)
+		rc.Temperature = uint(t)
+		return nil
+	}
+	t, err := strconv.Atoi(temp)
+	if err != nil || t < codecbase.C_Temp_Min || t > codecbase.C_Temp_Max {
+		return &FieldError{"temp", temp, temperatureValues}
 	}
+	rc.Temperature = uint(t)
+	return nil
 }
 
-func SetFanSpeed(fan string, rc *codec.RcConfig) {
-	if rc.Powerful == codecbase.C_Powerful_Enabled || rc.Quiet == codecbase.C_Quiet_Enabled {
-		return
+// Return the value before or after current in values, wrapping around at the ends. If current is not found, the first
+// value is returned.
+func cycle(values []uint, current uint, direction string) uint {
+	i := slices.Index(values, current)
+	if i < 0 {
+		return values[0]
 	}
+	switch direction {
+	case "next":
+		i = (i + 1) % len(values)
+	case "prev":
+		i = (i + len(values) - 1) % len(values)
+	}
+	return values[i]
+}
+
+var fanSpeedValues = []string{"auto", "lowest", "low", "middle", "high", "highest", "next", "prev"}
+
+// the order in which the fan button on the remote cycles through the fan speeds
+var fanSpeedCycle = []uint{codecbase.C_FanSpeed_Auto, codecbase.C_FanSpeed_Lowest, codecbase.C_FanSpeed_Low,
+	codecbase.C_FanSpeed_Middle, codecbase.C_FanSpeed_High, codecbase.C_FanSpeed_Highest}
+
+func SetFanSpeed(fan string, rc *codec.RcConfig) error {
+	var fanSpeed uint
 	switch fan {
+	case "":
+		return nil
 	case "auto":
-		rc.FanSpeed = codecbase.C_FanSpeed_Auto
+		fanSpeed = codecbase.C_FanSpeed_Auto
 	case "lowest", "slowest":
-		rc.FanSpeed = codecbase.C_FanSpeed_Lowest
+		fanSpeed = codecbase.C_FanSpeed_Lowest
 	case "low", "slow":
-		rc.FanSpeed = codecbase.C_FanSpeed_Low
+		fanSpeed = codecbase.C_FanSpeed_Low
 	case "middle", "center":
-		rc.FanSpeed = codecbase.C_FanSpeed_Middle
+		fanSpeed = codecbase.C_FanSpeed_Middle
 	case "high", "fast":
-		rc.FanSpeed = codecbase.C_FanSpeed_High
+		fanSpeed = codecbase.C_FanSpeed_High
 	case "highest", "fastest":
-		rc.FanSpeed = codecbase.C_FanSpeed_Highest
+		fanSpeed = codecbase.C_FanSpeed_Highest
+	case "next", "prev":
+		fanSpeed = cycle(fanSpeedCycle, rc.FanSpeed, fan)
 	default:
-		return
+		return &FieldError{"fan", fan, fanSpeedValues}
 	}
+	// the fan speed is overridden while powerful or quiet is enabled
+	if rc.Powerful == codecbase.C_Powerful_Disabled && rc.Quiet == codecbase.C_Quiet_Disabled {
+		rc.FanSpeed = fanSpeed
+	}
+	return nil
 }
 
-func SetVentVerticalPosition(vert string, rc *codec.RcConfig) {
+var ventVerticalValues = []string{"auto", "lowest", "low", "middle", "high", "highest", "next", "prev"}
+
+// the order in which the vertical swing button on the remote cycles through the positions
+var ventVerticalCycle = []uint{codecbase.C_VentVertical_Auto, codecbase.C_VentVertical_Highest, codecbase.C_VentVertical_High,
+	codecbase.C_VentVertical_Middle, codecbase.C_VentVertical_Low, codecbase.C_VentVertical_Lowest}
+
+func SetVentVerticalPosition(vert string, rc *codec.RcConfig) error {
 	switch vert {
+	case "":
 	case "auto":
 		rc.VentVertical = codecbase.C_VentVertical_Auto
 	case "lowest", "bottom":
@@ -136,13 +225,23 @@ func SetVentVerticalPosition(vert string, rc *codec.RcConfig) {
 		rc.VentVertical = codecbase.C_VentVertical_High
 	case "highest", "top":
 		rc.VentVertical = codecbase.C_VentVertical_Highest
+	case "next", "prev":
+		rc.VentVertical = cycle(ventVerticalCycle, rc.VentVertical, vert)
 	default:
-		return
+		return &FieldError{"vert", vert, ventVerticalValues}
 	}
+	return nil
 }
 
-func SetVentHorizontalPosition(horiz string, rc *codec.RcConfig) {
+var ventHorizontalValues = []string{"auto", "farleft", "left", "middle", "right", "farright", "next", "prev"}
+
+// the order in which the horizontal swing button on the remote cycles through the positions
+var ventHorizontalCycle = []uint{codecbase.C_VentHorizontal_Auto, codecbase.C_VentHorizontal_FarLeft, codecbase.C_VentHorizontal_Left,
+	codecbase.C_VentHorizontal_Middle, codecbase.C_VentHorizontal_Right, codecbase.C_VentHorizontal_FarRight}
+
+func SetVentHorizontalPosition(horiz string, rc *codec.RcConfig) error {
 	switch horiz {
+	case "":
 	case "auto":
 		rc.VentHorizontal = codecbase.C_VentHorizontal_Auto
 	case "farleft", "leftmost":
@@ -155,9 +254,12 @@ func SetVentHorizontalPosition(horiz string, rc *codec.RcConfig) {
 		rc.VentHorizontal = codecbase.C_VentHorizontal_Right
 	case "farright", "rightmost":
 		rc.VentHorizontal = codecbase.C_VentHorizontal_FarRight
+	case "next", "prev":
+		rc.VentHorizontal = cycle(ventHorizontalCycle, rc.VentHorizontal, horiz)
 	default:
-		return
+		return &FieldError{"horiz", horiz, ventHorizontalValues}
 	}
+	return nil
 }
 
 // Timers
@@ -184,6 +286,25 @@ func parseTime(time string) (hour, minute int, err error) {
 	return hour, minute, nil
 }
 
+// Parse the time of a one-time job, either a local date and time, e.g. "2024-05-17 16:30", or a time of day, e.g.
+// "16:30", which is the next time the clock shows that time.
+func ParseAt(at string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, at, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	hour, minute, err := parseTime(at)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expecting e.g. \"2024-05-17 16:30\" or \"16:30\"", at)
+	}
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !t.After(now) {
+		t = time.Date(now.Year(), now.Month(), now.Day()+1, hour, minute, 0, 0, now.Location())
+	}
+	return t, nil
+}
+
 func setTimes(rc, dbRc *codec.RcConfig) {
 	// copy saved times if unset
 	if rc.TimerOnTime == codecbase.C_Time_Unset {
@@ -196,8 +317,9 @@ func setTimes(rc, dbRc *codec.RcConfig) {
 	rc.SetClock()
 }
 
-func SetTimerOn(setting string, rc, dbRc *codec.RcConfig) {
+func SetTimerOn(setting string, rc, dbRc *codec.RcConfig) error {
 	switch setting {
+	case "":
 	case "on":
 		rc.TimerOn = codecbase.C_Timer_Enabled
 		setTimes(rc, dbRc)
@@ -205,12 +327,14 @@ func SetTimerOn(setting string, rc, dbRc *codec.RcConfig) {
 		rc.TimerOn = codecbase.C_Timer_Disabled
 		setTimes(rc, dbRc)
 	default:
-		return
+		return &FieldError{"ton", setting, onOffValues}
 	}
+	return nil
 }
 
-func SetTimerOff(setting string, rc, dbRc *codec.RcConfig) {
+func SetTimerOff(setting string, rc, dbRc *codec.RcConfig) error {
 	switch setting {
+	case "":
 	case "on":
 		rc.TimerOff = codecbase.C_Timer_Enabled
 		setTimes(rc, dbRc)
@@ -218,50 +342,74 @@ func SetTimerOff(setting string, rc, dbRc *codec.RcConfig) {
 		rc.TimerOff = codecbase.C_Timer_Disabled
 		setTimes(rc, dbRc)
 	default:
-		return
+		return &FieldError{"toff", setting, onOffValues}
 	}
+	return nil
 }
 
-func SetTimerOnTime(time string, rc, dbRc *codec.RcConfig) {
+var timeValues = []string{"00:00..23:59"}
+
+func SetTimerOnTime(time string, rc, dbRc *codec.RcConfig) error {
 	if time == "" {
-		return
+		return nil
 	}
 	hour, minute, err := parseTime(time)
 	if err != nil {
-		return
+		return &FieldError{"tont", time, timeValues}
 	}
 	rc.TimerOnTime = codec.NewTime(uint(hour), uint(minute))
 	setTimes(rc, dbRc)
+	return nil
 }
 
-func SetTimerOffTime(time string, rc, dbRc *codec.RcConfig) {
+func SetTimerOffTime(time string, rc, dbRc *codec.RcConfig) error {
 	if time == "" {
-		return
+		return nil
 	}
 	hour, minute, err := parseTime(time)
 	if err != nil {
-		return
+		return &FieldError{"tofft", time, timeValues}
 	}
 	rc.TimerOffTime = codec.NewTime(uint(hour), uint(minute))
 	setTimes(rc, dbRc)
+	return nil
 }
 
-func ComposeSendConfig(settings *codecbase.Settings, dbRc *codec.RcConfig) *codec.RcConfig {
+// Compose the config to send by applying the settings to a copy of the current config. When the mode is changed, the
+// temperature and fan speed of the new mode are taken from modeSettings. All settings are checked, and if any of them
+// are rejected a *SettingsError listing them is returned.
+func ComposeSendConfig(modeSettings ModeSettingsProvider, settings *codecbase.Settings, dbRc *codec.RcConfig) (*codec.RcConfig, error) {
 	sendRc := dbRc.CopyForSending()
-	SetPower(settings.Power, sendRc)
-	SetMode(settings.Mode, sendRc)
-	SetPowerful(settings.Powerful, sendRc)
-	SetQuiet(settings.Quiet, sendRc)
-	SetTemperature(settings.Temperature, sendRc)
-	SetFanSpeed(settings.FanSpeed, sendRc)
-	SetVentVerticalPosition(settings.VentVertical, sendRc)
-	SetVentHorizontalPosition(settings.VentHorizontal, sendRc)
-
-	// if timers are changed in any way, time fields are initialized
-	SetTimerOn(settings.TimerOn, sendRc, dbRc)
-	SetTimerOnTime(settings.TimerOnTime, sendRc, dbRc)
-	SetTimerOff(settings.TimerOff, sendRc, dbRc)
-	SetTimerOffTime(settings.TimerOffTime, sendRc, dbRc)
-
-	return sendRc
+
+	errs := []error{
+		SetPower(settings.Power, sendRc),
+		SetMode(modeSettings, settings.Mode, sendRc),
+		SetPowerful(modeSettings, settings.Powerful, sendRc),
+		SetQuiet(modeSettings, settings.Quiet, sendRc),
+		SetTemperature(settings.Temperature, sendRc),
+		SetFanSpeed(settings.FanSpeed, sendRc),
+		SetVentVerticalPosition(settings.VentVertical, sendRc),
+		SetVentHorizontalPosition(settings.VentHorizontal, sendRc),
+
+		// if timers are changed in any way, time fields are initialized
+		SetTimerOn(settings.TimerOn, sendRc, dbRc),
+		SetTimerOnTime(settings.TimerOnTime, sendRc, dbRc),
+		SetTimerOff(settings.TimerOff, sendRc, dbRc),
+		SetTimerOffTime(settings.TimerOffTime, sendRc, dbRc),
+	}
+
+	var settingsErr SettingsError
+	for _, err := range errs {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			settingsErr.Fields = append(settingsErr.Fields, fieldErr)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if settingsErr.Fields != nil {
+		return nil, &settingsErr
+	}
+
+	return sendRc, nil
 }
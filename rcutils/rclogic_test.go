@@ -0,0 +1,322 @@
+package rcutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+)
+
+func testModeSettings() MemModeSettings {
+	ms := NewMemModeSettings()
+	ms[codecbase.C_Mode_Heat] = ModeSetting{22, codecbase.C_FanSpeed_Low}
+	ms[codecbase.C_Mode_Cool] = ModeSetting{24, codecbase.C_FanSpeed_High}
+	return ms
+}
+
+func TestComposeSendConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   func(rc *codec.RcConfig) // changes to the default config
+		settings  codecbase.Settings
+		want      func(rc *codec.RcConfig) // expected changes to the current config
+		setsClock bool
+	}{
+		{
+			name:    "no settings",
+			current: func(rc *codec.RcConfig) { rc.Mode = codecbase.C_Mode_Heat },
+			want:    func(rc *codec.RcConfig) {},
+		},
+		{
+			name:     "mode switch restores temperature and fan speed",
+			settings: codecbase.Settings{Mode: "heat"},
+			want: func(rc *codec.RcConfig) {
+				rc.Mode = codecbase.C_Mode_Heat
+				rc.Temperature = 22
+				rc.FanSpeed = codecbase.C_FanSpeed_Low
+			},
+		},
+		{
+			name:     "mode switch with temperature",
+			settings: codecbase.Settings{Mode: "cool", Temperature: "19"},
+			want: func(rc *codec.RcConfig) {
+				rc.Mode = codecbase.C_Mode_Cool
+				rc.Temperature = 19
+				rc.FanSpeed = codecbase.C_FanSpeed_High
+			},
+		},
+		{
+			name:     "mode switch keeps fan speed while powerful",
+			current:  func(rc *codec.RcConfig) { rc.Powerful = codecbase.C_Powerful_Enabled },
+			settings: codecbase.Settings{Mode: "heat"},
+			want: func(rc *codec.RcConfig) {
+				rc.Mode = codecbase.C_Mode_Heat
+				rc.Temperature = 22
+			},
+		},
+		{
+			name:     "powerful overrides fan speed",
+			current:  func(rc *codec.RcConfig) { rc.FanSpeed = codecbase.C_FanSpeed_High },
+			settings: codecbase.Settings{Powerful: "on"},
+			want: func(rc *codec.RcConfig) {
+				rc.Powerful = codecbase.C_Powerful_Enabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Auto
+			},
+		},
+		{
+			name: "powerful disables quiet",
+			current: func(rc *codec.RcConfig) {
+				rc.Quiet = codecbase.C_Quiet_Enabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Lowest
+			},
+			settings: codecbase.Settings{Powerful: "on"},
+			want: func(rc *codec.RcConfig) {
+				rc.Powerful = codecbase.C_Powerful_Enabled
+				rc.Quiet = codecbase.C_Quiet_Disabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Auto
+			},
+		},
+		{
+			name:     "quiet overrides fan speed",
+			settings: codecbase.Settings{Quiet: "on", FanSpeed: "high"},
+			want: func(rc *codec.RcConfig) {
+				rc.Quiet = codecbase.C_Quiet_Enabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Lowest
+			},
+		},
+		{
+			name: "quiet off restores fan speed of mode",
+			current: func(rc *codec.RcConfig) {
+				rc.Mode = codecbase.C_Mode_Heat
+				rc.Quiet = codecbase.C_Quiet_Enabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Lowest
+			},
+			settings: codecbase.Settings{Quiet: "off"},
+			want: func(rc *codec.RcConfig) {
+				rc.Quiet = codecbase.C_Quiet_Disabled
+				rc.FanSpeed = codecbase.C_FanSpeed_Low
+			},
+		},
+		{
+			name:     "relative temperature is clamped",
+			current:  func(rc *codec.RcConfig) { rc.Temperature = 29 },
+			settings: codecbase.Settings{Temperature: "+3", FanSpeed: "next"},
+			want: func(rc *codec.RcConfig) {
+				rc.Temperature = codecbase.C_Temp_Max
+				rc.FanSpeed = codecbase.C_FanSpeed_Lowest
+			},
+		},
+		{
+			name: "times are unset when timers are unchanged",
+			current: func(rc *codec.RcConfig) {
+				rc.TimerOn = codecbase.C_Timer_Enabled
+				rc.TimerOnTime = codec.NewTime(6, 0)
+				rc.TimerOffTime = codec.NewTime(22, 0)
+			},
+			settings: codecbase.Settings{Temperature: "21"},
+			want:     func(rc *codec.RcConfig) { rc.Temperature = 21 },
+		},
+		{
+			name:     "timer on time keeps saved timer off time",
+			current:  func(rc *codec.RcConfig) { rc.TimerOffTime = codec.NewTime(22, 0) },
+			settings: codecbase.Settings{TimerOn: "on", TimerOnTime: "06:30"},
+			want: func(rc *codec.RcConfig) {
+				rc.TimerOn = codecbase.C_Timer_Enabled
+				rc.TimerOnTime = codec.NewTime(6, 30)
+				rc.TimerOffTime = codec.NewTime(22, 0)
+			},
+			setsClock: true,
+		},
+		{
+			name: "timer off uses saved times",
+			current: func(rc *codec.RcConfig) {
+				rc.TimerOnTime = codec.NewTime(6, 0)
+				rc.TimerOffTime = codec.NewTime(22, 0)
+			},
+			settings: codecbase.Settings{TimerOff: "on"},
+			want: func(rc *codec.RcConfig) {
+				rc.TimerOff = codecbase.C_Timer_Enabled
+				rc.TimerOnTime = codec.NewTime(6, 0)
+				rc.TimerOffTime = codec.NewTime(22, 0)
+			},
+			setsClock: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbRc := codec.NewRcConfig()
+			if tt.current != nil {
+				tt.current(dbRc)
+			}
+			want := dbRc.CopyForSending()
+			tt.want(want)
+
+			got, err := ComposeSendConfig(testModeSettings(), &tt.settings, dbRc)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.setsClock {
+				if got.Clock == codecbase.C_Time_Unset {
+					t.Errorf("clock was not set")
+				}
+				want.Clock = got.Clock
+			}
+			if *got != *want {
+				t.Errorf("got  %+v\nwant %+v", *got, *want)
+			}
+		})
+	}
+}
+
+func TestComposeSendConfigErrors(t *testing.T) {
+	settings := codecbase.Settings{Mode: "warm", Temperature: "35", FanSpeed: "high", TimerOnTime: "25:00"}
+	_, err := ComposeSendConfig(testModeSettings(), &settings, codec.NewRcConfig())
+
+	var settingsErr *SettingsError
+	if !errors.As(err, &settingsErr) {
+		t.Fatalf("expected a SettingsError, got %v", err)
+	}
+	var fields []string
+	for _, f := range settingsErr.Fields {
+		fields = append(fields, f.Field)
+	}
+	if len(fields) != 3 || fields[0] != "mode" || fields[1] != "temp" || fields[2] != "tont" {
+		t.Errorf("rejected fields %v, want [mode temp tont]", fields)
+	}
+
+	// errors from the provider are returned as they are
+	_, err = ComposeSendConfig(MemModeSettings{}, &codecbase.Settings{Mode: "heat"}, codec.NewRcConfig())
+	if err == nil || errors.As(err, &settingsErr) {
+		t.Errorf("expected a provider error, got %v", err)
+	}
+}
+
+func TestSetTemperature(t *testing.T) {
+	for _, tt := range []struct {
+		current uint
+		temp    string
+		want    uint
+	}{
+		{20, "+1", 21},
+		{20, "-2", 18},
+		{20, "-0", 20},
+		{28, "+5", codecbase.C_Temp_Max},
+		{18, "-5", codecbase.C_Temp_Min},
+		{20, "+9223372036854775807", codecbase.C_Temp_Max},
+		{20, "-9223372036854775808", codecbase.C_Temp_Min},
+		{20, "25", 25},
+	} {
+		rc := codec.NewRcConfig()
+		rc.Temperature = tt.current
+		if err := SetTemperature(tt.temp, rc); err != nil || rc.Temperature != tt.want {
+			t.Errorf("SetTemperature(%q) from %d = %d, %v, want %d", tt.temp, tt.current, rc.Temperature, err, tt.want)
+		}
+	}
+	for _, temp := range []string{"+1.5", "+1.0", "+Inf", "-Inf", "+NaN", "+1e300", "+0x1p4", "+", "+99999999999999999999", "35"} {
+		var fieldErr *FieldError
+		if err := SetTemperature(temp, codec.NewRcConfig()); !errors.As(err, &fieldErr) {
+			t.Errorf("SetTemperature(%q): expected a FieldError, got %v", temp, err)
+		}
+	}
+}
+
+func TestCycling(t *testing.T) {
+	rc := codec.NewRcConfig()
+	rc.FanSpeed = codecbase.C_FanSpeed_Highest
+	SetFanSpeed("next", rc)
+	if rc.FanSpeed != codecbase.C_FanSpeed_Auto {
+		t.Errorf("fan next from highest: %d", rc.FanSpeed)
+	}
+	SetFanSpeed("prev", rc)
+	if rc.FanSpeed != codecbase.C_FanSpeed_Highest {
+		t.Errorf("fan prev from auto: %d", rc.FanSpeed)
+	}
+	SetFanSpeed("prev", rc)
+	if rc.FanSpeed != codecbase.C_FanSpeed_High {
+		t.Errorf("fan prev from highest: %d", rc.FanSpeed)
+	}
+
+	rc.VentVertical = codecbase.C_VentVertical_Auto
+	SetVentVerticalPosition("next", rc)
+	if rc.VentVertical != codecbase.C_VentVertical_Highest {
+		t.Errorf("vert next from auto: %d", rc.VentVertical)
+	}
+	SetVentVerticalPosition("prev", rc)
+	SetVentVerticalPosition("prev", rc)
+	if rc.VentVertical != codecbase.C_VentVertical_Lowest {
+		t.Errorf("vert prev twice from highest: %d", rc.VentVertical)
+	}
+
+	rc.VentHorizontal = codecbase.C_VentHorizontal_FarRight
+	SetVentHorizontalPosition("next", rc)
+	if rc.VentHorizontal != codecbase.C_VentHorizontal_Auto {
+		t.Errorf("horiz next from far right: %d", rc.VentHorizontal)
+	}
+	SetVentHorizontalPosition("next", rc)
+	if rc.VentHorizontal != codecbase.C_VentHorizontal_FarLeft {
+		t.Errorf("horiz next from auto: %d", rc.VentHorizontal)
+	}
+	SetVentHorizontalPosition("prev", rc)
+	if rc.VentHorizontal != codecbase.C_VentHorizontal_Auto {
+		t.Errorf("horiz prev from far left: %d", rc.VentHorizontal)
+	}
+
+	// the fan speed doesn't change while quiet is enabled
+	rc.Quiet, rc.FanSpeed = codecbase.C_Quiet_Enabled, codecbase.C_FanSpeed_Lowest
+	SetFanSpeed("next", rc)
+	if rc.FanSpeed != codecbase.C_FanSpeed_Lowest {
+		t.Errorf("fan changed while quiet: %d", rc.FanSpeed)
+	}
+}
+
+func TestParseAt(t *testing.T) {
+	now := time.Date(2024, 5, 17, 12, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		at   string
+		want time.Time
+	}{
+		{"2024-05-20 16:30", time.Date(2024, 5, 20, 16, 30, 0, 0, time.Local)},
+		{"2024-05-20T07:05", time.Date(2024, 5, 20, 7, 5, 0, 0, time.Local)},
+		{"16:30", time.Date(2024, 5, 17, 16, 30, 0, 0, time.Local)},
+		{"12:00", time.Date(2024, 5, 18, 12, 0, 0, 0, time.Local)},
+		{"06:00", time.Date(2024, 5, 18, 6, 0, 0, 0, time.Local)},
+	} {
+		got, err := ParseAt(tt.at, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("ParseAt(%q) = %v, %v, want %v", tt.at, got, err, tt.want)
+		}
+	}
+	for _, at := range []string{"", "tomorrow", "24:00", "2024-05-20"} {
+		if _, err := ParseAt(at, now); err == nil {
+			t.Errorf("ParseAt(%q) succeeded", at)
+		}
+	}
+}
+
+func TestSavedConfig(t *testing.T) {
+	current := codec.NewRcConfig()
+	current.TimerOnTime, current.TimerOffTime = 7*60, 22*60
+	rc := *current
+	rc.Mode, rc.Temperature, rc.FanSpeed = codecbase.C_Mode_Heat, 23, codecbase.C_FanSpeed_High
+	rc.TimerOnTime, rc.TimerOffTime = codecbase.C_Time_Unset, 23*60
+
+	saved := SavedConfig(&rc, current)
+	if saved.TimerOnTime != 7*60 || saved.TimerOffTime != 23*60 || saved.Temperature != 23 {
+		t.Errorf("unexpected saved config %+v", saved)
+	}
+
+	ms := testModeSettings()
+	ms.Update(saved)
+	if ms[codecbase.C_Mode_Heat] != (ModeSetting{23, codecbase.C_FanSpeed_High}) {
+		t.Errorf("unexpected heat settings %+v", ms[codecbase.C_Mode_Heat])
+	}
+	// the fan speed isn't remembered while quiet overrides it
+	saved.Quiet, saved.FanSpeed, saved.Temperature = codecbase.C_Quiet_Enabled, codecbase.C_FanSpeed_Lowest, 21
+	ms.Update(saved)
+	if ms[codecbase.C_Mode_Heat] != (ModeSetting{21, codecbase.C_FanSpeed_High}) {
+		t.Errorf("unexpected heat settings %+v", ms[codecbase.C_Mode_Heat])
+	}
+}
@@ -0,0 +1,178 @@
+package sched
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/calendar"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+const activationJobCategory = "activation"
+
+// The activation of a job set is evaluated at least this often, so that changes to the calendar file are picked up.
+const ACTIVATION_INTERVAL = time.Hour
+
+// The state of each job set with an activation when it was last evaluated, keyed by unit/jobset.
+var activationStatus = make(map[string]*calendar.Status)
+
+// Held while activations are evaluated and their jobs replaced, and while activationStatus is accessed.
+var activationMutex sync.Mutex
+
+func activationTag(unit, jobset string) string {
+	return fmt.Sprintf("%s/%s/%s", activationJobCategory, unit, jobset)
+}
+
+// Return the activation of a job set, or nil if the job set is activated manually.
+func JobSetActivation(js *db.JobSet) (*calendar.Activation, error) {
+	if len(js.Activation) == 0 {
+		return nil, nil
+	}
+	var a calendar.Activation
+	if err := json.Unmarshal(js.Activation, &a); err != nil {
+		return nil, fmt.Errorf("job set %s: invalid activation: %w", js.Name, err)
+	}
+	return &a, nil
+}
+
+// Return the state of a job set with an activation when it was last evaluated, or nil if it is activated manually.
+func ActivationStatus(unit, jobset string) *calendar.Status {
+	activationMutex.Lock()
+	defer activationMutex.Unlock()
+	return activationStatus[unit+"/"+jobset]
+}
+
+// activationMutex must be held.
+func setActivationStatus(unit, jobset string, status *calendar.Status) {
+	if status == nil {
+		delete(activationStatus, unit+"/"+jobset)
+	} else {
+		activationStatus[unit+"/"+jobset] = status
+	}
+}
+
+func RunActivationJob(unit, jobset, jobName string) {
+	slog.Debug("running activation job", "unit", unit, "jobset", jobset, "jobName", jobName)
+	updateActivation(unit, jobset, true)
+}
+
+// Evaluate the activation of a job set, activate or deactivate the job set in the store, and schedule the next
+// evaluation at the next boundary of its events and ranges. If reschedule is true, the settings jobs of the job set are
+// rescheduled when its state changes. Nothing is done for job sets without an activation.
+func updateActivation(unit, jobset string, reschedule bool) {
+	activationMutex.Lock()
+	defer activationMutex.Unlock()
+	scheduler.RemoveByTags(activationTag(unit, jobset))
+
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		slog.Error("failed to get jobsets", "unit", unit, "err", err)
+		return
+	}
+	i := slices.IndexFunc(*jss, func(js db.JobSet) bool { return js.Name == jobset })
+	if i < 0 {
+		setActivationStatus(unit, jobset, nil)
+		return
+	}
+	js := &(*jss)[i]
+	a, err := JobSetActivation(js)
+	if a == nil || err != nil {
+		if err != nil {
+			slog.Error("failed to evaluate jobset activation", "unit", unit, "jobset", jobset, "err", err)
+		}
+		setActivationStatus(unit, jobset, nil)
+		return
+	}
+
+	now := time.Now()
+	status, err := a.Evaluate(now)
+	if err != nil {
+		// keep the job set as it is, and try again later
+		slog.Error("failed to evaluate jobset activation", "unit", unit, "jobset", jobset, "err", err)
+		status = &calendar.Status{Active: js.Active, Reason: "error: " + err.Error()}
+	} else if status.Active != js.Active {
+		if err := g_store.UpdateJobSet(unit, jobset, status.Active); err != nil {
+			slog.Error("failed to update jobset", "unit", unit, "jobset", jobset, "err", err)
+			return
+		}
+		slog.Info("changed jobset activation", "unit", unit, "jobset", jobset, "active", status.Active, "reason", status.Reason)
+		if reschedule {
+			ScheduleJobsForJobset(unit, jobset, status.Active)
+		}
+	}
+	setActivationStatus(unit, jobset, status)
+
+	next := now.Add(ACTIVATION_INTERVAL)
+	if !status.Until.IsZero() && status.Until.Before(next) {
+		next = status.Until
+	}
+	// one-time jobs can't start in the past
+	if next.Before(now.Add(time.Second)) {
+		next = now.Add(time.Second)
+	}
+	name := fmt.Sprintf("%s/%s_activation", unit, jobset)
+	_, err = scheduler.NewJob(
+		gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(next)),
+		gocron.NewTask(
+			RunActivationJob,
+			unit,
+			jobset,
+			name,
+		),
+		gocron.WithName(name),
+		gocron.WithTags(activationJobCategory, unit, activationTag(unit, jobset)),
+	)
+	if err != nil {
+		slog.Error("failed to schedule activation job", "jobName", name, "err", err)
+		return
+	}
+	slog.Debug("scheduled activation job", "jobName", name, "at", next)
+}
+
+// Evaluate the activations of the job sets of a unit, replacing the activation jobs already scheduled. The settings
+// jobs are not rescheduled.
+func createActivationJobs(unit string) {
+	for _, j := range scheduler.Jobs() {
+		if tags := j.Tags(); len(tags) == 3 && tags[0] == activationJobCategory && tags[1] == unit {
+			scheduler.RemoveJob(j.ID())
+		}
+	}
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		slog.Error("failed to get jobsets", "unit", unit, "err", err)
+		return
+	}
+	for _, js := range *jss {
+		updateActivation(unit, js.Name, false)
+	}
+}
+
+// Set the activation of a job set, or remove it if a is nil so that the job set is activated manually again. The job
+// set is activated or deactivated at once according to the activation.
+func SetJobSetActivation(unit, jobset string, a *calendar.Activation) error {
+	var b []byte
+	if a != nil {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+		// check that the calendar can be read
+		if _, err := a.Evaluate(time.Now()); err != nil {
+			return err
+		}
+		var err error
+		if b, err = json.Marshal(a); err != nil {
+			return err
+		}
+	}
+	if err := g_store.SetJobSetActivation(unit, jobset, b); err != nil {
+		return err
+	}
+	updateActivation(unit, jobset, true)
+	return nil
+}
@@ -0,0 +1,120 @@
+package sched
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/calendar"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func jobSetActive(t *testing.T, store db.Store, name string) bool {
+	jss, _ := store.GetJobSets(db.DefaultUnit)
+	for _, js := range *jss {
+		if js.Name == name {
+			return js.Active
+		}
+	}
+	t.Fatalf("job set %s not found", name)
+	return false
+}
+
+func TestActivation(t *testing.T) {
+	now := time.Now()
+	today := now.Format("2006-01-02")
+	vacation := fmt.Sprintf(`{"ranges": [{"name": "Vacation", "start": "%s", "end": "%s"}]}`, today, today)
+	normal := fmt.Sprintf(`{"ranges": [{"name": "Vacation", "start": "%s", "end": "%s"}], "invert": true}`, today, today)
+
+	store := db.NewMemStore()
+	store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	store.SetJobSetActivation(db.DefaultUnit, "Normal", []byte(normal))
+	store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Temperature: "22"}, nil)
+	store.SaveJobSet(db.DefaultUnit, "Vacation", false)
+	store.SetJobSetActivation(db.DefaultUnit, "Vacation", []byte(vacation))
+	store.SaveCronJob(db.DefaultUnit, "Vacation", "0 7 * * *", "", &codecbase.Settings{Temperature: "16"}, nil)
+
+	startTestScheduler(t, store)
+
+	// the vacation lasts all day
+	if jobSetActive(t, store, "Normal") || !jobSetActive(t, store, "Vacation") {
+		t.Errorf("job sets were not activated by their ranges")
+	}
+	if jobs := settingsJobs(); len(jobs) != 1 || !strings.HasPrefix(jobs[0], "default/Vacation_") {
+		t.Errorf("unexpected jobs %v", jobs)
+	}
+	tomorrow, _ := time.ParseInLocation("2006-01-02", now.AddDate(0, 0, 1).Format("2006-01-02"), time.Local)
+	status := ActivationStatus(db.DefaultUnit, "Vacation")
+	if status == nil || !status.Until.Equal(tomorrow) || !strings.HasPrefix(status.Reason, `during "Vacation"`) {
+		t.Errorf("unexpected status %+v", status)
+	}
+	for _, j := range scheduler.Jobs() {
+		if j.Name() == "default/Vacation_activation" {
+			if next, _ := j.NextRun(); next.Sub(now) > ACTIVATION_INTERVAL+time.Second || next.After(tomorrow) {
+				t.Errorf("activation is evaluated at %v", next)
+			}
+		}
+	}
+
+	// the vacation is moved to the past, and the job sets change when the activation is evaluated
+	past := &calendar.Activation{Ranges: []calendar.Range{{Name: "Vacation", Start: "2024-07-01", End: "2024-07-14"}}}
+	if err := SetJobSetActivation(db.DefaultUnit, "Vacation", past); err != nil {
+		t.Fatal(err)
+	}
+	store.SetJobSetActivation(db.DefaultUnit, "Normal", []byte(`{"ranges": [{"start": "2024-07-01", "end": "2024-07-14"}], "invert": true}`))
+	RunActivationJob(db.DefaultUnit, "Normal", "default/Normal_activation")
+	if !jobSetActive(t, store, "Normal") || jobSetActive(t, store, "Vacation") {
+		t.Errorf("job sets were not changed")
+	}
+	if jobs := settingsJobs(); len(jobs) != 1 || !strings.HasPrefix(jobs[0], "default/Normal_") {
+		t.Errorf("unexpected jobs %v", jobs)
+	}
+
+	// without an activation, the job set is left as it is
+	if err := SetJobSetActivation(db.DefaultUnit, "Vacation", nil); err != nil {
+		t.Fatal(err)
+	}
+	if ActivationStatus(db.DefaultUnit, "Vacation") != nil {
+		t.Errorf("status of manual job set")
+	}
+	for _, j := range scheduler.Jobs() {
+		if j.Name() == "default/Vacation_activation" {
+			t.Errorf("activation job of manual job set")
+		}
+	}
+}
+
+func TestLoadJobsFileActivation(t *testing.T) {
+	store := db.NewMemStore()
+	jobs := `{
+  "Vacation": {
+    "activation": { "ranges": [ { "start": "2024-07-01", "end": "2024-07-14" } ] },
+    "cronjobs": []
+  }
+}`
+	diff, err := LoadJobsFile(store, writeJobsFile(t, jobs), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `+ default/Vacation (inactive)
+    activation {"ranges":[{"start":"2024-07-01","end":"2024-07-14"}]}
+`
+	if diff.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", diff, want)
+	}
+	if diff, _ = LoadJobsFile(store, writeJobsFile(t, jobs), false); len(diff) != 0 {
+		t.Errorf("expected no changes, got %v", diff)
+	}
+
+	// the activation decides if the job set is active
+	invalid := strings.Replace(jobs, `"cronjobs"`, `"active": true, "cronjobs"`, 1)
+	if _, err := LoadJobsFile(store, writeJobsFile(t, invalid), false); err == nil || !strings.Contains(err.Error(), "jobs.json:2: job set Vacation") {
+		t.Errorf("unexpected error %v", err)
+	}
+	invalid = strings.Replace(jobs, `"2024-07-14"`, `"tomorrow"`, 1)
+	if _, err := LoadJobsFile(store, writeJobsFile(t, invalid), false); err == nil {
+		t.Errorf("invalid range was accepted")
+	}
+}
@@ -0,0 +1,118 @@
+package sched
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+const catchUpJobCategory = "catchup"
+
+// Cron jobs that were missed longer ago than this, e.g. because the controller was stopped for a long time, are not
+// caught up at startup.
+const MAX_CATCH_UP_PERIOD = 7 * 24 * time.Hour
+
+// The most recent run of a cron job that was missed while the controller wasn't running.
+type missedRun struct {
+	jobset   string
+	cronJob  db.CronJob
+	settings codecbase.Settings
+	ramp     *db.Ramp
+	at       time.Time
+	name     string
+}
+
+// Return the most recent missed run of each cron job of the active job sets of a unit, ordered by time. A run is
+// missed if it should have run after the last run of the job and before now. Job sets that skip missed jobs are left
+// out.
+func missedRuns(unit string, now time.Time) ([]missedRun, error) {
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		return nil, err
+	}
+	var missed []missedRun
+	for _, js := range *jss {
+		if !js.Active || js.SkipMissed {
+			continue
+		}
+		cjs, err := g_store.GetCronJobs(unit, js.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, cj := range *cjs {
+			// a job that has never run is caught up from when it was created
+			since := cj.LastRun
+			if since.IsZero() {
+				since = cj.CreatedAt
+			}
+			if oldest := now.Add(-MAX_CATCH_UP_PERIOD); since.Before(oldest) {
+				since = oldest
+			}
+			times, err := scheduleTimes(cj.Schedule, since, now)
+			if err != nil {
+				slog.Warn("failed to check cronjob for missed runs", "unit", unit, "jobset", js.Name, "schedule", cj.Schedule, "err", err)
+				continue
+			}
+			if len(times) == 0 {
+				continue
+			}
+			run := missedRun{jobset: js.Name, cronJob: cj, at: times[len(times)-1],
+				name: fmt.Sprintf("%s/%s_%d %s", unit, js.Name, cj.ID, cj.Schedule)}
+			if err := json.Unmarshal(cj.Settings, &run.settings); err != nil {
+				slog.Error("failed to unmarshal json", "jobName", run.name, "err", err)
+				continue
+			}
+			if run.ramp, err = cronJobRamp(&cj); err != nil {
+				slog.Error("failed to unmarshal json", "jobName", run.name, "err", err)
+				continue
+			}
+			missed = append(missed, run)
+		}
+	}
+	slices.SortStableFunc(missed, func(a, b missedRun) int { return a.at.Compare(b.at) })
+	return missed, nil
+}
+
+// Run the cron jobs of a unit that were missed while the controller wasn't running, e.g. during a power outage, so that
+// the unit gets the settings it would have had. The most recent missed run of each job is run, in the order they should
+// have run, and is recorded as the last run of the job. Jobs that would have been suppressed by a job set with a higher
+// priority are still suppressed.
+func RunCatchUpJob(unit string, now time.Time) {
+	missed, err := missedRuns(unit, now)
+	if err != nil {
+		slog.Error("RunCatchUpJob: failed to get missed jobs", "unit", unit, "err", err)
+		return
+	}
+	slog.Info("running catch-up job", "unit", unit, "missedJobs", len(missed))
+	for _, run := range missed {
+		slog.Warn("running missed settings job", "jobName", run.name, "at", run.at)
+		// each missed run is recorded as a run of its own job
+		startRun(run.name)
+		err := runCronJobAt(unit, run.jobset, run.cronJob.ID, run.settings, run.cronJob.Preset, run.ramp, run.name, run.at, run.at)
+		finishRun(run.name, err)
+	}
+}
+
+func scheduleCatchUpJob(unit string, now time.Time) {
+	name := fmt.Sprintf("%s/catchup", unit)
+	_, err := scheduler.NewJob(
+		gocron.OneTimeJob(gocron.OneTimeJobStartImmediately()),
+		gocron.NewTask(
+			RunCatchUpJob,
+			unit,
+			now,
+		),
+		gocron.WithName(name),
+		gocron.WithTags(catchUpJobCategory, unit),
+	)
+	if err != nil {
+		slog.Error("failed to schedule catch-up job", "jobName", name, "err", err)
+	}
+}
@@ -0,0 +1,98 @@
+package sched
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestCatchUp(t *testing.T) {
+	now := time.Now()
+	daily := func(t time.Time) string { return fmt.Sprintf("%d %d * * *", t.Minute(), t.Hour()) }
+
+	store := db.NewMemStore()
+	store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	store.SaveCronJob(db.DefaultUnit, "Normal", daily(now.Add(-2*time.Hour)), "", &codecbase.Settings{Power: "on", Mode: "heat", Temperature: "22"}, nil)
+	store.SaveCronJob(db.DefaultUnit, "Normal", daily(now.Add(-time.Hour)), "", &codecbase.Settings{Power: "on", Mode: "heat", Temperature: "23"}, nil)
+	store.SaveCronJob(db.DefaultUnit, "Normal", daily(now.Add(-30*time.Minute)), "", &codecbase.Settings{Temperature: "24"}, nil)
+	store.SaveJobSet(db.DefaultUnit, "Away", true)
+	store.SetJobSetPriority(db.DefaultUnit, "Away", 10)
+	store.SetJobSetSkipMissed(db.DefaultUnit, "Away", true)
+	store.SaveCronJob(db.DefaultUnit, "Away", daily(now.Add(-28*time.Minute)), "", &codecbase.Settings{Temperature: "16"}, nil)
+	store.SaveJobSet(db.DefaultUnit, "Inactive", false)
+	store.SaveCronJob(db.DefaultUnit, "Inactive", daily(now.Add(-90*time.Minute)), "", &codecbase.Settings{Temperature: "30"}, nil)
+
+	// the controller was stopped three days ago, except that the first job has never run
+	for _, js := range []string{"Normal", "Away", "Inactive"} {
+		cjs, _ := store.GetCronJobs(db.DefaultUnit, js)
+		for i, cj := range *cjs {
+			if js == "Normal" && i == 0 {
+				continue
+			}
+			store.SetCronJobLastRun(cj.ID, now.Add(-72*time.Hour))
+		}
+	}
+	g_store = store
+	missed, err := missedRuns(db.DefaultUnit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job that has never run was created now
+	if len(missed) != 2 || missed[0].settings.Temperature != "23" || missed[1].settings.Temperature != "24" {
+		t.Fatalf("unexpected missed runs %+v", missed)
+	}
+	if want := now.Add(-time.Hour).Truncate(time.Minute); !missed[0].at.Equal(want) {
+		t.Errorf("missed run at %v, want %v", missed[0].at, want)
+	}
+
+	startTestScheduler(t, store)
+
+	// the missed runs of Normal are recorded when they are caught up
+	waitFor(t, "the missed jobs to be caught up", func() bool {
+		cjs, _ := store.GetCronJobs(db.DefaultUnit, "Normal")
+		return (*cjs)[2].LastRun.After(now.Add(-time.Hour))
+	})
+	// the last missed job is suppressed by Away, even though the job of Away is skipped
+	if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Temperature != 23 || rc.Mode != codecbase.C_Mode_Heat {
+		t.Errorf("unexpected config after catch-up: mode %d temp %d", rc.Mode, rc.Temperature)
+	}
+	// each caught up job is recorded as a run of its own
+	var runs *[]db.JobRun
+	waitFor(t, "the runs of the caught up jobs", func() bool {
+		runs, _ = store.GetJobRuns(db.DefaultUnit, now)
+		return len(*runs) == 2
+	})
+	if (*runs)[1].Outcome != runOk || !(*runs)[1].Scheduled.Equal(missed[0].at) ||
+		(*runs)[0].Outcome != runSuppressed || (*runs)[0].JobSet != "Normal" {
+		t.Errorf("unexpected runs %+v", *runs)
+	}
+	if missed, _ := missedRuns(db.DefaultUnit, now); len(missed) != 0 {
+		t.Errorf("jobs are caught up again: %+v", missed)
+	}
+}
+
+func TestLoadJobsFileSkipMissed(t *testing.T) {
+	store := db.NewMemStore()
+	jobs := `{ "Away": { "active": true, "skipMissed": true, "cronjobs": [] } }`
+	diff, err := LoadJobsFile(store, writeJobsFile(t, jobs), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "+ default/Away (active)\n    skip missed true\n"; diff.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", diff, want)
+	}
+	diff, err = LoadJobsFile(store, writeJobsFile(t, strings.Replace(jobs, `"skipMissed": true, `, "", 1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "~ default/Away\n    skip missed false\n"; diff.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", diff, want)
+	}
+	if jss, _ := store.GetJobSets(db.DefaultUnit); (*jss)[0].SkipMissed {
+		t.Error("skipMissed was not cleared")
+	}
+}
@@ -0,0 +1,111 @@
+package sched
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/rcutils"
+)
+
+// The outcomes of job runs.
+const (
+	runOk         = "ok"
+	runSuppressed = "suppressed"
+	runDeferred   = "deferred"
+	runSkipped    = "skipped"
+	runFailed     = "failed"
+)
+
+// How long the runs of jobs are kept in the store.
+const JOB_RUN_RETENTION = 30 * 24 * time.Hour
+
+// The runs of the scheduled jobs are recorded by event listeners of the scheduler. A run is started before the job runs,
+// described by the job while it runs, and saved in the store after it has run. The runs are keyed by job name, which
+// is unambiguous since the scheduler runs one job at a time.
+var activeRuns = make(map[string]*db.JobRun)
+var activeRunsMutex sync.Mutex
+
+func startRun(jobName string) {
+	activeRunsMutex.Lock()
+	defer activeRunsMutex.Unlock()
+	activeRuns[jobName] = &db.JobRun{JobName: jobName, Started: time.Now()}
+}
+
+// Describe the active run of a job. Nothing is recorded for jobs that run outside the scheduler.
+func describeRun(jobName string, describe func(run *db.JobRun)) {
+	activeRunsMutex.Lock()
+	defer activeRunsMutex.Unlock()
+	if run, found := activeRuns[jobName]; found {
+		describe(run)
+	}
+}
+
+// Describe the active run of a job that applies settings.
+func describeSettingsRun(jobName, unit, kind string, id uint, scheduled time.Time, preset string, settings *codecbase.Settings) {
+	describeRun(jobName, func(run *db.JobRun) {
+		run.Unit, run.Kind, run.JobID, run.Scheduled, run.Preset = unit, kind, id, scheduled, preset
+		if json, err := json.Marshal(settings); err == nil {
+			run.Settings = json
+		}
+	})
+}
+
+// Save the run of a job in the store, with the resulting config. Runs that haven't been described, e.g. of the
+// initialization job, are not saved.
+func finishRun(jobName string, err error) {
+	activeRunsMutex.Lock()
+	run, found := activeRuns[jobName]
+	delete(activeRuns, jobName)
+	activeRunsMutex.Unlock()
+	if !found || run.Kind == "" {
+		return
+	}
+
+	run.Duration = time.Since(run.Started)
+	if err != nil {
+		run.Outcome, run.Error = runFailed, err.Error()
+	} else if run.Outcome == "" {
+		run.Outcome = runOk
+	}
+	if rc, err := g_store.CurrentConfig(run.Unit); err == nil {
+		var settings codecbase.Settings
+		rcutils.CopyToSettings(rc, &settings)
+		if json, err := json.Marshal(&settings); err == nil {
+			run.Config = json
+		}
+	}
+	if err := g_store.SaveJobRun(run); err != nil {
+		slog.Error("failed to save job run", "jobName", jobName, "err", err)
+	}
+	if err := g_store.DeleteJobRunsBefore(time.Now().Add(-JOB_RUN_RETENTION)); err != nil {
+		slog.Error("failed to delete old job runs", "err", err)
+	}
+}
+
+func beforeJobRuns(_ uuid.UUID, jobName string) {
+	startRun(jobName)
+}
+
+func afterJobRuns(_ uuid.UUID, jobName string) {
+	finishRun(jobName, nil)
+}
+
+func afterJobRunsWithError(_ uuid.UUID, jobName string, err error) {
+	finishRun(jobName, err)
+}
+
+// Return the most recent time of a schedule at or before t, i.e. when a job that runs at t was scheduled to run, or t
+// if there is none within a day.
+func scheduledAt(schedule string, t time.Time) time.Time {
+	times, err := scheduleTimes(schedule, t.Add(-24*time.Hour), t.Add(time.Second))
+	if err != nil || len(times) == 0 {
+		return t
+	}
+	return times[len(times)-1]
+}
@@ -0,0 +1,54 @@
+package sched
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestJobRunHistory(t *testing.T) {
+	store := db.NewMemStore()
+	now := time.Now()
+	store.SaveOneTimeJob(db.DefaultUnit, now.Add(-time.Minute), "", &codecbase.Settings{Power: "on", Temperature: "24"})
+	store.SaveOneTimeJob(db.DefaultUnit, now.Add(-time.Minute), "missing", &codecbase.Settings{})
+	store.SaveJobRun(&db.JobRun{Unit: db.DefaultUnit, Kind: timerJobCategory, Started: now.Add(-JOB_RUN_RETENTION - time.Hour)})
+
+	startTestScheduler(t, store)
+
+	// the missed one-time jobs run at once, and the old run is deleted
+	var runs *[]db.JobRun
+	waitFor(t, "the runs of the missed jobs", func() bool {
+		runs, _ = store.GetJobRuns(db.DefaultUnit, time.Time{})
+		return len(*runs) == 2
+	})
+	outcomes := make(map[string]db.JobRun)
+	for _, r := range *runs {
+		outcomes[r.Outcome] = r
+	}
+
+	ok := outcomes[runOk]
+	if ok.Kind != oneTimeJobCategory || !ok.Scheduled.Equal(now.Add(-time.Minute)) || ok.Started.Before(now) {
+		t.Errorf("unexpected run %+v", ok)
+	}
+	var config codecbase.Settings
+	if err := json.Unmarshal(ok.Config, &config); err != nil || config.Temperature != "24" || config.Power != "on" {
+		t.Errorf("unexpected config after run %s", ok.Config)
+	}
+
+	if failed := outcomes[runFailed]; failed.Preset != "missing" || failed.Error == "" {
+		t.Errorf("unexpected run %+v", failed)
+	}
+}
+
+func TestScheduledAt(t *testing.T) {
+	at := time.Date(2025, 3, 10, 5, 30, 0, 0, time.Local)
+	if got := scheduledAt("30 5 * * *", at.Add(1500*time.Millisecond)); !got.Equal(at) {
+		t.Errorf("scheduled at %v, want %v", got, at)
+	}
+	if got := scheduledAt("30 5 * * *", at.Add(-time.Minute)); !got.Equal(at.Add(-24 * time.Hour)) {
+		t.Errorf("scheduled at %v, want the day before", got)
+	}
+}
@@ -0,0 +1,278 @@
+package sched
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/rcutils"
+)
+
+const holdJobCategory = "hold"
+
+// What is done with the settings jobs that run during a hold.
+const (
+	// The jobs don't run, but are applied when the hold ends, as if they had run instead of the hold.
+	HoldDefer = "defer"
+	// The jobs don't run, and the fields changed by the hold are reverted when it ends.
+	HoldSkip = "skip"
+	// The jobs run with the held settings overriding theirs, and are applied when the hold ends.
+	HoldMerge = "merge"
+)
+
+var HoldPolicies = []string{HoldDefer, HoldSkip, HoldMerge}
+
+// The longest time that settings can be held.
+const MAX_HOLD_DURATION = 24 * time.Hour
+
+// Returned (wrapped) when a hold is rejected, e.g. because it ends in the past.
+var ErrInvalidHold = errors.New("invalid hold")
+
+// Serializes changes of the holds, and the settings jobs that check them.
+var holdMutex sync.Mutex
+
+func holdJobTag(unit string) string {
+	return fmt.Sprintf("%s#%s", holdJobCategory, unit)
+}
+
+func holdJobName(unit string) string {
+	return fmt.Sprintf("%s/hold", unit)
+}
+
+// Return the values in before of the fields that are set in changed, in the order of codecbase.MergeSettings.
+func changedFields(changed, before *codecbase.Settings) codecbase.Settings {
+	var reverted codecbase.Settings
+	fields := func(s *codecbase.Settings) []*string {
+		return []*string{&s.Power, &s.Mode, &s.Powerful, &s.Quiet, &s.Temperature, &s.FanSpeed, &s.VentVertical,
+			&s.VentHorizontal, &s.TimerOn, &s.TimerOnTime, &s.TimerOff, &s.TimerOffTime}
+	}
+	src, dst := fields(before), fields(&reverted)
+	for i, f := range fields(changed) {
+		if *f != "" {
+			*dst[i] = *src[i]
+		}
+	}
+	return reverted
+}
+
+// Hold settings on a unit until a time, when the fields changed by the hold are reverted. The policy decides what is
+// done with the settings jobs that run during the hold. A new hold replaces the current hold of the unit, but the
+// fields are still reverted to what they were before the first hold.
+func StartHold(unit, preset string, settings codecbase.Settings, until time.Time, policy string) (*db.Hold, error) {
+	if !slices.Contains(HoldPolicies, policy) {
+		return nil, fmt.Errorf("%w: the policy must be one of %s", ErrInvalidHold, strings.Join(HoldPolicies, ", "))
+	}
+	if d := time.Until(until); d <= 0 || d > MAX_HOLD_DURATION {
+		return nil, fmt.Errorf("%w: the hold must end within %v", ErrInvalidHold, MAX_HOLD_DURATION)
+	}
+	resolved, err := db.ResolvePreset(g_store, preset, &settings)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHold, err)
+	}
+	if resolved.TimerOn != "" || resolved.TimerOnTime != "" || resolved.TimerOff != "" || resolved.TimerOffTime != "" {
+		return nil, fmt.Errorf("%w: the timers can't be held", ErrInvalidHold)
+	}
+	if *resolved == (codecbase.Settings{}) {
+		return nil, fmt.Errorf("%w: no settings to hold", ErrInvalidHold)
+	}
+
+	holdMutex.Lock()
+	defer holdMutex.Unlock()
+
+	dbRc, err := g_store.CurrentConfig(unit)
+	if err != nil {
+		return nil, err
+	}
+	sendRc, err := composeConfig(db.UnitModeSettings{Store: g_store, Unit: unit}, resolved, dbRc)
+	if err != nil {
+		return nil, err
+	}
+
+	var before codecbase.Settings
+	rcutils.CopyToSettings(dbRc, &before)
+	reverted := changedFields(resolved, &before)
+	hold := &db.Hold{Unit: unit, Until: until, Preset: preset, Policy: policy}
+	if current, err := g_store.GetHold(unit); err == nil {
+		// the fields changed by the current hold are reverted to what they were before it
+		var currentReverted codecbase.Settings
+		if err := json.Unmarshal(current.Revert, &currentReverted); err != nil {
+			return nil, err
+		}
+		reverted = codecbase.MergeSettings(reverted, currentReverted)
+		hold.Deferred = current.Deferred
+	}
+	if hold.Settings, err = json.Marshal(&settings); err != nil {
+		return nil, err
+	}
+	if hold.Revert, err = json.Marshal(&reverted); err != nil {
+		return nil, err
+	}
+
+	if !sendConfig(unit, sendRc) {
+		return nil, fmt.Errorf("no IR sender for unit %q", unit)
+	}
+	if err := g_store.SaveConfig(unit, sendRc, dbRc); err != nil {
+		return nil, err
+	}
+	if err := g_store.SaveHold(hold); err != nil {
+		return nil, err
+	}
+	slog.Info("started hold", "unit", unit, "until", until, "policy", policy, "preset", preset)
+	scheduleHoldEnd(unit)
+	return hold, nil
+}
+
+// What the policy of a hold does with a settings job that runs during the hold: whether the job runs merged with the
+// held settings, which override its own, and whether its settings are deferred, to be applied when the hold ends.
+func holdPolicyEffect(policy string) (merge, deferred bool) {
+	return policy == HoldMerge, policy != HoldSkip
+}
+
+// Return the settings of the jobs that were deferred or merged during a hold, in the order they ran.
+func deferredSettings(hold *db.Hold) ([]codecbase.Settings, error) {
+	var deferred []codecbase.Settings
+	if hold.Deferred != nil {
+		if err := json.Unmarshal(hold.Deferred, &deferred); err != nil {
+			return nil, err
+		}
+	}
+	return deferred, nil
+}
+
+// Return the held settings of a hold, with its preset resolved.
+func heldSettings(store db.Store, hold *db.Hold) (*codecbase.Settings, error) {
+	var held codecbase.Settings
+	if err := json.Unmarshal(hold.Settings, &held); err != nil {
+		return nil, err
+	}
+	return db.ResolvePreset(store, hold.Preset, &held)
+}
+
+// Return the settings that are applied when a hold ends: the fields changed by the hold are reverted, and the deferred
+// settings applied in the order they ran.
+func holdEndSettings(revert codecbase.Settings, deferred []codecbase.Settings) codecbase.Settings {
+	settings := revert
+	for _, d := range deferred {
+		settings = codecbase.MergeSettings(settings, d)
+	}
+	return settings
+}
+
+// Apply the policy of a hold to the settings of a job that runs during the hold. The settings to apply are returned, or
+// nil if the job doesn't run. holdMutex must be held.
+func applyHoldPolicy(hold *db.Hold, settings *codecbase.Settings, jobName string) (*codecbase.Settings, error) {
+	merge, deferJob := holdPolicyEffect(hold.Policy)
+	if deferJob {
+		deferred, err := deferredSettings(hold)
+		if err != nil {
+			return nil, err
+		}
+		if hold.Deferred, err = json.Marshal(append(deferred, *settings)); err != nil {
+			return nil, err
+		}
+		if err := g_store.SaveHold(hold); err != nil {
+			return nil, err
+		}
+	}
+	if !merge {
+		if deferJob {
+			slog.Info("deferred settings job until the hold ends", "unit", hold.Unit, "jobName", jobName, "until", hold.Until)
+			describeRun(jobName, func(run *db.JobRun) { run.Outcome = runDeferred })
+		} else {
+			slog.Info("skipped settings job during hold", "unit", hold.Unit, "jobName", jobName)
+			describeRun(jobName, func(run *db.JobRun) { run.Outcome = runSkipped })
+		}
+		return nil, nil
+	}
+
+	held, err := heldSettings(g_store, hold)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("merged settings job with hold", "unit", hold.Unit, "jobName", jobName)
+	merged := codecbase.MergeSettings(*settings, *held)
+	return &merged, nil
+}
+
+// End the hold of a unit. The fields changed by the hold are reverted, and the jobs that were deferred or merged during
+// the hold are applied, as if they had run instead of the hold. Returns false if the unit has no hold.
+func EndHold(unit string) (bool, error) {
+	return endHold(unit, holdJobName(unit))
+}
+
+func endHold(unit, jobName string) (bool, error) {
+	holdMutex.Lock()
+	defer holdMutex.Unlock()
+
+	hold, err := g_store.GetHold(unit)
+	if errors.Is(err, db.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	scheduler.RemoveByTags(holdJobTag(unit))
+	if _, err := g_store.DeleteHold(unit); err != nil {
+		return true, err
+	}
+
+	var revert codecbase.Settings
+	if err := json.Unmarshal(hold.Revert, &revert); err != nil {
+		return true, err
+	}
+	deferred, err := deferredSettings(hold)
+	if err != nil {
+		return true, err
+	}
+	settings := holdEndSettings(revert, deferred)
+	slog.Info("ending hold", "unit", unit, "until", hold.Until, "deferredJobs", len(deferred))
+	describeSettingsRun(jobName, unit, holdJobCategory, 0, hold.Until, "", &settings)
+	return true, sendSettings(unit, &settings, jobName)
+}
+
+func RunHoldEndJob(unit, jobName string) error {
+	_, err := endHold(unit, jobName)
+	return err
+}
+
+// Schedule the end of the hold of a unit, if it has one. A hold that should already have ended, e.g. because the
+// controller wasn't running, ends at once.
+func scheduleHoldEnd(unit string) {
+	scheduler.RemoveByTags(holdJobTag(unit))
+	hold, err := g_store.GetHold(unit)
+	if errors.Is(err, db.ErrNotFound) {
+		return
+	} else if err != nil {
+		slog.Error("failed to get hold", "unit", unit, "err", err)
+		return
+	}
+
+	name := holdJobName(unit)
+	start := gocron.OneTimeJobStartDateTime(hold.Until)
+	if !hold.Until.After(time.Now()) {
+		start = gocron.OneTimeJobStartImmediately()
+	}
+	_, err = scheduler.NewJob(
+		gocron.OneTimeJob(start),
+		gocron.NewTask(
+			RunHoldEndJob,
+			unit,
+			name,
+		),
+		gocron.WithName(name),
+		gocron.WithTags(holdJobCategory, unit, holdJobTag(unit)),
+	)
+	if err != nil {
+		slog.Error("failed to schedule the end of hold", "jobName", name, "err", err)
+		return
+	}
+	slog.Info("scheduled the end of hold", "jobName", name, "at", hold.Until)
+}
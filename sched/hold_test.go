@@ -0,0 +1,84 @@
+package sched
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestHold(t *testing.T) {
+	store := db.NewMemStore()
+	startTestScheduler(t, store)
+
+	check := func(step string, powerful, temp uint) {
+		t.Helper()
+		if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Powerful != powerful || rc.Temperature != temp {
+			t.Errorf("%s: powerful %d temp %d, want %d %d", step, rc.Powerful, rc.Temperature, powerful, temp)
+		}
+	}
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Power: "on", Mode: "heat", Temperature: "21"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	until := time.Now().Add(time.Hour)
+
+	// a deferred job is applied when the hold ends
+	if _, err := StartHold(db.DefaultUnit, "", codecbase.Settings{Powerful: "on", Temperature: "25"}, until, HoldDefer); err != nil {
+		t.Fatal(err)
+	}
+	check("defer hold", codecbase.C_Powerful_Enabled, 25)
+	RunSettingsJob(db.DefaultUnit, codecbase.Settings{Temperature: "19"}, "", "job")
+	check("deferred job", codecbase.C_Powerful_Enabled, 25)
+	if ended, err := EndHold(db.DefaultUnit); !ended || err != nil {
+		t.Fatalf("hold not ended: %v", err)
+	}
+	check("defer end", codecbase.C_Powerful_Disabled, 19)
+
+	// a merged job runs with the held settings
+	StartHold(db.DefaultUnit, "", codecbase.Settings{Powerful: "on"}, until, HoldMerge)
+	RunSettingsJob(db.DefaultUnit, codecbase.Settings{Powerful: "off", Temperature: "23"}, "", "job")
+	check("merged job", codecbase.C_Powerful_Enabled, 23)
+	EndHold(db.DefaultUnit)
+	check("merge end", codecbase.C_Powerful_Disabled, 23)
+
+	// a skipped job is forgotten, and a new hold still reverts to the state before the first hold
+	StartHold(db.DefaultUnit, "", codecbase.Settings{Temperature: "26"}, until, HoldSkip)
+	RunSettingsJob(db.DefaultUnit, codecbase.Settings{Temperature: "18"}, "", "job")
+	StartHold(db.DefaultUnit, "", codecbase.Settings{Powerful: "on", Temperature: "27"}, until, HoldSkip)
+	check("skipped job", codecbase.C_Powerful_Enabled, 27)
+	EndHold(db.DefaultUnit)
+	check("skip end", codecbase.C_Powerful_Disabled, 23)
+	if ended, _ := EndHold(db.DefaultUnit); ended {
+		t.Error("ended a hold that doesn't exist")
+	}
+
+	for _, invalid := range []struct {
+		settings codecbase.Settings
+		until    time.Time
+		policy   string
+	}{
+		{codecbase.Settings{Temperature: "25"}, until, "later"},
+		{codecbase.Settings{Temperature: "25"}, time.Now().Add(-time.Minute), HoldDefer},
+		{codecbase.Settings{Temperature: "25"}, time.Now().Add(MAX_HOLD_DURATION + time.Minute), HoldDefer},
+		{codecbase.Settings{TimerOff: "on"}, until, HoldDefer},
+		{codecbase.Settings{}, until, HoldDefer},
+	} {
+		if _, err := StartHold(db.DefaultUnit, "", invalid.settings, invalid.until, invalid.policy); !errors.Is(err, ErrInvalidHold) {
+			t.Errorf("hold %+v: unexpected error %v", invalid, err)
+		}
+	}
+
+	// the hold ends by itself
+	StartHold(db.DefaultUnit, "", codecbase.Settings{Temperature: "28"}, time.Now().Add(200*time.Millisecond), HoldDefer)
+	check("short hold", codecbase.C_Powerful_Disabled, 28)
+	waitFor(t, "the hold to end", func() bool {
+		_, err := store.GetHold(db.DefaultUnit)
+		return errors.Is(err, db.ErrNotFound)
+	})
+	// the hold is deleted before the config is sent
+	holdMutex.Lock()
+	holdMutex.Unlock()
+	check("short hold end", codecbase.C_Powerful_Disabled, 23)
+}
@@ -1,19 +1,27 @@
 package sched
 
-import "fmt"
+import (
+	"fmt"
+	"sync"
+)
 
 type jobGenerations map[string]int
 
 var jobsetGens jobGenerations = make(jobGenerations)
 
+// Held while jobs of a generation are replaced, since jobs are rescheduled from web requests, the jobs file watcher and
+// the control socket.
+var jobsetGensMutex sync.Mutex
+
+// Job generations are kept per category and job set. The job set includes the unit, e.g. "default/Normal".
 func (jg jobGenerations) currentGen(category, jobset string) string {
-	gen := jg[jobset]
+	gen := jg[category+"/"+jobset]
 	return fmt.Sprintf("//%s/%s##%d", category, jobset, gen)
 }
 
 func (jg jobGenerations) nextGen(category, jobset string) string {
-	gen := jg[jobset]
+	gen := jg[category+"/"+jobset]
 	gen += 1
-	jg[jobset] = gen
+	jg[category+"/"+jobset] = gen
 	return fmt.Sprintf("//%s/%s##%d", category, jobset, gen)
 }
@@ -0,0 +1,576 @@
+package sched
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"rpi_panasonic_inverter_rc/calendar"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+// The format of the jobs file. Job sets belong to the default unit unless a unit is given. Job set names must be
+// unique in the file, also when they belong to different units. Instead of being active or not, a job set can have an
+// activation (see calendar.Activation), which activates it during the events in a calendar or during date ranges. Jobs
+// of a job set with a higher priority suppress jobs of other job sets that run at about the same time (see
+// PRIORITY_WINDOW). The default priority is 0. Jobs that were missed while the controller wasn't running are run when it
+// starts, unless skipMissed is true. A cron job can have a ramp, which changes the temperature gradually from the
+// temperature set by the job to the temperature of the ramp, over the minutes of the ramp in steps of step degrees (1 if
+// not given).
+//
+//	{
+//	  "Normal": {
+//	    "active": true,
+//	    "cronjobs": [
+//	      { "schedule": "0 6 * * *", "settings": { "mode": "heat", "temp": "22" } },
+//	      { "schedule": "0 22 * * *", "preset": "Night", "settings": { "temp": "18" } },
+//	      { "schedule": "@sunset-30m", "settings": { "quiet": "on" } }
+//	    ]
+//	  },
+//	  "Vacation": {
+//	    "activation": { "calendar": "/home/pi/family.ics", "match": "vacation" },
+//	    "priority": 10,
+//	    "skipMissed": true,
+//	    "cronjobs": [
+//	      { "schedule": "0 7 * * *", "settings": { "mode": "heat", "temp": "16" } }
+//	    ]
+//	  },
+//	  "Bedroom": {
+//	    "unit": "bedroom",
+//	    "active": true,
+//	    "cronjobs": [
+//	      { "schedule": "0 21 * * *", "settings": { "temp": "22" }, "ramp": { "to": 19, "minutes": 90 } },
+//	      { "schedule": "0 23 * * *", "settings": { "temp": "-2" } }
+//	    ]
+//	  }
+//	}
+type jobSetDef struct {
+	Unit       string               `json:"unit,omitempty"`
+	Active     bool                 `json:"active"`
+	Activation *calendar.Activation `json:"activation,omitempty"`
+	Priority   int                  `json:"priority,omitempty"`
+	SkipMissed bool                 `json:"skipMissed,omitempty"`
+	CronJobs   []cronJobDef         `json:"cronjobs"`
+	line       int
+	activeSet  bool // active is given in the file
+}
+
+type cronJobDef struct {
+	Schedule string             `json:"schedule"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+	Ramp     *db.Ramp           `json:"ramp,omitempty"`
+	line     int
+}
+
+type jobSetDefs map[string]*jobSetDef
+
+// A JobsFileError points to the line in the jobs file where a problem was found.
+type JobsFileError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *JobsFileError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+}
+
+func (e *JobsFileError) Unwrap() error {
+	return e.Err
+}
+
+// Return the line number of the first token at or after offset in data.
+func lineAt(data []byte, offset int64) int {
+	pos := int(offset)
+	for pos < len(data) && bytes.IndexByte([]byte(" \t\r\n,:"), data[pos]) >= 0 {
+		pos++
+	}
+	return bytes.Count(data[:min(pos, len(data))], []byte("\n")) + 1
+}
+
+type jobsFileParser struct {
+	file string
+	data []byte
+	dec  *json.Decoder
+}
+
+func (p *jobsFileParser) errorAt(offset int64, format string, args ...any) error {
+	return &JobsFileError{p.file, lineAt(p.data, offset), fmt.Errorf(format, args...)}
+}
+
+// Convert JSON decoding errors to errors with line numbers. The offsets of type errors are relative to the start of the
+// decoded value at valueOffset, and errors without an offset are reported at valueOffset.
+func (p *jobsFileParser) jsonError(err error, valueOffset int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return &JobsFileError{p.file, lineAt(p.data, syntaxErr.Offset-1), err}
+	case errors.As(err, &typeErr):
+		return &JobsFileError{p.file, lineAt(p.data, valueOffset+typeErr.Offset-1), err}
+	}
+	return p.errorAt(valueOffset, "%s", err)
+}
+
+func (p *jobsFileParser) expectDelim(delim json.Delim) error {
+	offset := p.dec.InputOffset()
+	tok, err := p.dec.Token()
+	if err != nil {
+		return p.jsonError(err, offset)
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return p.errorAt(offset, "expected %q, found %v", delim, tok)
+	}
+	return nil
+}
+
+func (p *jobsFileParser) key() (string, int64, error) {
+	offset := p.dec.InputOffset()
+	tok, err := p.dec.Token()
+	if err != nil {
+		return "", offset, p.jsonError(err, offset)
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", offset, p.errorAt(offset, "expected a name, found %v", tok)
+	}
+	return key, offset, nil
+}
+
+func (p *jobsFileParser) parseCronJobs(js *jobSetDef) error {
+	if err := p.expectDelim('['); err != nil {
+		return err
+	}
+	for p.dec.More() {
+		offset := p.dec.InputOffset()
+		cj := cronJobDef{line: lineAt(p.data, offset)}
+		if err := p.dec.Decode(&cj); err != nil {
+			return p.jsonError(err, offset)
+		}
+		js.CronJobs = append(js.CronJobs, cj)
+	}
+	return p.expectDelim(']')
+}
+
+func (p *jobsFileParser) parseJobSet(offset int64) (*jobSetDef, error) {
+	js := &jobSetDef{Unit: db.DefaultUnit, line: lineAt(p.data, offset)}
+	if err := p.expectDelim('{'); err != nil {
+		return nil, err
+	}
+	for p.dec.More() {
+		key, keyOffset, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "unit":
+			valueOffset := p.dec.InputOffset()
+			if err := p.dec.Decode(&js.Unit); err != nil {
+				return nil, p.jsonError(err, valueOffset)
+			}
+		case "active":
+			valueOffset := p.dec.InputOffset()
+			if err := p.dec.Decode(&js.Active); err != nil {
+				return nil, p.jsonError(err, valueOffset)
+			}
+			js.activeSet = true
+		case "activation":
+			valueOffset := p.dec.InputOffset()
+			if err := p.dec.Decode(&js.Activation); err != nil {
+				return nil, p.jsonError(err, valueOffset)
+			}
+		case "priority":
+			valueOffset := p.dec.InputOffset()
+			if err := p.dec.Decode(&js.Priority); err != nil {
+				return nil, p.jsonError(err, valueOffset)
+			}
+		case "skipMissed":
+			valueOffset := p.dec.InputOffset()
+			if err := p.dec.Decode(&js.SkipMissed); err != nil {
+				return nil, p.jsonError(err, valueOffset)
+			}
+		case "cronjobs":
+			if err := p.parseCronJobs(js); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, p.errorAt(keyOffset, "unknown field %q", key)
+		}
+	}
+	return js, p.expectDelim('}')
+}
+
+// Parse the jobs file, keeping track of the line numbers of job sets and cron jobs.
+func parseJobsFile(file string, data []byte) (jobSetDefs, error) {
+	p := &jobsFileParser{file: file, data: data, dec: json.NewDecoder(bytes.NewReader(data))}
+	// report misspelled fields instead of ignoring them
+	p.dec.DisallowUnknownFields()
+	jobsets := make(jobSetDefs)
+
+	if err := p.expectDelim('{'); err != nil {
+		return nil, err
+	}
+	for p.dec.More() {
+		name, offset, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		if _, found := jobsets[name]; found {
+			return nil, p.errorAt(offset, "duplicate job set %q", name)
+		}
+		js, err := p.parseJobSet(offset)
+		if err != nil {
+			return nil, err
+		}
+		jobsets[name] = js
+	}
+	if err := p.expectDelim('}'); err != nil {
+		return nil, err
+	}
+	return jobsets, nil
+}
+
+// Check a cron schedule with the parser that the scheduler uses when jobs are added. Schedules relative to sunrise or sunset, e.g. "@sunset-30m", are also accepted if the location
+// is configured.
+func ValidateSchedule(schedule string) error {
+	if isSolarSchedule(schedule) {
+		if _, err := ParseSolarSchedule(schedule); err != nil {
+			return err
+		}
+		if g_location == nil {
+			return errNoLocation
+		}
+		return nil
+	}
+	_, err := cron.ParseStandard(schedule)
+	return err
+}
+
+// Check that the units of all job sets exist, that their activations are valid, and that the schedules and settings of
+// all cron jobs are valid. All problems are returned. Job sets with an activation are made active or inactive according
+// to their activation at the current time.
+func validateJobSets(store db.Store, file string, jobsets jobSetDefs) error {
+	var errs []*JobsFileError
+	now := time.Now()
+	for name, js := range jobsets {
+		if _, err := store.GetUnit(js.Unit); err != nil {
+			errs = append(errs, &JobsFileError{file, js.line, fmt.Errorf("job set %s: %w", name, err)})
+			continue
+		}
+		if js.Activation != nil {
+			err := js.Activation.Validate()
+			if err == nil && js.activeSet {
+				err = errors.New("active can't be given together with an activation")
+			}
+			var status *calendar.Status
+			if err == nil {
+				status, err = js.Activation.Evaluate(now)
+			}
+			if err != nil {
+				errs = append(errs, &JobsFileError{file, js.line, fmt.Errorf("job set %s: %w", name, err)})
+			} else {
+				js.Active = status.Active
+			}
+		}
+		dbRc, err := store.CurrentConfig(js.Unit)
+		if err != nil {
+			return err
+		}
+		for _, cj := range js.CronJobs {
+			err := ValidateSchedule(cj.Schedule)
+			if err == nil && cj.Ramp != nil {
+				err = ValidateRamp(cj.Ramp)
+			}
+			var settings *codecbase.Settings
+			if err == nil {
+				// presets are resolved when jobs run, but must exist when the jobs are loaded
+				settings, err = db.ResolvePreset(store, cj.Preset, &cj.Settings)
+			}
+			if err == nil {
+				_, err = composeConfig(db.UnitModeSettings{Store: store, Unit: js.Unit}, settings, dbRc)
+			}
+			if err != nil {
+				errs = append(errs, &JobsFileError{file, cj.line, fmt.Errorf("job set %s: %w", name, err)})
+			}
+		}
+	}
+	slices.SortFunc(errs, func(a, b *JobsFileError) int { return a.Line - b.Line })
+	joined := make([]error, 0, len(errs))
+	for _, err := range errs {
+		joined = append(joined, err)
+	}
+	return errors.Join(joined...)
+}
+
+// The changes to a job set when a jobs file is loaded. Cron jobs are identified by their schedule, preset, settings and
+// ramp, so a changed cron job is removed and added.
+type JobSetChange struct {
+	Unit              string
+	Name              string
+	Op                byte // '+' added, '-' removed, '~' changed
+	Active            bool
+	WasActive         bool
+	Activation        []byte // JSON representation of the activation, nil if the job set is activated manually
+	ActivationChanged bool
+	Priority          int
+	WasPriority       int
+	SkipMissed        bool
+	WasSkipMissed     bool
+	Added             []cronJobDef
+	Removed           []db.CronJob
+}
+
+// The changes that loading a jobs file makes to the job sets in the store, ordered by unit and job set.
+type JobsDiff []JobSetChange
+
+func (d JobsDiff) String() string {
+	var sb strings.Builder
+	activeStr := map[bool]string{true: "active", false: "inactive"}
+	for _, c := range d {
+		switch {
+		case c.Op != '~':
+			fmt.Fprintf(&sb, "%c %s/%s (%s)\n", c.Op, c.Unit, c.Name, activeStr[c.Active])
+		case c.Active != c.WasActive:
+			fmt.Fprintf(&sb, "~ %s/%s (%s -> %s)\n", c.Unit, c.Name, activeStr[c.WasActive], activeStr[c.Active])
+		default:
+			fmt.Fprintf(&sb, "~ %s/%s\n", c.Unit, c.Name)
+		}
+		if c.Priority != c.WasPriority {
+			fmt.Fprintf(&sb, "    priority %d\n", c.Priority)
+		}
+		if c.SkipMissed != c.WasSkipMissed {
+			fmt.Fprintf(&sb, "    skip missed %t\n", c.SkipMissed)
+		}
+		if c.ActivationChanged || (c.Op == '+' && c.Activation != nil) {
+			if c.Activation != nil {
+				fmt.Fprintf(&sb, "    activation %s\n", c.Activation)
+			} else {
+				fmt.Fprintf(&sb, "    activation removed\n")
+			}
+		}
+		for _, cj := range c.Removed {
+			fmt.Fprintf(&sb, "    - %s\n", cronJobString(cj.Schedule, cj.Preset, cj.Settings, cj.Ramp))
+		}
+		for _, cj := range c.Added {
+			settings, _ := json.Marshal(&cj.Settings)
+			ramp, _ := db.RampJson(cj.Ramp)
+			fmt.Fprintf(&sb, "    + %s\n", cronJobString(cj.Schedule, cj.Preset, settings, ramp))
+		}
+	}
+	return sb.String()
+}
+
+func cronJobString(schedule, preset string, settings, ramp []byte) string {
+	s := fmt.Sprintf("%q %s", schedule, settings)
+	if preset != "" {
+		s = fmt.Sprintf("%q preset=%s %s", schedule, preset, settings)
+	}
+	if ramp != nil {
+		s += fmt.Sprintf(" ramp=%s", ramp)
+	}
+	return s
+}
+
+// Identifies a cron job when comparing the jobs file with the store.
+func cronJobKey(schedule, preset string, settings, ramp []byte) string {
+	return schedule + "\x00" + preset + "\x00" + string(settings) + "\x00" + string(ramp)
+}
+
+func activationJson(a *calendar.Activation) ([]byte, error) {
+	if a == nil {
+		return nil, nil
+	}
+	return json.Marshal(a)
+}
+
+// Compare the job sets in the file with the job sets in the store.
+func diffJobSets(store db.Store, jobsets jobSetDefs) (JobsDiff, error) {
+	var diff JobsDiff
+	type unitJobSet struct{ unit, name string }
+	seen := make(map[unitJobSet]bool)
+
+	units, err := store.GetUnits()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range *units {
+		existing, err := store.GetJobSets(u.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, js := range *existing {
+			seen[unitJobSet{u.Name, js.Name}] = true
+			cronjobs, err := store.GetCronJobs(u.Name, js.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			def, found := jobsets[js.Name]
+			if !found || def.Unit != u.Name {
+				diff = append(diff, JobSetChange{Unit: u.Name, Name: js.Name, Op: '-', Active: js.Active, Priority: js.Priority, WasPriority: js.Priority,
+					SkipMissed: js.SkipMissed, WasSkipMissed: js.SkipMissed, Removed: *cronjobs})
+				continue
+			}
+
+			activation, err := activationJson(def.Activation)
+			if err != nil {
+				return nil, err
+			}
+			change := JobSetChange{Unit: u.Name, Name: js.Name, Op: '~', Active: def.Active, WasActive: js.Active,
+				Activation: activation, ActivationChanged: !bytes.Equal(activation, js.Activation),
+				Priority: def.Priority, WasPriority: js.Priority, SkipMissed: def.SkipMissed, WasSkipMissed: js.SkipMissed}
+			// match the cron jobs in the file with the existing ones, which are kept with their IDs
+			unmatched := make(map[string][]db.CronJob)
+			for _, cj := range *cronjobs {
+				key := cronJobKey(cj.Schedule, cj.Preset, cj.Settings, cj.Ramp)
+				unmatched[key] = append(unmatched[key], cj)
+			}
+			for _, cj := range def.CronJobs {
+				settings, err := json.Marshal(&cj.Settings)
+				if err != nil {
+					return nil, err
+				}
+				ramp, err := db.RampJson(cj.Ramp)
+				if err != nil {
+					return nil, err
+				}
+				key := cronJobKey(cj.Schedule, cj.Preset, settings, ramp)
+				if len(unmatched[key]) > 0 {
+					unmatched[key] = unmatched[key][1:]
+				} else {
+					change.Added = append(change.Added, cj)
+				}
+			}
+			for _, cj := range *cronjobs {
+				key := cronJobKey(cj.Schedule, cj.Preset, cj.Settings, cj.Ramp)
+				if slices.ContainsFunc(unmatched[key], func(u db.CronJob) bool { return u.ID == cj.ID }) {
+					change.Removed = append(change.Removed, cj)
+				}
+			}
+			if change.Active != change.WasActive || change.ActivationChanged || change.Priority != change.WasPriority ||
+				change.SkipMissed != change.WasSkipMissed || len(change.Added) > 0 || len(change.Removed) > 0 {
+				diff = append(diff, change)
+			}
+		}
+	}
+
+	for name, def := range jobsets {
+		if !seen[unitJobSet{def.Unit, name}] {
+			activation, err := activationJson(def.Activation)
+			if err != nil {
+				return nil, err
+			}
+			diff = append(diff, JobSetChange{Unit: def.Unit, Name: name, Op: '+', Active: def.Active, Activation: activation, Priority: def.Priority,
+				SkipMissed: def.SkipMissed, Added: def.CronJobs})
+		}
+	}
+	slices.SortFunc(diff, func(a, b JobSetChange) int {
+		return strings.Compare(a.Unit+"/"+a.Name, b.Unit+"/"+b.Name)
+	})
+	return diff, nil
+}
+
+// Apply the changes to the store. Cron jobs that haven't changed are kept.
+func applyJobsDiff(tx db.Store, diff JobsDiff) error {
+	for _, c := range diff {
+		switch c.Op {
+		case '-':
+			if err := tx.DeleteJobSet(c.Unit, c.Name); err != nil {
+				return err
+			}
+			continue
+		case '+':
+			if err := tx.SaveJobSet(c.Unit, c.Name, c.Active); err != nil {
+				return err
+			}
+			if c.Activation != nil {
+				if err := tx.SetJobSetActivation(c.Unit, c.Name, c.Activation); err != nil {
+					return err
+				}
+			}
+			if c.Priority != 0 {
+				if err := tx.SetJobSetPriority(c.Unit, c.Name, c.Priority); err != nil {
+					return err
+				}
+			}
+			if c.SkipMissed {
+				if err := tx.SetJobSetSkipMissed(c.Unit, c.Name, true); err != nil {
+					return err
+				}
+			}
+		case '~':
+			if c.Active != c.WasActive {
+				if err := tx.UpdateJobSet(c.Unit, c.Name, c.Active); err != nil {
+					return err
+				}
+			}
+			if c.ActivationChanged {
+				if err := tx.SetJobSetActivation(c.Unit, c.Name, c.Activation); err != nil {
+					return err
+				}
+			}
+			if c.Priority != c.WasPriority {
+				if err := tx.SetJobSetPriority(c.Unit, c.Name, c.Priority); err != nil {
+					return err
+				}
+			}
+			if c.SkipMissed != c.WasSkipMissed {
+				if err := tx.SetJobSetSkipMissed(c.Unit, c.Name, c.SkipMissed); err != nil {
+					return err
+				}
+			}
+		}
+		for _, cj := range c.Removed {
+			if err := tx.DeleteCronJob(cj.ID); err != nil {
+				return err
+			}
+		}
+		for _, cj := range c.Added {
+			if err := tx.SaveCronJob(c.Unit, c.Name, cj.Schedule, cj.Preset, &cj.Settings, cj.Ramp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Load job sets and cron jobs from a file, making the job sets in the store equal to the ones in the file. The file is
+// validated before anything is changed, and all changes are made in one transaction. Job sets and cron jobs that
+// haven't changed are kept as they are. The changes are returned, and if dryRun is true they are not applied.
+func LoadJobsFile(store db.Store, file string, dryRun bool) (JobsDiff, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	jobsets, err := parseJobsFile(file, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = validateJobSets(store, file, jobsets); err != nil {
+		return nil, err
+	}
+
+	diff, err := diffJobSets(store, jobsets)
+	if err != nil || dryRun || len(diff) == 0 {
+		return diff, err
+	}
+	err = store.WithTx(func(tx db.Store) error {
+		return applyJobsDiff(tx, diff)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("loaded jobs file", "file", file, "changedJobSets", len(diff))
+	return diff, nil
+}
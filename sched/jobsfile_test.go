@@ -0,0 +1,155 @@
+package sched
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func writeJobsFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "jobs.json")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+const testJobs = `{
+  "Normal": {
+    "active": true,
+    "cronjobs": [
+      { "schedule": "0 6 * * *", "settings": { "mode": "heat", "temp": "22" } },
+      { "schedule": "0 22 * * *", "settings": { "temp": "18" } }
+    ]
+  },
+  "Away": {
+    "active": false,
+    "cronjobs": [ { "schedule": "0 12 * * *", "settings": { "temp": "16" } } ]
+  }
+}`
+
+func TestLoadJobsFile(t *testing.T) {
+	store := db.NewMemStore()
+
+	diff, err := LoadJobsFile(store, writeJobsFile(t, testJobs), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 2 || diff[0].Name != "Away" || diff[0].Op != '+' {
+		t.Errorf("unexpected diff %v", diff)
+	}
+	if jobsets, _ := store.GetJobSets(db.DefaultUnit); len(*jobsets) != 0 {
+		t.Errorf("dry run changed the store")
+	}
+
+	if _, err := LoadJobsFile(store, writeJobsFile(t, testJobs), false); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := store.GetCronJobs(db.DefaultUnit, "Normal")
+
+	// change one job, activate a job set, and remove the other
+	changed := strings.Replace(testJobs, `"temp": "18"`, `"temp": "17"`, 1)
+	changed = changed[:strings.Index(changed, `,
+  "Away"`)] + "\n}"
+	diff, err = LoadJobsFile(store, writeJobsFile(t, changed), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `- default/Away (inactive)
+    - "0 12 * * *" {"temp":"16"}
+~ default/Normal
+    - "0 22 * * *" {"temp":"18"}
+    + "0 22 * * *" {"temp":"17"}
+`
+	if diff.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", diff, want)
+	}
+	after, _ := store.GetCronJobs(db.DefaultUnit, "Normal")
+	if len(*after) != 2 || (*after)[0].ID != (*before)[0].ID {
+		t.Errorf("unchanged cron job was not kept: %+v", after)
+	}
+	if cronjobs, _ := store.GetCronJobs(db.DefaultUnit, "Away"); len(*cronjobs) != 0 {
+		t.Errorf("cron jobs of removed job set were kept")
+	}
+
+	if diff, _ = LoadJobsFile(store, writeJobsFile(t, changed), false); len(diff) != 0 {
+		t.Errorf("expected no changes, got %v", diff)
+	}
+}
+
+func TestLoadInvalidJobsFile(t *testing.T) {
+	store := db.NewMemStore()
+	invalid := strings.Replace(testJobs, "0 12 * * *", "0 12 * *", 1)
+	invalid = strings.Replace(invalid, `"temp": "22"`, `"temp": "42"`, 1)
+
+	_, err := LoadJobsFile(store, writeJobsFile(t, invalid), false)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	// both problems are reported, with line numbers
+	if !strings.Contains(err.Error(), "jobs.json:5: job set Normal") || !strings.Contains(err.Error(), "jobs.json:11: job set Away") {
+		t.Errorf("unexpected errors %q", err)
+	}
+	if jobsets, _ := store.GetJobSets(db.DefaultUnit); len(*jobsets) != 0 {
+		t.Errorf("invalid file changed the store")
+	}
+}
+
+// Return the names of the scheduled settings jobs.
+func settingsJobs() []string {
+	var names []string
+	for _, j := range scheduler.Jobs() {
+		if slices.Contains(j.Tags(), settingsJobCategory) {
+			names = append(names, j.Name())
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestWatchJobsFile(t *testing.T) {
+	store := db.NewMemStore()
+	startTestScheduler(t, store)
+
+	file := writeJobsFile(t, testJobs)
+	reload := make(chan os.Signal)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchJobsFile(file, time.Hour, reload, stop)
+
+	reload <- syscall.SIGHUP
+	waitForJobs := func(n int) []string {
+		t.Helper()
+		var jobs []string
+		waitFor(t, fmt.Sprintf("%d jobs", n), func() bool {
+			jobs = settingsJobs()
+			return len(jobs) == n
+		})
+		return jobs
+	}
+	// only the active job set is scheduled
+	jobs := waitForJobs(2)
+	if !strings.HasPrefix(jobs[0], "default/Normal_") {
+		t.Errorf("unexpected jobs %v", jobs)
+	}
+
+	os.WriteFile(file, []byte(strings.Replace(testJobs, `"active": false`, `"active": true`, 1)), 0644)
+	reload <- syscall.SIGHUP
+	waitForJobs(3)
+
+	// an invalid file keeps the current jobs
+	os.WriteFile(file, []byte(`{"Normal": {"cronjobs": [{"schedule": "bad"}]}}`), 0644)
+	reload <- syscall.SIGHUP
+	// the channel is unbuffered, so the second signal is received when the first reload has been done
+	reload <- syscall.SIGHUP
+	if jobs := settingsJobs(); len(jobs) != 3 {
+		t.Errorf("expected the current jobs to be kept, got %v", jobs)
+	}
+}
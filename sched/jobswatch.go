@@ -0,0 +1,63 @@
+package sched
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Load the jobs file into the store and reschedule the job sets that changed. The current config and the timers are not
+// touched. If the file is invalid, nothing is changed and the current jobs keep running.
+func ReloadJobsFile(file string) error {
+	diff, err := LoadJobsFile(g_store, file, false)
+	if err != nil {
+		return err
+	}
+	for _, c := range diff {
+		if _, found := g_irSenders[c.Unit]; !found {
+			slog.Warn("not scheduling jobset of unconfigured unit", "unit", c.Unit, "jobset", c.Name)
+			continue
+		}
+		updateActivation(c.Unit, c.Name, false)
+		// a removed job set is unscheduled
+		ScheduleJobsForJobset(c.Unit, c.Name, c.Op != '-' && c.Active)
+	}
+	if len(diff) > 0 {
+		slog.Info("reloaded jobs file", "file", file, "changes", diff.String())
+	}
+	return nil
+}
+
+// Reload the jobs file when its modification time changes, which is checked at every interval, and when something is
+// received on the reload channel, e.g. SIGHUP. The watcher runs until stop is closed.
+func WatchJobsFile(file string, interval time.Duration, reload <-chan os.Signal, stop <-chan struct{}) {
+	modTime := func() time.Time {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	lastModTime := modTime()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-reload:
+			slog.Info("reloading jobs file on request", "file", file)
+		case <-ticker.C:
+			if mt := modTime(); mt.Equal(lastModTime) || mt.IsZero() {
+				continue
+			}
+			slog.Info("jobs file changed, reloading", "file", file)
+		}
+		// take the time before loading, so that changes made while loading are picked up next time
+		lastModTime = modTime()
+		if err := ReloadJobsFile(file); err != nil {
+			slog.Error("failed to reload jobs file, keeping the current jobs", "file", file, "err", err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package sched
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+const oneTimeJobCategory = "onetime"
+
+// A one-time job that was missed, e.g. because the controller wasn't running, is still run at startup if it is late by
+// less than this. Older jobs are deleted without running.
+const MAX_ONE_TIME_JOB_DELAY = time.Hour
+
+func oneTimeJobTag(id uint) string {
+	return fmt.Sprintf("%s#%d", oneTimeJobCategory, id)
+}
+
+func oneTimeJobName(otj *db.OneTimeJob) string {
+	return fmt.Sprintf("%s/at_%d %s", otj.Unit, otj.ID, otj.At.Format(time.DateTime))
+}
+
+func RunOneTimeJob(unit string, settings codecbase.Settings, preset string, id uint, at time.Time, jobName string) error {
+	describeSettingsRun(jobName, unit, oneTimeJobCategory, id, at, preset, &settings)
+	err := RunSettingsJob(unit, settings, preset, jobName)
+
+	// the job is deleted even if it failed, so that it isn't run again at the next start
+	if _, err := g_store.DeleteOneTimeJob(id); err != nil {
+		slog.Error("RunOneTimeJob: failed to delete job", "jobName", jobName, "err", err)
+	}
+	// the scheduler keeps one-time jobs after they have run
+	UnscheduleOneTimeJob(id)
+	return err
+}
+
+// Schedule a one-time job that has been saved in the store. A job whose time has passed is run at once if it was missed
+// by less than MAX_ONE_TIME_JOB_DELAY, otherwise it is deleted.
+func ScheduleOneTimeJob(otj *db.OneTimeJob) error {
+	name := oneTimeJobName(otj)
+
+	var settings codecbase.Settings
+	if err := json.Unmarshal(otj.Settings, &settings); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	start := gocron.OneTimeJobStartDateTime(otj.At)
+	if late := time.Since(otj.At); late >= MAX_ONE_TIME_JOB_DELAY {
+		slog.Warn("deleting missed one-time job", "jobName", name, "late", late.Round(time.Second))
+		_, err := g_store.DeleteOneTimeJob(otj.ID)
+		return err
+	} else if late >= 0 {
+		slog.Warn("running missed one-time job", "jobName", name, "late", late.Round(time.Second))
+		start = gocron.OneTimeJobStartImmediately()
+	}
+
+	// replace the job if it is already scheduled
+	scheduler.RemoveByTags(oneTimeJobTag(otj.ID))
+	_, err := scheduler.NewJob(
+		gocron.OneTimeJob(start),
+		gocron.NewTask(
+			RunOneTimeJob,
+			otj.Unit,
+			settings,
+			otj.Preset,
+			otj.ID,
+			otj.At,
+			name,
+		),
+		gocron.WithName(name),
+		gocron.WithTags(oneTimeJobCategory, otj.Unit, oneTimeJobTag(otj.ID)),
+	)
+	if err != nil {
+		slog.Error("failed to schedule one-time job", "jobName", name, "err", err)
+		return err
+	}
+	slog.Info("scheduled one-time job", "jobName", name, "at", otj.At)
+	return nil
+}
+
+func UnscheduleOneTimeJob(id uint) {
+	scheduler.RemoveByTags(oneTimeJobTag(id))
+}
+
+// Schedule the one-time jobs of a unit, replacing those already scheduled.
+func createOneTimeJobs(unit string) {
+	for _, j := range scheduler.Jobs() {
+		if tags := j.Tags(); len(tags) == 3 && tags[0] == oneTimeJobCategory && tags[1] == unit {
+			scheduler.RemoveJob(j.ID())
+		}
+	}
+	otjs, err := g_store.GetOneTimeJobs(unit)
+	if err != nil {
+		slog.Error("failed to get one-time jobs", "unit", unit, "err", err)
+		return
+	}
+	for _, otj := range *otjs {
+		ScheduleOneTimeJob(&otj)
+	}
+}
@@ -0,0 +1,42 @@
+package sched
+
+import (
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestMissedOneTimeJobs(t *testing.T) {
+	store := db.NewMemStore()
+	now := time.Now()
+	store.SaveOneTimeJob(db.DefaultUnit, now.Add(-10*time.Minute), "", &codecbase.Settings{Temperature: "24"})
+	store.SaveOneTimeJob(db.DefaultUnit, now.Add(-2*time.Hour), "", &codecbase.Settings{Temperature: "17"})
+	future, _ := store.SaveOneTimeJob(db.DefaultUnit, now.Add(time.Hour), "", &codecbase.Settings{Temperature: "19"})
+
+	startTestScheduler(t, store)
+
+	// the recently missed job runs at once and is deleted, the old one is deleted without running
+	var jobs *[]db.OneTimeJob
+	waitFor(t, "the missed jobs to be deleted", func() bool {
+		jobs, _ = store.GetOneTimeJobs(db.DefaultUnit)
+		return len(*jobs) == 1
+	})
+	if (*jobs)[0].ID != future.ID {
+		t.Fatalf("expected only the future job to remain, got %+v", jobs)
+	}
+	if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Temperature != 24 {
+		t.Errorf("missed job did not run, temperature is %d", rc.Temperature)
+	}
+
+	scheduled := 0
+	for _, j := range scheduler.Jobs() {
+		if j.Name() == oneTimeJobName(future) {
+			scheduled++
+		}
+	}
+	if scheduled != 1 {
+		t.Errorf("future job is scheduled %d times", scheduled)
+	}
+}
@@ -0,0 +1,213 @@
+package sched
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+// A job of a job set is suppressed if an active job set of the same unit with a higher priority has a job that runs
+// within this time of it, e.g. an "Away" job set with a job at 06:00 suppresses a "Normal" job at 06:03.
+const PRIORITY_WINDOW = 5 * time.Minute
+
+// Return the first time of a schedule after the given time. The schedule is either in crontab format, parsed like the
+// scheduler does, or relative to sunrise or sunset.
+func scheduleNext(schedule string, after time.Time) (time.Time, error) {
+	if isSolarSchedule(schedule) {
+		if g_location == nil {
+			return time.Time{}, errNoLocation
+		}
+		ss, err := ParseSolarSchedule(schedule)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next, _ := ss.Next(after, *g_location)
+		return next, nil
+	}
+	s, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.Next(after), nil
+}
+
+// Return the times of a schedule after from and before to.
+func scheduleTimes(schedule string, from, to time.Time) ([]time.Time, error) {
+	var times []time.Time
+	for t := from; ; {
+		next, err := scheduleNext(schedule, t)
+		if err != nil {
+			return nil, err
+		}
+		if next.IsZero() || !next.Before(to) {
+			return times, nil
+		}
+		times = append(times, next)
+		t = next
+	}
+}
+
+// Run a settings job of a job set, unless it is suppressed by a job of a job set with a higher priority. The time of
+// the run is recorded in either case, so that the job isn't caught up at the next start. If the job has a ramp, it
+// starts when the settings have been sent.
+func RunCronJob(unit, jobset string, id uint, schedule string, settings codecbase.Settings, preset string, ramp *db.Ramp, jobName string) error {
+	now := time.Now()
+	return runCronJobAt(unit, jobset, id, settings, preset, ramp, jobName, scheduledAt(schedule, now), now)
+}
+
+// Run a settings job that was scheduled at scheduled as if it ran at t.
+func runCronJobAt(unit, jobset string, id uint, settings codecbase.Settings, preset string, ramp *db.Ramp, jobName string, scheduled, t time.Time) error {
+	describeSettingsRun(jobName, unit, settingsJobCategory, id, scheduled, preset, &settings)
+	describeRun(jobName, func(run *db.JobRun) { run.JobSet = jobset })
+	if err := g_store.SetCronJobLastRun(id, t); err != nil {
+		slog.Error("failed to record the run of settings job", "jobName", jobName, "err", err)
+	}
+	if by := suppressingJob(unit, jobset, t); by != "" {
+		slog.Info("suppressed settings job", "unit", unit, "jobName", jobName, "by", by)
+		describeRun(jobName, func(run *db.JobRun) { run.Outcome, run.Error = runSuppressed, "suppressed by "+by })
+		return nil
+	}
+	sent, err := runSettingsJob(unit, settings, preset, jobName)
+	if err != nil || sent == nil || ramp == nil {
+		return err
+	}
+	// the ramp starts when the job was scheduled, so that a missed job that is caught up continues where it would be
+	return startRamp(unit, ramp, scheduled, jobName)
+}
+
+// Return the name of a job of an active job set with a higher priority than jobset that runs within PRIORITY_WINDOW of
+// t, or "" if there is none.
+func suppressingJob(unit, jobset string, t time.Time) string {
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		slog.Error("failed to get jobsets", "unit", unit, "err", err)
+		return ""
+	}
+	priority := 0
+	if i := slices.IndexFunc(*jss, func(js db.JobSet) bool { return js.Name == jobset }); i >= 0 {
+		priority = (*jss)[i].Priority
+	}
+	for _, js := range *jss {
+		if !js.Active || js.Priority <= priority {
+			continue
+		}
+		cjs, err := g_store.GetCronJobs(unit, js.Name)
+		if err != nil {
+			slog.Error("failed to get cronjobs", "unit", unit, "jobset", js.Name, "err", err)
+			continue
+		}
+		for _, cj := range *cjs {
+			next, err := scheduleNext(cj.Schedule, t.Add(-PRIORITY_WINDOW-time.Second))
+			if err != nil {
+				slog.Warn("failed to check cronjob for conflicts", "unit", unit, "jobset", js.Name, "schedule", cj.Schedule, "err", err)
+				continue
+			}
+			if !next.IsZero() && !next.After(t.Add(PRIORITY_WINDOW)) {
+				return fmt.Sprintf("%s/%s_%d %s", unit, js.Name, cj.ID, cj.Schedule)
+			}
+		}
+	}
+	return ""
+}
+
+// A run of a cron job at a specific time.
+type ScheduledRun struct {
+	JobSet     string
+	Priority   int
+	CronJob    db.CronJob
+	At         time.Time
+	Suppressed bool // a job of a job set with a higher priority runs within PRIORITY_WINDOW
+}
+
+// Jobs of different job sets that run within PRIORITY_WINDOW of each other.
+type Conflict struct {
+	Runs []ScheduledRun
+	// The job set with the highest priority, whose jobs are run. If several job sets share the highest priority, it is
+	// empty, since all their jobs are run and the last one wins.
+	Winner string
+}
+
+// Return the runs of the cron jobs of the active job sets of a unit between from and to, ordered by time.
+func scheduledRuns(unit string, from, to time.Time) ([]ScheduledRun, error) {
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		return nil, err
+	}
+	var runs []ScheduledRun
+	for _, js := range *jss {
+		if !js.Active {
+			continue
+		}
+		cjs, err := g_store.GetCronJobs(unit, js.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, cj := range *cjs {
+			times, err := scheduleTimes(cj.Schedule, from, to)
+			if err != nil {
+				slog.Warn("failed to check cronjob for conflicts", "unit", unit, "jobset", js.Name, "schedule", cj.Schedule, "err", err)
+				continue
+			}
+			for _, t := range times {
+				runs = append(runs, ScheduledRun{JobSet: js.Name, Priority: js.Priority, CronJob: cj, At: t})
+			}
+		}
+	}
+	slices.SortStableFunc(runs, func(a, b ScheduledRun) int { return a.At.Compare(b.At) })
+	return runs, nil
+}
+
+// Return the jobs of the active job sets of a unit that run within PRIORITY_WINDOW of jobs of other job sets between
+// from and to, and how they are resolved.
+func Conflicts(unit string, from, to time.Time) ([]Conflict, error) {
+	runs, err := scheduledRuns(unit, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []Conflict
+	addConflict := func(group []ScheduledRun) {
+		jobsets := make(map[string]bool)
+		top := group[0].Priority
+		for _, r := range group {
+			jobsets[r.JobSet] = true
+			top = max(top, r.Priority)
+		}
+		if len(jobsets) < 2 {
+			return
+		}
+		c := Conflict{Runs: slices.Clone(group)}
+		winners := make(map[string]bool)
+		for i := range c.Runs {
+			r := &c.Runs[i]
+			if r.Priority == top {
+				winners[r.JobSet] = true
+			}
+			r.Suppressed = slices.ContainsFunc(group, func(o ScheduledRun) bool {
+				return o.Priority > r.Priority && o.At.Sub(r.At).Abs() <= PRIORITY_WINDOW
+			})
+		}
+		if len(winners) == 1 {
+			for js := range winners {
+				c.Winner = js
+			}
+		}
+		conflicts = append(conflicts, c)
+	}
+
+	// runs that follow each other within the window form a group
+	start := 0
+	for i := 1; i <= len(runs); i++ {
+		if i == len(runs) || runs[i].At.Sub(runs[i-1].At) > PRIORITY_WINDOW {
+			addConflict(runs[start:i])
+			start = i
+		}
+	}
+	return conflicts, nil
+}
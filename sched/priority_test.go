@@ -0,0 +1,65 @@
+package sched
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestPriorities(t *testing.T) {
+	store := db.NewMemStore()
+	for _, js := range []struct {
+		name      string
+		active    bool
+		priority  int
+		schedules []string
+	}{
+		{"Normal", true, 0, []string{"0 6 * * *", "0 22 * * *"}},
+		{"Away", true, 10, []string{"3 6 * * *"}},
+		{"Guests", true, 0, []string{"0 22 * * *"}},
+		{"Inactive", false, 20, []string{"0 6 * * *"}},
+	} {
+		store.SaveJobSet(db.DefaultUnit, js.name, js.active)
+		store.SetJobSetPriority(db.DefaultUnit, js.name, js.priority)
+		for _, s := range js.schedules {
+			store.SaveCronJob(db.DefaultUnit, js.name, s, "", &codecbase.Settings{}, nil)
+		}
+	}
+	g_store = store
+	now := time.Now()
+	at := func(hour, minute int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, time.Local)
+	}
+	today := at(0, 0)
+
+	if by := suppressingJob(db.DefaultUnit, "Normal", at(6, 0)); !strings.HasPrefix(by, "default/Away_") {
+		t.Errorf("Normal at 06:00 is suppressed by %q", by)
+	}
+	for _, tt := range []struct {
+		jobset string
+		t      time.Time
+	}{{"Away", at(6, 3)}, {"Normal", at(22, 0)}, {"Guests", at(22, 0)}, {"Normal", at(5, 55)}} {
+		if by := suppressingJob(db.DefaultUnit, tt.jobset, tt.t); by != "" {
+			t.Errorf("%s at %s is suppressed by %q", tt.jobset, tt.t.Format("15:04"), by)
+		}
+	}
+
+	conflicts, err := Conflicts(db.DefaultUnit, today, today.AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, got %+v", conflicts)
+	}
+	// the job of Away wins over the job of Normal, while Normal and Guests have the same priority
+	morning, evening := conflicts[0], conflicts[1]
+	if morning.Winner != "Away" || len(morning.Runs) != 2 || morning.Runs[0].JobSet != "Normal" || !morning.Runs[0].Suppressed || morning.Runs[1].Suppressed {
+		t.Errorf("unexpected conflict %+v", morning)
+	}
+	if evening.Winner != "" || len(evening.Runs) != 2 || evening.Runs[0].Suppressed || evening.Runs[1].Suppressed || !evening.Runs[0].At.Equal(at(22, 0)) {
+		t.Errorf("unexpected conflict %+v", evening)
+	}
+}
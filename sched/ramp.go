@@ -0,0 +1,262 @@
+package sched
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+const rampJobCategory = "ramp"
+
+// The longest time that a ramp can last.
+const MAX_RAMP_DURATION = 24 * time.Hour
+
+// Returned (wrapped) when a ramp is rejected, e.g. because its temperature is out of range.
+var ErrInvalidRamp = errors.New("invalid ramp")
+
+// A ramp that is in progress on a unit.
+type ActiveRamp struct {
+	JobName     string // the cron job that started the ramp
+	From        uint
+	To          uint
+	Start       time.Time
+	End         time.Time
+	Temperature uint // the temperature of the last step
+
+	steps []rampStep // the steps that are scheduled
+}
+
+// The ramps in progress, keyed by unit. A ramp is stopped by a manual change of the power, mode or temperature, by a
+// settings job that changes them, or by another ramp.
+var activeRamps = make(map[string]*ActiveRamp)
+var rampMutex sync.Mutex
+
+func rampJobTag(unit string) string {
+	return fmt.Sprintf("%s#%s", rampJobCategory, unit)
+}
+
+func rampJobName(unit string) string {
+	return fmt.Sprintf("%s/ramp", unit)
+}
+
+// Check that the temperature of a ramp is valid, and that it ends within MAX_RAMP_DURATION.
+func ValidateRamp(ramp *db.Ramp) error {
+	if ramp.To < codecbase.C_Temp_Min || ramp.To > codecbase.C_Temp_Max {
+		return fmt.Errorf("%w: the temperature must be between %d and %d", ErrInvalidRamp, codecbase.C_Temp_Min, codecbase.C_Temp_Max)
+	}
+	if d := time.Duration(ramp.Minutes) * time.Minute; d <= 0 || d > MAX_RAMP_DURATION {
+		return fmt.Errorf("%w: the ramp must last at most %v", ErrInvalidRamp, MAX_RAMP_DURATION)
+	}
+	return nil
+}
+
+// Return the ramp of a cron job, or nil if it has none.
+func cronJobRamp(cj *db.CronJob) (*db.Ramp, error) {
+	if cj.Ramp == nil {
+		return nil, nil
+	}
+	var ramp db.Ramp
+	if err := json.Unmarshal(cj.Ramp, &ramp); err != nil {
+		return nil, err
+	}
+	return &ramp, nil
+}
+
+// A step of a ramp, when the temperature is changed.
+type rampStep struct {
+	at          time.Time
+	temperature uint
+}
+
+// Return the steps of a ramp from a temperature that starts at start. The steps are evenly spread over the ramp, and
+// the last step, at the end of the ramp, sets the temperature of the ramp.
+func rampSteps(from uint, ramp *db.Ramp, start time.Time) []rampStep {
+	step := max(ramp.Step, 1)
+	diff := max(from, ramp.To) - min(from, ramp.To)
+	n := (diff + step - 1) / step
+	if n == 0 {
+		return nil
+	}
+	duration := time.Duration(ramp.Minutes) * time.Minute
+	steps := make([]rampStep, 0, n)
+	for i := uint(1); i <= n; i++ {
+		change := min(i*step, diff)
+		temperature := from + change
+		if ramp.To < from {
+			temperature = from - change
+		}
+		steps = append(steps, rampStep{start.Add(duration * time.Duration(i) / time.Duration(n)), temperature})
+	}
+	return steps
+}
+
+// Start a ramp from the current temperature of a unit, after a cron job has set it. A ramp in progress on the unit is
+// stopped.
+func startRamp(unit string, ramp *db.Ramp, start time.Time, jobName string) error {
+	dbRc, err := g_store.CurrentConfig(unit)
+	if err != nil {
+		return err
+	}
+	state := &db.RampState{Unit: unit, JobName: jobName, From: dbRc.Temperature, To: ramp.To, Step: max(ramp.Step, 1),
+		Start: start, End: start.Add(time.Duration(ramp.Minutes) * time.Minute)}
+
+	rampMutex.Lock()
+	defer rampMutex.Unlock()
+	stopRamp(unit, "replaced by "+jobName)
+	return scheduleRamp(state, "started ramp")
+}
+
+// Continue the ramp that was in progress on a unit when the controller was stopped.
+func restoreRamp(unit string) {
+	state, err := g_store.GetRampState(unit)
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			slog.Error("failed to get ramp", "unit", unit, "err", err)
+		}
+		return
+	}
+	rampMutex.Lock()
+	defer rampMutex.Unlock()
+	if err := scheduleRamp(state, "restored ramp"); err != nil {
+		slog.Error("failed to restore ramp", "unit", unit, "jobName", state.JobName, "err", err)
+	}
+}
+
+// Schedule the steps of a ramp that are still to come, and save it so that it continues after a restart. Steps that
+// should already have been taken, e.g. when a missed job is caught up, are replaced by sending the temperature of the
+// last of them at once. rampMutex must be held.
+func scheduleRamp(state *db.RampState, msg string) error {
+	unit, jobName := state.Unit, state.JobName
+	ramp := &db.Ramp{To: state.To, Minutes: uint(state.End.Sub(state.Start) / time.Minute), Step: state.Step}
+	steps := rampSteps(state.From, ramp, state.Start)
+
+	now := time.Now()
+	var passed int
+	for passed < len(steps) && !steps[passed].at.After(now) {
+		passed++
+	}
+	if passed > 0 {
+		settings := codecbase.Settings{Temperature: codecbase.Temperatur2String(steps[passed-1].temperature)}
+		if err := sendSettings(unit, &settings, jobName); err != nil {
+			return err
+		}
+	}
+	if passed == len(steps) {
+		slog.Info("ramp has already ended", "unit", unit, "jobName", jobName, "to", ramp.To)
+		if _, err := g_store.DeleteRampState(unit); err != nil {
+			slog.Error("failed to delete ramp", "unit", unit, "err", err)
+		}
+		return nil
+	}
+
+	name := rampJobName(unit)
+	for i, step := range steps[passed:] {
+		_, err := scheduler.NewJob(
+			gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(step.at)),
+			gocron.NewTask(
+				RunRampStepJob,
+				unit,
+				step.temperature,
+				passed+i == len(steps)-1,
+				name,
+			),
+			gocron.WithName(name),
+			gocron.WithTags(rampJobCategory, unit, rampJobTag(unit)),
+		)
+		if err != nil {
+			scheduler.RemoveByTags(rampJobTag(unit))
+			return fmt.Errorf("failed to schedule ramp step: %w", err)
+		}
+	}
+	if err := g_store.SaveRampState(state); err != nil {
+		scheduler.RemoveByTags(rampJobTag(unit))
+		return err
+	}
+	activeRamps[unit] = &ActiveRamp{JobName: jobName, From: state.From, To: ramp.To, Start: state.Start,
+		End: steps[len(steps)-1].at, Temperature: state.From, steps: steps[passed:]}
+	if passed > 0 {
+		activeRamps[unit].Temperature = steps[passed-1].temperature
+	}
+	slog.Info(msg, "unit", unit, "jobName", jobName, "from", state.From, "to", ramp.To,
+		"steps", len(steps)-passed, "end", steps[len(steps)-1].at)
+	return nil
+}
+
+// Send the temperature of a step of the ramp of a unit. Like other settings jobs, the steps are subject to holds.
+func RunRampStepJob(unit string, temperature uint, last bool, jobName string) error {
+	rampMutex.Lock()
+	ramp, found := activeRamps[unit]
+	if found {
+		ramp.Temperature = temperature
+		if last {
+			delete(activeRamps, unit)
+			if _, err := g_store.DeleteRampState(unit); err != nil {
+				slog.Error("failed to delete ramp", "unit", unit, "err", err)
+			}
+		}
+	}
+	rampMutex.Unlock()
+	if !found {
+		// the ramp was stopped while the step waited to run
+		return nil
+	}
+
+	slog.Info("running ramp step", "unit", unit, "jobName", jobName, "temperature", temperature, "startedBy", ramp.JobName)
+	settings := codecbase.Settings{Temperature: codecbase.Temperatur2String(temperature)}
+	describeSettingsRun(jobName, unit, rampJobCategory, 0, time.Now().Truncate(time.Minute), "", &settings)
+	_, err := runSettingsJob(unit, settings, "", jobName)
+	return err
+}
+
+// Stop the ramp of a unit, if it has one. rampMutex must be held.
+func stopRamp(unit, reason string) bool {
+	scheduler.RemoveByTags(rampJobTag(unit))
+	ramp, found := activeRamps[unit]
+	if !found {
+		return false
+	}
+	delete(activeRamps, unit)
+	if _, err := g_store.DeleteRampState(unit); err != nil {
+		slog.Error("failed to delete ramp", "unit", unit, "err", err)
+	}
+	slog.Info("stopped ramp", "unit", unit, "jobName", ramp.JobName, "temperature", ramp.Temperature, "reason", reason)
+	return true
+}
+
+// Stop the ramp of a unit. Returns false if the unit has no ramp in progress.
+func CancelRamp(unit string) bool {
+	rampMutex.Lock()
+	defer rampMutex.Unlock()
+	return stopRamp(unit, "cancelled")
+}
+
+// Stop the ramp of a unit if the power, mode or temperature was changed manually, e.g. with the remote control, so that
+// the ramp doesn't override the change.
+func ManualOverride(unit string, before, after *codec.RcConfig) {
+	if before.Power == after.Power && before.Mode == after.Mode && before.Temperature == after.Temperature {
+		return
+	}
+	rampMutex.Lock()
+	defer rampMutex.Unlock()
+	stopRamp(unit, "manual override")
+}
+
+// Return the ramp in progress on a unit, or nil if there is none.
+func GetActiveRamp(unit string) *ActiveRamp {
+	rampMutex.Lock()
+	defer rampMutex.Unlock()
+	if ramp, found := activeRamps[unit]; found {
+		r := *ramp
+		return &r
+	}
+	return nil
+}
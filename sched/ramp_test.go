@@ -0,0 +1,193 @@
+package sched
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestRampSteps(t *testing.T) {
+	start := time.Date(2025, 1, 10, 22, 0, 0, 0, time.Local)
+	steps := rampSteps(22, &db.Ramp{To: 18, Minutes: 180}, start)
+	if len(steps) != 4 {
+		t.Fatalf("unexpected steps %+v", steps)
+	}
+	for i, want := range []uint{21, 20, 19, 18} {
+		if at := start.Add(time.Duration(i+1) * 45 * time.Minute); steps[i].temperature != want || !steps[i].at.Equal(at) {
+			t.Errorf("step %d: %d at %v, want %d at %v", i, steps[i].temperature, steps[i].at, want, at)
+		}
+	}
+
+	// the last step reaches the temperature of the ramp, also when it is smaller
+	steps = rampSteps(18, &db.Ramp{To: 23, Minutes: 60, Step: 2}, start)
+	if len(steps) != 3 || steps[0].temperature != 20 || steps[2].temperature != 23 || !steps[2].at.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected steps %+v", steps)
+	}
+	if steps = rampSteps(18, &db.Ramp{To: 18, Minutes: 60}, start); len(steps) != 0 {
+		t.Errorf("unexpected steps %+v", steps)
+	}
+
+	for _, ramp := range []db.Ramp{{To: 15, Minutes: 60}, {To: 18}, {To: 18, Minutes: 25 * 60}} {
+		if err := ValidateRamp(&ramp); !errors.Is(err, ErrInvalidRamp) {
+			t.Errorf("ramp %+v: got %v, want ErrInvalidRamp", ramp, err)
+		}
+	}
+}
+
+func TestRamp(t *testing.T) {
+	store := db.NewMemStore()
+	startTestScheduler(t, store)
+
+	checkTemp := func(step string, temp uint) {
+		t.Helper()
+		if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Temperature != temp {
+			t.Errorf("%s: temp %d, want %d", step, rc.Temperature, temp)
+		}
+	}
+	rampJobs := func() int {
+		count := 0
+		for _, j := range scheduler.Jobs() {
+			if j.Name() == rampJobName(db.DefaultUnit) {
+				count++
+			}
+		}
+		return count
+	}
+
+	// a job that ran an hour into its ramp continues where the ramp would be
+	settings := codecbase.Settings{Power: "on", Mode: "heat", Temperature: "22"}
+	ramp := &db.Ramp{To: 18, Minutes: 240}
+	scheduled := time.Now().Add(-time.Hour)
+	if err := runCronJobAt(db.DefaultUnit, "Night", 1, settings, "", ramp, "job", scheduled, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	checkTemp("started ramp", 21)
+	if active := GetActiveRamp(db.DefaultUnit); active == nil || active.From != 22 || active.Temperature != 21 ||
+		!active.End.Equal(scheduled.Add(4*time.Hour)) {
+		t.Errorf("unexpected active ramp %+v", active)
+	}
+	if n := rampJobs(); n != 3 {
+		t.Errorf("%d ramp steps scheduled, want 3", n)
+	}
+	// the remaining steps are forecast
+	runs, err := Upcoming(store, db.DefaultUnit, time.Now(), time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 3 || runs[0].Kind != rampJobCategory || runs[2].Config.Temperature != 18 {
+		t.Errorf("unexpected upcoming runs %+v", runs)
+	}
+
+	// a step is sent like a settings job
+	if err := RunRampStepJob(db.DefaultUnit, 20, false, rampJobName(db.DefaultUnit)); err != nil {
+		t.Fatal(err)
+	}
+	checkTemp("ramp step", 20)
+
+	// a change with the remote control of something else than the power, mode or temperature doesn't stop the ramp
+	rc, _ := store.CurrentConfig(db.DefaultUnit)
+	changed := *rc
+	changed.FanSpeed = codecbase.C_FanSpeed_Lowest
+	ManualOverride(db.DefaultUnit, rc, &changed)
+	if GetActiveRamp(db.DefaultUnit) == nil {
+		t.Error("ramp was stopped by a change of the fan speed")
+	}
+	changed.Temperature = 23
+	ManualOverride(db.DefaultUnit, rc, &changed)
+	if GetActiveRamp(db.DefaultUnit) != nil || rampJobs() != 0 {
+		t.Error("ramp was not stopped by a manual change of the temperature")
+	}
+	// a step that was waiting to run when the ramp was stopped does nothing
+	if err := RunRampStepJob(db.DefaultUnit, 19, false, rampJobName(db.DefaultUnit)); err != nil {
+		t.Fatal(err)
+	}
+	checkTemp("stopped ramp", 20)
+
+	// a settings job that changes the temperature stops the ramp, but one that changes something else doesn't
+	if err := runCronJobAt(db.DefaultUnit, "Night", 1, settings, "", ramp, "job", time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	RunSettingsJob(db.DefaultUnit, codecbase.Settings{Quiet: "on"}, "", "quiet")
+	if GetActiveRamp(db.DefaultUnit) == nil || rampJobs() != 4 {
+		t.Error("ramp was stopped by a job that doesn't change the temperature")
+	}
+	RunSettingsJob(db.DefaultUnit, codecbase.Settings{Temperature: "20"}, "", "other")
+	if GetActiveRamp(db.DefaultUnit) != nil || rampJobs() != 0 {
+		t.Error("ramp was not stopped by a settings job")
+	}
+
+	// a ramp that has already ended sets the temperature of the ramp
+	if err := runCronJobAt(db.DefaultUnit, "Night", 1, settings, "", ramp, "job", time.Now().Add(-5*time.Hour), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	checkTemp("ended ramp", 18)
+	if GetActiveRamp(db.DefaultUnit) != nil {
+		t.Error("ramp that has ended is active")
+	}
+
+	// cancelling a ramp reports whether there was one
+	if err := runCronJobAt(db.DefaultUnit, "Night", 1, settings, "", &db.Ramp{To: 21, Minutes: 1}, "job", time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !CancelRamp(db.DefaultUnit) || CancelRamp(db.DefaultUnit) {
+		t.Error("unexpected result of cancelling the ramp")
+	}
+}
+
+func TestRestoreRamp(t *testing.T) {
+	store := db.NewMemStore()
+	start := time.Now().Add(-time.Hour)
+	store.SaveRampState(&db.RampState{Unit: db.DefaultUnit, JobName: "job", From: 22, To: 18, Step: 1, Start: start,
+		End: start.Add(4 * time.Hour)})
+	startTestScheduler(t, store)
+
+	// the step missed while the controller wasn't running is taken, and the remaining steps are scheduled
+	if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Temperature != 21 {
+		t.Errorf("temp %d, want 21", rc.Temperature)
+	}
+	if active := GetActiveRamp(db.DefaultUnit); active == nil || active.Temperature != 21 || len(active.steps) != 3 {
+		t.Errorf("unexpected active ramp %+v", active)
+	}
+	if !CancelRamp(db.DefaultUnit) {
+		t.Error("ramp was not restored")
+	}
+	if _, err := store.GetRampState(db.DefaultUnit); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("stopped ramp is saved: %v", err)
+	}
+}
+
+func TestLoadJobsFileRamp(t *testing.T) {
+	store := db.NewMemStore()
+	jobs := `{ "Night": { "active": true, "cronjobs": [
+  { "schedule": "0 22 * * *", "settings": { "temp": "22" }, "ramp": { "to": 18, "minutes": 180 } }
+] } }`
+	if _, err := LoadJobsFile(store, writeJobsFile(t, jobs), false); err != nil {
+		t.Fatal(err)
+	}
+	cjs, _ := store.GetCronJobs(db.DefaultUnit, "Night")
+	if ramp, err := cronJobRamp(&(*cjs)[0]); err != nil || ramp == nil || ramp.To != 18 || ramp.Minutes != 180 {
+		t.Errorf("unexpected ramp %+v, err %v", ramp, err)
+	}
+
+	// a changed ramp changes the job
+	diff, err := LoadJobsFile(store, writeJobsFile(t, strings.Replace(jobs, `"minutes": 180`, `"minutes": 180, "step": 2`, 1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `~ default/Night
+    - "0 22 * * *" {"temp":"22"} ramp={"to":18,"minutes":180}
+    + "0 22 * * *" {"temp":"22"} ramp={"to":18,"minutes":180,"step":2}
+`
+	if diff.String() != want {
+		t.Errorf("diff\n%s\nwant\n%s", diff, want)
+	}
+
+	_, err = LoadJobsFile(store, writeJobsFile(t, strings.Replace(jobs, `"to": 18`, `"to": 40`, 1)), false)
+	if !errors.Is(err, ErrInvalidRamp) || !strings.Contains(err.Error(), "jobs.json:2: job set Night") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
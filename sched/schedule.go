@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/go-co-op/gocron/v2"
@@ -16,60 +18,133 @@ import (
 )
 
 var scheduler gocron.Scheduler
-var g_irSender *codec.IrSender
+var g_irSenders map[string]*codec.IrSender
+var g_store db.Store
 
 const settingsJobCategory = "settings"
 const timerJobCategory = "timer"
 
+// Send a config to the unit, if there is a sender for it.
+func sendConfig(unit string, sendRc *codec.RcConfig) bool {
+	irSender, found := g_irSenders[unit]
+	if !found {
+		slog.Error("no IR sender for unit", "unit", unit)
+		return false
+	}
+	irSender.SendConfig(sendRc)
+	return true
+}
+
 func RunInitializationJob() {
 	slog.Info("running initialization job")
 
-	dbRc, err := db.CurrentConfig()
+	for unit := range g_irSenders {
+		dbRc, err := g_store.CurrentConfig(unit)
+		if err != nil {
+			slog.Error("RunInitializationJob: failed to get current config", "unit", unit, "err", err)
+			continue
+		}
+
+		sendRc := dbRc.CopyForSendingAll()
+		sendConfig(unit, sendRc)
+	}
+}
+
+// Apply the settings of a job to the current config of a unit and send it, unless a hold of the unit defers or skips
+// the job. An error is returned if the config couldn't be sent.
+func RunSettingsJob(unit string, settings codecbase.Settings, preset string, jobName string) error {
+	_, err := runSettingsJob(unit, settings, preset, jobName)
+	return err
+}
+
+// Like RunSettingsJob, but returns the settings that were sent, or nil if a hold deferred or skipped the job. A job that
+// changes the power, mode or temperature stops the ramp of the unit, unless it is a step of the ramp.
+func runSettingsJob(unit string, settings codecbase.Settings, preset string, jobName string) (*codecbase.Settings, error) {
+	slog.Info("running settings job", "unit", unit, "jobName", jobName, "preset", preset)
+
+	// presets are resolved when the job runs, so that changes to a preset apply to all jobs using it
+	resolved, err := db.ResolvePreset(g_store, preset, &settings)
 	if err != nil {
-		slog.Error("RunInitializationJob: failed to get current config", "err", err)
-		return
+		slog.Error("RunSettingsJob: failed to resolve preset", "jobName", jobName, "err", err)
+		return nil, err
 	}
 
-	sendRc := dbRc.CopyForSendingAll()
-	g_irSender.SendConfig(sendRc)
+	holdMutex.Lock()
+	defer holdMutex.Unlock()
+	if hold, err := g_store.GetHold(unit); err == nil && time.Now().Before(hold.Until) {
+		if resolved, err = applyHoldPolicy(hold, resolved, jobName); err != nil || resolved == nil {
+			return nil, err
+		}
+	}
+	if err := sendSettings(unit, resolved, jobName); err != nil {
+		return nil, err
+	}
+	if jobName != rampJobName(unit) && (resolved.Power != "" || resolved.Mode != "" || resolved.Temperature != "") {
+		rampMutex.Lock()
+		stopRamp(unit, "replaced by "+jobName)
+		rampMutex.Unlock()
+	}
+	return resolved, nil
 }
 
-func RunSettingsJob(settings codecbase.Settings, jobName string) {
-	slog.Info("running settings job", "jobName", jobName)
+// Return the config to send when settings are applied to rc, with the mode settings of the unit. An error is returned if
+// the settings are rejected or the config is invalid. This is shared by the jobs and the forecast of Upcoming.
+func composeConfig(modeSettings rcutils.ModeSettingsProvider, settings *codecbase.Settings, rc *codec.RcConfig) (*codec.RcConfig, error) {
+	sendRc, err := rcutils.ComposeSendConfig(modeSettings, settings, rc)
+	if err != nil {
+		return nil, err
+	}
+	if violations := sendRc.Validate(); violations != nil {
+		return nil, violations
+	}
+	return sendRc, nil
+}
 
-	dbRc, err := db.CurrentConfig()
+// Apply settings to the current config of a unit, send it and save it.
+func sendSettings(unit string, settings *codecbase.Settings, jobName string) error {
+	dbRc, err := g_store.CurrentConfig(unit)
 	if err != nil {
-		slog.Error("RunSettingsJob: failed to get current config", "err", err)
-		return
+		slog.Error("sendSettings: failed to get current config", "err", err)
+		return err
 	}
 
-	sendRc := rcutils.ComposeSendConfig(&settings, dbRc)
-	g_irSender.SendConfig(sendRc)
+	sendRc, err := composeConfig(db.UnitModeSettings{Store: g_store, Unit: unit}, settings, dbRc)
+	if err != nil {
+		slog.Error("sendSettings: failed to compose config", "jobName", jobName, "err", err)
+		return err
+	}
+	if !sendConfig(unit, sendRc) {
+		return fmt.Errorf("no IR sender for unit %q", unit)
+	}
 
-	err = db.SaveConfig(sendRc, dbRc)
+	err = g_store.SaveConfig(unit, sendRc, dbRc)
 	if err != nil {
-		slog.Error("RunSettingsJob: failed to save config", "err", err)
-		return
+		slog.Error("sendSettings: failed to save config", "err", err)
+		return err
 	}
 
-	CondRestartTimerJobs(&settings)
+	CondRestartTimerJobs(unit, settings)
+	return nil
 }
 
-func ScheduleJobsForJobset(jobset string, active bool) {
+func ScheduleJobsForJobset(unit string, jobset string, active bool) {
+	jobsetGensMutex.Lock()
+	defer jobsetGensMutex.Unlock()
+
 	// remove existing jobs of the current generation
-	jobsetGen := jobsetGens.currentGen(settingsJobCategory, jobset)
+	jobsetGen := jobsetGens.currentGen(settingsJobCategory, unit+"/"+jobset)
 	scheduler.RemoveByTags(jobsetGen)
 
 	if !active {
-		slog.Info("Unscheduled inactive jobset", "jobset", jobset, "jobsetGen", jobsetGen)
+		slog.Info("Unscheduled inactive jobset", "unit", unit, "jobset", jobset, "jobsetGen", jobsetGen)
 		return
 	}
 
 	// get the next job generation before creating new jobs
-	jobsetGen = jobsetGens.nextGen(settingsJobCategory, jobset)
-	slog.Info("Scheduling jobset", "jobset", jobset, "jobsetGen", jobsetGen)
+	jobsetGen = jobsetGens.nextGen(settingsJobCategory, unit+"/"+jobset)
+	slog.Info("Scheduling jobset", "unit", unit, "jobset", jobset, "jobsetGen", jobsetGen)
 
-	cjs, err := db.GetCronJobs(jobset)
+	cjs, err := g_store.GetCronJobs(unit, jobset)
 	if err != nil {
 		slog.Error("failed to get cronjobs", "err", err)
 		return
@@ -82,105 +157,176 @@ func ScheduleJobsForJobset(jobset string, active bool) {
 			slog.Error("failed to unmarshal json", "err", err)
 			break
 		}
-		name := fmt.Sprintf("%s_%d %s", jobset, cj.ID, cj.Schedule)
+		ramp, err := cronJobRamp(&cj)
+		if err != nil {
+			slog.Error("failed to unmarshal json", "err", err)
+			break
+		}
+		name := fmt.Sprintf("%s/%s_%d %s", unit, jobset, cj.ID, cj.Schedule)
+		if isSolarSchedule(cj.Schedule) {
+			if err := scheduleSolarJob(unit, jobset, jobsetGen, cj.Schedule, cj.ID, *settings, cj.Preset, ramp, name, time.Now()); err != nil {
+				slog.Error("failed to schedule solar settings job", "schedule", cj.Schedule, "err", err)
+			}
+			continue
+		}
 		j, err := scheduler.NewJob(
 			gocron.CronJob(cj.Schedule, false),
 			gocron.NewTask(
-				RunSettingsJob,
+				RunCronJob,
+				unit,
+				jobset,
+				cj.ID,
+				cj.Schedule,
 				*settings,
+				cj.Preset,
+				ramp,
 				name,
 			),
 			gocron.WithName(name),
-			gocron.WithTags(settingsJobCategory, jobset, jobsetGen),
+			gocron.WithTags(settingsJobCategory, unit, jobset, jobsetGen),
 		)
 		if err != nil {
 			slog.Error("failed to schedule settings job", "schedule", cj.Schedule, "err", err)
 			break
 		}
-		slog.Debug("scheduled settings job", "jobset", jobset, "jobsetGen", jobsetGen, "job_id", j.ID())
+		slog.Debug("scheduled settings job", "unit", unit, "jobset", jobset, "jobsetGen", jobsetGen, "job_id", j.ID())
 	}
 	listJobs()
 }
 
 func createSettingsJobs() {
-	if jss, err := db.GetActiveJobSets(); err != nil {
+	if jss, err := g_store.GetActiveJobSets(); err != nil {
 		slog.Error("failed to get active jobsets", "err", err)
 	} else {
 		for _, js := range *jss {
-			ScheduleJobsForJobset(js.Name, js.Active)
+			if _, found := g_irSenders[js.Unit]; !found {
+				slog.Warn("not scheduling jobset of unconfigured unit", "unit", js.Unit, "jobset", js.Name)
+				continue
+			}
+			ScheduleJobsForJobset(js.Unit, js.Name, js.Active)
 		}
 	}
 }
 
-func RunTimerJob(power uint, jobName string) {
-	slog.Info("running timer job", "jobName", jobName, "power", power)
-	if err := db.SetPower(power); err != nil {
+// Reschedule the job sets, activations, one-time jobs and timers of a unit, after another process has changed them in the store.
+func ReloadUnit(unit string) error {
+	if _, found := g_irSenders[unit]; !found {
+		return fmt.Errorf("unit %q is not configured", unit)
+	}
+	// before getting the job sets, since it activates and deactivates job sets
+	createActivationJobs(unit)
+	jss, err := g_store.GetJobSets(unit)
+	if err != nil {
+		return err
+	}
+	// remove the jobs of job sets that have been deleted
+	for _, j := range scheduler.Jobs() {
+		tags := j.Tags()
+		if len(tags) == 4 && tags[0] == settingsJobCategory && tags[1] == unit &&
+			!slices.ContainsFunc(*jss, func(js db.JobSet) bool { return js.Name == tags[2] }) {
+			scheduler.RemoveJob(j.ID())
+		}
+	}
+	for _, js := range *jss {
+		ScheduleJobsForJobset(unit, js.Name, js.Active)
+	}
+	createOneTimeJobs(unit)
+	scheduleHoldEnd(unit)
+	RestartTimerJobs(unit)
+	return nil
+}
+
+// Return the next run of a cron job, or the zero time if it isn't scheduled, e.g. because its job set is inactive.
+func NextRun(unit, jobset string, id uint) time.Time {
+	prefix := fmt.Sprintf("%s/%s_%d ", unit, jobset, id)
+	for _, j := range scheduler.Jobs() {
+		if tags := j.Tags(); len(tags) > 0 && tags[0] == settingsJobCategory && strings.HasPrefix(j.Name(), prefix) {
+			if next, err := j.NextRun(); err == nil && !next.IsZero() {
+				return next
+			}
+		}
+	}
+	return time.Time{}
+}
+
+func RunTimerJob(unit string, power uint, jobName string) error {
+	slog.Info("running timer job", "unit", unit, "jobName", jobName, "power", power)
+	describeSettingsRun(jobName, unit, timerJobCategory, 0, time.Now().Truncate(time.Minute), "",
+		&codecbase.Settings{Power: codecbase.Power2String(power)})
+	if err := g_store.SetPower(unit, power); err != nil {
 		slog.Error("RunTimerJob: failed to set power", "err", err)
-		return
+		return err
 	}
 	slog.Debug("RunTimerJob: updated power", "power", power)
+	return nil
 }
 
-func scheduleTimerJob(jobName, jobsetGen string, power uint, t codec.Time) (gocron.Job, error) {
+func scheduleTimerJob(unit, jobName, jobsetGen string, power uint, t codec.Time) (gocron.Job, error) {
 	j, err := scheduler.NewJob(
 		gocron.DailyJob(1, gocron.NewAtTimes(gocron.NewAtTime(t.Hour(), t.Minute(), 0))),
 		gocron.NewTask(
 			RunTimerJob,
+			unit,
 			power,
 			jobName,
 		),
 		gocron.WithName(jobName),
-		gocron.WithTags(timerJobCategory, jobsetGen),
+		gocron.WithTags(timerJobCategory, unit, jobsetGen),
 	)
 	if err != nil {
-		slog.Error("failed to schedule timer job", "jobName", jobName, "jobsetGen", jobsetGen, "at", t.ToString(), "err", err)
+		slog.Error("failed to schedule timer job", "unit", unit, "jobName", jobName, "jobsetGen", jobsetGen, "at", t.ToString(), "err", err)
 		return nil, err
 	}
-	slog.Info("scheduled timer job", "jobName", jobName, "jobsetGen", jobsetGen, "at", t.ToString())
+	slog.Info("scheduled timer job", "unit", unit, "jobName", jobName, "jobsetGen", jobsetGen, "at", t.ToString())
 	return j, nil
 }
 
-func RunDstTransitionJob(jobName, jobsetGen string) {
-	slog.Info("running DST transition job", "jobName", jobName, "jobsetGen", jobsetGen)
+func RunDstTransitionJob(unit, jobName, jobsetGen string) error {
+	slog.Info("running DST transition job", "unit", unit, "jobName", jobName, "jobsetGen", jobsetGen)
+	describeSettingsRun(jobName, unit, dstJobKind, 0, time.Now().Truncate(time.Minute), "", nil)
+
+	// re-schedule the next DST transition job
+	defer scheduleDstTransitionJob(unit, jobName, jobsetGen)
 
-	dbRc, err := db.CurrentConfig()
+	dbRc, err := g_store.CurrentConfig(unit)
 	if err != nil {
 		slog.Error("RunDstTransitionJob: failed to get current config", "err", err)
-		return
+		return err
 	}
 
 	// re-send the current configuration with an updated clock
 	sendRc := dbRc.CopyForSendingAll()
-	g_irSender.SendConfig(sendRc)
-
-	// re-schedule the next DST transition job
-	scheduleDstTransitionJob(jobName, jobsetGen)
+	if !sendConfig(unit, sendRc) {
+		return fmt.Errorf("no IR sender for unit %q", unit)
+	}
+	return nil
 }
 
-func scheduleDstTransitionJob(jobName, jobsetGen string) (gocron.Job, error) {
+func scheduleDstTransitionJob(unit, jobName, jobsetGen string) (gocron.Job, error) {
 	_, end := time.Now().ZoneBounds()
 	j, err := scheduler.NewJob(
 		gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(end)),
 		gocron.NewTask(
 			RunDstTransitionJob,
+			unit,
 			jobName,
 			jobsetGen,
 		),
 		gocron.WithName(jobName),
-		gocron.WithTags(timerJobCategory, jobsetGen),
+		gocron.WithTags(timerJobCategory, unit, jobsetGen),
 	)
 	if err != nil {
-		slog.Error("failed to schedule DST transition job", "jobName", jobName, "jobsetGen", jobsetGen, "at", end, "err", err)
+		slog.Error("failed to schedule DST transition job", "unit", unit, "jobName", jobName, "jobsetGen", jobsetGen, "at", end, "err", err)
 		return nil, err
 	}
-	slog.Info("scheduled DST transition job", "jobName", jobName, "jobsetGen", jobsetGen, "at", end)
+	slog.Info("scheduled DST transition job", "unit", unit, "jobName", jobName, "jobsetGen", jobsetGen, "at", end)
 	return j, nil
 }
 
-func CondRestartTimerJobs(settings *codecbase.Settings) {
+func CondRestartTimerJobs(unit string, settings *codecbase.Settings) {
 	if settings.TimerOn != "" || settings.TimerOnTime != "" ||
 		settings.TimerOff != "" || settings.TimerOffTime != "" {
-		RestartTimerJobs()
+		RestartTimerJobs(unit)
 	}
 }
 
@@ -188,22 +334,24 @@ func CondRestartTimerJobs(settings *codecbase.Settings) {
 // on the current indoor and outdoor temperatures (it actually turns on silently to check the temperatures so it can
 // decide how long time before to power on). After being off during the night it sometimes starts 45 minutes before.
 // Since we can't know when it will start, we'll create two timer on jobs, one that runs 60 minutes before time and one
-// that runs on time.
-func RestartTimerJobs() {
-	slog.Debug("restarting timer jobs")
+// that runs on time. Each unit has its own timers.
+func RestartTimerJobs(unit string) {
+	slog.Debug("restarting timer jobs", "unit", unit)
+	jobsetGensMutex.Lock()
+	defer jobsetGensMutex.Unlock()
 
-	dbRc, err := db.CurrentConfig()
+	dbRc, err := g_store.CurrentConfig(unit)
 	if err != nil {
-		slog.Error("failed to get current config", "err", err)
+		slog.Error("failed to get current config", "unit", unit, "err", err)
 		return
 	}
 
 	// remove existing jobs of the current generation
-	jobsetGen := jobsetGens.currentGen(timerJobCategory, timerJobCategory)
+	jobsetGen := jobsetGens.currentGen(timerJobCategory, unit)
 	scheduler.RemoveByTags(jobsetGen)
 
 	// get the next job generation before creating new jobs
-	jobsetGen = jobsetGens.nextGen(timerJobCategory, timerJobCategory)
+	jobsetGen = jobsetGens.nextGen(timerJobCategory, unit)
 
 	const job1MinutesBefore = 60
 	if dbRc.TimerOn == codecbase.C_Timer_Enabled {
@@ -214,21 +362,21 @@ func RestartTimerJobs() {
 		} else {
 			preOnTime = 24*60 + onTime - job1MinutesBefore
 		}
-		scheduleTimerJob("timer_on_pre", jobsetGen, codecbase.C_Power_On, preOnTime)
-		scheduleTimerJob("timer_on", jobsetGen, codecbase.C_Power_On, onTime)
+		scheduleTimerJob(unit, "timer_on_pre", jobsetGen, codecbase.C_Power_On, preOnTime)
+		scheduleTimerJob(unit, "timer_on", jobsetGen, codecbase.C_Power_On, onTime)
 	}
 	if dbRc.TimerOff == codecbase.C_Timer_Enabled {
 		jobTime := dbRc.TimerOffTime
-		scheduleTimerJob("timer_off", jobsetGen, codecbase.C_Power_Off, jobTime)
+		scheduleTimerJob(unit, "timer_off", jobsetGen, codecbase.C_Power_Off, jobTime)
 	}
 
 	// schedule a DST transition job if timers are enabled
 	if dbRc.TimerOn == codecbase.C_Timer_Enabled || dbRc.TimerOff == codecbase.C_Timer_Enabled {
-		scheduleDstTransitionJob("dst_transition", jobsetGen)
+		scheduleDstTransitionJob(unit, "dst_transition", jobsetGen)
 	}
 
 	listJobs()
-	slog.Debug("updated timer jobs")
+	slog.Debug("updated timer jobs", "unit", unit)
 }
 
 func listJobs() {
@@ -239,15 +387,23 @@ func listJobs() {
 	}
 }
 
-func InitScheduler(irSender *codec.IrSender) error {
+// Initialize the scheduler with the store and the IR senders of the configured units, keyed by unit name.
+func InitScheduler(store db.Store, irSenders map[string]*codec.IrSender) error {
 	var err error
 
-	g_irSender = irSender
+	g_store = store
+	g_irSenders = irSenders
 
 	// create a scheduler
 	scheduler, err = gocron.NewScheduler(
 		gocron.WithLogger(slog.Default()),
 		gocron.WithLimitConcurrentJobs(1, gocron.LimitModeWait),
+		// record the runs of the jobs
+		gocron.WithGlobalJobOptions(gocron.WithEventListeners(
+			gocron.BeforeJobRuns(beforeJobRuns),
+			gocron.AfterJobRuns(afterJobRuns),
+			gocron.AfterJobRunsWithError(afterJobRunsWithError),
+		)),
 	)
 	if err != nil {
 		return err
@@ -271,9 +427,24 @@ func InitScheduler(irSender *codec.IrSender) error {
 	}
 	slog.Info("Scheduled initialization job")
 
-	// Schedule all the active cron jobs
+	// Schedule all the active cron jobs, after the job sets with an activation have been activated or deactivated. The
+	// jobs that were missed before now are caught up, while the scheduler runs those after now.
+	now := time.Now()
+	for unit := range g_irSenders {
+		createActivationJobs(unit)
+	}
 	createSettingsJobs()
-	RestartTimerJobs()
+	for unit := range g_irSenders {
+		// a hold that ended while the controller wasn't running ends before the missed jobs are caught up
+		scheduleHoldEnd(unit)
+		// a ramp continues before the missed jobs are caught up, which may replace it
+		restoreRamp(unit)
+		scheduleCatchUpJob(unit, now)
+		createOneTimeJobs(unit)
+		RestartTimerJobs(unit)
+		scheduleThermostatJob(unit)
+	}
+	scheduleSensorJobs()
 
 	return nil
 }
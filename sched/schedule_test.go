@@ -0,0 +1,37 @@
+package sched
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+// Start the scheduler with the store, and an IR sender of the default unit that writes to a file. Both are stopped when
+// the test ends.
+func startTestScheduler(t *testing.T, store db.Store) {
+	t.Helper()
+	senderOptions := codec.NewSenderOptions()
+	senderOptions.Device = false
+	irSender := codec.StartIrSender(filepath.Join(t.TempDir(), "out.lirc"), senderOptions)
+	t.Cleanup(irSender.Stop)
+	if err := InitScheduler(store, map[string]*codec.IrSender{db.DefaultUnit: irSender}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(Stop)
+}
+
+// Wait until cond is true, which is checked every 10ms. The test fails if it isn't true within a few seconds, which is
+// plenty even on a slow Raspberry Pi.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,165 @@
+package sched
+
+import (
+	"log/slog"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sensor"
+)
+
+const sensorJobCategory = "sensors"
+
+// The sensors are sampled regularly, and the samples are kept for two days. Older samples are downsampled to hourly
+// averages, which are kept for a year.
+const (
+	SENSOR_SAMPLE_INTERVAL   = 5 * time.Minute
+	SENSOR_RAW_RETENTION     = 48 * time.Hour
+	SENSOR_HISTORY_RETENTION = 365 * 24 * time.Hour
+)
+
+var g_sensors sensor.Sensors
+
+// The time of the last saved reading of each sensor, so that a reading of a file or push sensor that hasn't been
+// updated since the last sample isn't saved twice.
+var lastSampled = make(map[string]time.Time)
+var sampleMutex sync.Mutex
+
+// Return the sensor with the given name, or nil if there is none.
+func GetSensor(name string) sensor.Sensor {
+	return g_sensors[name]
+}
+
+// Return the names of the sensors, sorted.
+func SensorNames() []string {
+	names := make([]string, 0, len(g_sensors))
+	for name := range g_sensors {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Read all sensors and save the readings in the store. Sensors that can't be read are skipped.
+func RunSensorSampleJob() error {
+	sampleMutex.Lock()
+	defer sampleMutex.Unlock()
+	for _, name := range SensorNames() {
+		r, err := g_sensors[name].Read()
+		if err != nil {
+			slog.Warn("failed to read sensor", "sensor", name, "err", err)
+			continue
+		}
+		if !r.Time.After(lastSampled[name]) {
+			continue
+		}
+		reading := db.SensorReading{Sensor: name, Time: r.Time, Temperature: r.Temperature, Humidity: r.Humidity}
+		if err := g_store.SaveSensorReading(&reading); err != nil {
+			return err
+		}
+		lastSampled[name] = r.Time
+	}
+	return nil
+}
+
+// Replace the readings that are older than SENSOR_RAW_RETENTION by the average of each hour, and delete the readings
+// that are older than SENSOR_HISTORY_RETENTION.
+func RunSensorDownsampleJob() error {
+	return downsampleSensorReadings(time.Now())
+}
+
+type sensorAverage struct {
+	hour                       time.Time
+	temperature, humidity      float64
+	readings, humidityReadings int
+}
+
+// Round an average to hundredths of a degree or percent.
+func roundAverage(sum float64, n int) float64 {
+	return math.Round(sum/float64(n)*100) / 100
+}
+
+func downsampleSensorReadings(now time.Time) error {
+	oldest := now.Add(-SENSOR_HISTORY_RETENTION)
+	before := now.Add(-SENSOR_RAW_RETENTION).Truncate(time.Hour)
+	return g_store.WithTx(func(tx db.Store) error {
+		if err := tx.DeleteSensorReadingsBefore(oldest); err != nil {
+			return err
+		}
+		for _, name := range SensorNames() {
+			readings, err := tx.GetSensorReadings(name, oldest, before)
+			if err != nil {
+				return err
+			}
+			var ids []uint
+			var averages []*sensorAverage
+			for _, r := range *readings {
+				if r.Period != 0 {
+					continue
+				}
+				ids = append(ids, r.ID)
+				// the readings are ordered by time
+				hour := r.Time.Truncate(time.Hour)
+				if len(averages) == 0 || !averages[len(averages)-1].hour.Equal(hour) {
+					averages = append(averages, &sensorAverage{hour: hour})
+				}
+				a := averages[len(averages)-1]
+				a.temperature += r.Temperature
+				a.readings++
+				if r.Humidity != nil {
+					a.humidity += *r.Humidity
+					a.humidityReadings++
+				}
+			}
+			if len(ids) == 0 {
+				continue
+			}
+			if err := tx.DeleteSensorReadings(ids); err != nil {
+				return err
+			}
+			for _, a := range averages {
+				reading := db.SensorReading{Sensor: name, Time: a.hour, Temperature: roundAverage(a.temperature, a.readings), Period: time.Hour}
+				if a.humidityReadings > 0 {
+					humidity := roundAverage(a.humidity, a.humidityReadings)
+					reading.Humidity = &humidity
+				}
+				if err := tx.SaveSensorReading(&reading); err != nil {
+					return err
+				}
+			}
+			slog.Info("downsampled sensor readings", "sensor", name, "readings", len(ids), "hours", len(averages))
+		}
+		return nil
+	})
+}
+
+// Schedule the sampling and downsampling of the sensors, if there are any.
+func scheduleSensorJobs() {
+	if len(g_sensors) == 0 {
+		return
+	}
+	for name, job := range map[string]struct {
+		interval time.Duration
+		task     func() error
+	}{
+		"sensors/sample":     {SENSOR_SAMPLE_INTERVAL, RunSensorSampleJob},
+		"sensors/downsample": {time.Hour, RunSensorDownsampleJob},
+	} {
+		_, err := scheduler.NewJob(
+			gocron.DurationJob(job.interval),
+			gocron.NewTask(job.task),
+			gocron.WithName(name),
+			gocron.WithTags(sensorJobCategory),
+		)
+		if err != nil {
+			slog.Error("failed to schedule sensor job", "jobName", name, "err", err)
+			continue
+		}
+		slog.Info("scheduled sensor job", "jobName", name, "interval", job.interval)
+	}
+}
@@ -0,0 +1,92 @@
+package sched
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sensor"
+)
+
+func TestSensorSampling(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "temp1_input"), []byte("21500\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "humidity1_input"), []byte("40000\n"), 0644)
+	hwmon, _ := sensor.New(sensor.Config{Type: sensor.HWMON, Path: dir})
+	push := &sensor.PushSensor{}
+	if err := SetSensors(sensor.Sensors{"living": hwmon, "bedroom": push}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSensors(nil, nil)
+	store := db.NewMemStore()
+	g_store = store
+
+	// the push sensor has no reading yet
+	if err := RunSensorSampleJob(); err != nil {
+		t.Fatal(err)
+	}
+	push.Push(sensor.Reading{Temperature: 19})
+	RunSensorSampleJob()
+	// a pushed reading is only saved once
+	RunSensorSampleJob()
+
+	now := time.Now()
+	if readings, _ := store.GetSensorReadings("living", now.Add(-time.Hour), now.Add(time.Hour)); len(*readings) != 3 ||
+		(*readings)[0].Temperature != 21.5 || (*readings)[0].Humidity == nil || *(*readings)[0].Humidity != 40 {
+		t.Errorf("unexpected readings %+v", *readings)
+	}
+	if readings, _ := store.GetSensorReadings("bedroom", now.Add(-time.Hour), now.Add(time.Hour)); len(*readings) != 1 ||
+		(*readings)[0].Temperature != 19 || (*readings)[0].Humidity != nil {
+		t.Errorf("unexpected readings %+v", *readings)
+	}
+}
+
+func TestSensorDownsampling(t *testing.T) {
+	if err := SetSensors(sensor.Sensors{"living": &sensor.PushSensor{}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSensors(nil, nil)
+	store := db.NewMemStore()
+	g_store = store
+
+	now := time.Date(2024, 11, 10, 14, 20, 0, 0, time.UTC)
+	start := time.Date(2024, 11, 8, 12, 0, 0, 0, time.UTC)
+	humidity := 50.0
+	// a reading every 20 minutes during 4 hours, of which the first 2 hours are older than SENSOR_RAW_RETENTION
+	for i := range 12 {
+		r := db.SensorReading{Sensor: "living", Time: start.Add(time.Duration(i) * 20 * time.Minute), Temperature: 20 + float64(i)}
+		if i < 3 {
+			r.Humidity = &humidity
+		}
+		store.SaveSensorReading(&r)
+	}
+	// a reading that is older than SENSOR_HISTORY_RETENTION
+	store.SaveSensorReading(&db.SensorReading{Sensor: "living", Time: now.Add(-SENSOR_HISTORY_RETENTION - time.Hour), Period: time.Hour})
+
+	if err := downsampleSensorReadings(now); err != nil {
+		t.Fatal(err)
+	}
+	readings, _ := store.GetSensorReadings("living", time.Time{}, now)
+	if len(*readings) != 8 {
+		t.Fatalf("unexpected readings %+v", *readings)
+	}
+	for i, want := range []db.SensorReading{{Time: start, Temperature: 21, Period: time.Hour}, {Time: start.Add(time.Hour), Temperature: 24, Period: time.Hour}} {
+		if r := (*readings)[i]; !r.Time.Equal(want.Time) || r.Temperature != want.Temperature || r.Period != want.Period {
+			t.Errorf("average %d: %+v, want %+v", i, r, want)
+		}
+	}
+	if h := (*readings)[0].Humidity; h == nil || *h != 50 || (*readings)[1].Humidity != nil {
+		t.Errorf("unexpected humidity of averages %+v", *readings)
+	}
+	if r := (*readings)[2]; r.Period != 0 || !r.Time.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("unexpected reading %+v", r)
+	}
+
+	// downsampling again changes nothing
+	downsampleSensorReadings(now)
+	if readings, _ = store.GetSensorReadings("living", time.Time{}, now); len(*readings) != 8 {
+		t.Errorf("%d readings after downsampling again, want 8", len(*readings))
+	}
+}
@@ -0,0 +1,151 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/solar"
+)
+
+const SUNRISE = "@sunrise"
+const SUNSET = "@sunset"
+
+// The largest offset from sunrise or sunset, so that a job always runs on the same day as the event.
+const MAX_SOLAR_OFFSET = 12 * time.Hour
+
+// The location used to compute sunrise and sunset, or nil if it isn't configured.
+var g_location *solar.Location
+
+var errNoLocation = errors.New("the location is not configured, which is needed for schedules relative to sunrise and sunset")
+
+// Set the location used by schedules relative to sunrise and sunset. It must be set before the scheduler is
+// initialized.
+func SetLocation(loc *solar.Location) {
+	g_location = loc
+}
+
+// A schedule relative to sunrise or sunset, e.g. "@sunset-30m" or "@sunrise+1h15m".
+type SolarSchedule struct {
+	Event  string // SUNRISE or SUNSET
+	Offset time.Duration
+}
+
+func isSolarSchedule(schedule string) bool {
+	return strings.HasPrefix(schedule, SUNRISE) || strings.HasPrefix(schedule, SUNSET)
+}
+
+func ParseSolarSchedule(schedule string) (*SolarSchedule, error) {
+	var s SolarSchedule
+	var offset string
+	var found bool
+	if offset, found = strings.CutPrefix(schedule, SUNRISE); found {
+		s.Event = SUNRISE
+	} else if offset, found = strings.CutPrefix(schedule, SUNSET); found {
+		s.Event = SUNSET
+	} else {
+		return nil, fmt.Errorf("schedule %q is not relative to %s or %s", schedule, SUNRISE, SUNSET)
+	}
+	if offset != "" {
+		if offset[0] != '+' && offset[0] != '-' {
+			return nil, fmt.Errorf("invalid offset %q in schedule %q, expecting e.g. %s-30m", offset, schedule, s.Event)
+		}
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %q in schedule %q, expecting e.g. %s-30m", offset, schedule, s.Event)
+		}
+		if d <= -MAX_SOLAR_OFFSET || d >= MAX_SOLAR_OFFSET {
+			return nil, fmt.Errorf("offset %q in schedule %q must be less than %s", offset, schedule, MAX_SOLAR_OFFSET)
+		}
+		s.Offset = d
+	}
+	return &s, nil
+}
+
+// Return the first time of the schedule after the given time. Days without sunrise or sunset, i.e. during polar day or
+// night, are skipped. If there is no such day within a year, ok is false.
+func (s *SolarSchedule) Next(after time.Time, loc solar.Location) (next time.Time, ok bool) {
+	// start the day before, since a negative offset can move the time to the previous day
+	for d := -1; d <= 366; d++ {
+		sunrise, sunset, ok := solar.SunriseSunset(after.AddDate(0, 0, d), loc)
+		if !ok {
+			continue
+		}
+		t := sunrise
+		if s.Event == SUNSET {
+			t = sunset
+		}
+		if t = t.Add(s.Offset); t.After(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Run a settings job with a schedule relative to sunrise or sunset, and schedule it again for the next day.
+func RunSolarJob(unit, jobset, jobsetGen, schedule string, id uint, settings codecbase.Settings, preset string, ramp *db.Ramp, jobName string) error {
+	err := RunCronJob(unit, jobset, id, schedule, settings, preset, ramp, jobName)
+
+	jobsetGensMutex.Lock()
+	defer jobsetGensMutex.Unlock()
+	// the job set has been rescheduled while the job ran
+	if jobsetGens.currentGen(settingsJobCategory, unit+"/"+jobset) != jobsetGen {
+		return err
+	}
+	// the scheduler keeps one-time jobs after they have run
+	for _, j := range scheduler.Jobs() {
+		if j.Name() == jobName {
+			scheduler.RemoveJob(j.ID())
+		}
+	}
+	// a minute later, so that a job that runs early isn't scheduled again for the same time
+	if err := scheduleSolarJob(unit, jobset, jobsetGen, schedule, id, settings, preset, ramp, jobName, time.Now().Add(time.Minute)); err != nil {
+		slog.Error("RunSolarJob: failed to schedule the next run", "jobName", jobName, "err", err)
+	}
+	return err
+}
+
+// Schedule a settings job at the next time of a schedule relative to sunrise or sunset. The job schedules itself again
+// when it runs, since the time changes every day. jobsetGensMutex must be held.
+func scheduleSolarJob(unit, jobset, jobsetGen, schedule string, id uint, settings codecbase.Settings, preset string, ramp *db.Ramp, jobName string, after time.Time) error {
+	if g_location == nil {
+		return errNoLocation
+	}
+	ss, err := ParseSolarSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	next, ok := ss.Next(after, *g_location)
+	if !ok {
+		return fmt.Errorf("schedule %q: no %s within a year", schedule, ss.Event)
+	}
+
+	j, err := scheduler.NewJob(
+		gocron.OneTimeJob(gocron.OneTimeJobStartDateTime(next)),
+		gocron.NewTask(
+			RunSolarJob,
+			unit,
+			jobset,
+			jobsetGen,
+			schedule,
+			id,
+			settings,
+			preset,
+			ramp,
+			jobName,
+		),
+		gocron.WithName(jobName),
+		gocron.WithTags(settingsJobCategory, unit, jobset, jobsetGen),
+	)
+	if err != nil {
+		return err
+	}
+	slog.Info("scheduled solar settings job", "unit", unit, "jobset", jobset, "jobName", jobName, "at", next, "job_id", j.ID())
+	return nil
+}
@@ -0,0 +1,103 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/solar"
+)
+
+var stockholm = solar.Location{Latitude: 59.3293, Longitude: 18.0686}
+
+func TestParseSolarSchedule(t *testing.T) {
+	for schedule, want := range map[string]SolarSchedule{
+		"@sunrise":         {SUNRISE, 0},
+		"@sunset-30m":      {SUNSET, -30 * time.Minute},
+		"@sunrise+1h15m":   {SUNRISE, 75 * time.Minute},
+		"@sunset+11h59m0s": {SUNSET, 11*time.Hour + 59*time.Minute},
+	} {
+		got, err := ParseSolarSchedule(schedule)
+		if err != nil || *got != want {
+			t.Errorf("ParseSolarSchedule(%q) = %+v, %v, want %+v", schedule, got, err, want)
+		}
+	}
+	for _, schedule := range []string{"@sunrise30m", "@sunset-30", "@sunset+12h", "@noon", "@sunset -1h"} {
+		if err := ValidateSchedule(schedule); err == nil {
+			t.Errorf("ValidateSchedule(%q) succeeded", schedule)
+		}
+	}
+}
+
+func TestLoadJobsFileSolarWithoutLocation(t *testing.T) {
+	store := db.NewMemStore()
+	jobs := `{ "Summer": { "active": true, "cronjobs": [
+  { "schedule": "@sunset", "settings": { "quiet": "on" } }
+] } }`
+	_, err := LoadJobsFile(store, writeJobsFile(t, jobs), false)
+	if !errors.Is(err, errNoLocation) || !strings.Contains(err.Error(), "jobs.json:2: job set Summer") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	SetLocation(&stockholm)
+	defer SetLocation(nil)
+	if _, err := LoadJobsFile(store, writeJobsFile(t, jobs), false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSolarScheduleNext(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*3600)
+	s, _ := ParseSolarSchedule("@sunset-30m")
+
+	// sunset is at 22:08 at midsummer
+	next, ok := s.Next(time.Date(2024, 6, 21, 12, 0, 0, 0, cest), stockholm)
+	if !ok || next.Format("2006-01-02 15:04") != "2024-06-21 21:38" {
+		t.Errorf("next %v", next)
+	}
+	next, _ = s.Next(time.Date(2024, 6, 21, 21, 40, 0, 0, cest), stockholm)
+	if next.Format("2006-01-02") != "2024-06-22" {
+		t.Errorf("expected tomorrow, got %v", next)
+	}
+
+	// the sun doesn't set in Tromsø until late July
+	next, ok = s.Next(time.Date(2024, 6, 21, 12, 0, 0, 0, cest), solar.Location{Latitude: 69.6496, Longitude: 18.9560})
+	if !ok || next.Month() != time.July || next.Day() < 20 {
+		t.Errorf("next %v", next)
+	}
+}
+
+func TestScheduleSolarJob(t *testing.T) {
+	store := db.NewMemStore()
+	store.SaveJobSet(db.DefaultUnit, "Summer", true)
+	store.SaveCronJob(db.DefaultUnit, "Summer", "@sunset", "", &codecbase.Settings{Quiet: "on"}, nil)
+	cjs, _ := store.GetCronJobs(db.DefaultUnit, "Summer")
+
+	SetLocation(&stockholm)
+	defer SetLocation(nil)
+	startTestScheduler(t, store)
+
+	next := NextRun(db.DefaultUnit, "Summer", (*cjs)[0].ID)
+	s, _ := ParseSolarSchedule("@sunset")
+	want, _ := s.Next(time.Now(), stockholm)
+	if !next.Equal(want) {
+		t.Errorf("next run %v, want %v", next, want)
+	}
+
+	// the job schedules itself again when it runs, and the job that ran is removed
+	name := fmt.Sprintf("%s/Summer_%d @sunset", db.DefaultUnit, (*cjs)[0].ID)
+	RunSolarJob(db.DefaultUnit, "Summer", jobsetGens.currentGen(settingsJobCategory, db.DefaultUnit+"/Summer"), "@sunset", 0, codecbase.Settings{Quiet: "on"}, "", nil, name)
+	waitFor(t, "the job to be scheduled once", func() bool {
+		count := 0
+		for _, j := range scheduler.Jobs() {
+			if j.Name() == name {
+				count++
+			}
+		}
+		return count == 1 && !NextRun(db.DefaultUnit, "Summer", (*cjs)[0].ID).IsZero()
+	})
+}
@@ -0,0 +1,238 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-co-op/gocron/v2"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sensor"
+)
+
+const thermostatJobCategory = "thermostat"
+
+// How often the thermostats read their sensors.
+const THERMOSTAT_INTERVAL = time.Minute
+
+// The defaults of the thermostat settings.
+const (
+	DEFAULT_HYSTERESIS   = 0.5
+	DEFAULT_MIN_INTERVAL = 15 // minutes
+)
+
+// A thermostat adjusts the temperature setting of a unit, one degree at a time, until the temperature at a sensor, e.g.
+// where people sit, reaches the target. The inverter measures the temperature at the indoor unit, which is often
+// warmer or colder than the rest of the room. The setting is only adjusted while the unit heats or cools, and not
+// during holds and ramps.
+//
+//	{ "sensor": "living", "target": 21.5, "hysteresis": 0.5, "minInterval": 15, "min": 18, "max": 26 }
+type Thermostat struct {
+	Sensor      string  `json:"sensor"`
+	Target      float64 `json:"target"`                // the temperature to reach at the sensor
+	Hysteresis  float64 `json:"hysteresis,omitempty"`  // the setting isn't adjusted while the sensor is this close to the target
+	MinInterval uint    `json:"minInterval,omitempty"` // minutes between adjustments, to give the room time to react
+	Min         uint    `json:"min,omitempty"`         // the lowest temperature setting
+	Max         uint    `json:"max,omitempty"`         // the highest temperature setting
+	Disabled    bool    `json:"disabled,omitempty"`
+}
+
+// The state of the thermostat of a unit.
+type ThermostatStatus struct {
+	Thermostat
+	Reading      *sensor.Reading // the last reading of the sensor
+	Error        string          // why the sensor couldn't be read
+	State        string          // what the thermostat did the last time it ran, e.g. "adjusted" or "hold"
+	LastAdjusted time.Time
+}
+
+// Returned (wrapped) when a thermostat is rejected, e.g. because its sensor doesn't exist.
+var ErrInvalidThermostat = errors.New("invalid thermostat")
+
+// The thermostats, keyed by unit.
+var thermostats = make(map[string]*ThermostatStatus)
+var thermostatMutex sync.Mutex
+
+func checkThermostat(t *Thermostat) error {
+	if _, found := g_sensors[t.Sensor]; !found {
+		return fmt.Errorf("%w: no sensor %q", ErrInvalidThermostat, t.Sensor)
+	}
+	if t.Target < codecbase.C_Temp_Min || t.Target > codecbase.C_Temp_Max {
+		return fmt.Errorf("%w: the target must be between %d and %d", ErrInvalidThermostat, codecbase.C_Temp_Min, codecbase.C_Temp_Max)
+	}
+	if t.Hysteresis < 0 {
+		return fmt.Errorf("%w: the hysteresis can't be negative", ErrInvalidThermostat)
+	}
+	if t.Min < codecbase.C_Temp_Min || t.Max > codecbase.C_Temp_Max || t.Min > t.Max {
+		return fmt.Errorf("%w: the limits must be between %d and %d", ErrInvalidThermostat, codecbase.C_Temp_Min, codecbase.C_Temp_Max)
+	}
+	return nil
+}
+
+// Set the sensors, and the thermostats of the units, before the scheduler is initialized. Thermostats that don't give
+// the hysteresis, the interval or the limits get the defaults.
+func SetSensors(sensors sensor.Sensors, units map[string]Thermostat) error {
+	g_sensors = sensors
+	sampleMutex.Lock()
+	lastSampled = make(map[string]time.Time)
+	sampleMutex.Unlock()
+	ts := make(map[string]*ThermostatStatus)
+	for unit, t := range units {
+		if t.Hysteresis == 0 {
+			t.Hysteresis = DEFAULT_HYSTERESIS
+		}
+		if t.MinInterval == 0 {
+			t.MinInterval = DEFAULT_MIN_INTERVAL
+		}
+		if t.Min == 0 {
+			t.Min = codecbase.C_Temp_Min
+		}
+		if t.Max == 0 {
+			t.Max = codecbase.C_Temp_Max
+		}
+		if err := checkThermostat(&t); err != nil {
+			return fmt.Errorf("unit %q: %w", unit, err)
+		}
+		ts[unit] = &ThermostatStatus{Thermostat: t}
+	}
+
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	thermostats = ts
+	return nil
+}
+
+// Return the state of the thermostat of a unit, or nil if it has none.
+func GetThermostat(unit string) *ThermostatStatus {
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	if ts, found := thermostats[unit]; found {
+		status := *ts
+		return &status
+	}
+	return nil
+}
+
+// Change the target of the thermostat of a unit, or enable or disable it. The changes are not saved, so the thermostat
+// gets the settings of the sensors file when the controller restarts.
+func UpdateThermostat(unit string, target *float64, disabled *bool) (*ThermostatStatus, error) {
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	ts, found := thermostats[unit]
+	if !found {
+		return nil, fmt.Errorf("thermostat of unit %q: %w", unit, db.ErrNotFound)
+	}
+	t := ts.Thermostat
+	if target != nil {
+		t.Target = *target
+	}
+	if disabled != nil {
+		t.Disabled = *disabled
+	}
+	if err := checkThermostat(&t); err != nil {
+		return nil, err
+	}
+	ts.Thermostat = t
+	slog.Info("updated thermostat", "unit", unit, "target", t.Target, "disabled", t.Disabled)
+	status := *ts
+	return &status, nil
+}
+
+// Read the sensor of the thermostat of a unit, and adjust the temperature setting by one degree if the sensor is
+// further from the target than the hysteresis, and the setting hasn't been adjusted within the minimum interval.
+func RunThermostatJob(unit, jobName string) error {
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	ts, found := thermostats[unit]
+	if !found {
+		return nil
+	}
+
+	reading, err := g_sensors[ts.Sensor].Read()
+	ts.Reading, ts.Error = reading, ""
+	if err != nil {
+		ts.Error = err.Error()
+	}
+	switch {
+	case ts.Disabled:
+		ts.State = "disabled"
+		return nil
+	case err != nil:
+		slog.Warn("thermostat failed to read sensor", "unit", unit, "sensor", ts.Sensor, "err", err)
+		ts.State = "no reading"
+		return nil
+	}
+
+	dbRc, err := g_store.CurrentConfig(unit)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	diff := ts.Target - reading.Temperature
+	setting := dbRc.Temperature
+	// only step towards the target; a setting outside the limits (e.g. changed on the remote) is left alone
+	if diff > 0 && setting+1 <= ts.Max {
+		setting++
+	} else if diff < 0 && setting > ts.Min {
+		setting--
+	}
+	switch hold, err := g_store.GetHold(unit); {
+	case dbRc.Power != codecbase.C_Power_On:
+		ts.State = "power off"
+	case dbRc.Mode != codecbase.C_Mode_Heat && dbRc.Mode != codecbase.C_Mode_Cool:
+		ts.State = "not heating or cooling"
+	case err == nil && now.Before(hold.Until):
+		ts.State = "hold"
+	case GetActiveRamp(unit) != nil:
+		ts.State = "ramp"
+	case math.Abs(diff) <= ts.Hysteresis:
+		ts.State = "on target"
+	case now.Sub(ts.LastAdjusted) < time.Duration(ts.MinInterval)*time.Minute:
+		ts.State = "waiting"
+	case setting == dbRc.Temperature:
+		ts.State = "at limit"
+	default:
+		slog.Info("thermostat adjusting temperature", "unit", unit, "sensor", ts.Sensor, "measured", reading.Temperature,
+			"target", ts.Target, "from", dbRc.Temperature, "to", setting)
+		settings := codecbase.Settings{Temperature: codecbase.Temperatur2String(setting)}
+		describeSettingsRun(jobName, unit, thermostatJobCategory, 0, now.Truncate(time.Minute), "", &settings)
+		if err := sendSettings(unit, &settings, jobName); err != nil {
+			ts.State = "failed"
+			return err
+		}
+		ts.State, ts.LastAdjusted = "adjusted", now
+	}
+	return nil
+}
+
+// Schedule the thermostat of a unit, if it has one.
+func scheduleThermostatJob(unit string) {
+	thermostatMutex.Lock()
+	_, found := thermostats[unit]
+	thermostatMutex.Unlock()
+	if !found {
+		return
+	}
+
+	name := fmt.Sprintf("%s/thermostat", unit)
+	_, err := scheduler.NewJob(
+		gocron.DurationJob(THERMOSTAT_INTERVAL),
+		gocron.NewTask(
+			RunThermostatJob,
+			unit,
+			name,
+		),
+		gocron.WithName(name),
+		gocron.WithTags(thermostatJobCategory, unit),
+	)
+	if err != nil {
+		slog.Error("failed to schedule thermostat", "jobName", name, "err", err)
+		return
+	}
+	slog.Info("scheduled thermostat", "jobName", name, "interval", THERMOSTAT_INTERVAL)
+}
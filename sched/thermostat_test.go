@@ -0,0 +1,151 @@
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sensor"
+)
+
+func TestThermostat(t *testing.T) {
+	// a fake hwmon device
+	dir := t.TempDir()
+	setTemp := func(temp float64) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "temp1_input"), fmt.Appendf(nil, "%d\n", int(temp*1000)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := sensor.New(sensor.Config{Type: sensor.HWMON, Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetSensors(sensor.Sensors{"living": s}, map[string]Thermostat{db.DefaultUnit: {Sensor: "living", Target: 21, Max: 23}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetSensors(nil, nil)
+
+	store := db.NewMemStore()
+	startTestScheduler(t, store)
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Power: "on", Mode: "heat", Temperature: "21"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	jobName := "default/thermostat"
+	run := func(step string, temp uint, state string) {
+		t.Helper()
+		if err := RunThermostatJob(db.DefaultUnit, jobName); err != nil {
+			t.Fatal(err)
+		}
+		if rc, _ := store.CurrentConfig(db.DefaultUnit); rc.Temperature != temp {
+			t.Errorf("%s: temp %d, want %d", step, rc.Temperature, temp)
+		}
+		if ts := GetThermostat(db.DefaultUnit); ts.State != state {
+			t.Errorf("%s: state %q, want %q", step, ts.State, state)
+		}
+	}
+	// pretend that the last adjustment was long ago
+	allowAdjustment := func() {
+		thermostatMutex.Lock()
+		thermostats[db.DefaultUnit].LastAdjusted = time.Time{}
+		thermostatMutex.Unlock()
+	}
+
+	// the defaults are filled in
+	if ts := GetThermostat(db.DefaultUnit); ts == nil || ts.Hysteresis != DEFAULT_HYSTERESIS || ts.MinInterval != DEFAULT_MIN_INTERVAL ||
+		ts.Min != codecbase.C_Temp_Min || ts.Max != 23 {
+		t.Fatalf("unexpected thermostat %+v", ts)
+	}
+
+	setTemp(20.75)
+	run("within hysteresis", 21, "on target")
+	setTemp(19)
+	run("too cold", 22, "adjusted")
+	if ts := GetThermostat(db.DefaultUnit); ts.Reading == nil || ts.Reading.Temperature != 19 {
+		t.Errorf("unexpected reading %+v", ts.Reading)
+	}
+	run("within the interval", 22, "waiting")
+	allowAdjustment()
+	run("still too cold", 23, "adjusted")
+	allowAdjustment()
+	run("at the limit", 23, "at limit")
+
+	// a setting above the limit isn't lowered while the room is too cold
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Temperature: "26"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	allowAdjustment()
+	run("above the limit", 26, "at limit")
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Temperature: "23"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the thermostat leaves the setting alone during a hold
+	setTemp(23)
+	allowAdjustment()
+	if err := store.SaveHold(&db.Hold{Unit: db.DefaultUnit, Until: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	run("hold", 23, "hold")
+	if _, err := store.DeleteHold(db.DefaultUnit); err != nil {
+		t.Fatal(err)
+	}
+	run("too warm", 22, "adjusted")
+
+	// and while the unit doesn't heat or cool
+	allowAdjustment()
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Mode: "dry"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	// the modes have their own temperatures
+	rc, _ := store.CurrentConfig(db.DefaultUnit)
+	temp := rc.Temperature
+	run("dry", temp, "not heating or cooling")
+	if err := sendSettings(db.DefaultUnit, &codecbase.Settings{Power: "off"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	run("power off", temp, "power off")
+
+	// a missing reading is reported
+	os.Remove(filepath.Join(dir, "temp1_input"))
+	run("no reading", temp, "no reading")
+	if ts := GetThermostat(db.DefaultUnit); ts.Error == "" {
+		t.Error("missing reading wasn't reported")
+	}
+
+	// the thermostat can be disabled, and the target changed
+	disabled := true
+	if _, err := UpdateThermostat(db.DefaultUnit, nil, &disabled); err != nil {
+		t.Fatal(err)
+	}
+	run("disabled", temp, "disabled")
+	target := 40.0
+	if _, err := UpdateThermostat(db.DefaultUnit, &target, nil); !errors.Is(err, ErrInvalidThermostat) {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := UpdateThermostat("other", &target, nil); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestInvalidThermostats(t *testing.T) {
+	defer SetSensors(nil, nil)
+	sensors := sensor.Sensors{"push": &sensor.PushSensor{}}
+	for _, th := range []Thermostat{
+		{Sensor: "other", Target: 21},
+		{Sensor: "push", Target: 35},
+		{Sensor: "push", Target: 21, Hysteresis: -1},
+		{Sensor: "push", Target: 21, Min: 25, Max: 20},
+	} {
+		if err := SetSensors(sensors, map[string]Thermostat{db.DefaultUnit: th}); !errors.Is(err, ErrInvalidThermostat) {
+			t.Errorf("thermostat %+v: got %v, want ErrInvalidThermostat", th, err)
+		}
+	}
+}
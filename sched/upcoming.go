@@ -0,0 +1,326 @@
+package sched
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"rpi_panasonic_inverter_rc/calendar"
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/rcutils"
+)
+
+const dstJobKind = "dst"
+
+// A run of a job within the forecast of a unit, and the config that is expected after it.
+type UpcomingRun struct {
+	At         time.Time
+	Kind       string // "settings" for cron jobs, "onetime", "ramp", "hold", "timer" or "dst"
+	Name       string
+	JobSet     string
+	Preset     string
+	Settings   *codecbase.Settings // the settings applied by the job, or the power set by a timer
+	Suppressed string              // the job of a job set with a higher priority that suppresses the run
+	Hold       string              // what the hold of the unit does with the run: "skipped", "deferred" or "merged"
+	Error      string              // why the settings can't be applied, in which case the config is unchanged
+	Config     *codec.RcConfig
+
+	ramp *db.Ramp // the ramp of a cron job, which starts when the job has run
+}
+
+// The periods when a job set with an activation is active, or nil if it is activated manually.
+type activePeriods struct {
+	periods []calendar.Period
+	invert  bool
+}
+
+func (ap *activePeriods) activeAt(t time.Time) bool {
+	during := slices.ContainsFunc(ap.periods, func(p calendar.Period) bool { return !p.Start.After(t) && p.End.After(t) })
+	return during != ap.invert
+}
+
+// Return the runs of the cron jobs and one-time jobs of a unit between from and to, ordered by time. The cron jobs of
+// job sets with an activation are included while the job set is expected to be active.
+func settingsRuns(store db.Store, unit string, from, to time.Time) ([]UpcomingRun, error) {
+	jss, err := store.GetJobSets(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	// the jobs that suppress jobs in the forecast may run just outside it
+	var runs []ScheduledRun
+	var names []string
+	for _, js := range *jss {
+		a, err := JobSetActivation(&js)
+		if err != nil {
+			return nil, err
+		}
+		var ap *activePeriods
+		if a != nil {
+			periods, err := a.Periods(from.Add(-PRIORITY_WINDOW), to.Add(PRIORITY_WINDOW))
+			if err != nil {
+				slog.Warn("failed to evaluate jobset activation", "unit", unit, "jobset", js.Name, "err", err)
+			}
+			ap = &activePeriods{periods, a.Invert}
+		} else if !js.Active {
+			continue
+		}
+		cjs, err := store.GetCronJobs(unit, js.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, cj := range *cjs {
+			times, err := scheduleTimes(cj.Schedule, from.Add(-PRIORITY_WINDOW), to.Add(PRIORITY_WINDOW))
+			if err != nil {
+				slog.Warn("failed to get upcoming runs of cronjob", "unit", unit, "jobset", js.Name, "schedule", cj.Schedule, "err", err)
+				continue
+			}
+			for _, t := range times {
+				if ap == nil || ap.activeAt(t) {
+					runs = append(runs, ScheduledRun{JobSet: js.Name, Priority: js.Priority, CronJob: cj, At: t})
+					names = append(names, fmt.Sprintf("%s/%s_%d %s", unit, js.Name, cj.ID, cj.Schedule))
+				}
+			}
+		}
+	}
+
+	var upcoming []UpcomingRun
+	for i, r := range runs {
+		if r.At.Before(from) || !r.At.Before(to) {
+			continue
+		}
+		ur := UpcomingRun{At: r.At, Kind: settingsJobCategory, Name: names[i], JobSet: r.JobSet, Preset: r.CronJob.Preset}
+		ur.Settings = new(codecbase.Settings)
+		if err := json.Unmarshal(r.CronJob.Settings, ur.Settings); err != nil {
+			ur.Error = err.Error()
+		}
+		if ur.ramp, err = cronJobRamp(&r.CronJob); err != nil {
+			ur.Error = err.Error()
+		}
+		for j, o := range runs {
+			if o.Priority > r.Priority && o.At.Sub(r.At).Abs() <= PRIORITY_WINDOW {
+				ur.Suppressed = names[j]
+				break
+			}
+		}
+		upcoming = append(upcoming, ur)
+	}
+
+	otjs, err := store.GetOneTimeJobs(unit)
+	if err != nil {
+		return nil, err
+	}
+	for _, otj := range *otjs {
+		if otj.At.Before(from) || !otj.At.Before(to) {
+			continue
+		}
+		ur := UpcomingRun{At: otj.At, Kind: oneTimeJobCategory, Name: oneTimeJobName(&otj), Preset: otj.Preset}
+		ur.Settings = new(codecbase.Settings)
+		if err := json.Unmarshal(otj.Settings, ur.Settings); err != nil {
+			ur.Error = err.Error()
+		}
+		upcoming = append(upcoming, ur)
+	}
+
+	slices.SortStableFunc(upcoming, func(a, b UpcomingRun) int { return a.At.Compare(b.At) })
+	return upcoming, nil
+}
+
+// Add the steps of a ramp of a unit that are taken at or after from to the runs, keeping them ordered by time.
+func addRampSteps(runs []UpcomingRun, unit string, steps []rampStep, from time.Time) []UpcomingRun {
+	for _, step := range steps {
+		if step.at.Before(from) {
+			continue
+		}
+		settings := &codecbase.Settings{Temperature: codecbase.Temperatur2String(step.temperature)}
+		runs = append(runs, UpcomingRun{At: step.at, Kind: rampJobCategory, Name: rampJobName(unit), Settings: settings})
+	}
+	slices.SortStableFunc(runs, func(a, b UpcomingRun) int { return a.At.Compare(b.At) })
+	return runs
+}
+
+// Return the first time after t that the clock shows ct.
+func nextClockTime(ct codec.Time, t time.Time) time.Time {
+	next := time.Date(t.Year(), t.Month(), t.Day(), int(ct.Hour()), int(ct.Minute()), 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, int(ct.Hour()), int(ct.Minute()), 0, 0, t.Location())
+	}
+	return next
+}
+
+// Return the first timer or DST transition job after t, as they are scheduled by RestartTimerJobs for the config, or
+// nil if the timers are disabled.
+func nextTimerRun(rc *codec.RcConfig, t time.Time) *UpcomingRun {
+	var runs []UpcomingRun
+	power := func(p uint) *codecbase.Settings { return &codecbase.Settings{Power: codecbase.Power2String(p)} }
+	if rc.TimerOn == codecbase.C_Timer_Enabled {
+		preOnTime := (rc.TimerOnTime + 23*60) % (24 * 60)
+		runs = append(runs,
+			UpcomingRun{At: nextClockTime(preOnTime, t), Kind: timerJobCategory, Name: "timer_on_pre", Settings: power(codecbase.C_Power_On)},
+			UpcomingRun{At: nextClockTime(rc.TimerOnTime, t), Kind: timerJobCategory, Name: "timer_on", Settings: power(codecbase.C_Power_On)})
+	}
+	if rc.TimerOff == codecbase.C_Timer_Enabled {
+		runs = append(runs, UpcomingRun{At: nextClockTime(rc.TimerOffTime, t), Kind: timerJobCategory, Name: "timer_off", Settings: power(codecbase.C_Power_Off)})
+	}
+	if len(runs) == 0 {
+		return nil
+	}
+	if _, end := t.ZoneBounds(); !end.IsZero() {
+		runs = append(runs, UpcomingRun{At: end, Kind: dstJobKind, Name: "dst_transition"})
+	}
+	first := slices.MinFunc(runs, func(a, b UpcomingRun) int { return a.At.Compare(b.At) })
+	return &first
+}
+
+// Return the config after settings have been applied to rc, as it is saved by the store, and update the mode settings
+// like the store does.
+func applyUpcomingSettings(ms rcutils.MemModeSettings, settings *codecbase.Settings, rc *codec.RcConfig) (*codec.RcConfig, error) {
+	sendRc, err := composeConfig(ms, settings, rc)
+	if err != nil {
+		return nil, err
+	}
+	next := rcutils.SavedConfig(sendRc, rc)
+	ms.Update(next)
+	return next, nil
+}
+
+// Return the runs of the jobs of a unit between from and to, ordered by time, with the config that is expected after
+// each of them. The forecast starts from the current config, and follows the timers as they are changed by the jobs.
+// Job sets with an activation are expected to be active according to it. The steps of ramps, both the one in progress
+// and those started by the jobs, are included, and the hold of the unit is applied to the jobs until it ends. Changes
+// made with the remote control and the API can of course not be foreseen.
+func Upcoming(store db.Store, unit string, from, to time.Time) ([]UpcomingRun, error) {
+	rc, err := store.CurrentConfig(unit)
+	if err != nil {
+		return nil, err
+	}
+	ms := make(rcutils.MemModeSettings)
+	for _, m := range []uint{codecbase.C_Mode_Auto, codecbase.C_Mode_Heat, codecbase.C_Mode_Cool, codecbase.C_Mode_Dry} {
+		temp, fan, err := store.GetModeSettings(unit, m)
+		if err != nil {
+			return nil, err
+		}
+		ms[m] = rcutils.ModeSetting{Temperature: temp, FanSpeed: fan}
+	}
+	runs, err := settingsRuns(store, unit, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if ramp := GetActiveRamp(unit); ramp != nil {
+		runs = addRampSteps(runs, unit, ramp.steps, from)
+	}
+
+	// the settings jobs that run during the hold are deferred, skipped or merged with the held settings
+	hold, err := store.GetHold(unit)
+	if errors.Is(err, db.ErrNotFound) {
+		hold = nil
+	} else if err != nil {
+		return nil, err
+	}
+	var held *codecbase.Settings
+	var heldErr error
+	var revert codecbase.Settings
+	var deferred []codecbase.Settings
+	if hold != nil {
+		held, heldErr = heldSettings(store, hold)
+		if err := json.Unmarshal(hold.Revert, &revert); err != nil {
+			return nil, err
+		}
+		if deferred, err = deferredSettings(hold); err != nil {
+			return nil, err
+		}
+		// a hold that should already have ended ends at once
+		end := hold.Until
+		if end.Before(from) {
+			end = from
+		}
+		if end.Before(to) {
+			runs = append(runs, UpcomingRun{At: end, Kind: holdJobCategory, Name: holdJobName(unit)})
+			slices.SortStableFunc(runs, func(a, b UpcomingRun) int { return a.At.Compare(b.At) })
+		}
+	}
+
+	var upcoming []UpcomingRun
+	t := from
+	for len(runs) > 0 || rc.TimerOn == codecbase.C_Timer_Enabled || rc.TimerOff == codecbase.C_Timer_Enabled {
+		// the timers depend on the config, which may be changed by the next settings job
+		run := nextTimerRun(rc, t)
+		if run == nil || len(runs) > 0 && !runs[0].At.After(run.At) {
+			if len(runs) == 0 {
+				break
+			}
+			run, runs = &runs[0], runs[1:]
+		}
+		if !run.At.Before(to) {
+			break
+		}
+		t = run.At
+
+		switch {
+		case run.Kind == timerJobCategory:
+			next := *rc
+			rcutils.SetPower(run.Settings.Power, &next)
+			rc = &next
+		case run.Kind == dstJobKind, run.Suppressed != "", run.Error != "":
+		case run.Kind == holdJobCategory:
+			// like endHold, the fields changed by the hold are reverted, and the deferred jobs applied
+			settings := holdEndSettings(revert, deferred)
+			run.Settings, hold = &settings, nil
+			if next, err := applyUpcomingSettings(ms, &settings, rc); err != nil {
+				run.Error = err.Error()
+			} else {
+				rc = next
+			}
+		default:
+			// like runSettingsJob
+			resolved, err := db.ResolvePreset(store, run.Preset, run.Settings)
+			if err == nil && hold != nil && run.At.Before(hold.Until) {
+				// like applyHoldPolicy
+				merge, deferJob := holdPolicyEffect(hold.Policy)
+				if deferJob {
+					deferred = append(deferred, *resolved)
+				}
+				switch {
+				case merge:
+					run.Hold = "merged"
+					if err = heldErr; err == nil {
+						merged := codecbase.MergeSettings(*resolved, *held)
+						resolved = &merged
+					}
+				case deferJob:
+					run.Hold, resolved = "deferred", nil
+				default:
+					run.Hold, resolved = "skipped", nil
+				}
+			}
+			if err != nil {
+				run.Error = err.Error()
+				break
+			}
+			if resolved == nil {
+				break
+			}
+			next, err := applyUpcomingSettings(ms, resolved, rc)
+			if err != nil {
+				run.Error = err.Error()
+				break
+			}
+			rc = next
+			// a settings job stops the ramp in progress, and a cron job with a ramp starts a new one
+			if run.ramp != nil || run.Kind != rampJobCategory && (resolved.Power != "" || resolved.Mode != "" || resolved.Temperature != "") {
+				runs = slices.DeleteFunc(runs, func(r UpcomingRun) bool { return r.Kind == rampJobCategory })
+			}
+			if run.ramp != nil {
+				runs = addRampSteps(runs, unit, rampSteps(rc.Temperature, run.ramp, run.At), from)
+			}
+		}
+		run.Config = rc
+		upcoming = append(upcoming, *run)
+	}
+	return upcoming, nil
+}
@@ -0,0 +1,135 @@
+package sched
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+)
+
+func TestUpcoming(t *testing.T) {
+	store := db.NewMemStore()
+	store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Power: "on", Mode: "heat", TimerOff: "on", TimerOffTime: "22:00"}, nil)
+	store.SaveCronJob(db.DefaultUnit, "Normal", "0 12 * * *", "", &codecbase.Settings{Temperature: "21"}, nil)
+	store.SaveJobSet(db.DefaultUnit, "Boost", true)
+	store.SetJobSetPriority(db.DefaultUnit, "Boost", 5)
+	store.SaveCronJob(db.DefaultUnit, "Boost", "2 12 * * *", "", &codecbase.Settings{Temperature: "25"}, nil)
+	store.SaveJobSet(db.DefaultUnit, "Vacation", false)
+	store.SaveCronJob(db.DefaultUnit, "Vacation", "0 9 * * *", "", &codecbase.Settings{Power: "off"}, nil)
+
+	from := time.Date(2025, 1, 15, 0, 0, 0, 0, time.Local)
+	store.SaveOneTimeJob(db.DefaultUnit, from.Add(32*time.Hour), "", &codecbase.Settings{Temperature: "19"})
+	store.SaveOneTimeJob(db.DefaultUnit, from.Add(-time.Hour), "", &codecbase.Settings{Temperature: "30"})
+
+	runs, err := Upcoming(store, db.DefaultUnit, from, from.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range runs {
+		s := fmt.Sprintf("%s %s %s %s %d", r.At.Format("02 15:04"), r.Kind, r.JobSet,
+			codecbase.Power2String(r.Config.Power), r.Config.Temperature)
+		if r.Suppressed != "" {
+			s += " suppressed"
+		}
+		got = append(got, s)
+	}
+	want := []string{
+		"15 06:00 settings Normal on 20",
+		"15 12:00 settings Normal on 20 suppressed",
+		"15 12:02 settings Boost on 25",
+		"15 22:00 timer  off 25",
+		"16 06:00 settings Normal on 25",
+		"16 08:00 onetime  on 19",
+		"16 12:00 settings Normal on 19 suppressed",
+		"16 12:02 settings Boost on 25",
+		"16 22:00 timer  off 25",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("upcoming runs\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the temperature of the heat mode is remembered
+	if temp, _, _ := store.GetModeSettings(db.DefaultUnit, codecbase.C_Mode_Heat); temp == 25 {
+		t.Error("the forecast changed the mode settings in the store")
+	}
+
+	// invalid settings don't change the config
+	store.SaveCronJob(db.DefaultUnit, "Boost", "0 18 * * *", "missing", &codecbase.Settings{}, nil)
+	runs, _ = Upcoming(store, db.DefaultUnit, from, from.Add(24*time.Hour))
+	if r := runs[3]; r.At.Hour() != 18 || !strings.Contains(r.Error, "missing") || r.Config.Temperature != 25 {
+		t.Errorf("unexpected run %+v", r)
+	}
+}
+
+func TestUpcomingRampAndHold(t *testing.T) {
+	store := db.NewMemStore()
+	store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Power: "on", Mode: "heat", Temperature: "22"},
+		&db.Ramp{To: 19, Minutes: 180})
+	from := time.Date(2025, 1, 15, 0, 0, 0, 0, time.Local)
+	store.SaveOneTimeJob(db.DefaultUnit, from.Add(8*time.Hour+30*time.Minute), "", &codecbase.Settings{Temperature: "23"})
+
+	forecast := func() string {
+		t.Helper()
+		runs, err := Upcoming(store, db.DefaultUnit, from, from.Add(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range runs {
+			got = append(got, fmt.Sprintf("%s %s %s %s %d", r.At.Format("15:04"), r.Kind, r.Hold,
+				codecbase.Power2String(r.Config.Power), r.Config.Temperature))
+		}
+		return strings.Join(got, "\n")
+	}
+	check := func(step string, want ...string) {
+		t.Helper()
+		if got := forecast(); got != strings.Join(want, "\n") {
+			t.Errorf("%s: upcoming runs\n%s\nwant\n%s", step, got, strings.Join(want, "\n"))
+		}
+	}
+
+	// the ramp is stopped by the one-time job
+	check("ramp",
+		"06:00 settings  on 22",
+		"07:00 ramp  on 21",
+		"08:00 ramp  on 20",
+		"08:30 onetime  on 23",
+	)
+
+	// the deferred job is applied when the hold ends, but doesn't start its ramp
+	hold := &db.Hold{Unit: db.DefaultUnit, Until: from.Add(6*time.Hour + 30*time.Minute), Policy: HoldDefer,
+		Settings: []byte(`{"temp":"25"}`), Revert: []byte(`{"temp":"20"}`)}
+	store.SaveHold(hold)
+	check("deferred",
+		"06:00 settings deferred off 20",
+		"06:30 hold  on 22",
+		"08:30 onetime  on 23",
+	)
+
+	// the merged job starts its ramp from the held temperature
+	hold.Policy = HoldMerge
+	store.SaveHold(hold)
+	check("merged",
+		"06:00 settings merged on 25",
+		"06:30 hold  on 22",
+		"06:30 ramp  on 24",
+		"07:00 ramp  on 23",
+		"07:30 ramp  on 22",
+		"08:00 ramp  on 21",
+		"08:30 onetime  on 23",
+	)
+
+	hold.Policy = HoldSkip
+	store.SaveHold(hold)
+	check("skipped",
+		"06:00 settings skipped off 20",
+		"06:30 hold  off 20",
+		"08:30 onetime  off 23",
+	)
+}
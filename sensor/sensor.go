@@ -0,0 +1,303 @@
+// Package sensor reads the room temperature, and the humidity of sensors that measure it, from sensors attached to the
+// Raspberry Pi, through the Linux hwmon and IIO sysfs interfaces or 1-Wire w1_slave files, from JSON files written by
+// other programs, e.g. a DHT22 daemon, or from readings pushed over HTTP.
+package sensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The types of sensors.
+const (
+	HWMON = "hwmon" // a hwmon device, e.g. /sys/class/hwmon/hwmon2, with the temperature in temp1_input
+	IIO   = "iio"   // an IIO device, e.g. /sys/bus/iio/devices/iio:device0, with in_temp_input or in_temp_raw
+	W1    = "w1"    // a 1-Wire device, e.g. /sys/bus/w1/devices/28-0000072a4c1b, with a w1_slave file
+	FILE  = "file"  // a JSON file written by another program, e.g. { "temp": 21.5, "humidity": 45 }
+	PUSH  = "push"  // readings pushed over HTTP
+)
+
+// Readings from files and pushed readings that are older than this are not used, since whatever writes them has
+// probably stopped.
+const MAX_READING_AGE = 10 * time.Minute
+
+// Returned (wrapped) when a sensor has no current reading.
+var ErrNoReading = errors.New("no reading")
+
+// A reading of a sensor.
+type Reading struct {
+	Temperature float64   `json:"temp"`               // degrees Celsius
+	Humidity    *float64  `json:"humidity,omitempty"` // relative humidity in percent, if the sensor measures it
+	Time        time.Time `json:"time"`               // when the reading was taken
+}
+
+// A sensor returns its current reading. A reading that is too old is returned together with an error that wraps
+// ErrNoReading.
+type Sensor interface {
+	Read() (*Reading, error)
+}
+
+// The configuration of a sensor. Offset is added to the readings, to calibrate the sensor.
+//
+//	{ "type": "w1", "path": "/sys/bus/w1/devices/28-0000072a4c1b", "offset": -0.5 }
+//	{ "type": "hwmon", "path": "/sys/class/hwmon/hwmon2", "channel": "temp2" }
+//	{ "type": "push" }
+type Config struct {
+	Type    string  `json:"type"`
+	Path    string  `json:"path,omitempty"`    // the device directory, or the JSON file
+	Channel string  `json:"channel,omitempty"` // the hwmon channel, temp1 by default
+	Offset  float64 `json:"offset,omitempty"`
+}
+
+// The sensors, keyed by name.
+type Sensors map[string]Sensor
+
+// Create a sensor from its configuration. The sensor isn't read, since it might not be connected yet.
+func New(c Config) (Sensor, error) {
+	if c.Type != PUSH && c.Path == "" {
+		return nil, fmt.Errorf("a %s sensor must have a path", c.Type)
+	}
+	var s Sensor
+	switch c.Type {
+	case HWMON:
+		channel := c.Channel
+		if channel == "" {
+			channel = "temp1"
+		}
+		s = &hwmonSensor{
+			filepath.Join(c.Path, channel+"_input"),
+			filepath.Join(c.Path, "humidity"+strings.TrimPrefix(channel, "temp")+"_input"),
+		}
+	case IIO:
+		s = &iioSensor{c.Path}
+	case W1:
+		s = &w1Sensor{filepath.Join(c.Path, "w1_slave")}
+	case FILE:
+		s = &fileSensor{c.Path}
+	case PUSH:
+		s = &PushSensor{}
+	default:
+		return nil, fmt.Errorf("unknown sensor type %q, expecting %s, %s, %s, %s or %s", c.Type, HWMON, IIO, W1, FILE, PUSH)
+	}
+	if c.Offset != 0 {
+		s = &offsetSensor{s, c.Offset}
+	}
+	return s, nil
+}
+
+// Read a sysfs attribute that contains a number.
+func readNumber(file string) (float64, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", file, err)
+	}
+	return v, nil
+}
+
+// Read an optional sysfs attribute, returning nil if it doesn't exist.
+func readOptional(file string) (*float64, error) {
+	v, err := readNumber(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// hwmon reports temperatures in millidegrees Celsius, and humidity in millipercent in the humidity channel with the
+// same number as the temperature channel.
+type hwmonSensor struct {
+	file         string
+	humidityFile string
+}
+
+func (s *hwmonSensor) Read() (*Reading, error) {
+	v, err := readNumber(s.file)
+	if err != nil {
+		return nil, err
+	}
+	humidity, err := readOptional(s.humidityFile)
+	if err != nil {
+		return nil, err
+	}
+	if humidity != nil {
+		*humidity /= 1000
+	}
+	return &Reading{Temperature: v / 1000, Humidity: humidity, Time: time.Now()}, nil
+}
+
+// IIO reports processed temperatures in millidegrees Celsius and humidity in millipercent, or raw values that are
+// converted with (raw + offset) * scale. Humidity sensors, e.g. the DHT11 driver, have in_humidityrelative channels.
+type iioSensor struct {
+	dir string
+}
+
+// Read a channel of an IIO device, e.g. temp. Returns nil if the device doesn't have the channel.
+func (s *iioSensor) readChannel(channel string) (*float64, error) {
+	prefix := filepath.Join(s.dir, "in_"+channel)
+	if v, err := readOptional(prefix + "_input"); err != nil || v != nil {
+		return v, err
+	}
+	raw, err := readOptional(prefix + "_raw")
+	if err != nil || raw == nil {
+		return nil, err
+	}
+	scale, err := readNumber(prefix + "_scale")
+	if err != nil {
+		return nil, err
+	}
+	// the offset is optional
+	offset, err := readOptional(prefix + "_offset")
+	if err != nil {
+		return nil, err
+	} else if offset == nil {
+		offset = new(float64)
+	}
+	v := (*raw + *offset) * scale
+	return &v, nil
+}
+
+func (s *iioSensor) Read() (*Reading, error) {
+	temp, err := s.readChannel("temp")
+	if err != nil {
+		return nil, err
+	} else if temp == nil {
+		return nil, fmt.Errorf("%s: %w, no temperature channel", s.dir, ErrNoReading)
+	}
+	humidity, err := s.readChannel("humidityrelative")
+	if err != nil {
+		return nil, err
+	}
+	if humidity != nil {
+		*humidity /= 1000
+	}
+	return &Reading{Temperature: *temp / 1000, Humidity: humidity, Time: time.Now()}, nil
+}
+
+// The w1_slave file of a DS18B20 has two lines, where the first ends with YES if the CRC is valid, and the second ends
+// with the temperature in millidegrees Celsius:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+type w1Sensor struct {
+	file string
+}
+
+func (s *w1Sensor) Read() (*Reading, error) {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return nil, fmt.Errorf("%s: %w, CRC check failed", s.file, ErrNoReading)
+	}
+	_, t, found := strings.Cut(lines[1], "t=")
+	if !found {
+		return nil, fmt.Errorf("%s: %w, no temperature", s.file, ErrNoReading)
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file, err)
+	}
+	return &Reading{Temperature: v / 1000, Time: time.Now()}, nil
+}
+
+// A JSON file with a reading, e.g. { "temp": 21.5, "humidity": 45, "time": "2024-11-02T14:05:00+01:00" }. Without a
+// time, the modification time of the file is used.
+type fileSensor struct {
+	file string
+}
+
+func (s *fileSensor) Read() (*Reading, error) {
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return nil, err
+	}
+	var r struct {
+		Temperature *float64  `json:"temp"`
+		Humidity    *float64  `json:"humidity"`
+		Time        time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file, err)
+	}
+	if r.Temperature == nil {
+		return nil, fmt.Errorf("%s: %w, no temperature", s.file, ErrNoReading)
+	}
+	if r.Time.IsZero() {
+		fi, err := os.Stat(s.file)
+		if err != nil {
+			return nil, err
+		}
+		r.Time = fi.ModTime()
+	}
+	reading := &Reading{Temperature: *r.Temperature, Humidity: r.Humidity, Time: r.Time}
+	return reading, checkAge(reading)
+}
+
+// A sensor whose readings are pushed to the controller, e.g. by a microcontroller in another room.
+type PushSensor struct {
+	mu   sync.Mutex
+	last *Reading
+}
+
+func (s *PushSensor) Push(r Reading) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	s.last = &r
+}
+
+func (s *PushSensor) Read() (*Reading, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return nil, fmt.Errorf("%w has been pushed", ErrNoReading)
+	}
+	r := *s.last
+	return &r, checkAge(&r)
+}
+
+func checkAge(r *Reading) error {
+	if age := time.Since(r.Time); age > MAX_READING_AGE {
+		return fmt.Errorf("%w, the last reading is %v old", ErrNoReading, age.Round(time.Second))
+	}
+	return nil
+}
+
+type offsetSensor struct {
+	Sensor
+	offset float64
+}
+
+func (s *offsetSensor) Read() (*Reading, error) {
+	r, err := s.Sensor.Read()
+	if r != nil {
+		r.Temperature += s.offset
+	}
+	return r, err
+}
+
+// Return the sensor as a push sensor, or nil if readings can't be pushed to it.
+func AsPushSensor(s Sensor) *PushSensor {
+	if o, ok := s.(*offsetSensor); ok {
+		s = o.Sensor
+	}
+	p, _ := s.(*PushSensor)
+	return p
+}
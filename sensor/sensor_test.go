@@ -0,0 +1,142 @@
+package sensor
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a fake sysfs directory with the given files.
+func fakeDevice(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestSensors(t *testing.T) {
+	jsonFile := filepath.Join(t.TempDir(), "living.json")
+	os.WriteFile(jsonFile, []byte(`{"temp": 20.25}`), 0644)
+
+	for name, test := range map[string]struct {
+		config Config
+		want   float64
+	}{
+		"hwmon":          {Config{Type: HWMON, Path: fakeDevice(t, map[string]string{"temp1_input": "21500\n"})}, 21.5},
+		"hwmon channel":  {Config{Type: HWMON, Path: fakeDevice(t, map[string]string{"temp2_input": "19000\n"}), Channel: "temp2"}, 19},
+		"iio input":      {Config{Type: IIO, Path: fakeDevice(t, map[string]string{"in_temp_input": "22125\n"})}, 22.125},
+		"iio raw":        {Config{Type: IIO, Path: fakeDevice(t, map[string]string{"in_temp_raw": "1000\n", "in_temp_offset": "100\n", "in_temp_scale": "20\n"})}, 22},
+		"iio raw offset": {Config{Type: IIO, Path: fakeDevice(t, map[string]string{"in_temp_raw": "2300\n", "in_temp_scale": "10\n"})}, 23},
+		"w1": {Config{Type: W1, Path: fakeDevice(t, map[string]string{
+			"w1_slave": "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"})}, 23.125},
+		"file":   {Config{Type: FILE, Path: jsonFile}, 20.25},
+		"offset": {Config{Type: HWMON, Path: fakeDevice(t, map[string]string{"temp1_input": "21500\n"}), Offset: -1.5}, 20},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(r.Temperature-test.want) > 1e-9 || time.Since(r.Time) > time.Minute {
+				t.Errorf("reading %+v, want %v", r, test.want)
+			}
+		})
+	}
+}
+
+func TestHumidity(t *testing.T) {
+	jsonFile := filepath.Join(t.TempDir(), "dht22.json")
+	os.WriteFile(jsonFile, []byte(`{"temp": 20.25, "humidity": 41.5}`), 0644)
+
+	for name, test := range map[string]struct {
+		config Config
+		want   float64
+	}{
+		"hwmon":   {Config{Type: HWMON, Path: fakeDevice(t, map[string]string{"temp1_input": "21500\n", "humidity1_input": "45200\n"})}, 45.2},
+		"iio":     {Config{Type: IIO, Path: fakeDevice(t, map[string]string{"in_temp_input": "22125\n", "in_humidityrelative_input": "38000\n"})}, 38},
+		"iio raw": {Config{Type: IIO, Path: fakeDevice(t, map[string]string{"in_temp_input": "22125\n", "in_humidityrelative_raw": "500\n", "in_humidityrelative_scale": "100\n"})}, 50},
+		"file":    {Config{Type: FILE, Path: jsonFile, Offset: 1}, 41.5},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := New(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Humidity == nil || math.Abs(*r.Humidity-test.want) > 1e-9 {
+				t.Errorf("reading %+v, want humidity %v", r, test.want)
+			}
+		})
+	}
+
+	// sensors that don't measure humidity
+	s, _ := New(Config{Type: HWMON, Path: fakeDevice(t, map[string]string{"temp1_input": "21500\n"})})
+	if r, err := s.Read(); err != nil || r.Humidity != nil {
+		t.Errorf("unexpected reading %+v, err %v", r, err)
+	}
+}
+
+func TestInvalidSensors(t *testing.T) {
+	for _, c := range []Config{{Type: "dht"}, {Type: HWMON}} {
+		if _, err := New(c); err == nil {
+			t.Errorf("invalid sensor %+v was accepted", c)
+		}
+	}
+
+	// a failed CRC check, e.g. because of a loose wire
+	s, _ := New(Config{Type: W1, Path: fakeDevice(t, map[string]string{
+		"w1_slave": "72 01 4b 46 7f ff 0e 10 57 : crc=00 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"})})
+	if _, err := s.Read(); !errors.Is(err, ErrNoReading) {
+		t.Errorf("unexpected error %v", err)
+	}
+	// a disconnected device
+	s, _ = New(Config{Type: HWMON, Path: filepath.Join(t.TempDir(), "hwmon9")})
+	if _, err := s.Read(); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// a file that is no longer updated
+	file := filepath.Join(t.TempDir(), "living.json")
+	os.WriteFile(file, []byte(`{"temp": 20.5, "time": "2024-11-02T14:05:00+01:00"}`), 0644)
+	s, _ = New(Config{Type: FILE, Path: file})
+	if r, err := s.Read(); !errors.Is(err, ErrNoReading) || r == nil || r.Temperature != 20.5 {
+		t.Errorf("unexpected reading %+v, err %v", r, err)
+	}
+}
+
+func TestPushSensor(t *testing.T) {
+	s, _ := New(Config{Type: PUSH, Offset: 0.5})
+	if _, err := s.Read(); !errors.Is(err, ErrNoReading) {
+		t.Errorf("unexpected error %v", err)
+	}
+	p := AsPushSensor(s)
+	if p == nil {
+		t.Fatal("not a push sensor")
+	}
+	p.Push(Reading{Temperature: 21})
+	if r, err := s.Read(); err != nil || r.Temperature != 21.5 {
+		t.Errorf("unexpected reading %+v, err %v", r, err)
+	}
+	p.Push(Reading{Temperature: 21, Time: time.Now().Add(-time.Hour)})
+	if _, err := s.Read(); !errors.Is(err, ErrNoReading) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	hwmon, _ := New(Config{Type: HWMON, Path: "/sys/class/hwmon/hwmon0"})
+	if AsPushSensor(hwmon) != nil {
+		t.Error("readings can be pushed to a hwmon sensor")
+	}
+}
@@ -4,11 +4,15 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,15 +20,19 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/httplog/v2"
 
+	"rpi_panasonic_inverter_rc/backup"
+	"rpi_panasonic_inverter_rc/calendar"
 	"rpi_panasonic_inverter_rc/codec"
 	"rpi_panasonic_inverter_rc/codecbase"
 	"rpi_panasonic_inverter_rc/db"
 	"rpi_panasonic_inverter_rc/logs"
 	"rpi_panasonic_inverter_rc/rcutils"
 	"rpi_panasonic_inverter_rc/sched"
+	"rpi_panasonic_inverter_rc/sensor"
 )
 
-var g_irSender *codec.IrSender
+var g_irSenders map[string]*codec.IrSender
+var g_store db.Store
 var rootTemplate *template.Template
 
 type RootData struct {
@@ -72,12 +80,80 @@ func getRoot(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Return all settings as JSON
-func returnCurrentSettings(w http.ResponseWriter) {
+// Error details returned as JSON to API clients
+type ErrorResponse struct {
+	Error      string                `json:"error"`
+	Fields     []*rcutils.FieldError `json:"fields,omitempty"`
+	Violations codec.Violations      `json:"violations,omitempty"`
+	UsedBy     []string              `json:"usedBy,omitempty"`
+}
+
+func returnError(w http.ResponseWriter, status int, errResp *ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(errResp)
+	if err != nil {
+		slog.Error("JSON encode error response failed", "err", err)
+	}
+}
+
+// Return the unit in the URL. Routes without a unit apply to the default unit.
+func unitParam(r *http.Request) string {
+	unit := chi.URLParam(r, "unit")
+	if unit == "" {
+		return db.DefaultUnit
+	}
+	return unit
+}
+
+// Respond with 404 Not Found if the unit in the URL is not configured.
+func checkUnit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unit := unitParam(r)
+		if _, found := g_irSenders[unit]; !found {
+			returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no such unit: " + unit})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type Unit struct {
+	Name string `json:"name"`
+}
+
+func apiGetUnits(w http.ResponseWriter, r *http.Request) {
+	var allUnits []Unit = make([]Unit, 0)
+
+	units, err := g_store.GetUnits()
+	if err != nil {
+		slog.Error("apiGetUnits get units failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// only units with LIRC devices are controlled by the controller
+	for _, u := range *units {
+		if _, found := g_irSenders[u.Name]; found {
+			allUnits = append(allUnits, Unit{Name: u.Name})
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allUnits)
+	if err != nil {
+		slog.Error("apiGetUnits JSON encode units failed", "err", err)
+	}
+}
+
+// Return all settings of the unit as JSON
+func returnCurrentSettings(w http.ResponseWriter, unit string) {
 	var theSettings codecbase.AllSettings
 	theSettings.ModeSettings = make(codecbase.ModeSettingsMap)
 
-	dbRc, err := db.CurrentConfig()
+	dbRc, err := g_store.CurrentConfig(unit)
 	if err != nil {
 		slog.Error("apiGetSettings get current config failed", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -87,7 +163,7 @@ func returnCurrentSettings(w http.ResponseWriter) {
 	rcutils.CopyToSettings(dbRc, &theSettings.Settings)
 
 	for _, m := range []uint{codecbase.C_Mode_Auto, codecbase.C_Mode_Heat, codecbase.C_Mode_Cool, codecbase.C_Mode_Dry} {
-		temp, fan, err := db.GetModeSettings(m)
+		temp, fan, err := g_store.GetModeSettings(unit, m)
 		if err != nil {
 			slog.Error("apiGetSettings get mode settings failed", "mode", m, "err", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -108,7 +184,7 @@ func returnCurrentSettings(w http.ResponseWriter) {
 }
 
 func apiGetSettings(w http.ResponseWriter, r *http.Request) {
-	returnCurrentSettings(w)
+	returnCurrentSettings(w, unitParam(r))
 }
 
 func apiPostSettings(w http.ResponseWriter, r *http.Request) {
@@ -128,38 +204,74 @@ func apiPostSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbRc, err := db.CurrentConfig()
+	applySettings(w, unitParam(r), settings, "apiPostSettings")
+}
+
+// Compose the config to send and check that it is valid. If not, an error is returned to the client, and nil is
+// returned.
+func composeValidConfig(w http.ResponseWriter, unit string, settings *codecbase.Settings, dbRc *codec.RcConfig, caller string) *codec.RcConfig {
+	sendRc, err := rcutils.ComposeSendConfig(db.UnitModeSettings{Store: g_store, Unit: unit}, settings, dbRc)
+	if err != nil {
+		slog.Error(caller+": compose config failed", "err", err)
+		var settingsErr *rcutils.SettingsError
+		if errors.As(err, &settingsErr) {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "invalid settings", Fields: settingsErr.Fields})
+		} else {
+			returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		}
+		return nil
+	}
+	if violations := sendRc.Validate(); violations != nil {
+		slog.Error(caller+": invalid config", "err", violations)
+		returnError(w, http.StatusUnprocessableEntity, &ErrorResponse{Error: "invalid settings", Violations: violations})
+		return nil
+	}
+	return sendRc
+}
+
+// Apply the settings to the current config of the unit, send it to the inverter, and return all settings to the client.
+func applySettings(w http.ResponseWriter, unit string, settings *codecbase.Settings, caller string) {
+	dbRc, err := g_store.CurrentConfig(unit)
 	if err != nil {
-		slog.Error("apiPostSettings: save config failed", "err", err)
+		slog.Error(caller+": get current config failed", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	sendRc := rcutils.ComposeSendConfig(settings, dbRc)
-	g_irSender.SendConfig(sendRc)
+	sendRc := composeValidConfig(w, unit, settings, dbRc, caller)
+	if sendRc == nil {
+		return
+	}
+	g_irSenders[unit].SendConfig(sendRc)
 
-	err = db.SaveConfig(sendRc, dbRc)
+	err = g_store.SaveConfig(unit, sendRc, dbRc)
 	if err != nil {
-		slog.Error("apiPostSettings: failed to save config", "err", err)
+		slog.Error(caller+": failed to save config", "err", err)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	sched.ManualOverride(unit, dbRc, sendRc)
 
-	sched.CondRestartTimerJobs(settings)
+	sched.CondRestartTimerJobs(unit, settings)
 
-	returnCurrentSettings(w)
+	returnCurrentSettings(w, unit)
 }
 
 type JobSet struct {
-	Name   string `json:"name"`
-	Active bool   `json:"active"`
+	Name       string               `json:"name"`
+	Active     bool                 `json:"active"`
+	Priority   int                  `json:"priority"`
+	SkipMissed bool                 `json:"skipMissed"`           // missed jobs are not run when the controller starts
+	Activation *calendar.Activation `json:"activation,omitempty"` // not set if the job set is activated manually
+	Reason     string               `json:"reason,omitempty"`     // why a job set with an activation is active or not
+	Until      *time.Time           `json:"until,omitempty"`      // when the activation is evaluated next
 }
 
-func returnJobSets(w http.ResponseWriter) {
+func returnJobSets(w http.ResponseWriter, unit string) {
 	var allJS []JobSet = make([]JobSet, 0)
 
-	jss, err := db.GetJobSets()
+	jss, err := g_store.GetJobSets(unit)
 	if err != nil {
 		slog.Error("apiGetJobsets get jobset failed", "err", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -168,7 +280,18 @@ func returnJobSets(w http.ResponseWriter) {
 	}
 
 	for _, js := range *jss {
-		allJS = append(allJS, JobSet{Name: js.Name, Active: js.Active})
+		ajs := JobSet{Name: js.Name, Active: js.Active, Priority: js.Priority, SkipMissed: js.SkipMissed}
+		ajs.Activation, err = sched.JobSetActivation(&js)
+		if err != nil {
+			slog.Error("apiGetJobsets", "err", err)
+		}
+		if status := sched.ActivationStatus(unit, js.Name); ajs.Activation != nil && status != nil {
+			ajs.Reason = status.Reason
+			if !status.Until.IsZero() {
+				ajs.Until = &status.Until
+			}
+		}
+		allJS = append(allJS, ajs)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -180,7 +303,7 @@ func returnJobSets(w http.ResponseWriter) {
 }
 
 func apiGetJobsets(w http.ResponseWriter, r *http.Request) {
-	returnJobSets(w)
+	returnJobSets(w, unitParam(r))
 }
 
 func apiPostJobsets(w http.ResponseWriter, r *http.Request) {
@@ -201,59 +324,1310 @@ func apiPostJobsets(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	unit := unitParam(r)
+	current, err := g_store.GetJobSets(unit)
+	if err != nil {
+		slog.Error("apiPostJobsets get jobsets failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	for _, js := range allJS {
+		// job sets with an activation are activated and deactivated by the scheduler
+		if slices.ContainsFunc(*current, func(c db.JobSet) bool {
+			return c.Name == js.Name && len(c.Activation) > 0 && c.Active != js.Active
+		}) {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "jobset " + js.Name + " is activated by its calendar or date ranges"})
+			return
+		}
+	}
 	for _, js := range allJS {
-		db.UpdateJobSet(js.Name, js.Active)
-		sched.ScheduleJobsForJobset(js.Name, js.Active)
+		if err := g_store.UpdateJobSet(unit, js.Name, js.Active); err != nil {
+			slog.Error("apiPostJobsets update jobset failed", "jobset", js.Name, "err", err)
+			returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+			return
+		}
+		sched.ScheduleJobsForJobset(unit, js.Name, js.Active)
 	}
 
-	returnJobSets(w)
+	returnJobSets(w, unit)
 }
 
-func StartServer(logLevel string, irSender *codec.IrSender) {
-	var err error
+// Set the activation of a job set, which activates and deactivates it automatically, e.g.
+// {"calendar": "/home/pi/family.ics", "match": "vacation"}. The calendar file must be readable by the controller.
+func apiPutActivation(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutActivation: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var activation calendar.Activation
+	err := json.NewDecoder(r.Body).Decode(&activation)
+	if err != nil {
+		slog.Error("apiPutActivation: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
 
-	g_irSender = irSender
+	js := jobSetParam(w, r, "apiPutActivation")
+	if js == nil {
+		return
+	}
+	if err := sched.SetJobSetActivation(js.Unit, js.Name, &activation); err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnJobSets(w, js.Unit)
+}
 
-	r := chi.NewRouter()
+// Remove the activation of a job set, so that it is activated manually again. The job set stays as it is.
+func apiDeleteActivation(w http.ResponseWriter, r *http.Request) {
+	js := jobSetParam(w, r, "apiDeleteActivation")
+	if js == nil {
+		return
+	}
+	if err := sched.SetJobSetActivation(js.Unit, js.Name, nil); err != nil {
+		slog.Error("apiDeleteActivation failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnJobSets(w, js.Unit)
+}
 
-	// Logger
-	logger := httplog.NewLogger("paninv-controller", httplog.Options{
-		JSON:             true,
-		LogLevel:         logs.SetLoggerOpts(logLevel).Level.Level(),
-		Concise:          true,
-		RequestHeaders:   false,
-		SourceFieldName:  "",
-		TimeFieldName:    "time",
-		MessageFieldName: "msg",
-	})
+type Priority struct {
+	Priority int `json:"priority"`
+}
 
-	// A good base middleware stack
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(httplog.RequestLogger(logger))
-	r.Use(middleware.Recoverer)
+// Set the priority of a job set. Jobs of job sets with a higher priority suppress jobs of this job set that run at
+// about the same time.
+func apiPutPriority(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutPriority: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
 
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(60 * time.Second))
+	var priority Priority
+	err := json.NewDecoder(r.Body).Decode(&priority)
+	if err != nil {
+		slog.Error("apiPutPriority: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
 
-	// Handler to return compressed responses
-	r.Use(Gzip)
+	js := jobSetParam(w, r, "apiPutPriority")
+	if js == nil {
+		return
+	}
+	if err := g_store.SetJobSetPriority(js.Unit, js.Name, priority.Priority); err != nil {
+		slog.Error("apiPutPriority failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnJobSets(w, js.Unit)
+}
 
-	// status page
-	r.Get("/", getRoot)
-	webFunctions := template.FuncMap{}
-	rootTemplate = template.Must(template.New("root.gohtml").Funcs(webFunctions).ParseFiles("web/root.gohtml"))
+type SkipMissed struct {
+	SkipMissed bool `json:"skipMissed"`
+}
 
-	r.Route("/api/v1", func(r chi.Router) {
-		r.Get("/settings", apiGetSettings)
-		r.Post("/settings", apiPostSettings)
-		r.Get("/jobsets", apiGetJobsets)
-		r.Post("/jobsets", apiPostJobsets)
-	})
+// Set whether the jobs of a job set that were missed while the controller wasn't running are skipped, instead of being
+// run when it starts.
+func apiPutSkipMissed(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutSkipMissed: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var skip SkipMissed
+	err := json.NewDecoder(r.Body).Decode(&skip)
+	if err != nil {
+		slog.Error("apiPutSkipMissed: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	js := jobSetParam(w, r, "apiPutSkipMissed")
+	if js == nil {
+		return
+	}
+	if err := g_store.SetJobSetSkipMissed(js.Unit, js.Name, skip.SkipMissed); err != nil {
+		slog.Error("apiPutSkipMissed failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnJobSets(w, js.Unit)
+}
+
+type ConflictRun struct {
+	JobSet     string    `json:"jobset"`
+	Priority   int       `json:"priority"`
+	ID         uint      `json:"id"`
+	Schedule   string    `json:"schedule"`
+	At         time.Time `json:"at"`
+	Suppressed bool      `json:"suppressed"`
+}
+
+type Conflict struct {
+	Runs   []ConflictRun `json:"runs"`
+	Winner string        `json:"winner,omitempty"` // not set if the job sets have the same priority
+}
+
+// The longest period that conflicts can be listed for.
+const MAX_CONFLICT_DAYS = 31
+
+// List the jobs of different active job sets that run at about the same time within the next days (default 7), and
+// which of them are suppressed.
+func apiGetConflicts(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if s := r.URL.Query().Get("days"); s != "" {
+		var err error
+		if days, err = strconv.Atoi(s); err != nil || days < 1 || days > MAX_CONFLICT_DAYS {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("days must be between 1 and %d", MAX_CONFLICT_DAYS)})
+			return
+		}
+	}
+
+	now := time.Now()
+	conflicts, err := sched.Conflicts(unitParam(r), now, now.AddDate(0, 0, days))
+	if err != nil {
+		slog.Error("apiGetConflicts failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	allConflicts := make([]Conflict, 0, len(conflicts))
+	for _, c := range conflicts {
+		ac := Conflict{Winner: c.Winner}
+		for _, run := range c.Runs {
+			ac.Runs = append(ac.Runs, ConflictRun{JobSet: run.JobSet, Priority: run.Priority, ID: run.CronJob.ID,
+				Schedule: run.CronJob.Schedule, At: run.At, Suppressed: run.Suppressed})
+		}
+		allConflicts = append(allConflicts, ac)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allConflicts)
+	if err != nil {
+		slog.Error("apiGetConflicts JSON encode conflicts failed", "err", err)
+	}
+}
+
+type UpcomingRun struct {
+	At         time.Time           `json:"at"`
+	Kind       string              `json:"kind"` // settings, onetime, ramp, hold, timer or dst
+	Name       string              `json:"name"`
+	JobSet     string              `json:"jobset,omitempty"`
+	Preset     string              `json:"preset,omitempty"`
+	Settings   *codecbase.Settings `json:"settings,omitempty"`
+	Suppressed string              `json:"suppressed,omitempty"` // the job that suppresses the run
+	Hold       string              `json:"hold,omitempty"`       // skipped, deferred or merged by the hold
+	Error      string              `json:"error,omitempty"`
+	Config     codecbase.Settings  `json:"config"` // the expected config after the run
+}
+
+// The longest period that upcoming runs can be listed for.
+const MAX_UPCOMING_HOURS = 7 * 24
+
+// List the runs of the jobs of the unit within the next hours (default 48), with the config that is expected after each
+// of them.
+func apiGetUpcoming(w http.ResponseWriter, r *http.Request) {
+	hours := 48
+	if s := r.URL.Query().Get("hours"); s != "" {
+		var err error
+		if hours, err = strconv.Atoi(s); err != nil || hours < 1 || hours > MAX_UPCOMING_HOURS {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("hours must be between 1 and %d", MAX_UPCOMING_HOURS)})
+			return
+		}
+	}
+
+	now := time.Now()
+	runs, err := sched.Upcoming(g_store, unitParam(r), now, now.Add(time.Duration(hours)*time.Hour))
+	if err != nil {
+		slog.Error("apiGetUpcoming failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	allRuns := make([]UpcomingRun, 0, len(runs))
+	for _, run := range runs {
+		ur := UpcomingRun{At: run.At, Kind: run.Kind, Name: run.Name, JobSet: run.JobSet, Preset: run.Preset,
+			Settings: run.Settings, Suppressed: run.Suppressed, Hold: run.Hold, Error: run.Error}
+		rcutils.CopyToSettings(run.Config, &ur.Config)
+		allRuns = append(allRuns, ur)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allRuns)
+	if err != nil {
+		slog.Error("apiGetUpcoming JSON encode runs failed", "err", err)
+	}
+}
+
+// Settings held for a while. In a request, minutes can be given instead of until.
+type Hold struct {
+	Until    time.Time           `json:"until"`
+	Minutes  int                 `json:"minutes,omitempty"`
+	Preset   string              `json:"preset,omitempty"`
+	Settings codecbase.Settings  `json:"settings"`
+	Policy   string              `json:"policy"`             // defer, skip or merge (default defer)
+	Revert   *codecbase.Settings `json:"revert,omitempty"`   // the settings that are restored when the hold ends
+	Deferred int                 `json:"deferred,omitempty"` // the number of jobs deferred or merged during the hold
+}
+
+func returnHold(w http.ResponseWriter, hold *db.Hold) {
+	h := Hold{Until: hold.Until, Preset: hold.Preset, Policy: hold.Policy, Revert: new(codecbase.Settings)}
+	if err := json.Unmarshal(hold.Settings, &h.Settings); err != nil {
+		slog.Error("returnHold failed to unmarshal settings", "err", err)
+	}
+	if err := json.Unmarshal(hold.Revert, h.Revert); err != nil {
+		slog.Error("returnHold failed to unmarshal revert", "err", err)
+	}
+	if hold.Deferred != nil {
+		var deferred []codecbase.Settings
+		if err := json.Unmarshal(hold.Deferred, &deferred); err != nil {
+			slog.Error("returnHold failed to unmarshal deferred jobs", "err", err)
+		}
+		h.Deferred = len(deferred)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&h)
+	if err != nil {
+		slog.Error("returnHold JSON encode hold failed", "err", err)
+	}
+}
+
+func apiGetHold(w http.ResponseWriter, r *http.Request) {
+	hold, err := g_store.GetHold(unitParam(r))
+	if errors.Is(err, db.ErrNotFound) {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no hold"})
+		return
+	} else if err != nil {
+		slog.Error("apiGetHold failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnHold(w, hold)
+}
+
+// Hold settings until a time, or for a number of minutes, after which the fields changed by the hold are reverted.
+func apiPutHold(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutHold: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var req Hold
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.Error("apiPutHold: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Minutes != 0 {
+		req.Until = time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	}
+	if req.Policy == "" {
+		req.Policy = sched.HoldDefer
+	}
+
+	hold, err := sched.StartHold(unitParam(r), req.Preset, req.Settings, req.Until, req.Policy)
+	if err != nil {
+		slog.Error("apiPutHold failed", "err", err)
+		var settingsErr *rcutils.SettingsError
+		var violations codec.Violations
+		switch {
+		case errors.Is(err, sched.ErrInvalidHold):
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		case errors.As(err, &settingsErr):
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "invalid settings", Fields: settingsErr.Fields})
+		case errors.As(err, &violations):
+			returnError(w, http.StatusUnprocessableEntity, &ErrorResponse{Error: "invalid settings", Violations: violations})
+		default:
+			returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		}
+		return
+	}
+	returnHold(w, hold)
+}
+
+// End the hold now, and return the settings after it.
+func apiDeleteHold(w http.ResponseWriter, r *http.Request) {
+	unit := unitParam(r)
+	ended, err := sched.EndHold(unit)
+	if err != nil {
+		slog.Error("apiDeleteHold failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !ended {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no hold"})
+		return
+	}
+	returnCurrentSettings(w, unit)
+}
+
+// A ramp in progress, which changes the temperature gradually.
+type Ramp struct {
+	JobName     string    `json:"jobName"` // the cron job that started the ramp
+	From        uint      `json:"from"`
+	To          uint      `json:"to"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Temperature uint      `json:"temp"` // the temperature of the last step
+}
+
+func apiGetRamp(w http.ResponseWriter, r *http.Request) {
+	ramp := sched.GetActiveRamp(unitParam(r))
+	if ramp == nil {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no ramp"})
+		return
+	}
+	ar := Ramp{JobName: ramp.JobName, From: ramp.From, To: ramp.To, Start: ramp.Start, End: ramp.End, Temperature: ramp.Temperature}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&ar)
+	if err != nil {
+		slog.Error("apiGetRamp JSON encode ramp failed", "err", err)
+	}
+}
+
+// Stop the ramp in progress, keeping the current temperature, and return the current settings.
+func apiDeleteRamp(w http.ResponseWriter, r *http.Request) {
+	unit := unitParam(r)
+	if !sched.CancelRamp(unit) {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no ramp"})
+		return
+	}
+	returnCurrentSettings(w, unit)
+}
+
+// The thermostat of a unit, which adjusts the temperature setting to reach a target temperature at a sensor.
+type Thermostat struct {
+	Sensor       string          `json:"sensor"`
+	Target       float64         `json:"target"`
+	Hysteresis   float64         `json:"hysteresis"`
+	MinInterval  uint            `json:"minInterval"` // minutes
+	Min          uint            `json:"min"`
+	Max          uint            `json:"max"`
+	Disabled     bool            `json:"disabled"`
+	Reading      *sensor.Reading `json:"reading,omitempty"`
+	Error        string          `json:"error,omitempty"` // why the sensor couldn't be read
+	State        string          `json:"state,omitempty"`
+	LastAdjusted *time.Time      `json:"lastAdjusted,omitempty"`
+}
+
+// A change of the target of a thermostat, or of whether it is disabled.
+type ThermostatUpdate struct {
+	Target   *float64 `json:"target"`
+	Disabled *bool    `json:"disabled"`
+}
+
+func returnThermostat(w http.ResponseWriter, ts *sched.ThermostatStatus) {
+	at := Thermostat{Sensor: ts.Sensor, Target: ts.Target, Hysteresis: ts.Hysteresis, MinInterval: ts.MinInterval,
+		Min: ts.Min, Max: ts.Max, Disabled: ts.Disabled, Reading: ts.Reading, Error: ts.Error, State: ts.State}
+	if !ts.LastAdjusted.IsZero() {
+		at.LastAdjusted = &ts.LastAdjusted
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&at)
+	if err != nil {
+		slog.Error("returnThermostat JSON encode thermostat failed", "err", err)
+	}
+}
+
+func apiGetThermostat(w http.ResponseWriter, r *http.Request) {
+	ts := sched.GetThermostat(unitParam(r))
+	if ts == nil {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no thermostat"})
+		return
+	}
+	returnThermostat(w, ts)
+}
+
+// Change the target of the thermostat, or disable or enable it, until the controller is restarted.
+func apiPutThermostat(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutThermostat: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var req ThermostatUpdate
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.Error("apiPutThermostat: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ts, err := sched.UpdateThermostat(unitParam(r), req.Target, req.Disabled)
+	if err != nil {
+		slog.Error("apiPutThermostat failed", "err", err)
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+			returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no thermostat"})
+		case errors.Is(err, sched.ErrInvalidThermostat):
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		default:
+			returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		}
+		return
+	}
+	returnThermostat(w, ts)
+}
+
+// The current reading of a sensor.
+type Sensor struct {
+	Name    string          `json:"name"`
+	Reading *sensor.Reading `json:"reading,omitempty"`
+	Error   string          `json:"error,omitempty"` // why the sensor couldn't be read
+}
+
+// A saved reading of a sensor, or the average of the readings of a period.
+type SensorReading struct {
+	Time        time.Time     `json:"time"`
+	Temperature float64       `json:"temp"`
+	Humidity    *float64      `json:"humidity,omitempty"`
+	Period      time.Duration `json:"period,omitempty"` // in nanoseconds, for an average
+}
+
+// The most hours of sensor readings that can be requested.
+const MAX_SENSOR_HISTORY_HOURS = int(sched.SENSOR_HISTORY_RETENTION / time.Hour)
+
+// Read all sensors. A stale reading is returned together with the error.
+func apiGetSensors(w http.ResponseWriter, r *http.Request) {
+	sensors := make([]Sensor, 0)
+	for _, name := range sched.SensorNames() {
+		reading, err := sched.GetSensor(name).Read()
+		s := Sensor{Name: name, Reading: reading}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		sensors = append(sensors, s)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&sensors)
+	if err != nil {
+		slog.Error("apiGetSensors JSON encode sensors failed", "err", err)
+	}
+}
+
+// Return the saved readings of a sensor during the last hours, the oldest first. Readings older than two days are
+// hourly averages.
+func apiGetSensorHistory(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if sched.GetSensor(name) == nil {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: fmt.Sprintf("no sensor %q", name)})
+		return
+	}
+	hours := 24
+	if s := r.URL.Query().Get("hours"); s != "" {
+		var err error
+		if hours, err = strconv.Atoi(s); err != nil || hours < 1 || hours > MAX_SENSOR_HISTORY_HOURS {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("hours must be between 1 and %d", MAX_SENSOR_HISTORY_HOURS)})
+			return
+		}
+	}
+
+	now := time.Now()
+	readings, err := g_store.GetSensorReadings(name, now.Add(-time.Duration(hours)*time.Hour), now.Add(time.Minute))
+	if err != nil {
+		slog.Error("apiGetSensorHistory failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	history := make([]SensorReading, 0, len(*readings))
+	for _, r := range *readings {
+		history = append(history, SensorReading{Time: r.Time, Temperature: r.Temperature, Humidity: r.Humidity, Period: r.Period})
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&history)
+	if err != nil {
+		slog.Error("apiGetSensorHistory JSON encode readings failed", "err", err)
+	}
+}
+
+// Push a reading to a sensor, e.g. from a microcontroller in another room, and return the reading of the sensor, which
+// includes its offset. The time defaults to now.
+func apiPutSensorReading(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutSensorReading: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	s := sched.GetSensor(name)
+	if s == nil {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: fmt.Sprintf("no sensor %q", name)})
+		return
+	}
+	ps := sensor.AsPushSensor(s)
+	if ps == nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("readings can't be pushed to sensor %q", name)})
+		return
+	}
+
+	var req struct {
+		Temperature *float64  `json:"temp"`
+		Humidity    *float64  `json:"humidity"`
+		Time        time.Time `json:"time"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		slog.Error("apiPutSensorReading: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Temperature == nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "the reading has no temperature"})
+		return
+	}
+	ps.Push(sensor.Reading{Temperature: *req.Temperature, Humidity: req.Humidity, Time: req.Time})
+	reading, err := s.Read()
+	if err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(reading)
+	if err != nil {
+		slog.Error("apiPutSensorReading JSON encode reading failed", "err", err)
+	}
+}
+
+type JobRun struct {
+	Started   time.Time           `json:"started"`
+	Scheduled time.Time           `json:"scheduled"`
+	Duration  time.Duration       `json:"duration"` // in nanoseconds
+	Kind      string              `json:"kind"`     // settings, onetime, timer, dst, hold, ramp or thermostat
+	Name      string              `json:"name"`
+	JobSet    string              `json:"jobset,omitempty"`
+	JobID     uint                `json:"jobId,omitempty"`
+	Preset    string              `json:"preset,omitempty"`
+	Settings  *codecbase.Settings `json:"settings,omitempty"`
+	Config    *codecbase.Settings `json:"config,omitempty"` // the config after the run
+	Outcome   string              `json:"outcome"`          // ok, suppressed, deferred, skipped or failed
+	Error     string              `json:"error,omitempty"`
+}
+
+// The longest period that job runs can be listed for, which is how long they are kept.
+const MAX_JOB_RUN_HOURS = int(sched.JOB_RUN_RETENTION / time.Hour)
+
+// List the runs of the jobs of the unit within the last hours (default 24), the most recent first. The runs can be
+// limited to the jobs of a job set.
+func apiGetJobRuns(w http.ResponseWriter, r *http.Request) {
+	hours := 24
+	if s := r.URL.Query().Get("hours"); s != "" {
+		var err error
+		if hours, err = strconv.Atoi(s); err != nil || hours < 1 || hours > MAX_JOB_RUN_HOURS {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: fmt.Sprintf("hours must be between 1 and %d", MAX_JOB_RUN_HOURS)})
+			return
+		}
+	}
+	jobset := r.URL.Query().Get("jobset")
+
+	runs, err := g_store.GetJobRuns(unitParam(r), time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		slog.Error("apiGetJobRuns failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	allRuns := make([]JobRun, 0, len(*runs))
+	for _, run := range *runs {
+		if jobset != "" && run.JobSet != jobset {
+			continue
+		}
+		jr := JobRun{Started: run.Started, Scheduled: run.Scheduled, Duration: run.Duration, Kind: run.Kind, Name: run.JobName,
+			JobSet: run.JobSet, JobID: run.JobID, Preset: run.Preset, Outcome: run.Outcome, Error: run.Error}
+		if run.Settings != nil {
+			jr.Settings = new(codecbase.Settings)
+			if err := json.Unmarshal(run.Settings, jr.Settings); err != nil {
+				slog.Error("apiGetJobRuns failed to unmarshal settings", "jobName", run.JobName, "err", err)
+			}
+		}
+		if run.Config != nil {
+			jr.Config = new(codecbase.Settings)
+			if err := json.Unmarshal(run.Config, jr.Config); err != nil {
+				slog.Error("apiGetJobRuns failed to unmarshal config", "jobName", run.JobName, "err", err)
+			}
+		}
+		allRuns = append(allRuns, jr)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allRuns)
+	if err != nil {
+		slog.Error("apiGetJobRuns JSON encode runs failed", "err", err)
+	}
+}
+
+type CronJob struct {
+	ID       uint               `json:"id"`
+	Schedule string             `json:"schedule"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+	Ramp     *db.Ramp           `json:"ramp,omitempty"` // changes the temperature gradually after the job has run
+	NextRun  *time.Time         `json:"next,omitempty"` // not set if the job set is inactive
+}
+
+// Return the job set in the URL, or respond with 404 Not Found and return nil if it doesn't exist.
+func jobSetParam(w http.ResponseWriter, r *http.Request, caller string) *db.JobSet {
+	name := chi.URLParam(r, "jobset")
+	jss, err := g_store.GetJobSets(unitParam(r))
+	if err != nil {
+		slog.Error(caller+": get jobsets failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return nil
+	}
+	for _, js := range *jss {
+		if js.Name == name {
+			return &js
+		}
+	}
+	returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no such jobset: " + name})
+	return nil
+}
+
+func returnCronJobs(w http.ResponseWriter, unit, jobset string) {
+	var allJobs []CronJob = make([]CronJob, 0)
+
+	cjs, err := g_store.GetCronJobs(unit, jobset)
+	if err != nil {
+		slog.Error("apiGetCronJobs get cronjobs failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	for _, cj := range *cjs {
+		job := CronJob{ID: cj.ID, Schedule: cj.Schedule, Preset: cj.Preset}
+		if err := json.Unmarshal(cj.Settings, &job.Settings); err != nil {
+			slog.Error("apiGetCronJobs unmarshal settings failed", "id", cj.ID, "err", err)
+			continue
+		}
+		if cj.Ramp != nil {
+			if err := json.Unmarshal(cj.Ramp, &job.Ramp); err != nil {
+				slog.Error("apiGetCronJobs unmarshal ramp failed", "id", cj.ID, "err", err)
+				continue
+			}
+		}
+		if next := sched.NextRun(unit, jobset, cj.ID); !next.IsZero() {
+			job.NextRun = &next
+		}
+		allJobs = append(allJobs, job)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allJobs)
+	if err != nil {
+		slog.Error("apiGetCronJobs JSON encode cronjobs failed", "err", err)
+	}
+}
+
+func apiGetCronJobs(w http.ResponseWriter, r *http.Request) {
+	if js := jobSetParam(w, r, "apiGetCronJobs"); js != nil {
+		returnCronJobs(w, js.Unit, js.Name)
+	}
+}
+
+// Add a cron job to a job set. The schedule is either in crontab format or relative to sunrise or sunset, e.g.
+// "@sunset-30m". Note that the jobs file replaces the job set when it is reloaded.
+func apiPostCronJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPostCronJobs: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var job CronJob
+	err := json.NewDecoder(r.Body).Decode(&job)
+	if err != nil {
+		slog.Error("apiPostCronJobs: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	js := jobSetParam(w, r, "apiPostCronJobs")
+	if js == nil {
+		return
+	}
+	if err := sched.ValidateSchedule(job.Schedule); err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if job.Ramp != nil {
+		if err := sched.ValidateRamp(job.Ramp); err != nil {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+	resolved, err := db.ResolvePreset(g_store, job.Preset, &job.Settings)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	dbRc, err := g_store.CurrentConfig(js.Unit)
+	if err != nil {
+		slog.Error("apiPostCronJobs: get current config failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if composeValidConfig(w, js.Unit, resolved, dbRc, "apiPostCronJobs") == nil {
+		return
+	}
+
+	if err := g_store.SaveCronJob(js.Unit, js.Name, job.Schedule, job.Preset, &job.Settings, job.Ramp); err != nil {
+		slog.Error("apiPostCronJobs: save cronjob failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	sched.ScheduleJobsForJobset(js.Unit, js.Name, js.Active)
+
+	returnCronJobs(w, js.Unit, js.Name)
+}
+
+func apiDeleteCronJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 0)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "invalid job id"})
+		return
+	}
+	js := jobSetParam(w, r, "apiDeleteCronJob")
+	if js == nil {
+		return
+	}
+	cjs, err := g_store.GetCronJobs(js.Unit, js.Name)
+	if err != nil {
+		slog.Error("apiDeleteCronJob get cronjobs failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !slices.ContainsFunc(*cjs, func(cj db.CronJob) bool { return cj.ID == uint(id) }) {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no such job"})
+		return
+	}
+	if err := g_store.DeleteCronJob(uint(id)); err != nil {
+		slog.Error("apiDeleteCronJob delete cronjob failed", "id", id, "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	sched.ScheduleJobsForJobset(js.Unit, js.Name, js.Active)
+
+	returnCronJobs(w, js.Unit, js.Name)
+}
+
+type OneTimeJob struct {
+	ID       uint               `json:"id"`
+	At       time.Time          `json:"at"`
+	Preset   string             `json:"preset,omitempty"`
+	Settings codecbase.Settings `json:"settings"`
+}
+
+func returnOneTimeJobs(w http.ResponseWriter, unit string) {
+	var allJobs []OneTimeJob = make([]OneTimeJob, 0)
+
+	otjs, err := g_store.GetOneTimeJobs(unit)
+	if err != nil {
+		slog.Error("apiGetOneTimeJobs get one-time jobs failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	for _, otj := range *otjs {
+		job := OneTimeJob{ID: otj.ID, At: otj.At, Preset: otj.Preset}
+		if err := json.Unmarshal(otj.Settings, &job.Settings); err != nil {
+			slog.Error("apiGetOneTimeJobs unmarshal settings failed", "id", otj.ID, "err", err)
+			continue
+		}
+		allJobs = append(allJobs, job)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allJobs)
+	if err != nil {
+		slog.Error("apiGetOneTimeJobs JSON encode jobs failed", "err", err)
+	}
+}
+
+func apiGetOneTimeJobs(w http.ResponseWriter, r *http.Request) {
+	returnOneTimeJobs(w, unitParam(r))
+}
+
+// Create a one-time job. The settings are checked against the current config of the unit, but the preset and the
+// settings are applied to the config that is current when the job runs.
+func apiPostOneTimeJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPostOneTimeJobs: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var job OneTimeJob
+	err := json.NewDecoder(r.Body).Decode(&job)
+	if err != nil {
+		slog.Error("apiPostOneTimeJobs: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !job.At.After(time.Now()) {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "the time of the job must be in the future"})
+		return
+	}
+
+	unit := unitParam(r)
+	resolved, err := db.ResolvePreset(g_store, job.Preset, &job.Settings)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	dbRc, err := g_store.CurrentConfig(unit)
+	if err != nil {
+		slog.Error("apiPostOneTimeJobs: get current config failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if composeValidConfig(w, unit, resolved, dbRc, "apiPostOneTimeJobs") == nil {
+		return
+	}
+
+	otj, err := g_store.SaveOneTimeJob(unit, job.At, job.Preset, &job.Settings)
+	if err != nil {
+		slog.Error("apiPostOneTimeJobs: save job failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := sched.ScheduleOneTimeJob(otj); err != nil {
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	returnOneTimeJobs(w, unit)
+}
+
+func apiDeleteOneTimeJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 0)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "invalid job id"})
+		return
+	}
+	unit := unitParam(r)
+	otjs, err := g_store.GetOneTimeJobs(unit)
+	if err != nil {
+		slog.Error("apiDeleteOneTimeJob get one-time jobs failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	// only jobs of the unit in the URL can be deleted
+	if !slices.ContainsFunc(*otjs, func(otj db.OneTimeJob) bool { return otj.ID == uint(id) }) {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no such job"})
+		return
+	}
+	sched.UnscheduleOneTimeJob(uint(id))
+	if _, err := g_store.DeleteOneTimeJob(uint(id)); err != nil {
+		slog.Error("apiDeleteOneTimeJob delete job failed", "id", id, "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	returnOneTimeJobs(w, unit)
+}
+
+type Preset struct {
+	Name     string             `json:"name"`
+	Settings codecbase.Settings `json:"settings"`
+}
+
+func returnPresets(w http.ResponseWriter) {
+	var allPresets []Preset = make([]Preset, 0)
+
+	presets, err := g_store.GetPresets()
+	if err != nil {
+		slog.Error("apiGetPresets get presets failed", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	for _, p := range *presets {
+		preset := Preset{Name: p.Name}
+		if err := json.Unmarshal(p.Settings, &preset.Settings); err != nil {
+			slog.Error("apiGetPresets unmarshal settings failed", "preset", p.Name, "err", err)
+			continue
+		}
+		allPresets = append(allPresets, preset)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&allPresets)
+	if err != nil {
+		slog.Error("apiGetPresets JSON encode presets failed", "err", err)
+	}
+}
+
+func apiGetPresets(w http.ResponseWriter, r *http.Request) {
+	returnPresets(w)
+}
+
+// Check that the settings of a preset are valid, and save it. Presets are shared by all units, and are checked against
+// the current config of each unit that uses the preset, or of the default unit if no unit uses it.
+func savePreset(w http.ResponseWriter, preset *Preset, caller string) bool {
+	if preset.Name == "" {
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: "preset name is missing"})
+		return false
+	}
+	units, err := db.PresetUnits(g_store, preset.Name)
+	if err != nil {
+		slog.Error(caller+": get preset users failed", "preset", preset.Name, "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return false
+	}
+	if len(units) == 0 {
+		units = []string{db.DefaultUnit}
+	}
+	for _, unit := range units {
+		dbRc, err := g_store.CurrentConfig(unit)
+		if err != nil {
+			slog.Error(caller+": get current config failed", "unit", unit, "err", err)
+			returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+			return false
+		}
+		if composeValidConfig(w, unit, &preset.Settings, dbRc, caller) == nil {
+			return false
+		}
+	}
+	if err := g_store.SavePreset(preset.Name, &preset.Settings); err != nil {
+		slog.Error(caller+": save preset failed", "preset", preset.Name, "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return false
+	}
+	return true
+}
+
+func apiPostPresets(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPostPresets: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	var preset Preset
+	err := json.NewDecoder(r.Body).Decode(&preset)
+	if err != nil {
+		slog.Error("apiPostPresets: decode body failed", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if savePreset(w, &preset, "apiPostPresets") {
+		returnPresets(w)
+	}
+}
+
+func apiGetPreset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	settings, err := g_store.GetPreset(name)
+	if err != nil {
+		slog.Error("apiGetPreset get preset failed", "preset", name, "err", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		returnError(w, status, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&Preset{Name: name, Settings: *settings})
+	if err != nil {
+		slog.Error("apiGetPreset JSON encode preset failed", "err", err)
+	}
+}
+
+func apiPutPreset(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPutPreset: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	preset := Preset{Name: chi.URLParam(r, "name")}
+	err := json.NewDecoder(r.Body).Decode(&preset.Settings)
+	if err != nil {
+		slog.Error("apiPutPreset: decode body failed", "err", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if savePreset(w, &preset, "apiPutPreset") {
+		returnPresets(w)
+	}
+}
+
+func apiDeletePreset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	var found bool
+	var usedBy []string
+	// check the references in the same transaction, so that no job can start using the preset in between
+	err := g_store.WithTx(func(tx db.Store) error {
+		var err error
+		if usedBy, err = db.PresetUsers(tx, name); err != nil || len(usedBy) > 0 {
+			return err
+		}
+		found, err = tx.DeletePreset(name)
+		return err
+	})
+	if err != nil {
+		slog.Error("apiDeletePreset delete preset failed", "preset", name, "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if len(usedBy) > 0 {
+		slog.Warn("apiDeletePreset preset is in use", "preset", name, "usedBy", usedBy)
+		returnError(w, http.StatusConflict, &ErrorResponse{Error: "preset is in use", UsedBy: usedBy})
+		return
+	}
+	if !found {
+		returnError(w, http.StatusNotFound, &ErrorResponse{Error: "no such preset"})
+		return
+	}
+	returnPresets(w)
+}
+
+// Apply a preset to the current config, and send it to the inverter.
+func apiApplyPreset(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	settings, err := g_store.GetPreset(name)
+	if err != nil {
+		slog.Error("apiApplyPreset get preset failed", "preset", name, "err", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, db.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		returnError(w, status, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	applySettings(w, unitParam(r), settings, "apiApplyPreset")
+}
+
+type ReceiverStats struct {
+	Rejections map[string]int `json:"rejections"`
+}
+
+func apiGetReceiverStats(w http.ResponseWriter, r *http.Request) {
+	stats := ReceiverStats{Rejections: codec.RejectionCounts()}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&stats)
+	if err != nil {
+		slog.Error("apiGetReceiverStats JSON encode stats failed", "err", err)
+	}
+}
+
+func apiGetBackup(w http.ResponseWriter, r *http.Request) {
+	b, err := backup.Export(g_store)
+	if err != nil {
+		slog.Error("apiGetBackup export failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="paninv-backup.json"`)
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(b)
+	if err != nil {
+		slog.Error("apiGetBackup JSON encode backup failed", "err", err)
+	}
+}
+
+// Import a backup. The mode query parameter is merge (default) or replace.
+func apiPostBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		slog.Error("apiPostBackup: expecting JSON data", "Content-Type", r.Header.Get("Content-Type"))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("expecting JSON in request"))
+		return
+	}
+
+	mode := backup.MODE_MERGE
+	if m := r.URL.Query().Get("mode"); m != "" {
+		var err error
+		if mode, err = backup.ParseMode(m); err != nil {
+			returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	var b backup.Backup
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		slog.Error("apiPostBackup: decode body failed", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := backup.Validate(g_store, &b, mode); err != nil {
+		slog.Error("apiPostBackup invalid backup", "err", err)
+		returnError(w, http.StatusBadRequest, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := backup.Import(g_store, &b, mode); err != nil {
+		slog.Error("apiPostBackup import failed", "err", err)
+		returnError(w, http.StatusInternalServerError, &ErrorResponse{Error: err.Error()})
+		return
+	}
+	slog.Info("imported backup", "mode", mode, "created", b.Created)
+
+	for unit := range g_irSenders {
+		if err := sched.ReloadUnit(unit); err != nil {
+			slog.Error("apiPostBackup reload unit failed", "unit", unit, "err", err)
+		}
+	}
+	apiGetBackup(w, r)
+}
+
+// Routes that control a unit. They are available both with and without a unit in the URL.
+func unitRoutes(r chi.Router) {
+	r.Use(checkUnit)
+	r.Get("/settings", apiGetSettings)
+	r.Post("/settings", apiPostSettings)
+	r.Get("/jobsets", apiGetJobsets)
+	r.Post("/jobsets", apiPostJobsets)
+	r.Get("/jobsets/conflicts", apiGetConflicts)
+	r.Put("/jobsets/{jobset}/priority", apiPutPriority)
+	r.Put("/jobsets/{jobset}/skipmissed", apiPutSkipMissed)
+	r.Put("/jobsets/{jobset}/activation", apiPutActivation)
+	r.Delete("/jobsets/{jobset}/activation", apiDeleteActivation)
+	r.Get("/jobsets/{jobset}/cronjobs", apiGetCronJobs)
+	r.Post("/jobsets/{jobset}/cronjobs", apiPostCronJobs)
+	r.Delete("/jobsets/{jobset}/cronjobs/{id}", apiDeleteCronJob)
+	r.Get("/onetimejobs", apiGetOneTimeJobs)
+	r.Post("/onetimejobs", apiPostOneTimeJobs)
+	r.Delete("/onetimejobs/{id}", apiDeleteOneTimeJob)
+	r.Post("/presets/{name}/apply", apiApplyPreset)
+	r.Get("/schedule/upcoming", apiGetUpcoming)
+	r.Get("/jobs/runs", apiGetJobRuns)
+	r.Get("/hold", apiGetHold)
+	r.Put("/hold", apiPutHold)
+	r.Delete("/hold", apiDeleteHold)
+	r.Get("/ramp", apiGetRamp)
+	r.Delete("/ramp", apiDeleteRamp)
+	r.Get("/thermostat", apiGetThermostat)
+	r.Put("/thermostat", apiPutThermostat)
+}
+
+// Create the router with the web page and the API. The handlers use the store and the IR senders of the configured
+// units, keyed by unit name.
+func NewRouter(logLevel string, store db.Store, irSenders map[string]*codec.IrSender) http.Handler {
+	g_store = store
+	g_irSenders = irSenders
+
+	r := chi.NewRouter()
+
+	// Logger
+	logger := httplog.NewLogger("paninv-controller", httplog.Options{
+		JSON:             true,
+		LogLevel:         logs.SetLoggerOpts(logLevel).Level.Level(),
+		Concise:          true,
+		RequestHeaders:   false,
+		SourceFieldName:  "",
+		TimeFieldName:    "time",
+		MessageFieldName: "msg",
+	})
+
+	// A good base middleware stack
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(httplog.RequestLogger(logger))
+	r.Use(middleware.Recoverer)
+
+	// Set a timeout value on the request context (ctx), that will signal
+	// through ctx.Done() that the request has timed out and further
+	// processing should be stopped.
+	r.Use(middleware.Timeout(60 * time.Second))
+
+	// Handler to return compressed responses
+	r.Use(Gzip)
+
+	// status page
+	r.Get("/", getRoot)
+
+	r.Route("/api/v1", func(r chi.Router) {
+		// the routes without a unit apply to the default unit
+		r.Group(unitRoutes)
+		r.Route("/units/{unit}", unitRoutes)
+		r.Get("/units", apiGetUnits)
+		r.Get("/presets", apiGetPresets)
+		r.Post("/presets", apiPostPresets)
+		r.Get("/presets/{name}", apiGetPreset)
+		r.Put("/presets/{name}", apiPutPreset)
+		r.Delete("/presets/{name}", apiDeletePreset)
+		r.Get("/receiver/stats", apiGetReceiverStats)
+		r.Get("/sensors", apiGetSensors)
+		r.Put("/sensors/{name}", apiPutSensorReading)
+		r.Get("/sensors/{name}/history", apiGetSensorHistory)
+		r.Get("/backup", apiGetBackup)
+		r.Post("/backup", apiPostBackup)
+	})
+
+	return r
+}
+
+// Serve the web page and the API on the TCP address, e.g. ":3333", and optionally also on a unix socket for local
+// clients.
+func StartServer(logLevel, addr, socket string, store db.Store, irSenders map[string]*codec.IrSender) {
+	var err error
+
+	r := NewRouter(logLevel, store, irSenders)
+
+	webFunctions := template.FuncMap{}
+	rootTemplate = template.Must(template.New("root.gohtml").Funcs(webFunctions).ParseFiles("web/root.gohtml"))
+
+	if socket != "" {
+		// remove the socket of a previous run
+		os.Remove(socket)
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			slog.Error("error opening API socket", "socket", socket, "err", err)
+		} else {
+			go func() {
+				if err := http.Serve(listener, r); err != nil {
+					slog.Error("error serving API socket", "socket", socket, "err", err)
+				}
+			}()
+		}
+	}
 
-	err = http.ListenAndServe(":3333", r)
+	err = http.ListenAndServe(addr, r)
 	if errors.Is(err, http.ErrServerClosed) {
 		slog.Info("server closed")
 	} else if err != nil {
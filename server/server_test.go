@@ -0,0 +1,599 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"rpi_panasonic_inverter_rc/codec"
+	"rpi_panasonic_inverter_rc/codecbase"
+	"rpi_panasonic_inverter_rc/db"
+	"rpi_panasonic_inverter_rc/sched"
+	"rpi_panasonic_inverter_rc/sensor"
+	"rpi_panasonic_inverter_rc/solar"
+)
+
+type testServer struct {
+	handler   http.Handler
+	store     *db.MemStore
+	irSenders map[string]*codec.IrSender
+	irOutputs map[string]string
+}
+
+// Create a server with an in-memory store, and IR senders that write to files.
+func newTestServer(t *testing.T, units ...string) *testServer {
+	ts := &testServer{
+		store:     db.NewMemStore(),
+		irSenders: make(map[string]*codec.IrSender),
+		irOutputs: make(map[string]string),
+	}
+	senderOptions := codec.NewSenderOptions()
+	senderOptions.Device = false
+	for _, unit := range append([]string{db.DefaultUnit}, units...) {
+		ts.irOutputs[unit] = filepath.Join(t.TempDir(), unit+".lirc")
+		ts.irSenders[unit] = codec.StartIrSender(ts.irOutputs[unit], senderOptions)
+		ts.store.SaveUnit(unit, "", ts.irOutputs[unit])
+	}
+	if err := sched.InitScheduler(ts.store, ts.irSenders); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sched.Stop)
+	ts.handler = NewRouter("error", ts.store, ts.irSenders)
+	return ts
+}
+
+// Wait until all configs have been sent, and return the units that were sent to.
+func (ts *testServer) sentTo() []string {
+	var units []string
+	for unit, irSender := range ts.irSenders {
+		irSender.Stop()
+		if fi, err := os.Stat(ts.irOutputs[unit]); err == nil && fi.Size() > 0 {
+			units = append(units, unit)
+		}
+	}
+	return units
+}
+
+func (ts *testServer) request(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	var v T
+	if err := json.NewDecoder(rec.Body).Decode(&v); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return v
+}
+
+func TestGetSettings(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.request(t, "GET", "/api/v1/settings", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	all := decode[codecbase.AllSettings](t, rec)
+	if all.Settings.Mode != "auto" || all.Settings.Temperature != "20" || len(all.ModeSettings) != 4 {
+		t.Errorf("unexpected settings %+v", all)
+	}
+}
+
+func TestPostSettings(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.request(t, "POST", "/api/v1/settings", `{"mode": "heat", "temp": "23"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if all := decode[codecbase.AllSettings](t, rec); all.Settings.Mode != "heat" || all.Settings.Temperature != "23" {
+		t.Errorf("unexpected settings %+v", all.Settings)
+	}
+	rc, _ := ts.store.CurrentConfig(db.DefaultUnit)
+	if rc.Mode != codecbase.C_Mode_Heat || rc.Temperature != 23 {
+		t.Errorf("config not saved: %+v", rc)
+	}
+	if sent := ts.sentTo(); len(sent) != 1 || sent[0] != db.DefaultUnit {
+		t.Errorf("config sent to %v", sent)
+	}
+}
+
+func TestPostInvalidSettings(t *testing.T) {
+	ts := newTestServer(t)
+
+	rec := ts.request(t, "POST", "/api/v1/settings", `{"temp": "35", "fan": "turbo"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	errResp := decode[ErrorResponse](t, rec)
+	if len(errResp.Fields) != 2 || errResp.Fields[0].Field != "temp" || errResp.Fields[1].Field != "fan" {
+		t.Errorf("unexpected error response %+v", errResp)
+	}
+	if sent := ts.sentTo(); len(sent) != 0 {
+		t.Errorf("config sent to %v", sent)
+	}
+}
+
+func TestUnits(t *testing.T) {
+	ts := newTestServer(t, "bedroom")
+
+	rec := ts.request(t, "GET", "/api/v1/units", "")
+	if units := decode[[]Unit](t, rec); len(units) != 2 || units[0].Name != "bedroom" || units[1].Name != db.DefaultUnit {
+		t.Errorf("unexpected units %+v", units)
+	}
+
+	rec = ts.request(t, "POST", "/api/v1/units/bedroom/settings", `{"temp": "+2"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rc, _ := ts.store.CurrentConfig("bedroom"); rc.Temperature != 22 {
+		t.Errorf("bedroom temperature %d, want 22", rc.Temperature)
+	}
+	if rc, _ := ts.store.CurrentConfig(db.DefaultUnit); rc.Temperature != 20 {
+		t.Errorf("default temperature %d, want 20", rc.Temperature)
+	}
+	if sent := ts.sentTo(); len(sent) != 1 || sent[0] != "bedroom" {
+		t.Errorf("config sent to %v", sent)
+	}
+
+	rec = ts.request(t, "GET", "/api/v1/units/attic/settings", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unknown unit: status %d", rec.Code)
+	}
+}
+
+func TestPresets(t *testing.T) {
+	ts := newTestServer(t, "bedroom")
+
+	rec := ts.request(t, "POST", "/api/v1/presets", `{"name": "Night", "settings": {"mode": "heat", "temp": "18"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	rec = ts.request(t, "PUT", "/api/v1/presets/Bad", `{"temp": "50"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid preset: status %d", rec.Code)
+	}
+	if presets := decode[[]Preset](t, ts.request(t, "GET", "/api/v1/presets", "")); len(presets) != 1 {
+		t.Errorf("unexpected presets %+v", presets)
+	}
+
+	rec = ts.request(t, "POST", "/api/v1/units/bedroom/presets/Night/apply", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if rc, _ := ts.store.CurrentConfig("bedroom"); rc.Mode != codecbase.C_Mode_Heat || rc.Temperature != 18 {
+		t.Errorf("preset not applied: %+v", rc)
+	}
+
+	// a preset can't be deleted while a job uses it
+	ts.store.SaveJobSet("bedroom", "Normal", false)
+	ts.store.SaveCronJob("bedroom", "Normal", "0 22 * * *", "Night", &codecbase.Settings{}, nil)
+	rec = ts.request(t, "DELETE", "/api/v1/presets/Night", "")
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("delete used preset: status %d", rec.Code)
+	}
+	if errResp := decode[ErrorResponse](t, rec); len(errResp.UsedBy) != 1 || !strings.HasPrefix(errResp.UsedBy[0], "bedroom/Normal cron job") {
+		t.Errorf("unexpected users %+v", errResp.UsedBy)
+	}
+	ts.store.DeleteJobSet("bedroom", "Normal")
+
+	rec = ts.request(t, "DELETE", "/api/v1/presets/Night", "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("delete: status %d", rec.Code)
+	}
+	rec = ts.request(t, "POST", "/api/v1/presets/Night/apply", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("apply deleted preset: status %d", rec.Code)
+	}
+
+	// a preset is checked against the config of the units that use it
+	if rec := ts.request(t, "PUT", "/api/v1/presets/Fan", `{"fan": "high"}`); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	rc, _ := ts.store.CurrentConfig("bedroom")
+	invalid := *rc
+	invalid.Powerful, invalid.Quiet = codecbase.C_Powerful_Enabled, codecbase.C_Quiet_Enabled
+	ts.store.SaveConfig("bedroom", &invalid, rc)
+	ts.store.SaveOneTimeJob("bedroom", time.Now().Add(time.Hour), "Fan", &codecbase.Settings{})
+	if rec := ts.request(t, "PUT", "/api/v1/presets/Fan", `{"fan": "high"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("preset invalid for bedroom: status %d", rec.Code)
+	}
+}
+
+func TestJobsets(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Normal", false)
+	ts.store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Temperature: "21"}, nil)
+
+	rec := ts.request(t, "POST", "/api/v1/jobsets", `[{"name": "Normal", "active": true}]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if jobsets := decode[[]JobSet](t, rec); len(jobsets) != 1 || !jobsets[0].Active {
+		t.Errorf("unexpected jobsets %+v", jobsets)
+	}
+	if active, _ := ts.store.GetActiveJobSets(); len(*active) != 1 {
+		t.Errorf("jobset not activated")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SavePreset("Night", &codecbase.Settings{Temperature: "18"})
+
+	rec := ts.request(t, "GET", "/api/v1/backup", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"Night"`) {
+		t.Errorf("preset missing from backup: %s", body)
+	}
+
+	rec = ts.request(t, "POST", "/api/v1/backup?mode=replace", strings.Replace(body, `"18"`, `"40"`, 1))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid backup: status %d", rec.Code)
+	}
+	rec = ts.request(t, "POST", "/api/v1/backup?mode=replace", strings.Replace(body, `"Night"`, `"Evening"`, 1))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if presets, _ := ts.store.GetPresets(); len(*presets) != 1 || (*presets)[0].Name != "Evening" {
+		t.Errorf("unexpected presets after import %+v", presets)
+	}
+}
+
+func TestOneTimeJobs(t *testing.T) {
+	ts := newTestServer(t, "bedroom")
+
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+	body := fmt.Sprintf(`{"at": %q, "settings": {"temp": "23"}}`, at.Format(time.RFC3339))
+	rec := ts.request(t, "POST", "/api/v1/onetimejobs", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	jobs := decode[[]OneTimeJob](t, rec)
+	if len(jobs) != 1 || !jobs[0].At.Equal(at) || jobs[0].Settings.Temperature != "23" {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+
+	for _, body := range []string{
+		fmt.Sprintf(`{"at": %q, "settings": {"temp": "23"}}`, time.Now().Add(-time.Minute).Format(time.RFC3339)),
+		fmt.Sprintf(`{"at": %q, "settings": {"temp": "42"}}`, at.Format(time.RFC3339)),
+		fmt.Sprintf(`{"at": %q, "preset": "Missing"}`, at.Format(time.RFC3339)),
+	} {
+		if rec := ts.request(t, "POST", "/api/v1/onetimejobs", body); rec.Code == http.StatusOK {
+			t.Errorf("invalid job %s was accepted", body)
+		}
+	}
+
+	if rec := ts.request(t, "DELETE", fmt.Sprintf("/api/v1/units/bedroom/onetimejobs/%d", jobs[0].ID), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("deleting the job of another unit: status %d", rec.Code)
+	}
+	rec = ts.request(t, "DELETE", fmt.Sprintf("/api/v1/onetimejobs/%d", jobs[0].ID), "")
+	if jobs := decode[[]OneTimeJob](t, rec); rec.Code != http.StatusOK || len(jobs) != 0 {
+		t.Errorf("job was not deleted: %d %+v", rec.Code, jobs)
+	}
+}
+
+func TestCronJobs(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Summer", false)
+
+	// schedules relative to sunset need the location
+	if rec := ts.request(t, "POST", "/api/v1/jobsets/Summer/cronjobs", `{"schedule": "@sunset-30m"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d without location: %s", rec.Code, rec.Body)
+	}
+	sched.SetLocation(&solar.Location{Latitude: 59.3293, Longitude: 18.0686})
+	defer sched.SetLocation(nil)
+
+	rec := ts.request(t, "POST", "/api/v1/jobsets/Summer/cronjobs", `{"schedule": "@sunset-30m", "settings": {"quiet": "on"}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	jobs := decode[[]CronJob](t, rec)
+	if len(jobs) != 1 || jobs[0].Schedule != "@sunset-30m" || jobs[0].NextRun != nil {
+		t.Fatalf("unexpected jobs %+v", jobs)
+	}
+
+	// activating the job set schedules the job
+	ts.request(t, "POST", "/api/v1/jobsets", `[{"name": "Summer", "active": true}]`)
+	jobs = decode[[]CronJob](t, ts.request(t, "GET", "/api/v1/jobsets/Summer/cronjobs", ""))
+	if len(jobs) != 1 || jobs[0].NextRun == nil || !jobs[0].NextRun.After(time.Now()) {
+		t.Errorf("job was not scheduled: %+v", jobs)
+	}
+
+	for path, body := range map[string]string{
+		"/api/v1/jobsets/Summer/cronjobs": `{"schedule": "@sunset+13h"}`,
+		"/api/v1/jobsets/Winter/cronjobs": `{"schedule": "@sunrise"}`,
+	} {
+		if rec := ts.request(t, "POST", path, body); rec.Code == http.StatusOK {
+			t.Errorf("invalid job %s %s was accepted", path, body)
+		}
+	}
+
+	rec = ts.request(t, "DELETE", fmt.Sprintf("/api/v1/jobsets/Summer/cronjobs/%d", jobs[0].ID), "")
+	if jobs := decode[[]CronJob](t, rec); rec.Code != http.StatusOK || len(jobs) != 0 {
+		t.Errorf("job was not deleted: %d %+v", rec.Code, jobs)
+	}
+}
+
+func TestJobSetActivation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Christmas", false)
+	today := time.Now().Format("2006-01-02")
+
+	rec := ts.request(t, "PUT", "/api/v1/jobsets/Christmas/activation",
+		fmt.Sprintf(`{"ranges": [{"name": "Christmas", "start": "%s", "end": "%s"}]}`, today, today))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	jobsets := decode[[]JobSet](t, rec)
+	if len(jobsets) != 1 || !jobsets[0].Active || jobsets[0].Activation == nil ||
+		!strings.HasPrefix(jobsets[0].Reason, `during "Christmas" until`) || jobsets[0].Until == nil {
+		t.Fatalf("unexpected jobsets %+v", jobsets)
+	}
+
+	// the job set can't be deactivated manually while it has an activation
+	if rec := ts.request(t, "POST", "/api/v1/jobsets", `[{"name": "Christmas", "active": false}]`); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+	for _, body := range []string{`{}`, `{"calendar": "/nonexistent/family.ics"}`, `{"ranges": [{"start": "today", "end": "tomorrow"}]}`} {
+		if rec := ts.request(t, "PUT", "/api/v1/jobsets/Christmas/activation", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("invalid activation %s was accepted", body)
+		}
+	}
+
+	rec = ts.request(t, "DELETE", "/api/v1/jobsets/Christmas/activation", "")
+	if jobsets := decode[[]JobSet](t, rec); rec.Code != http.StatusOK || jobsets[0].Activation != nil || jobsets[0].Reason != "" {
+		t.Errorf("activation was not removed: %d %+v", rec.Code, jobsets)
+	}
+	if rec := ts.request(t, "POST", "/api/v1/jobsets", `[{"name": "Christmas", "active": false}]`); rec.Code != http.StatusOK {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConflicts(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	ts.store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Temperature: "22"}, nil)
+	ts.store.SaveJobSet(db.DefaultUnit, "Away", true)
+	ts.store.SaveCronJob(db.DefaultUnit, "Away", "2 6 * * *", "", &codecbase.Settings{Temperature: "16"}, nil)
+
+	rec := ts.request(t, "PUT", "/api/v1/jobsets/Away/priority", `{"priority": 10}`)
+	if jobsets := decode[[]JobSet](t, rec); rec.Code != http.StatusOK || jobsets[1].Name != "Away" || jobsets[1].Priority != 10 {
+		t.Fatalf("priority was not set: %d %+v", rec.Code, jobsets)
+	}
+
+	rec = ts.request(t, "GET", "/api/v1/jobsets/conflicts?days=2", "")
+	conflicts := decode[[]Conflict](t, rec)
+	if rec.Code != http.StatusOK || len(conflicts) != 2 {
+		t.Fatalf("unexpected conflicts %d %+v", rec.Code, conflicts)
+	}
+	if c := conflicts[0]; c.Winner != "Away" || len(c.Runs) != 2 || c.Runs[0].JobSet != "Normal" || !c.Runs[0].Suppressed {
+		t.Errorf("unexpected conflict %+v", c)
+	}
+	if rec := ts.request(t, "GET", "/api/v1/jobsets/conflicts?days=100", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d", rec.Code)
+	}
+}
+
+func TestUpcoming(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Normal", true)
+	ts.store.SaveCronJob(db.DefaultUnit, "Normal", "0 6 * * *", "", &codecbase.Settings{Power: "on", Temperature: "22"}, nil)
+	ts.store.SaveCronJob(db.DefaultUnit, "Normal", "0 22 * * *", "", &codecbase.Settings{Power: "off"}, nil)
+
+	rec := ts.request(t, "GET", "/api/v1/units/default/schedule/upcoming?hours=24", "")
+	runs := decode[[]UpcomingRun](t, rec)
+	if rec.Code != http.StatusOK || len(runs) != 2 {
+		t.Fatalf("unexpected runs %d %+v", rec.Code, runs)
+	}
+	for _, r := range runs {
+		if r.Kind != "settings" || r.JobSet != "Normal" || r.Config.Power != r.Settings.Power {
+			t.Errorf("unexpected run %+v", r)
+		}
+	}
+	if rec := ts.request(t, "GET", "/api/v1/schedule/upcoming?hours=0", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d", rec.Code)
+	}
+}
+
+func TestJobRuns(t *testing.T) {
+	ts := newTestServer(t)
+	now := time.Now()
+	settings, _ := json.Marshal(&codecbase.Settings{Temperature: "22"})
+	ts.store.SaveJobRun(&db.JobRun{Unit: db.DefaultUnit, JobName: "default/Normal_1 30 5 * * *", Kind: "settings", JobSet: "Normal",
+		Scheduled: now.Add(-25 * time.Hour), Started: now.Add(-25 * time.Hour), Settings: settings, Outcome: "ok"})
+	ts.store.SaveJobRun(&db.JobRun{Unit: db.DefaultUnit, JobName: "default/Normal_1 30 5 * * *", Kind: "settings", JobSet: "Normal",
+		Scheduled: now.Add(-time.Hour), Started: now.Add(-time.Hour), Settings: settings, Outcome: "failed", Error: "no IR sender"})
+	ts.store.SaveJobRun(&db.JobRun{Unit: db.DefaultUnit, JobName: "timer_off", Kind: "timer", Started: now.Add(-30 * time.Minute), Outcome: "ok"})
+
+	rec := ts.request(t, "GET", "/api/v1/jobs/runs", "")
+	runs := decode[[]JobRun](t, rec)
+	if rec.Code != http.StatusOK || len(runs) != 2 || runs[0].Name != "timer_off" || runs[1].Outcome != "failed" {
+		t.Fatalf("unexpected runs %d %+v", rec.Code, runs)
+	}
+	rec = ts.request(t, "GET", "/api/v1/units/default/jobs/runs?hours=48&jobset=Normal", "")
+	runs = decode[[]JobRun](t, rec)
+	if len(runs) != 2 || runs[1].Settings == nil || runs[1].Settings.Temperature != "22" {
+		t.Errorf("unexpected runs %+v", runs)
+	}
+	if rec := ts.request(t, "GET", "/api/v1/jobs/runs?hours=1000", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d", rec.Code)
+	}
+}
+
+func TestHold(t *testing.T) {
+	ts := newTestServer(t)
+	if rec := ts.request(t, "GET", "/api/v1/hold", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d", rec.Code)
+	}
+
+	rec := ts.request(t, "PUT", "/api/v1/units/default/hold", `{"minutes": 30, "settings": {"powerful": "on"}}`)
+	hold := decode[Hold](t, rec)
+	if rec.Code != http.StatusOK || hold.Policy != "defer" || hold.Revert == nil || hold.Revert.Powerful != "off" ||
+		hold.Until.Sub(time.Now()).Round(time.Minute) != 30*time.Minute {
+		t.Fatalf("unexpected hold %d %+v", rec.Code, hold)
+	}
+	if rc, _ := ts.store.CurrentConfig(db.DefaultUnit); rc.Powerful != codecbase.C_Powerful_Enabled {
+		t.Error("the held settings were not applied")
+	}
+	if rec := ts.request(t, "GET", "/api/v1/hold", ""); rec.Code != http.StatusOK || decode[Hold](t, rec).Settings.Powerful != "on" {
+		t.Errorf("unexpected hold %d", rec.Code)
+	}
+
+	for body, status := range map[string]int{
+		`{"minutes": 30, "policy": "later", "settings": {"temp": "25"}}`: http.StatusBadRequest,
+		`{"minutes": 30, "settings": {"toff": "on"}}`:                    http.StatusBadRequest,
+		`{"minutes": 30, "settings": {"temp": "hot"}}`:                   http.StatusBadRequest,
+		`{"until": "2020-01-01T00:00:00Z", "settings": {"temp": "25"}}`:  http.StatusBadRequest,
+	} {
+		if rec := ts.request(t, "PUT", "/api/v1/hold", body); rec.Code != status {
+			t.Errorf("%s: status %d, want %d", body, rec.Code, status)
+		}
+	}
+
+	rec = ts.request(t, "DELETE", "/api/v1/hold", "")
+	if rec.Code != http.StatusOK || decode[codecbase.AllSettings](t, rec).Settings.Powerful != "off" {
+		t.Errorf("unexpected response %d %s", rec.Code, rec.Body)
+	}
+	if rec := ts.request(t, "DELETE", "/api/v1/hold", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d", rec.Code)
+	}
+}
+
+func TestRamp(t *testing.T) {
+	ts := newTestServer(t)
+	ts.store.SaveJobSet(db.DefaultUnit, "Night", true)
+
+	rec := ts.request(t, "POST", "/api/v1/jobsets/Night/cronjobs", `{"schedule": "0 22 * * *", "settings": {"temp": "22"}, "ramp": {"to": 18, "minutes": 180}}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if jobs := decode[[]CronJob](t, rec); len(jobs) != 1 || jobs[0].Ramp == nil || jobs[0].Ramp.To != 18 || jobs[0].Ramp.Minutes != 180 {
+		t.Errorf("unexpected jobs %+v", jobs)
+	}
+	rec = ts.request(t, "POST", "/api/v1/jobsets/Night/cronjobs", `{"schedule": "0 22 * * *", "settings": {"temp": "22"}, "ramp": {"to": 18}}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid ramp: status %d", rec.Code)
+	}
+
+	for _, method := range []string{"GET", "DELETE"} {
+		if rec := ts.request(t, method, "/api/v1/ramp", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", method, rec.Code)
+		}
+	}
+}
+
+func TestThermostat(t *testing.T) {
+	push := &sensor.PushSensor{}
+	hwmon, _ := sensor.New(sensor.Config{Type: sensor.HWMON, Path: t.TempDir()})
+	err := sched.SetSensors(sensor.Sensors{"living": push, "hwmon": hwmon}, map[string]sched.Thermostat{db.DefaultUnit: {Sensor: "living", Target: 21}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sched.SetSensors(nil, nil) })
+	ts := newTestServer(t, "bedroom")
+
+	rec := ts.request(t, "PUT", "/api/v1/sensors/living", `{"temp": 19.5}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if reading := decode[sensor.Reading](t, rec); reading.Temperature != 19.5 || time.Since(reading.Time) > time.Minute {
+		t.Errorf("unexpected reading %+v", reading)
+	}
+	for path, status := range map[string]int{"/api/v1/sensors/other": http.StatusNotFound, "/api/v1/sensors/hwmon": http.StatusBadRequest} {
+		if rec := ts.request(t, "PUT", path, `{"temp": 19.5}`); rec.Code != status {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, status)
+		}
+	}
+
+	if err := sched.RunThermostatJob(db.DefaultUnit, "default/thermostat"); err != nil {
+		t.Fatal(err)
+	}
+	rec = ts.request(t, "GET", "/api/v1/thermostat", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if th := decode[Thermostat](t, rec); th.Sensor != "living" || th.Target != 21 || th.Reading == nil || th.Reading.Temperature != 19.5 ||
+		th.State != "power off" {
+		t.Errorf("unexpected thermostat %+v", th)
+	}
+
+	rec = ts.request(t, "PUT", "/api/v1/thermostat", `{"target": 22.5, "disabled": true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if th := decode[Thermostat](t, rec); th.Target != 22.5 || !th.Disabled {
+		t.Errorf("unexpected thermostat %+v", th)
+	}
+	if rec := ts.request(t, "PUT", "/api/v1/thermostat", `{"target": 40}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid target: status %d", rec.Code)
+	}
+	for _, method := range []string{"GET", "PUT"} {
+		if rec := ts.request(t, method, "/api/v1/units/bedroom/thermostat", `{"target": 20}`); rec.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", method, rec.Code)
+		}
+	}
+}
+
+func TestSensors(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "temp1_input"), []byte("21500\n"), 0644)
+	hwmon, _ := sensor.New(sensor.Config{Type: sensor.HWMON, Path: dir})
+	push := &sensor.PushSensor{}
+	if err := sched.SetSensors(sensor.Sensors{"living": hwmon, "bedroom": push}, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sched.SetSensors(nil, nil) })
+	ts := newTestServer(t)
+
+	if rec := ts.request(t, "PUT", "/api/v1/sensors/bedroom", `{"temp": 19.5, "humidity": 48}`); rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	rec := ts.request(t, "GET", "/api/v1/sensors", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	sensors := decode[[]Sensor](t, rec)
+	if len(sensors) != 2 || sensors[0].Name != "bedroom" || sensors[0].Reading == nil || sensors[0].Reading.Humidity == nil ||
+		*sensors[0].Reading.Humidity != 48 || sensors[1].Name != "living" || sensors[1].Reading == nil || sensors[1].Reading.Temperature != 21.5 {
+		t.Errorf("unexpected sensors %+v", sensors)
+	}
+
+	now := time.Now()
+	ts.store.SaveSensorReading(&db.SensorReading{Sensor: "living", Time: now.Add(-30 * time.Hour), Temperature: 20, Period: time.Hour})
+	ts.store.SaveSensorReading(&db.SensorReading{Sensor: "living", Time: now.Add(-10 * time.Minute), Temperature: 21})
+	rec = ts.request(t, "GET", "/api/v1/sensors/living/history?hours=48", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if history := decode[[]SensorReading](t, rec); len(history) != 2 || history[0].Period != time.Hour || history[1].Temperature != 21 {
+		t.Errorf("unexpected history %+v", history)
+	}
+	rec = ts.request(t, "GET", "/api/v1/sensors/living/history", "")
+	if history := decode[[]SensorReading](t, rec); len(history) != 1 {
+		t.Errorf("unexpected history %+v", history)
+	}
+	for path, status := range map[string]int{
+		"/api/v1/sensors/other/history":          http.StatusNotFound,
+		"/api/v1/sensors/living/history?hours=0": http.StatusBadRequest,
+	} {
+		if rec := ts.request(t, "GET", path, ""); rec.Code != status {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, status)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Package solar computes the times of sunrise and sunset, using the algorithm of the NOAA solar calculator. The times
+// are accurate to within a minute or two for latitudes between +/- 72 degrees, which is plenty for scheduling.
+package solar
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A position on earth in degrees. Latitude is positive north of the equator, and longitude is positive east of
+// Greenwich.
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Parse a location given as "latitude,longitude" in decimal degrees, e.g. "59.33,18.07".
+func ParseLocation(s string) (*Location, error) {
+	lat, lon, found := strings.Cut(s, ",")
+	if !found {
+		return nil, fmt.Errorf("invalid location %q, expecting latitude,longitude, e.g. 59.33,18.07", s)
+	}
+	var loc Location
+	var err1, err2 error
+	loc.Latitude, err1 = strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	loc.Longitude, err2 = strconv.ParseFloat(strings.TrimSpace(lon), 64)
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("invalid location %q, expecting latitude,longitude, e.g. 59.33,18.07", s)
+	}
+	if loc.Latitude < -90 || loc.Latitude > 90 || loc.Longitude < -180 || loc.Longitude > 180 {
+		return nil, fmt.Errorf("invalid location %q, the latitude must be within +/-90 and the longitude within +/-180", s)
+	}
+	return &loc, nil
+}
+
+// The sun is considered to have risen when its upper edge is at the horizon, taking atmospheric refraction into
+// account.
+const sunriseZenith = 90.833
+
+func rad(deg float64) float64 {
+	return deg * math.Pi / 180
+}
+
+func deg(rad float64) float64 {
+	return rad * 180 / math.Pi
+}
+
+// Return the times of sunrise and sunset on the date of t, in the time zone of t. If the sun doesn't rise or set that
+// day, i.e. during polar day or night, ok is false.
+func SunriseSunset(t time.Time, loc Location) (sunrise, sunset time.Time, ok bool) {
+	// midnight UTC of the date, and the Julian day of the local solar noon
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	jd := float64(midnight.Unix())/86400 + 2440587.5 + 0.5 - loc.Longitude/360
+	jc := (jd - 2451545) / 36525
+
+	geomMeanLongSun := math.Mod(280.46646+jc*(36000.76983+jc*0.0003032), 360)
+	geomMeanAnomSun := 357.52911 + jc*(35999.05029-0.0001537*jc)
+	eccentEarthOrbit := 0.016708634 - jc*(0.000042037+0.0000001267*jc)
+	sunEqOfCtr := math.Sin(rad(geomMeanAnomSun))*(1.914602-jc*(0.004817+0.000014*jc)) +
+		math.Sin(rad(2*geomMeanAnomSun))*(0.019993-0.000101*jc) +
+		math.Sin(rad(3*geomMeanAnomSun))*0.000289
+	sunTrueLong := geomMeanLongSun + sunEqOfCtr
+	sunAppLong := sunTrueLong - 0.00569 - 0.00478*math.Sin(rad(125.04-1934.136*jc))
+	meanObliqEcliptic := 23 + (26+(21.448-jc*(46.815+jc*(0.00059-jc*0.001813)))/60)/60
+	obliqCorr := meanObliqEcliptic + 0.00256*math.Cos(rad(125.04-1934.136*jc))
+	sunDeclin := deg(math.Asin(math.Sin(rad(obliqCorr)) * math.Sin(rad(sunAppLong))))
+
+	y := math.Pow(math.Tan(rad(obliqCorr/2)), 2)
+	eqOfTime := 4 * deg(y*math.Sin(2*rad(geomMeanLongSun))-
+		2*eccentEarthOrbit*math.Sin(rad(geomMeanAnomSun))+
+		4*eccentEarthOrbit*y*math.Sin(rad(geomMeanAnomSun))*math.Cos(2*rad(geomMeanLongSun))-
+		0.5*y*y*math.Sin(4*rad(geomMeanLongSun))-
+		1.25*eccentEarthOrbit*eccentEarthOrbit*math.Sin(2*rad(geomMeanAnomSun)))
+
+	cosHaSunrise := math.Cos(rad(sunriseZenith))/(math.Cos(rad(loc.Latitude))*math.Cos(rad(sunDeclin))) -
+		math.Tan(rad(loc.Latitude))*math.Tan(rad(sunDeclin))
+	if cosHaSunrise < -1 || cosHaSunrise > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	haSunrise := deg(math.Acos(cosHaSunrise))
+
+	// minutes after midnight UTC
+	solarNoon := 720 - 4*loc.Longitude - eqOfTime
+	minutes := func(m float64) time.Time {
+		return midnight.Add(time.Duration(m * float64(time.Minute))).Round(time.Second).In(t.Location())
+	}
+	return minutes(solarNoon - 4*haSunrise), minutes(solarNoon + 4*haSunrise), true
+}
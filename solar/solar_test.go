@@ -0,0 +1,63 @@
+package solar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSunriseSunset(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*3600)
+	cet := time.FixedZone("CET", 1*3600)
+	est := time.FixedZone("EST", -5*3600)
+	aest := time.FixedZone("AEST", 10*3600)
+	stockholm := Location{59.3293, 18.0686}
+
+	for _, tt := range []struct {
+		name    string
+		date    time.Time
+		loc     Location
+		sunrise string
+		sunset  string
+	}{
+		// published times, rounded to the minute
+		{"Stockholm midsummer", time.Date(2024, 6, 21, 12, 0, 0, 0, cest), stockholm, "03:30", "22:08"},
+		{"Stockholm midwinter", time.Date(2024, 12, 21, 12, 0, 0, 0, cet), stockholm, "08:43", "14:48"},
+		{"New York", time.Date(2024, 1, 1, 0, 0, 0, 0, est), Location{40.7128, -74.0060}, "07:20", "16:39"},
+		{"Sydney", time.Date(2024, 3, 1, 23, 59, 0, 0, aest), Location{-33.8688, 151.2093}, "05:43", "18:32"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sunrise, sunset, ok := SunriseSunset(tt.date, tt.loc)
+			if !ok {
+				t.Fatal("no sunrise")
+			}
+			check := func(what string, got time.Time, want string) {
+				w, _ := time.ParseInLocation("2006-01-02 15:04", tt.date.Format("2006-01-02 ")+want, tt.date.Location())
+				if d := got.Sub(w); d < -2*time.Minute || d > 2*time.Minute {
+					t.Errorf("%s %s, want %s", what, got.Format(time.DateTime), want)
+				}
+			}
+			check("sunrise", sunrise, tt.sunrise)
+			check("sunset", sunset, tt.sunset)
+		})
+	}
+
+	// midnight sun and polar night in Tromsø
+	tromso := Location{69.6496, 18.9560}
+	if _, _, ok := SunriseSunset(time.Date(2024, 6, 21, 12, 0, 0, 0, cest), tromso); ok {
+		t.Errorf("expected no sunset at midsummer in Tromsø")
+	}
+	if _, _, ok := SunriseSunset(time.Date(2024, 12, 21, 12, 0, 0, 0, cet), tromso); ok {
+		t.Errorf("expected no sunrise at midwinter in Tromsø")
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	if loc, err := ParseLocation("59.3293, -18.0686"); err != nil || *loc != (Location{59.3293, -18.0686}) {
+		t.Errorf("ParseLocation = %+v, %v", loc, err)
+	}
+	for _, s := range []string{"", "59.33", "north,east", "91,0", "0,181"} {
+		if _, err := ParseLocation(s); err == nil {
+			t.Errorf("ParseLocation(%q) succeeded", s)
+		}
+	}
+}